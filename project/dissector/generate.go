@@ -0,0 +1,121 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"io"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+//go:embed dissector.lua.tmpl
+var dissectorTemplate string
+
+var messageTypes = []messageType{
+	{utils.MessageHello, "Hello"},
+	{utils.MessageEvent, "Event"},
+	{utils.MessageAck, "Ack"},
+	{utils.MessagePosition, "Position"},
+	{utils.MessageSyncRequest, "SyncRequest"},
+	{utils.MessageSyncResponse, "SyncResponse"},
+	{utils.MessageNack, "Nack"},
+}
+
+type messageType struct {
+	Value int
+	Name  string
+}
+
+// luaField is a utils.Field with the names the template needs.
+type luaField struct {
+	utils.Field
+	Kind   string
+	Size   int
+	Var    string
+	Abbrev string
+}
+
+type templateData struct {
+	ALPN         string
+	Magic        string
+	MessageTypes []messageType
+	Fields       []luaField
+
+	Hello, Event, Ack, SyncResponse, Nack int
+}
+
+// Generate writes a Lua dissector for layout, recognizing streams that
+// negotiated alpn, to w.
+func Generate(w io.Writer, layout []utils.Field, alpn string) error {
+	tmpl, err := template.New("dissector").Funcs(template.FuncMap{"lua": luaString}).Parse(dissectorTemplate)
+	if err != nil {
+		return fmt.Errorf("error parsing dissector template: %v", err)
+	}
+
+	data := templateData{
+		ALPN:         alpn,
+		Magic:        utils.SessionMagic,
+		MessageTypes: messageTypes,
+		Hello:        utils.MessageHello,
+		Event:        utils.MessageEvent,
+		Ack:          utils.MessageAck,
+		SyncResponse: utils.MessageSyncResponse,
+		Nack:         utils.MessageNack,
+	}
+	for _, field := range layout {
+		name := snakeCase(field.Name)
+		data.Fields = append(data.Fields, luaField{
+			Field:  field,
+			Kind:   field.Kind.String(),
+			Size:   field.Kind.Size(),
+			Var:    name,
+			Abbrev: "lrtpids." + name,
+		})
+	}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		return fmt.Errorf("error generating dissector: %v", err)
+	}
+	return nil
+}
+
+// snakeCase turns a Go field name such as TransactionID into transaction_id.
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var builder strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			previousLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if previousLower || (nextLower && unicode.IsUpper(runes[i-1])) {
+				builder.WriteByte('_')
+			}
+		}
+		builder.WriteRune(unicode.ToLower(r))
+	}
+	return builder.String()
+}
+
+// luaString quotes s as a Lua string literal. Lua has no \u escape before
+// 5.3, so everything outside printable ASCII is written as decimal bytes.
+func luaString(s string) string {
+	var builder strings.Builder
+	builder.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			builder.WriteByte('\\')
+			builder.WriteByte(c)
+		case c < 0x20 || c >= 0x7F:
+			fmt.Fprintf(&builder, "\\%03d", c)
+		default:
+			builder.WriteByte(c)
+		}
+	}
+	builder.WriteByte('"')
+	return builder.String()
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/pids.lua from the generator")
+
+const testALPN = "lrt-jabodebek-2306214510"
+
+// TestGenerateGolden compares the dissector for utils.PacketLayout with
+// testdata/pids.lua. After an intended change to the layout or template,
+// review the difference and rerun with -update.
+func TestGenerateGolden(t *testing.T) {
+	var output bytes.Buffer
+	if err := Generate(&output, utils.PacketLayout, testALPN); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+
+	golden := filepath.Join("testdata", "pids.lua")
+	if *update {
+		if err := os.WriteFile(golden, output.Bytes(), 0o644); err != nil {
+			t.Fatalf("error writing %s: %v", golden, err)
+		}
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatalf("error reading %s: %v", golden, err)
+	}
+	if !bytes.Equal(output.Bytes(), want) {
+		t.Errorf("generated dissector differs from %s, rerun with -update if that is intended", golden)
+	}
+}
+
+func TestGenerateCoversLayout(t *testing.T) {
+	var output bytes.Buffer
+	if err := Generate(&output, utils.PacketLayout, testALPN); err != nil {
+		t.Fatalf("Generate: %v", err)
+	}
+	lua := output.String()
+
+	for _, field := range utils.PacketLayout {
+		name := snakeCase(field.Name)
+		for _, want := range []string{
+			"pf." + name + " = ProtoField.",
+			luaString("lrtpids." + name),
+			luaString(field.Description),
+			"pf." + name + ",",
+		} {
+			if !strings.Contains(lua, want) {
+				t.Errorf("dissector lacks %s for field %s", want, field.Name)
+			}
+		}
+	}
+	if !strings.Contains(lua, luaString(testALPN)) {
+		t.Errorf("dissector lacks the ALPN %s", testALPN)
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	tests := map[string]string{
+		"TransactionID":     "transaction_id",
+		"IsAck":             "is_ack",
+		"DestinationLength": "destination_length",
+		"HTTPServer":        "http_server",
+		"Sequence":          "sequence",
+	}
+	for name, want := range tests {
+		if got := snakeCase(name); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+// dissector writes a Wireshark Lua dissector generated from
+// utils.PacketLayout, so that it always matches utils.Encode and Decode.
+// Regenerate it whenever the layout changes:
+//
+//	go run ./project/dissector -o ~/.local/lib/wireshark/plugins/pids.lua
+func main() {
+	output := flag.String("o", "", "file to write the dissector to, standard output when empty")
+	alpn := flag.String("alpn", "lrt-jabodebek-2306214510", "ALPN identifying PIDS connections over QUIC and TLS")
+	flag.Parse()
+
+	if *output == "" {
+		if err := Generate(os.Stdout, utils.PacketLayout, *alpn); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating %s: %v\n", *output, err)
+		os.Exit(1)
+	}
+	if err := Generate(file, utils.PacketLayout, *alpn); err != nil {
+		file.Close()
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := file.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "error writing %s: %v\n", *output, err)
+		os.Exit(1)
+	}
+}
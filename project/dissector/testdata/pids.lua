@@ -0,0 +1,349 @@
+-- Code generated by the dissector command from utils.PacketLayout; DO NOT EDIT.
+--
+-- Wireshark dissector for LRT PIDS sessions and packets. Copy this file into
+-- the personal Lua plugins folder listed under Help > About Wireshark >
+-- Folders. Streams are recognized by the "lrt-jabodebek-2306214510" ALPN, so QUIC
+-- captures need the TLS secrets, either embedded in the pcapng file or from
+-- the key log set under TLS protocol preferences.
+
+local MAGIC = "PIDS"
+local ALPN = "lrt-jabodebek-2306214510"
+
+local lrtpids = Proto("lrtpids", "LRT PIDS Packet")
+local pids = Proto("pids", "LRT PIDS Session")
+
+local message_types = {
+	[1] = "Hello",
+	[2] = "Event",
+	[3] = "Ack",
+	[4] = "Position",
+	[5] = "SyncRequest",
+	[6] = "SyncResponse",
+	[7] = "Nack",
+}
+
+local pf = lrtpids.fields
+pf.transaction_id = ProtoField.uint16("lrtpids.transaction_id", "Transaction ID", base.DEC)
+pf.is_ack = ProtoField.bool("lrtpids.is_ack", "Acknowledgement")
+pf.is_new_train = ProtoField.bool("lrtpids.is_new_train", "New train")
+pf.is_update_train = ProtoField.bool("lrtpids.is_update_train", "Update train")
+pf.is_delete_train = ProtoField.bool("lrtpids.is_delete_train", "Delete train")
+pf.is_train_arriving = ProtoField.bool("lrtpids.is_train_arriving", "Train arriving")
+pf.is_train_departing = ProtoField.bool("lrtpids.is_train_departing", "Train departing")
+pf.train_number = ProtoField.uint16("lrtpids.train_number", "Train number", base.DEC)
+pf.destination_length = ProtoField.uint8("lrtpids.destination_length", "Destination length", base.DEC)
+pf.destination = ProtoField.string("lrtpids.destination", "Destination", base.UNICODE)
+pf.sequence = ProtoField.uint16("lrtpids.sequence", "Sequence number", base.DEC)
+
+local expert_truncated = ProtoExpert.new("lrtpids.truncated", "Packet is truncated", expert.group.MALFORMED, expert.severity.ERROR)
+local expert_trailing = ProtoExpert.new("lrtpids.trailing", "Bytes after the packet are ignored", expert.group.PROTOCOL, expert.severity.WARN)
+lrtpids.experts = { expert_truncated, expert_trailing }
+
+local sf = pids.fields
+sf.magic = ProtoField.string("pids.magic", "Magic")
+sf.type = ProtoField.uint8("pids.type", "Message type", base.HEX, message_types)
+sf.length = ProtoField.uint16("pids.length", "Payload length", base.DEC)
+sf.version = ProtoField.uint8("pids.hello.version", "Version", base.DEC)
+sf.supported = ProtoField.uint8("pids.hello.message_type", "Supported message type", base.HEX, message_types)
+sf.station = ProtoField.string("pids.hello.station", "Station ID", base.UNICODE)
+sf.trains = ProtoField.uint16("pids.sync.trains", "Trains", base.DEC)
+sf.train_length = ProtoField.uint16("pids.sync.train_length", "Train length", base.DEC)
+sf.nack_transaction_id = ProtoField.uint16("pids.nack.transaction_id", "Transaction ID", base.DEC)
+sf.nack_reason = ProtoField.string("pids.nack.reason", "Reason", base.UNICODE)
+
+local expert_malformed = ProtoExpert.new("pids.malformed", "Malformed message", expert.group.MALFORMED, expert.severity.ERROR)
+pids.experts = { expert_malformed }
+
+-- dissect_packet adds the LRTPIDSPacket in tvb to tree and returns a one
+-- line summary of it for the info column.
+local function dissect_packet(tvb, tree)
+	local subtree = tree:add(lrtpids, tvb())
+	local offset = 0
+	local length = 0
+	local event = "none"
+	local summary = {}
+
+	local function finish()
+		local text = event
+		if #summary > 0 then
+			text = text .. " " .. table.concat(summary, " ")
+		end
+		subtree:append_text(", " .. text)
+		return text
+	end
+
+	-- TransactionID
+	if tvb:len() < offset + 2 then
+		subtree:add_proto_expert_info(expert_truncated, "TransactionID is missing")
+		return finish()
+	end
+	subtree:add(pf.transaction_id, tvb(offset, 2))
+	table.insert(summary, "TransactionID=" .. tvb(offset, 2):uint())
+	offset = offset + 2
+
+	-- IsAck
+	if tvb:len() < offset + 1 then
+		subtree:add_proto_expert_info(expert_truncated, "IsAck is missing")
+		return finish()
+	end
+	subtree:add(pf.is_ack, tvb(offset, 1))
+	if event == "none" and tvb(offset, 1):uint() == 1 then
+		event = "ack"
+	end
+	offset = offset + 1
+
+	-- IsNewTrain
+	if tvb:len() < offset + 1 then
+		subtree:add_proto_expert_info(expert_truncated, "IsNewTrain is missing")
+		return finish()
+	end
+	subtree:add(pf.is_new_train, tvb(offset, 1))
+	if event == "none" and tvb(offset, 1):uint() == 1 then
+		event = "new"
+	end
+	offset = offset + 1
+
+	-- IsUpdateTrain
+	if tvb:len() < offset + 1 then
+		subtree:add_proto_expert_info(expert_truncated, "IsUpdateTrain is missing")
+		return finish()
+	end
+	subtree:add(pf.is_update_train, tvb(offset, 1))
+	if event == "none" and tvb(offset, 1):uint() == 1 then
+		event = "update"
+	end
+	offset = offset + 1
+
+	-- IsDeleteTrain
+	if tvb:len() < offset + 1 then
+		subtree:add_proto_expert_info(expert_truncated, "IsDeleteTrain is missing")
+		return finish()
+	end
+	subtree:add(pf.is_delete_train, tvb(offset, 1))
+	if event == "none" and tvb(offset, 1):uint() == 1 then
+		event = "delete"
+	end
+	offset = offset + 1
+
+	-- IsTrainArriving
+	if tvb:len() < offset + 1 then
+		subtree:add_proto_expert_info(expert_truncated, "IsTrainArriving is missing")
+		return finish()
+	end
+	subtree:add(pf.is_train_arriving, tvb(offset, 1))
+	if event == "none" and tvb(offset, 1):uint() == 1 then
+		event = "arriving"
+	end
+	offset = offset + 1
+
+	-- IsTrainDeparting
+	if tvb:len() < offset + 1 then
+		subtree:add_proto_expert_info(expert_truncated, "IsTrainDeparting is missing")
+		return finish()
+	end
+	subtree:add(pf.is_train_departing, tvb(offset, 1))
+	if event == "none" and tvb(offset, 1):uint() == 1 then
+		event = "departing"
+	end
+	offset = offset + 1
+
+	-- TrainNumber
+	if tvb:len() < offset + 2 then
+		subtree:add_proto_expert_info(expert_truncated, "TrainNumber is missing")
+		return finish()
+	end
+	subtree:add(pf.train_number, tvb(offset, 2))
+	table.insert(summary, "TrainNumber=" .. tvb(offset, 2):uint())
+	offset = offset + 2
+
+	-- DestinationLength
+	if tvb:len() < offset + 1 then
+		subtree:add_proto_expert_info(expert_truncated, "DestinationLength is missing")
+		return finish()
+	end
+	subtree:add(pf.destination_length, tvb(offset, 1))
+	length = tvb(offset, 1):uint()
+	offset = offset + 1
+
+	-- Destination
+	if tvb:len() < offset + length then
+		subtree:add_proto_expert_info(expert_truncated, "Destination is truncated")
+		return finish()
+	end
+	if length > 0 then
+		subtree:add_packet_field(pf.destination, tvb(offset, length), ENC_UTF_8)
+		table.insert(summary, "Destination=" .. tvb(offset, length):string(ENC_UTF_8))
+	end
+	offset = offset + length
+
+	-- Sequence
+	if offset >= tvb:len() then
+		return finish()
+	end
+	if tvb:len() < offset + 2 then
+		subtree:add_proto_expert_info(expert_truncated, "Sequence is missing")
+		return finish()
+	end
+	subtree:add(pf.sequence, tvb(offset, 2))
+	table.insert(summary, "Sequence=" .. tvb(offset, 2):uint())
+	offset = offset + 2
+
+	if offset < tvb:len() then
+		subtree:add_proto_expert_info(expert_trailing)
+	end
+	return finish()
+end
+
+local function dissect_hello(tvb, tree)
+	if tvb:len() < 2 or tvb:len() < 3 + tvb(1, 1):uint() then
+		tree:add_proto_expert_info(expert_malformed, "Hello is truncated")
+		return "Hello"
+	end
+	tree:add(sf.version, tvb(0, 1))
+	local count = tvb(1, 1):uint()
+	for i = 0, count - 1 do
+		tree:add(sf.supported, tvb(2 + i, 1))
+	end
+
+	local offset = 2 + count
+	local length = tvb(offset, 1):uint()
+	if tvb:len() < offset + 1 + length then
+		tree:add_proto_expert_info(expert_malformed, "Station ID is truncated")
+		return "Hello"
+	end
+	if length == 0 then
+		return "Hello"
+	end
+	tree:add_packet_field(sf.station, tvb(offset + 1, length), ENC_UTF_8)
+	return "Hello " .. tvb(offset + 1, length):string(ENC_UTF_8)
+end
+
+local function dissect_sync_response(tvb, tree)
+	if tvb:len() < 2 then
+		tree:add_proto_expert_info(expert_malformed, "Train count is missing")
+		return "SyncResponse"
+	end
+	tree:add(sf.trains, tvb(0, 2))
+	local count = tvb(0, 2):uint()
+
+	local offset = 2
+	for i = 1, count do
+		if tvb:len() < offset + 2 or tvb:len() < offset + 2 + tvb(offset, 2):uint() then
+			tree:add_proto_expert_info(expert_malformed, "Train " .. i .. " is truncated")
+			break
+		end
+		local length = tvb(offset, 2):uint()
+		tree:add(sf.train_length, tvb(offset, 2))
+		if length > 0 then
+			dissect_packet(tvb(offset + 2, length):tvb(), tree)
+		end
+		offset = offset + 2 + length
+	end
+	return "SyncResponse " .. count .. " trains"
+end
+
+local function dissect_nack(tvb, tree)
+	if tvb:len() < 3 or tvb:len() < 3 + tvb(2, 1):uint() then
+		tree:add_proto_expert_info(expert_malformed, "Nack is truncated")
+		return "Nack"
+	end
+	tree:add(sf.nack_transaction_id, tvb(0, 2))
+	local length = tvb(2, 1):uint()
+	if length == 0 then
+		return "Nack TransactionID=" .. tvb(0, 2):uint()
+	end
+	tree:add_packet_field(sf.nack_reason, tvb(3, length), ENC_UTF_8)
+	return "Nack TransactionID=" .. tvb(0, 2):uint() .. " " .. tvb(3, length):string(ENC_UTF_8)
+end
+
+-- dissect_message adds one framed session message, type (1 byte) |
+-- payload length (2 bytes) | payload, and returns its summary.
+local function dissect_message(tvb, tree)
+	local message_type = tvb(0, 1):uint()
+	local name = message_types[message_type] or string.format("Unknown (0x%02x)", message_type)
+	local subtree = tree:add(pids, tvb(), name)
+	subtree:add(sf.type, tvb(0, 1))
+	subtree:add(sf.length, tvb(1, 2))
+	if tvb:len() == 3 then
+		return name
+	end
+
+	local payload = tvb(3):tvb()
+	if message_type == 1 then
+		return dissect_hello(payload, subtree)
+	elseif message_type == 2 or message_type == 3 then
+		return name .. " " .. dissect_packet(payload, subtree)
+	elseif message_type == 6 then
+		return dissect_sync_response(payload, subtree)
+	elseif message_type == 7 then
+		return dissect_nack(payload, subtree)
+	end
+	return name
+end
+
+-- Connections whose stream opened with MAGIC carry framed messages in both
+-- directions; all others carry one legacy LRTPIDSPacket per stream.
+local sessions = {}
+
+function pids.init()
+	sessions = {}
+end
+
+local function conversation_key(pinfo)
+	local a = tostring(pinfo.src) .. ":" .. pinfo.src_port
+	local b = tostring(pinfo.dst) .. ":" .. pinfo.dst_port
+	if a > b then
+		a, b = b, a
+	end
+	return a .. "-" .. b
+end
+
+function pids.dissector(tvb, pinfo, tree)
+	pinfo.cols.protocol = "PIDS"
+	local key = conversation_key(pinfo)
+	local offset = 0
+	if tvb:len() >= #MAGIC and tvb(0, #MAGIC):string() == MAGIC then
+		sessions[key] = true
+	end
+
+	if not sessions[key] then
+		pinfo.cols.info:set(dissect_packet(tvb, tree))
+		return tvb:len()
+	end
+
+	local subtree = tree:add(pids, tvb())
+	if tvb:len() >= #MAGIC and tvb(0, #MAGIC):string() == MAGIC then
+		subtree:add(sf.magic, tvb(0, #MAGIC))
+		offset = #MAGIC
+	end
+
+	local summaries = {}
+	while offset < tvb:len() do
+		local remaining = tvb:len() - offset
+		if remaining < 3 then
+			pinfo.desegment_offset = offset
+			pinfo.desegment_len = DESEGMENT_ONE_MORE_SEGMENT
+			break
+		end
+		local length = tvb(offset + 1, 2):uint()
+		if remaining < 3 + length then
+			pinfo.desegment_offset = offset
+			pinfo.desegment_len = 3 + length - remaining
+			break
+		end
+		table.insert(summaries, dissect_message(tvb(offset, 3 + length):tvb(), subtree))
+		offset = offset + 3 + length
+	end
+	if #summaries > 0 then
+		pinfo.cols.info:set(table.concat(summaries, ", "))
+	end
+	return tvb:len()
+end
+
+-- Older Wireshark releases lack one table or the other.
+for _, name in ipairs({ "quic.proto", "tls.alpn" }) do
+	local ok, dissectors = pcall(DissectorTable.get, name)
+	if ok and dissectors then
+		dissectors:add(ALPN, pids)
+	end
+end
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/transport"
+	"jarkom.cs.ui.ac.id/h01/project/utils/pidslog"
+)
+
+// loadgen measures how many events a PIDS subscriber can take. It opens
+// -connections connections with -streams workers each, every worker cycling
+// one train through its lifecycle and waiting for the ACK of each event
+// before sending the next.
+func main() {
+	address := flag.String("addr", "127.0.0.1:4510", "subscriber address")
+	transportKind := flag.String("transport", transport.KindQUIC, "transport to reach the subscriber with: "+strings.Join(transport.Kinds, ", "))
+	connections := flag.Int("connections", 1, "number of connections to open")
+	streams := flag.Int("streams", 1, "concurrent streams per connection, each sending one event at a time")
+	legacyStreams := flag.Bool("legacy-streams", false, "open a new stream per event instead of a session stream per worker")
+	rate := flag.Float64("rate", 0, "target events per second over all streams, 0 sends as fast as the ACKs come back")
+	duration := flag.Duration("duration", 10*time.Second, "how long to send for")
+	count := flag.Int64("count", 0, "stop after sending this many events, 0 for no limit")
+	ackTimeout := flag.Duration("ack-timeout", 5*time.Second, "how long to wait for each ACK")
+	firstTrain := flag.Uint("first-train", 1000, "train number of the first stream, the others follow on")
+	destination := flag.String("destination", "Harjamukti", "destination of every train")
+	reportInterval := flag.Duration("report-interval", time.Second, "how often to print progress, 0 to only print the summary")
+	asJSON := flag.Bool("json", false, "print the summary as JSON")
+	logConfig := pidslog.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	logger, err := logConfig.NewLogger(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	workers := *connections * *streams
+	if *connections < 1 || *streams < 1 || *rate < 0 || *firstTrain+uint(workers)-1 > 0xFFFF {
+		fmt.Fprintln(os.Stderr, "-connections and -streams must be positive, -rate may not be negative and the train numbers must fit in 16 bits")
+		os.Exit(2)
+	}
+
+	t, err := transport.New(*transportKind, transport.Config{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"lrt-jabodebek-2306214510"},
+			ServerName:         "3.81.118.89",
+		},
+	})
+	if err != nil {
+		logger.Error("failed to create transport", "error", err)
+		os.Exit(2)
+	}
+
+	var conns []transport.Conn
+	defer func() {
+		for _, conn := range conns {
+			conn.CloseWithError(0, "load test done")
+		}
+	}()
+	for i := 0; i < *connections; i++ {
+		conn, err := t.Dial(context.Background(), *address)
+		if err != nil {
+			logger.Error("failed to connect", "address", *address, "transport", *transportKind, "connection", i, "error", err)
+			os.Exit(1)
+		}
+		conns = append(conns, conn)
+	}
+	logger.Info("connected", "address", *address, "transport", *transportKind, "connections", *connections, "streams", *streams)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	ctx, cancel := context.WithTimeout(ctx, *duration)
+	defer cancel()
+
+	var interval time.Duration
+	if *rate > 0 {
+		interval = time.Duration(float64(workers) / *rate * float64(time.Second))
+	}
+
+	var remaining atomic.Int64
+	remaining.Store(*count)
+	limit := func() bool {
+		return *count == 0 || remaining.Add(-1) >= 0
+	}
+
+	results := newStats()
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		w := &worker{
+			conn:          conns[i%len(conns)],
+			legacy:        *legacyStreams,
+			train:         uint16(*firstTrain) + uint16(i),
+			destination:   *destination,
+			ackTimeout:    *ackTimeout,
+			stats:         results,
+			transactionID: uint16(i) << 8,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.run(ctx, interval, limit)
+		}()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	if *reportInterval > 0 {
+		reportProgress(os.Stderr, results, start, *reportInterval, finished)
+	}
+	<-finished
+
+	summary := results.summary(time.Since(start))
+	summary.Transport = *transportKind
+	summary.Mode = "session"
+	if *legacyStreams {
+		summary.Mode = "legacy-streams"
+	}
+	summary.Connections = *connections
+	summary.Streams = *streams
+	summary.TargetRate = *rate
+
+	if *asJSON {
+		json.NewEncoder(os.Stdout).Encode(summary)
+	} else {
+		printSummary(os.Stdout, summary)
+	}
+
+	if summary.Acked == 0 {
+		os.Exit(1)
+	}
+}
+
+// reportProgress prints the rates of the last interval until finished.
+func reportProgress(w io.Writer, results *stats, start time.Time, interval time.Duration, finished <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last := results.progress()
+	lastTime := start
+	for {
+		select {
+		case <-finished:
+			return
+		case now := <-ticker.C:
+			current := results.progress()
+			seconds := now.Sub(lastTime).Seconds()
+			acked := current.acked - last.acked
+
+			mean := 0.0
+			if acked > 0 {
+				mean = float64(current.latencySum-last.latencySum) / float64(acked) / float64(time.Millisecond)
+			}
+			fmt.Fprintf(w, "%6.1fs  sent %8d  acked %8d  errors %6d  %9.1f events/s  %9.1f ACK/s  mean latency %.3fms\n",
+				now.Sub(start).Seconds(), current.sent, current.acked, current.errors,
+				float64(current.sent-last.sent)/seconds, float64(acked)/seconds, mean)
+
+			last, lastTime = current, now
+		}
+	}
+}
+
+func printSummary(w io.Writer, s Summary) {
+	target := "unlimited"
+	if s.TargetRate > 0 {
+		target = fmt.Sprintf("%.1f events/s", s.TargetRate)
+	}
+
+	fmt.Fprintf(w, "transport    %s, %d connections x %d streams (%s)\n", s.Transport, s.Connections, s.Streams, s.Mode)
+	fmt.Fprintf(w, "target rate  %s\n", target)
+	fmt.Fprintf(w, "duration     %.2fs\n", s.Duration)
+	fmt.Fprintf(w, "sent         %d\n", s.Sent)
+	fmt.Fprintf(w, "acked        %d\n", s.Acked)
+
+	var total int64
+	kinds := make([]string, 0, len(s.Errors))
+	for kind, n := range s.Errors {
+		total += n
+		kinds = append(kinds, fmt.Sprintf("%s=%d", kind, n))
+	}
+	sort.Strings(kinds)
+	if total > 0 {
+		fmt.Fprintf(w, "errors       %d (%s)\n", total, strings.Join(kinds, ", "))
+	} else {
+		fmt.Fprintf(w, "errors       0\n")
+	}
+
+	fmt.Fprintf(w, "throughput   %.1f ACK/s\n", s.Throughput)
+	l := s.LatencyMs
+	fmt.Fprintf(w, "latency ms   min %.3f  mean %.3f  p50 %.3f  p90 %.3f  p99 %.3f  p99.9 %.3f  max %.3f\n",
+		l.Min, l.Mean, l.P50, l.P90, l.P99, l.P999, l.Max)
+}
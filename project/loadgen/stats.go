@@ -0,0 +1,145 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats collects the outcome of every event sent during a run.
+type stats struct {
+	sent  atomic.Int64
+	acked atomic.Int64
+	// latencySum is in nanoseconds, for the mean of each progress report.
+	latencySum atomic.Int64
+
+	mutex     sync.Mutex
+	errors    map[string]int64
+	latencies []time.Duration
+}
+
+func newStats() *stats {
+	return &stats{errors: make(map[string]int64)}
+}
+
+func (s *stats) recordAck(latency time.Duration) {
+	s.acked.Add(1)
+	s.latencySum.Add(int64(latency))
+
+	s.mutex.Lock()
+	s.latencies = append(s.latencies, latency)
+	s.mutex.Unlock()
+}
+
+func (s *stats) recordError(kind string) {
+	s.mutex.Lock()
+	s.errors[kind]++
+	s.mutex.Unlock()
+}
+
+func (s *stats) errorCount() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var total int64
+	for _, n := range s.errors {
+		total += n
+	}
+	return total
+}
+
+// progress is a snapshot of the counters, reported while the run goes on.
+type progress struct {
+	sent, acked, errors, latencySum int64
+}
+
+func (s *stats) progress() progress {
+	return progress{
+		sent:       s.sent.Load(),
+		acked:      s.acked.Load(),
+		errors:     s.errorCount(),
+		latencySum: s.latencySum.Load(),
+	}
+}
+
+// Latencies summarises the ACK latencies of a run in milliseconds.
+type Latencies struct {
+	Min  float64 `json:"min"`
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+}
+
+// Summary is the report printed at the end of a run.
+type Summary struct {
+	Transport   string           `json:"transport"`
+	Mode        string           `json:"mode"`
+	Connections int              `json:"connections"`
+	Streams     int              `json:"streams"`
+	TargetRate  float64          `json:"targetRate"`
+	Duration    float64          `json:"durationSeconds"`
+	Sent        int64            `json:"sent"`
+	Acked       int64            `json:"acked"`
+	Errors      map[string]int64 `json:"errors"`
+	Throughput  float64          `json:"acksPerSecond"`
+	LatencyMs   Latencies        `json:"latencyMs"`
+}
+
+func (s *stats) summary(elapsed time.Duration) Summary {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	summary := Summary{
+		Duration: elapsed.Seconds(),
+		Sent:     s.sent.Load(),
+		Acked:    s.acked.Load(),
+		Errors:   make(map[string]int64, len(s.errors)),
+	}
+	for kind, n := range s.errors {
+		summary.Errors[kind] = n
+	}
+	if elapsed > 0 {
+		summary.Throughput = float64(summary.Acked) / elapsed.Seconds()
+	}
+
+	latencies := s.latencies
+	if len(latencies) == 0 {
+		return summary
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	var total time.Duration
+	for _, latency := range latencies {
+		total += latency
+	}
+	summary.LatencyMs = Latencies{
+		Min:  milliseconds(latencies[0]),
+		Mean: milliseconds(total / time.Duration(len(latencies))),
+		P50:  milliseconds(percentile(latencies, 0.50)),
+		P90:  milliseconds(percentile(latencies, 0.90)),
+		P99:  milliseconds(percentile(latencies, 0.99)),
+		P999: milliseconds(percentile(latencies, 0.999)),
+		Max:  milliseconds(latencies[len(latencies)-1]),
+	}
+	return summary
+}
+
+// percentile returns the nearest-rank percentile of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	rank := int(p*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
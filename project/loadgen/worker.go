@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/transport"
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+var errAckTimeout = errors.New("timed out waiting for ACK")
+
+// worker sends the events of one train, one at a time, over a session stream
+// of its own or a new stream per event in legacy mode. It walks the train
+// through its whole lifecycle over and over, so that even a subscriber
+// enforcing the lifecycle accepts every event.
+type worker struct {
+	conn        transport.Conn
+	legacy      bool
+	train       uint16
+	destination string
+	ackTimeout  time.Duration
+	stats       *stats
+
+	transactionID uint16
+	sequence      uint16
+	step          int
+
+	// session is the open session stream, nil until the first event and
+	// after an error.
+	session transport.Stream
+	acks    chan utils.LRTPIDSPacket
+	done    chan struct{}
+
+	// timer is reused for every wait, creating one per event would add up
+	// at high rates.
+	timer *time.Timer
+}
+
+// after is time.After on the timer of the worker.
+func (w *worker) after(d time.Duration) <-chan time.Time {
+	if w.timer == nil {
+		w.timer = time.NewTimer(d)
+		return w.timer.C
+	}
+
+	if !w.timer.Stop() {
+		select {
+		case <-w.timer.C:
+		default:
+		}
+	}
+	w.timer.Reset(d)
+	return w.timer.C
+}
+
+// lifecycleSteps are the flags of the events a worker cycles through.
+var lifecycleSteps = []func(*utils.LRTPIDSPacket){
+	func(p *utils.LRTPIDSPacket) { p.IsNewTrain = 1 },
+	func(p *utils.LRTPIDSPacket) { p.IsUpdateTrain = 1 },
+	func(p *utils.LRTPIDSPacket) { p.IsTrainArriving = 1 },
+	func(p *utils.LRTPIDSPacket) { p.IsTrainDeparting = 1 },
+	func(p *utils.LRTPIDSPacket) { p.IsDeleteTrain = 1 },
+}
+
+func (w *worker) nextPacket() utils.LRTPIDSPacket {
+	w.transactionID++
+	if w.transactionID == 0 {
+		w.transactionID++
+	}
+	w.sequence++
+	if w.sequence == 0 {
+		w.sequence++
+	}
+
+	packet := utils.LRTPIDSPacket{
+		TransactionID: w.transactionID,
+		TrainNumber:   w.train,
+		Destination:   w.destination,
+		Sequence:      w.sequence,
+	}
+	lifecycleSteps[w.step](&packet)
+	w.step = (w.step + 1) % len(lifecycleSteps)
+	return packet
+}
+
+// run sends events until ctx is done, one per interval when interval is
+// positive and back to back otherwise. limit is shared by all workers and
+// ends the run once the requested number of events has been sent.
+func (w *worker) run(ctx context.Context, interval time.Duration, limit func() bool) {
+	defer w.closeSession()
+
+	next := time.Now()
+	for ctx.Err() == nil {
+		if interval > 0 {
+			if wait := time.Until(next); wait > 0 {
+				select {
+				case <-w.after(wait):
+				case <-ctx.Done():
+					return
+				}
+			}
+			// A worker that fell behind does not burst to catch up, the
+			// achieved rate shows in the report instead.
+			next = next.Add(interval)
+			if now := time.Now(); next.Before(now) {
+				next = now
+			}
+		}
+
+		if !limit() {
+			return
+		}
+
+		packet := w.nextPacket()
+		data, err := utils.Encode(packet)
+		if err != nil {
+			w.stats.recordError("encode")
+			continue
+		}
+
+		w.stats.sent.Add(1)
+		start := time.Now()
+		var ack utils.LRTPIDSPacket
+		if w.legacy {
+			ack, err = w.sendOnStream(ctx, data)
+		} else {
+			ack, err = w.sendOnSession(ctx, data)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			w.stats.recordError(errorKind(err))
+			continue
+		}
+
+		if ack.IsAck != 1 || ack.TransactionID != packet.TransactionID {
+			w.stats.recordError("invalid_ack")
+			continue
+		}
+		w.stats.recordAck(time.Since(start))
+	}
+}
+
+// kindError labels an error for the report.
+type kindError struct {
+	kind string
+	err  error
+}
+
+func (e *kindError) Error() string { return fmt.Sprintf("%s: %v", e.kind, e.err) }
+
+func errorKind(err error) string {
+	var kindErr *kindError
+	if errors.As(err, &kindErr) {
+		return kindErr.kind
+	}
+	if errors.Is(err, errAckTimeout) {
+		return "ack_timeout"
+	}
+	return "other"
+}
+
+func (w *worker) sendOnStream(ctx context.Context, data []byte) (utils.LRTPIDSPacket, error) {
+	stream, err := w.conn.OpenStream(ctx)
+	if err != nil {
+		return utils.LRTPIDSPacket{}, &kindError{"open_stream", err}
+	}
+	defer stream.Close()
+
+	if _, err := stream.Write(data); err != nil {
+		return utils.LRTPIDSPacket{}, &kindError{"write", err}
+	}
+
+	type result struct {
+		ack utils.LRTPIDSPacket
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		buffer := make([]byte, 1024)
+		n, err := stream.Read(buffer)
+		if err != nil {
+			results <- result{err: &kindError{"read_ack", err}}
+			return
+		}
+		ack, err := utils.Decode(buffer[:n])
+		if err != nil {
+			err = &kindError{"decode_ack", err}
+		}
+		results <- result{ack, err}
+	}()
+
+	select {
+	case r := <-results:
+		return r.ack, r.err
+	case <-w.after(w.ackTimeout):
+		return utils.LRTPIDSPacket{}, errAckTimeout
+	case <-ctx.Done():
+		return utils.LRTPIDSPacket{}, ctx.Err()
+	}
+}
+
+func (w *worker) sendOnSession(ctx context.Context, data []byte) (utils.LRTPIDSPacket, error) {
+	if w.session == nil {
+		if err := w.openSession(ctx); err != nil {
+			return utils.LRTPIDSPacket{}, err
+		}
+	}
+
+	if err := utils.WriteMessage(w.session, utils.MessageEvent, data); err != nil {
+		w.closeSession()
+		return utils.LRTPIDSPacket{}, &kindError{"write", err}
+	}
+
+	select {
+	case ack := <-w.acks:
+		return ack, nil
+	case <-w.done:
+		w.closeSession()
+		return utils.LRTPIDSPacket{}, &kindError{"read_ack", errors.New("session closed")}
+	case <-w.after(w.ackTimeout):
+		// A late ACK would be taken for the next event, start over.
+		w.closeSession()
+		return utils.LRTPIDSPacket{}, errAckTimeout
+	case <-ctx.Done():
+		return utils.LRTPIDSPacket{}, ctx.Err()
+	}
+}
+
+func (w *worker) openSession(ctx context.Context) error {
+	stream, err := w.conn.OpenStream(ctx)
+	if err != nil {
+		return &kindError{"open_stream", err}
+	}
+
+	hello := utils.Hello{
+		Version:      utils.SessionVersion,
+		MessageTypes: []uint8{utils.MessageEvent, utils.MessageAck},
+		StationID:    "loadgen",
+	}
+	if err := utils.WriteSessionStart(stream, hello); err != nil {
+		stream.Close()
+		return &kindError{"hello", err}
+	}
+
+	peer, err := utils.ReadHello(stream)
+	if err != nil {
+		stream.Close()
+		return &kindError{"hello", err}
+	}
+	if peer.Version != utils.SessionVersion || !peer.Supports(utils.MessageEvent) {
+		stream.Close()
+		return &kindError{"hello", fmt.Errorf("subscriber does not accept session version %d events", utils.SessionVersion)}
+	}
+
+	w.session = stream
+	w.acks = make(chan utils.LRTPIDSPacket, 1)
+	w.done = make(chan struct{})
+	go readAcks(stream, w.acks, w.done, w.stats)
+	return nil
+}
+
+// readAcks passes the ACKs read from a session stream on until it fails.
+func readAcks(stream transport.Stream, acks chan<- utils.LRTPIDSPacket, done chan<- struct{}, stats *stats) {
+	defer close(done)
+
+	for {
+		messageType, payload, err := utils.ReadMessage(stream)
+		if err != nil {
+			return
+		}
+		if messageType != utils.MessageAck {
+			continue
+		}
+
+		ack, err := utils.Decode(payload)
+		if err != nil {
+			stats.recordError("decode_ack")
+			continue
+		}
+		select {
+		case acks <- ack:
+		default:
+			stats.recordError("unexpected_ack")
+		}
+	}
+}
+
+func (w *worker) closeSession() {
+	if w.session != nil {
+		w.session.Close()
+		w.session = nil
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"unicode/utf8"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+var messageNames = map[uint8]string{
+	utils.MessageHello:        "Hello",
+	utils.MessageEvent:        "Event",
+	utils.MessageAck:          "Ack",
+	utils.MessagePosition:     "Position",
+	utils.MessageSyncRequest:  "SyncRequest",
+	utils.MessageSyncResponse: "SyncResponse",
+	utils.MessageNack:         "Nack",
+}
+
+// problem is something wrong with the input, at a byte offset into it.
+type problem struct {
+	Offset  int
+	Message string
+}
+
+// dumper prints the structure of its input to w and collects problems on
+// the way. Offsets are always relative to the start of the input.
+type dumper struct {
+	w        io.Writer
+	problems []problem
+}
+
+func (d *dumper) problemf(offset int, format string, args ...any) {
+	d.problems = append(d.problems, problem{offset, fmt.Sprintf(format, args...)})
+}
+
+// printProblems lists the problems found, ordered by offset.
+func (d *dumper) printProblems() {
+	if len(d.problems) == 0 {
+		return
+	}
+	sort.SliceStable(d.problems, func(i, j int) bool { return d.problems[i].Offset < d.problems[j].Offset })
+	fmt.Fprintln(d.w, "\nproblems:")
+	for _, problem := range d.problems {
+		fmt.Fprintf(d.w, "  at byte %d: %s\n", problem.Offset, problem.Message)
+	}
+}
+
+func (d *dumper) printf(indent int, format string, args ...any) {
+	fmt.Fprintf(d.w, "%s%s\n", strings.Repeat("  ", indent), fmt.Sprintf(format, args...))
+}
+
+// detectFraming guesses how data was captured: a whole session stream from
+// the magic on, a run of framed messages, or a bare LRTPIDSPacket.
+func detectFraming(data []byte) string {
+	if len(data) >= len(utils.SessionMagic) && utils.IsSessionStart(data[:len(utils.SessionMagic)]) {
+		return "session"
+	}
+
+	offset := 0
+	for offset+3 <= len(data) {
+		if _, ok := messageNames[data[offset]]; !ok {
+			return "packet"
+		}
+		offset += 3 + int(binary.BigEndian.Uint16(data[offset+1:]))
+	}
+	if offset == len(data) && offset > 0 {
+		return "message"
+	}
+	return "packet"
+}
+
+func (d *dumper) dump(data []byte, framing string) error {
+	if framing == "auto" {
+		framing = detectFraming(data)
+	}
+
+	switch framing {
+	case "session":
+		if len(data) < len(utils.SessionMagic) || !utils.IsSessionStart(data[:len(utils.SessionMagic)]) {
+			d.problemf(0, "session does not start with %q", utils.SessionMagic)
+			d.dumpMessages(data, 0)
+			return nil
+		}
+		d.printf(0, "session magic %q", utils.SessionMagic)
+		d.dumpMessages(data[len(utils.SessionMagic):], len(utils.SessionMagic))
+	case "message":
+		d.dumpMessages(data, 0)
+	case "packet":
+		d.printf(0, "LRTPIDSPacket, %d bytes", len(data))
+		d.dumpPacket(data, 0, 1)
+	default:
+		return fmt.Errorf("unknown framing %q", framing)
+	}
+	return nil
+}
+
+// dumpMessages prints framed messages, type (1 byte) | payload length
+// (2 bytes) | payload, until data runs out.
+func (d *dumper) dumpMessages(data []byte, base int) {
+	for offset := 0; offset < len(data); {
+		if len(data)-offset < 3 {
+			d.problemf(base+offset, "message header needs 3 bytes, %d left", len(data)-offset)
+			return
+		}
+
+		messageType := data[offset]
+		length := int(binary.BigEndian.Uint16(data[offset+1:]))
+		payload := data[offset+3:]
+		if length > len(payload) {
+			d.problemf(base+offset+1, "message payload length is %d but only %d bytes follow", length, len(payload))
+		} else {
+			payload = payload[:length]
+		}
+
+		name, ok := messageNames[messageType]
+		if !ok {
+			name = "unknown"
+			d.problemf(base+offset, "unknown message type %#02x", messageType)
+		}
+		d.printf(0, "message at %d: %s (%#02x), %d byte payload", base+offset, name, messageType, length)
+
+		payloadBase := base + offset + 3
+		switch messageType {
+		case utils.MessageHello:
+			d.dumpHello(payload, payloadBase)
+		case utils.MessageEvent, utils.MessageAck:
+			d.dumpPacket(payload, payloadBase, 1)
+		case utils.MessageSyncRequest:
+			if len(payload) > 0 {
+				d.problemf(payloadBase, "sync request carries %d unexpected bytes", len(payload))
+			}
+		case utils.MessageSyncResponse:
+			d.dumpSyncResponse(payload, payloadBase)
+		case utils.MessageNack:
+			d.dumpNack(payload, payloadBase)
+		case utils.MessagePosition:
+			d.problemf(base+offset, "positions travel as datagrams, not session messages")
+		}
+
+		offset += 3 + len(payload)
+	}
+}
+
+func (d *dumper) dumpHello(data []byte, base int) {
+	hello, err := utils.DecodeHello(data)
+	if err != nil {
+		d.problemf(base, "%v", err)
+		return
+	}
+
+	types := make([]string, len(hello.MessageTypes))
+	for i, messageType := range hello.MessageTypes {
+		name, ok := messageNames[messageType]
+		if !ok {
+			name = "unknown"
+		}
+		types[i] = fmt.Sprintf("%s (%#02x)", name, messageType)
+	}
+	d.printf(1, "version       %d", hello.Version)
+	d.printf(1, "message types %s", strings.Join(types, ", "))
+	d.printf(1, "station       %q", hello.StationID)
+
+	if hello.Version != utils.SessionVersion {
+		d.problemf(base, "hello version %d, this build speaks %d", hello.Version, utils.SessionVersion)
+	}
+	if !utf8.ValidString(hello.StationID) {
+		d.problemf(base, "station ID is not valid UTF-8")
+	}
+	if used := 3 + len(hello.MessageTypes) + len(hello.StationID); used < len(data) {
+		d.problemf(base+used, "%d trailing bytes after the hello: % x", len(data)-used, data[used:])
+	}
+}
+
+func (d *dumper) dumpNack(data []byte, base int) {
+	nack, err := utils.DecodeNack(data)
+	if err != nil {
+		d.problemf(base, "%v", err)
+		return
+	}
+	d.printf(1, "transaction %d", nack.TransactionID)
+	d.printf(1, "reason      %q", nack.Reason)
+
+	if used := 3 + len(nack.Reason); used < len(data) {
+		d.problemf(base+used, "%d trailing bytes after the NACK: % x", len(data)-used, data[used:])
+	}
+}
+
+func (d *dumper) dumpSyncResponse(data []byte, base int) {
+	if len(data) < 2 {
+		d.problemf(base, "sync response needs a 2 byte train count, %d bytes left", len(data))
+		return
+	}
+	count := int(binary.BigEndian.Uint16(data))
+	d.printf(1, "%d trains", count)
+
+	offset := 2
+	for i := 0; i < count; i++ {
+		if len(data)-offset < 2 {
+			d.problemf(base+offset, "train %d of %d is missing", i+1, count)
+			return
+		}
+		length := int(binary.BigEndian.Uint16(data[offset:]))
+		train := data[offset+2:]
+		if length > len(train) {
+			d.problemf(base+offset, "train %d length is %d but only %d bytes follow", i+1, length, len(train))
+		} else {
+			train = train[:length]
+		}
+		d.printf(1, "train %d at %d, %d bytes", i+1, base+offset, length)
+		d.dumpPacket(train, base+offset+2, 2)
+		offset += 2 + len(train)
+	}
+	if offset < len(data) {
+		d.problemf(base+offset, "%d trailing bytes after the trains: % x", len(data)-offset, data[offset:])
+	}
+}
+
+// dumpPacket prints every field of utils.PacketLayout found in data, then
+// what utils.Decode and utils.DecodeStrict make of it.
+func (d *dumper) dumpPacket(data []byte, base, indent int) {
+	table := tabwriter.NewWriter(d.w, 0, 0, 2, ' ', 0)
+	prefix := strings.Repeat("  ", indent)
+	fmt.Fprintf(table, "%soffset\tbytes\tfield\tvalue\n", prefix)
+
+	offset := 0
+	var length int
+	var events []string
+	truncated := false
+	for _, field := range utils.PacketLayout {
+		left := len(data) - offset
+		if field.Optional && left == 0 {
+			fmt.Fprintf(table, "%s%d\t\t%s\tabsent, sent by an older publisher\n", prefix, base+offset, field.Name)
+			break
+		}
+
+		size := field.Kind.Size()
+		if field.Kind == utils.FieldString {
+			size = length
+		}
+		if size > left {
+			truncated = true
+			if field.Kind != utils.FieldString {
+				d.problemf(base+offset, "%s is missing", field.Name)
+				break
+			}
+			d.problemf(base+offset, "%s needs %d bytes, %d left", field.Name, size, left)
+			size = left
+		}
+		raw := data[offset : offset+size]
+
+		var value string
+		switch field.Kind {
+		case utils.FieldUint16:
+			value = fmt.Sprint(binary.BigEndian.Uint16(raw))
+		case utils.FieldFlag:
+			switch raw[0] {
+			case 0:
+				value = "0 (no)"
+			case 1:
+				value = fmt.Sprintf("1 (yes, %s event)", field.Event)
+				events = append(events, field.Event)
+			default:
+				value = fmt.Sprintf("%d (invalid)", raw[0])
+				d.problemf(base+offset, "%s is %d, flags are 0 or 1", field.Name, raw[0])
+			}
+		case utils.FieldLength:
+			length = int(raw[0])
+			value = fmt.Sprint(length)
+		case utils.FieldString:
+			value = fmt.Sprintf("%q", raw)
+			if !utf8.Valid(raw) {
+				d.problemf(base+offset, "%s is not valid UTF-8", field.Name)
+			}
+		default:
+			value = fmt.Sprint(raw[0])
+		}
+		fmt.Fprintf(table, "%s%d\t% x\t%s\t%s\n", prefix, base+offset, raw, field.Name, value)
+		offset += size
+		if truncated {
+			break
+		}
+	}
+	table.Flush()
+
+	if !truncated && offset < len(data) {
+		d.problemf(base+offset, "%d trailing bytes after the packet: % x", len(data)-offset, data[offset:])
+	}
+	switch {
+	case len(events) == 0 && !truncated:
+		d.problemf(base, "no flag is set")
+	case len(events) > 1 && events[0] == "ack":
+		d.problemf(base, "an ACK also carries %s", strings.Join(events[1:], ", "))
+	}
+
+	packet, err := utils.Decode(data)
+	if err != nil {
+		d.printf(indent, "utils.Decode: %v", err)
+		return
+	}
+	d.printf(indent, "utils.Decode: %s train %d to %q, transaction %d, sequence %d",
+		packet.EventType(), packet.TrainNumber, packet.Destination, packet.TransactionID, packet.Sequence)
+
+	if _, err := utils.DecodeStrict(data); err != nil {
+		d.printf(indent, "utils.DecodeStrict: %v", err)
+	} else {
+		d.printf(indent, "utils.DecodeStrict: ok")
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+func mustEncode(t *testing.T, packet utils.LRTPIDSPacket) []byte {
+	t.Helper()
+	data, err := utils.Encode(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// message frames payload as a session message of messageType.
+func message(t *testing.T, messageType uint8, payload []byte) []byte {
+	t.Helper()
+	var buffer bytes.Buffer
+	if err := utils.WriteMessage(&buffer, messageType, payload); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestDumpGolden(t *testing.T) {
+	event := utils.LRTPIDSPacket{TransactionID: 0x5c62, IsNewTrain: 1, TrainNumber: 42, Destination: "Harjamukti", Sequence: 1}
+	ack := utils.LRTPIDSPacket{TransactionID: 0x5c62, IsAck: 1, TrainNumber: 42}
+	hello, err := utils.EncodeHello(utils.Hello{
+		Version:      utils.SessionVersion,
+		MessageTypes: []uint8{utils.MessageEvent, utils.MessageAck, utils.MessageNack},
+		StationID:    "Dukuh Atas BNI",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	position, err := utils.EncodePosition(utils.LRTPIDSPosition{TrainNumber: 42, Timestamp: 1696224600000, Latitude: -6.2, Longitude: 106.8, Speed: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncResponse, err := utils.EncodeSyncResponse([]utils.LRTPIDSPacket{
+		{IsNewTrain: 1, TrainNumber: 42, Destination: "Harjamukti"},
+		{IsNewTrain: 1, IsTrainArriving: 1, TrainNumber: 43, Destination: "Dukuh Atas"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	malformed := mustEncode(t, utils.LRTPIDSPacket{TransactionID: 7, IsAck: 1, IsTrainArriving: 1, TrainNumber: 42, Destination: "Cawang"})
+	// An invalid flag, and a destination cut short.
+	malformed[3] = 2
+	malformed = malformed[:len(malformed)-5]
+
+	tests := []struct {
+		name    string
+		framing string
+		data    []byte
+	}{
+		{"packet", "auto", mustEncode(t, event)},
+		// Packets of older publishers end before the sequence.
+		{"packet-legacy", "auto", mustEncode(t, event)[:len(mustEncode(t, event))-2]},
+		{"packet-malformed", "packet", malformed},
+		{"hello", "auto", message(t, utils.MessageHello, hello)},
+		{"event", "auto", message(t, utils.MessageEvent, mustEncode(t, event))},
+		{"ack", "auto", message(t, utils.MessageAck, mustEncode(t, ack))},
+		{"position", "auto", message(t, utils.MessagePosition, position)},
+		{"sync-request", "auto", message(t, utils.MessageSyncRequest, nil)},
+		{"sync-response", "auto", message(t, utils.MessageSyncResponse, syncResponse)},
+		{"nack", "auto", message(t, utils.MessageNack, utils.EncodeNack(utils.Nack{TransactionID: 0x5c62, Reason: "train 42: new event not allowed while scheduled"}))},
+		{"unknown-message", "message", message(t, 0x09, []byte{1, 2})},
+		{"session", "auto", bytes.Join([][]byte{
+			[]byte(utils.SessionMagic),
+			message(t, utils.MessageHello, hello),
+			message(t, utils.MessageEvent, mustEncode(t, event)),
+		}, nil)},
+		// The last message says it is longer than what is left.
+		{"session-truncated", "session", bytes.Join([][]byte{
+			[]byte(utils.SessionMagic),
+			message(t, utils.MessageSyncRequest, nil),
+			{utils.MessageEvent, 0, 30, 0x5c},
+		}, nil)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var output bytes.Buffer
+			d := &dumper{w: &output}
+			if err := d.dump(test.data, test.framing); err != nil {
+				t.Fatalf("dump: %v", err)
+			}
+			d.printProblems()
+
+			path := filepath.Join("testdata", test.name+".golden")
+			if *update {
+				if err := os.WriteFile(path, output.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("%v, run the tests with -update to create it", err)
+			}
+			if !bytes.Equal(output.Bytes(), want) {
+				t.Errorf("dump of % x:\n%s\nwant:\n%s", test.data, output.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestDumpUnknownFraming(t *testing.T) {
+	d := &dumper{w: &bytes.Buffer{}}
+	if err := d.dump([]byte{1}, "frame"); err == nil {
+		t.Error("dump with an unknown framing succeeded")
+	}
+}
+
+func TestDetectFraming(t *testing.T) {
+	tests := []struct {
+		data []byte
+		want string
+	}{
+		{[]byte("PIDS\x01\x00\x00"), "session"},
+		{[]byte{utils.MessageSyncRequest, 0, 0}, "message"},
+		{[]byte{utils.MessageSyncRequest, 0, 0, utils.MessageAck, 0, 1, 0}, "message"},
+		// A message length that overshoots is a packet after all.
+		{[]byte{utils.MessageEvent, 0, 9, 0}, "packet"},
+		{[]byte{0x5c, 0x62, 0, 1}, "packet"},
+		{nil, "packet"},
+	}
+	for _, test := range tests {
+		if got := detectFraming(test.data); got != test.want {
+			t.Errorf("detectFraming(% x) = %s, want %s", test.data, got, test.want)
+		}
+	}
+}
+
+func TestParseInput(t *testing.T) {
+	want := []byte{0x5c, 0x62, 0x00, 0x01, 0x2a}
+	tests := []struct {
+		name   string
+		text   string
+		format string
+		ok     bool
+	}{
+		{"hex", "5c62 0001 2a", "auto", true},
+		{"separators", "0x5c:0x62,00-01\n\t2A", "hex", true},
+		{"hexdump", "00000000  5c 62 00 01 2a                                    |\\b..*|", "hex", true},
+		{"xxd", "00000000: 5c62 0001 2a                              \\b..*", "hex", true},
+		{"base64", "XGIAASo=", "auto", true},
+		{"base64 without padding", "XGIAASo", "base64", true},
+		{"base64 split over lines", "XGIA\nASo=", "base64", true},
+		{"odd hex digits", "5c6", "hex", false},
+		{"neither", "not a dump!", "auto", false},
+		{"unknown format", "5c62", "octal", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := parseInput(test.text, test.format)
+			if !test.ok {
+				if err == nil {
+					t.Errorf("parseInput(%q, %s) = % x, want an error", test.text, test.format, data)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(data, want) {
+				t.Errorf("parseInput(%q, %s) = % x, %v, want % x", test.text, test.format, data, err, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// dumpOffset matches the offset column of `hexdump -C` and `xxd` lines.
+var dumpOffset = regexp.MustCompile(`^[0-9a-fA-F]{6,16}(:|\s\s)`)
+
+// parseInput turns text pasted from a log into bytes. format is "hex",
+// "base64" or "auto", which tries hex first.
+func parseInput(text, format string) ([]byte, error) {
+	switch format {
+	case "hex":
+		return parseHex(text)
+	case "base64":
+		return parseBase64(text)
+	case "auto":
+		if data, err := parseHex(text); err == nil {
+			return data, nil
+		}
+		if data, err := parseBase64(text); err == nil {
+			return data, nil
+		}
+		return nil, fmt.Errorf("input is neither hex nor base64")
+	}
+	return nil, fmt.Errorf("unknown input format %q", format)
+}
+
+// parseHex accepts hex digits separated by anything in " \t\r\n:,-", with
+// optional 0x prefixes, as well as `hexdump -C` and `xxd` output.
+func parseHex(text string) ([]byte, error) {
+	var digits strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if match := dumpOffset.FindString(line); match != "" {
+			isXXD := strings.HasSuffix(match, ":")
+			line = line[len(match):]
+			// Drop the text column.
+			if isXXD {
+				if i := strings.Index(strings.TrimLeft(line, " "), "  "); i >= 0 {
+					line = strings.TrimLeft(line, " ")[:i]
+				}
+			} else if i := strings.Index(line, "|"); i >= 0 {
+				line = line[:i]
+			}
+		}
+
+		for _, word := range strings.FieldsFunc(line, func(r rune) bool { return strings.ContainsRune(" \t\r:,-", r) }) {
+			word = strings.TrimPrefix(strings.TrimPrefix(word, "0x"), "0X")
+			digits.WriteString(word)
+		}
+	}
+
+	data, err := hex.DecodeString(digits.String())
+	if err != nil {
+		return nil, fmt.Errorf("error decoding hex: %v", err)
+	}
+	return data, nil
+}
+
+// parseBase64 accepts the standard and URL alphabets, padded or not.
+func parseBase64(text string) ([]byte, error) {
+	text = strings.Join(strings.Fields(text), "")
+	for _, encoding := range []*base64.Encoding{base64.StdEncoding, base64.RawStdEncoding, base64.URLEncoding, base64.RawURLEncoding} {
+		if data, err := encoding.DecodeString(text); err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("error decoding base64: invalid input")
+}
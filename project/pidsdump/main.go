@@ -0,0 +1,72 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// pidsdump decodes an LRTPIDSPacket, framed session messages or a whole
+// session stream from a hex or base64 dump, or from a binary file, and
+// prints every field along with anything that looks wrong:
+//
+//	pidsdump 5c62 0001 0000 0000 002a 0a 4861726a616d756b7469 0001
+//	pidsdump -file stream.bin
+//
+// It exits with status 1 when it found problems.
+func main() {
+	file := flag.String("file", "", "binary file to decode instead of the arguments or standard input")
+	format := flag.String("format", "auto", "encoding of the arguments or standard input: auto, hex or base64")
+	framing := flag.String("framing", "auto", "what the bytes hold: auto, packet, message (framed session messages) or session (magic first)")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: pidsdump [flags] [hex or base64 ...]\n\nReads standard input when no data is given.\n\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	data, err := readInput(*file, *format, flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if len(data) == 0 {
+		fmt.Fprintln(os.Stderr, "no input")
+		os.Exit(2)
+	}
+
+	d := &dumper{w: os.Stdout}
+	if err := d.dump(data, *framing); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if len(d.problems) > 0 {
+		d.printProblems()
+		os.Exit(1)
+	}
+}
+
+func readInput(file, format string, args []string) ([]byte, error) {
+	if file != "" {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("give either -file or data arguments, not both")
+		}
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %v", file, err)
+		}
+		return data, nil
+	}
+
+	text := strings.Join(args, " ")
+	if len(args) == 0 {
+		input, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("error reading standard input: %v", err)
+		}
+		text = string(input)
+	}
+	return parseInput(text, format)
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils/pcapng"
+)
+
+// capture writes the datagrams the proxy delivers to a pcapng file. With a
+// key log it embeds the secrets a publisher or subscriber appends to that
+// file, checking for new ones before every datagram so that they precede
+// the packets they decrypt.
+type capture struct {
+	writer *pcapng.Writer
+	logger *slog.Logger
+
+	mutex   sync.Mutex
+	keyLog  *os.File
+	partial []byte
+}
+
+func openCapture(path, keyLogPath string, logger *slog.Logger) (*capture, error) {
+	writer, err := pcapng.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &capture{writer: writer, logger: logger}
+	if keyLogPath != "" {
+		// The key log may not exist until an endpoint starts.
+		keyLog, err := os.OpenFile(keyLogPath, os.O_RDONLY|os.O_CREATE, 0o600)
+		if err != nil {
+			writer.Close()
+			return nil, fmt.Errorf("failed to open TLS key log: %v", err)
+		}
+		c.keyLog = keyLog
+	}
+	return c, nil
+}
+
+func (c *capture) datagram(src, dst net.Addr, payload []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.keyLog != nil {
+		c.readSecrets()
+	}
+	if err := c.writer.WriteUDP(time.Now(), src, dst, payload); err != nil {
+		c.logger.Debug("failed to capture datagram", "error", err)
+	}
+}
+
+// readSecrets embeds the complete lines appended to the key log since the
+// last call.
+func (c *capture) readSecrets() {
+	data, err := io.ReadAll(c.keyLog)
+	if err != nil {
+		c.logger.Warn("failed to read TLS key log", "error", err)
+		return
+	}
+	if len(data) == 0 {
+		return
+	}
+
+	c.partial = append(c.partial, data...)
+	end := bytes.LastIndexByte(c.partial, '\n')
+	if end < 0 {
+		return
+	}
+
+	if err := c.writer.WriteSecrets(c.partial[:end+1]); err != nil {
+		c.logger.Warn("failed to embed TLS secrets", "error", err)
+	}
+	c.partial = append(c.partial[:0], c.partial[end+1:]...)
+}
+
+func (c *capture) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.keyLog != nil {
+		c.readSecrets()
+		c.keyLog.Close()
+	}
+	return c.writer.Close()
+}
@@ -0,0 +1,7 @@
+module jarkom.cs.ui.ac.id/h01/project/proxy
+
+go 1.21
+
+require jarkom.cs.ui.ac.id/h01/project/utils v0.0.0
+
+replace jarkom.cs.ui.ac.id/h01/project/utils => ../utils
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils/netem"
+	"jarkom.cs.ui.ac.id/h01/project/utils/pidslog"
+)
+
+// proxy sits between a publisher and a subscriber talking QUIC or the UDP
+// transport and impairs their datagrams, see package netem.
+func main() {
+	os.Exit(run())
+}
+
+// run is main returning its exit code, so that deferred closes still run.
+func run() int {
+	listenAddress := flag.String("listen", ":4511", "address publishers send to")
+	target := flag.String("target", "127.0.0.1:4510", "subscriber address")
+	direction := flag.String("direction", "both", "which direction to impair: both, upstream (to the subscriber) or downstream")
+	loss := flag.Float64("loss", 0, "probability of dropping a datagram, 0 to 1")
+	delay := flag.Duration("delay", 0, "delay added to every datagram")
+	jitter := flag.Duration("jitter", 0, "random variation of the delay in either direction")
+	duplicate := flag.Float64("duplicate", 0, "probability of sending a datagram twice")
+	reorder := flag.Float64("reorder", 0, "probability of holding a datagram back so that later ones overtake it")
+	reorderDelay := flag.Duration("reorder-delay", 10*time.Millisecond, "how long reordered datagrams are held back")
+	bandwidth := flag.String("bandwidth", "", "bandwidth cap in bits per second with an optional k, M or G suffix, e.g. 256k, empty for none")
+	queueSize := flag.Int("queue-size", netem.DefaultQueueSize, "bytes that may wait behind the bandwidth cap before datagrams are dropped")
+	seed := flag.Int64("seed", 0, "random seed for repeatable runs, the current time when 0")
+	captureFile := flag.String("capture", "", "pcapng file to record the delivered datagrams in, empty to disable")
+	captureKeyLog := flag.String("capture-keylog", "", "TLS key log written by the publisher or subscriber, whose secrets are embedded in the capture")
+	statsInterval := flag.Duration("stats-interval", 10*time.Second, "how often to log datagram counts, 0 to disable")
+	logConfig := pidslog.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	logger, err := logConfig.NewLogger(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	slog.SetDefault(logger)
+
+	bytesPerSecond, err := parseBandwidth(*bandwidth)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	impairment := netem.Impairment{
+		Loss:         *loss,
+		Delay:        *delay,
+		Jitter:       *jitter,
+		Duplicate:    *duplicate,
+		Reorder:      *reorder,
+		ReorderDelay: *reorderDelay,
+		Bandwidth:    bytesPerSecond,
+		QueueSize:    *queueSize,
+	}
+
+	config := netem.Config{Seed: *seed, Logger: logger}
+	switch *direction {
+	case "both":
+		config.Upstream, config.Downstream = impairment, impairment
+	case "upstream":
+		config.Upstream = impairment
+	case "downstream":
+		config.Downstream = impairment
+	default:
+		fmt.Fprintf(os.Stderr, "unknown direction %q\n", *direction)
+		return 2
+	}
+
+	if *captureFile != "" {
+		c, err := openCapture(*captureFile, *captureKeyLog, logger)
+		if err != nil {
+			logger.Error("failed to start capture", "error", err)
+			return 1
+		}
+		defer c.Close()
+		config.Capture = c.datagram
+		logger.Info("capturing datagrams", "file", *captureFile, "keylog", *captureKeyLog)
+	}
+
+	proxy, err := netem.Listen(*listenAddress, *target, config)
+	if err != nil {
+		logger.Error("failed to start proxy", "error", err)
+		return 1
+	}
+	defer proxy.Close()
+
+	logger.Info("proxy started", "listen", proxy.Addr().String(), "target", *target, "direction", *direction,
+		"loss", *loss, "delay", *delay, "jitter", *jitter, "duplicate", *duplicate, "reorder", *reorder, "bandwidth", *bandwidth)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	var tick <-chan time.Time
+	if *statsInterval > 0 {
+		ticker := time.NewTicker(*statsInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-tick:
+			logStats(logger, proxy.Stats())
+		case <-signals:
+			logStats(logger, proxy.Stats())
+			logger.Info("shutting down")
+			return 0
+		}
+	}
+}
+
+func logStats(logger *slog.Logger, stats netem.Stats) {
+	for _, direction := range []struct {
+		name  string
+		stats netem.LinkStats
+	}{{"upstream", stats.Upstream}, {"downstream", stats.Downstream}} {
+		logger.Info("datagrams", "direction", direction.name, "clients", stats.Clients,
+			"received", direction.stats.Received, "delivered", direction.stats.Delivered,
+			"lost", direction.stats.Lost, "duplicated", direction.stats.Duplicated,
+			"reordered", direction.stats.Reordered, "overflowed", direction.stats.Overflowed)
+	}
+}
+
+// bandwidthUnits are the suffixes parseBandwidth accepts.
+var bandwidthUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"k", 1e3},
+	{"M", 1e6},
+	{"G", 1e9},
+}
+
+// parseBandwidth turns bits per second like 256k or 1.5M into bytes per
+// second.
+func parseBandwidth(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	number, multiplier := value, 1.0
+	for _, unit := range bandwidthUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			number, multiplier = strings.TrimSuffix(value, unit.suffix), unit.multiplier
+			break
+		}
+	}
+
+	bits, err := strconv.ParseFloat(number, 64)
+	if err != nil || bits <= 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q", value)
+	}
+	return int64(bits * multiplier / 8), nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestParseBandwidth(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+	}{
+		{"", 0},
+		{"8000", 1000},
+		{"256k", 32000},
+		{"1.5M", 187500},
+		{"1G", 125000000},
+	}
+	for _, test := range tests {
+		got, err := parseBandwidth(test.value)
+		if err != nil || got != test.want {
+			t.Errorf("parseBandwidth(%q) = %d, %v, want %d", test.value, got, err, test.want)
+		}
+	}
+
+	for _, value := range []string{"k", "10kk", "10kbit", "10kbitbit", "10Mk", "-1M", "0", "fast"} {
+		if got, err := parseBandwidth(value); err == nil {
+			t.Errorf("parseBandwidth(%q) = %d, want an error", value, got)
+		}
+	}
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/transport"
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+	"jarkom.cs.ui.ac.id/h01/project/utils/pidslog"
+)
+
+const defaultAddress = "3.81.118.89:4510"
+
+type command struct {
+	name    string
+	summary string
+	run     func(name string, args []string) int
+}
+
+var commands = []command{
+	{"new", "register a train and its destination", runEvent},
+	{"update", "change the destination of a train", runEvent},
+	{"delete", "remove a train", runEvent},
+	{"arrive", "announce that a train is arriving", runEvent},
+	{"depart", "announce that a train is departing", runEvent},
+	{"send-raw", "send a packet with any combination of flag bits, unvalidated", runSendRaw},
+	{"replay", "send the events of a timetable or scenario file in real or accelerated time", runReplay},
+	{"simulate", "run trains along the line and send what every station display sees", runSimulate},
+	{"console", "send events interactively, showing each ACK as it arrives", runConsole},
+	{"demo", "replay the arrival and departure of train 42", runDemo},
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: publisher <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "  %-9s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Run "publisher <command> -h" for the flags of a command.`)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+
+	name := os.Args[1]
+	if name == "-h" || name == "-help" || name == "help" {
+		usage(os.Stdout)
+		return
+	}
+
+	for _, c := range commands {
+		if c.name == name {
+			os.Exit(c.run(name, os.Args[2:]))
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+	usage(os.Stderr)
+	os.Exit(2)
+}
+
+// connectionFlags are shared by every command that talks to a subscriber.
+type connectionFlags struct {
+	address       *string
+	transport     *string
+	qlogDir       *string
+	keyLogFile    *string
+	legacyStreams *bool
+	stationID     *string
+	truncate      *bool
+	ackTimeout    *time.Duration
+	log           *pidslog.Config
+}
+
+func addConnectionFlags(fs *flag.FlagSet) *connectionFlags {
+	return &connectionFlags{
+		address:       fs.String("addr", defaultAddress, "subscriber address"),
+		transport:     fs.String("transport", transport.KindQUIC, "transport to reach the subscriber with: "+strings.Join(transport.Kinds, ", ")),
+		qlogDir:       fs.String("qlog-dir", "", "directory to write one qlog file per connection to, empty to disable"),
+		keyLogFile:    fs.String("keylog-file", os.Getenv(transport.KeyLogFileEnv), "file to append TLS secrets to for decrypting captures (default $"+transport.KeyLogFileEnv+"), empty to disable"),
+		legacyStreams: fs.Bool("legacy-streams", false, "send every packet on its own stream, for subscribers without session support"),
+		stationID:     fs.String("station", "", "station ID announced to the subscriber when the session starts"),
+		truncate:      fs.Bool("truncate-destination", false, "shorten destinations longer than 255 bytes instead of refusing them"),
+		ackTimeout:    fs.Duration("ack-timeout", DefaultAckTimeout, "how long to wait for each ACK before giving up"),
+		log:           pidslog.RegisterFlags(fs),
+	}
+}
+
+// setupLogger installs the default logger writing to w.
+func (c *connectionFlags) setupLogger(w io.Writer) (*slog.Logger, error) {
+	logger, err := c.log.NewLogger(w)
+	if err != nil {
+		return nil, err
+	}
+	slog.SetDefault(logger)
+	return logger, nil
+}
+
+// connect opens a publisher. Commands that keep running pass the registry
+// they publish against, which lives as long as the command does: the
+// publisher then reconnects whenever the subscriber is lost and offers it a
+// sync. One-shot commands pass nil, their registry would only tell the
+// subscriber about no trains.
+func (c *connectionFlags) connect(datagrams bool, registry *TrainRegistry) (*PIDSPublisher, error) {
+	return NewPIDSPublisher(*c.address, PublisherOptions{
+		Transport:            *c.transport,
+		QlogDir:              *c.qlogDir,
+		KeyLogFile:           *c.keyLogFile,
+		Datagrams:            datagrams,
+		LegacyStreams:        *c.legacyStreams,
+		StationID:            *c.stationID,
+		TruncateDestinations: *c.truncate,
+		AckTimeout:           *c.ackTimeout,
+		Registry:             registry,
+		Reconnect:            registry != nil,
+	})
+}
+
+// commandResult is printed once per command, as JSON with -json.
+type commandResult struct {
+	Command       string `json:"command"`
+	TransactionID uint16 `json:"transactionId"`
+	TrainNumber   uint16 `json:"trainNumber"`
+	Sequence      uint16 `json:"sequence"`
+	Event         string `json:"event"`
+	Acked         bool   `json:"acked"`
+	// Refused is set when the subscriber answered with a NACK; Error then
+	// holds its reason.
+	Refused   bool    `json:"refused"`
+	LatencyMs float64 `json:"latencyMs,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// setError records why a send failed.
+func (r *commandResult) setError(err error) {
+	var nack *nackError
+	r.Refused = errors.As(err, &nack)
+	r.Error = err.Error()
+}
+
+func (r commandResult) print(w io.Writer, asJSON bool) {
+	if asJSON {
+		json.NewEncoder(w).Encode(r)
+		return
+	}
+
+	if r.Error != "" {
+		verdict := "ERROR"
+		if r.Refused {
+			verdict = "NACK"
+		}
+		fmt.Fprintf(w, "%s %s train=%d transaction=%d: %s\n", verdict, r.Event, r.TrainNumber, r.TransactionID, r.Error)
+		return
+	}
+	fmt.Fprintf(w, "ACK %s train=%d transaction=%d sequence=%d latency=%.3fms\n", r.Event, r.TrainNumber, r.TransactionID, r.Sequence, r.LatencyMs)
+}
+
+// packetFlags are the LRTPIDSPacket fields every event command takes.
+type packetFlags struct {
+	train       *uint
+	destination *string
+	transaction *uint
+	sequence    *uint
+}
+
+func addPacketFlags(fs *flag.FlagSet) *packetFlags {
+	return &packetFlags{
+		train:       fs.Uint("train", 0, "TrainNumber (required)"),
+		destination: fs.String("destination", "", "Destination"),
+		transaction: fs.Uint("transaction", 0, "TransactionID, random when 0"),
+		sequence:    fs.Uint("sequence", 0, "Sequence, numbered by the publisher when 0"),
+	}
+}
+
+func (f *packetFlags) packet(fs *flag.FlagSet) (utils.LRTPIDSPacket, error) {
+	if !isSet(fs, "train") {
+		return utils.LRTPIDSPacket{}, errors.New("-train is required")
+	}
+	if *f.train > 0xFFFF || *f.transaction > 0xFFFF || *f.sequence > 0xFFFF {
+		return utils.LRTPIDSPacket{}, errors.New("-train, -transaction and -sequence must fit in 16 bits")
+	}
+
+	transactionID := uint16(*f.transaction)
+	if transactionID == 0 {
+		transactionID = uint16(1 + rand.Intn(0xFFFF))
+	}
+
+	return utils.LRTPIDSPacket{
+		TransactionID: transactionID,
+		TrainNumber:   uint16(*f.train),
+		Destination:   *f.destination,
+		Sequence:      uint16(*f.sequence),
+	}, nil
+}
+
+func isSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: publisher %s [flags]\n\n", name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func runEvent(name string, args []string) int {
+	fs := newFlagSet(name)
+	connection := addConnectionFlags(fs)
+	fields := addPacketFlags(fs)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	packet, err := fields.packet(fs)
+	if err == nil && name == "new" && packet.Destination == "" {
+		err = errors.New("-destination is required")
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 2
+	}
+
+	switch name {
+	case "new":
+		packet.IsNewTrain = 1
+	case "update":
+		packet.IsUpdateTrain = 1
+	case "delete":
+		packet.IsDeleteTrain = 1
+	case "arrive":
+		packet.IsTrainArriving = 1
+	case "depart":
+		packet.IsTrainDeparting = 1
+	}
+
+	// Every command runs in a fresh process whose registry knows no trains,
+	// so the lifecycle is left for the subscriber to enforce against the
+	// state it keeps across connections.
+	return send(name, connection, packet, true, *asJSON)
+}
+
+func runSendRaw(name string, args []string) int {
+	fs := newFlagSet(name)
+	connection := addConnectionFlags(fs)
+	fields := addPacketFlags(fs)
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+	isAck := fs.Bool("ack", false, "set IsAck")
+	isNew := fs.Bool("new", false, "set IsNewTrain")
+	isUpdate := fs.Bool("update", false, "set IsUpdateTrain")
+	isDelete := fs.Bool("delete", false, "set IsDeleteTrain")
+	isArriving := fs.Bool("arriving", false, "set IsTrainArriving")
+	isDeparting := fs.Bool("departing", false, "set IsTrainDeparting")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	packet, err := fields.packet(fs)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+		return 2
+	}
+
+	packet.IsAck = flagBit(*isAck)
+	packet.IsNewTrain = flagBit(*isNew)
+	packet.IsUpdateTrain = flagBit(*isUpdate)
+	packet.IsDeleteTrain = flagBit(*isDelete)
+	packet.IsTrainArriving = flagBit(*isArriving)
+	packet.IsTrainDeparting = flagBit(*isDeparting)
+
+	return send(name, connection, packet, true, *asJSON)
+}
+
+func flagBit(set bool) uint8 {
+	if set {
+		return 1
+	}
+	return 0
+}
+
+// send connects, sends packet, prints the result and returns the exit code.
+func send(name string, connection *connectionFlags, packet utils.LRTPIDSPacket, force, asJSON bool) int {
+	// Logs go to stderr so that stdout only carries the result.
+	if _, err := connection.setupLogger(os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	result := commandResult{
+		Command:       name,
+		TransactionID: packet.TransactionID,
+		TrainNumber:   packet.TrainNumber,
+		Sequence:      packet.Sequence,
+		Event:         packet.EventType(),
+	}
+
+	publisher, err := connection.connect(false, nil)
+	if err != nil {
+		result.Error = err.Error()
+		result.print(os.Stdout, asJSON)
+		return 1
+	}
+	defer publisher.Close()
+
+	sent, err := publisher.Send(packet, force)
+	result.Sequence = sent.Packet.Sequence
+	if err != nil {
+		result.setError(err)
+		result.print(os.Stdout, asJSON)
+		return 1
+	}
+
+	result.Acked = true
+	result.LatencyMs = float64(sent.Latency.Microseconds()) / 1000
+	result.print(os.Stdout, asJSON)
+	return 0
+}
+
+// runDemo replays the original publisher scenario: train 42 to Harjamukti is
+// registered, arrives, and departs two seconds later.
+func runDemo(name string, args []string) int {
+	fs := newFlagSet(name)
+	connection := addConnectionFlags(fs)
+	metricsAddress := fs.String("metrics", "", "HTTP address to expose /metrics on, empty to disable")
+	positions := fs.Bool("positions", false, "stream train positions as QUIC datagrams between the arrival and departure events")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	logger, err := connection.setupLogger(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if *metricsAddress != "" {
+		go serveMetrics(*metricsAddress)
+	}
+
+	publisher, err := connection.connect(*positions, nil)
+	if err != nil {
+		logger.Error("failed to create publisher", "error", err)
+		return 1
+	}
+	defer publisher.Close()
+
+	publisher.logger.Info("PIDS publisher connected to server")
+
+	packetA := utils.LRTPIDSPacket{
+		TransactionID:     42,
+		IsAck:             0,
+		IsNewTrain:        0,
+		IsUpdateTrain:     0,
+		IsDeleteTrain:     0,
+		IsTrainArriving:   1,
+		IsTrainDeparting:  0,
+		TrainNumber:       42,
+		DestinationLength: 0,
+		Destination:       "Harjamukti",
+	}
+
+	packetNew := utils.LRTPIDSPacket{
+		TransactionID:     41,
+		IsAck:             0,
+		IsNewTrain:        1,
+		IsUpdateTrain:     0,
+		IsDeleteTrain:     0,
+		IsTrainArriving:   0,
+		IsTrainDeparting:  0,
+		TrainNumber:       42,
+		DestinationLength: 0,
+		Destination:       "Harjamukti",
+	}
+
+	logger.Info("sending new train packet")
+	if err := publisher.SendPacket(packetNew); err != nil {
+		logger.Error("failed to send new train packet", "error", err)
+		return 1
+	}
+
+	logger.Info("sending Packet A (Train Arriving)")
+	if err := publisher.SendPacket(packetA); err != nil {
+		logger.Error("failed to send Packet A", "error", err)
+		return 1
+	}
+
+	if *positions {
+		publisher.sendDemoPositions(packetA.TrainNumber, 2*time.Second)
+	} else {
+		time.Sleep(2 * time.Second)
+	}
+
+	packetB := utils.LRTPIDSPacket{
+		TransactionID:     42,
+		IsAck:             0,
+		IsNewTrain:        0,
+		IsUpdateTrain:     0,
+		IsDeleteTrain:     0,
+		IsTrainArriving:   0,
+		IsTrainDeparting:  1,
+		TrainNumber:       42,
+		DestinationLength: 0,
+		Destination:       "Harjamukti",
+	}
+
+	logger.Info("sending Packet B (Train Departing)")
+	if err := publisher.SendPacket(packetB); err != nil {
+		logger.Error("failed to send Packet B", "error", err)
+		return 1
+	}
+
+	logger.Info("all packets sent")
+	return 0
+}
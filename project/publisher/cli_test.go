@@ -0,0 +1,34 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCommandResultPrint(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{"acked", nil, "ACK arriving train=5 transaction=7 sequence=2 latency=1.500ms\n"},
+		{"refused", &nackError{"train 5 is not registered"}, "NACK arriving train=5 transaction=7: refused by subscriber: train 5 is not registered\n"},
+		{"failed", errors.New("no ACK within 5s, session closed"), "ERROR arriving train=5 transaction=7: no ACK within 5s, session closed\n"},
+	}
+	for _, test := range tests {
+		result := commandResult{Command: "arrive", TransactionID: 7, TrainNumber: 5, Sequence: 2, Event: "arriving"}
+		if test.err != nil {
+			result.setError(test.err)
+		} else {
+			result.Acked = true
+			result.LatencyMs = 1.5
+		}
+
+		var output strings.Builder
+		result.print(&output, false)
+		if output.String() != test.want {
+			t.Errorf("%s: print = %q, want %q", test.name, output.String(), test.want)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+// consoleCommand is one command of the interactive console.
+type consoleCommand struct {
+	name  string
+	usage string
+	// takesTrain makes the first argument complete to known train numbers.
+	takesTrain bool
+	run        func(c *console, args []string) error
+}
+
+var consoleCommands []consoleCommand
+
+func init() {
+	consoleCommands = []consoleCommand{
+		{"new", "new <train> <destination>", true, (*console).eventCommand},
+		{"update", "update <train> <destination>", true, (*console).eventCommand},
+		{"delete", "delete <train>", true, (*console).eventCommand},
+		{"arrive", "arrive <train>", true, (*console).eventCommand},
+		{"depart", "depart <train>", true, (*console).eventCommand},
+		{"raw", "raw <train> <flag>[,<flag>...] [destination], flags: " + strings.Join(rawFlags, ", "), true, (*console).rawCommand},
+		{"trains", "trains", false, (*console).trainsCommand},
+		{"force", "force [on|off]", false, (*console).forceCommand},
+		{"history", "history", false, (*console).historyCommand},
+		{"help", "help", false, (*console).helpCommand},
+		{"quit", "quit", false, nil},
+	}
+}
+
+var rawFlags = []string{"ack", "new", "update", "delete", "arriving", "departing"}
+
+// consoleRequest is an event queued for the sender.
+type consoleRequest struct {
+	command string
+	packet  utils.LRTPIDSPacket
+	force   bool
+	// done is closed once the result has been shown, if set.
+	done chan struct{}
+}
+
+type console struct {
+	publisher *PIDSPublisher
+	editor    *lineEditor
+	// force skips the lifecycle check of the registry, see Send.
+	force         bool
+	transactionID uint16
+
+	// requests are sent one at a time, in the order they were typed, while
+	// the operator keeps typing.
+	requests chan consoleRequest
+	sent     chan struct{}
+}
+
+func runConsole(name string, args []string) int {
+	fs := newFlagSet(name)
+	connection := addConnectionFlags(fs)
+	historyPath := fs.String("history", "", "file to keep the command history in across sessions, empty to keep it in memory")
+	// Every ACK is already shown at the prompt, so only problems are logged.
+	fs.Lookup("log-level").DefValue = "warn"
+	fs.Set("log-level", "warn")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	c := &console{
+		transactionID: uint16(rand.Intn(0xFFFF)),
+		requests:      make(chan consoleRequest, 64),
+		sent:          make(chan struct{}),
+	}
+	c.editor = newLineEditor(os.Stdin, os.Stdout, "pids> ", c.complete)
+	defer c.editor.Close()
+
+	if *historyPath != "" {
+		if err := c.editor.LoadHistory(*historyPath); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+
+	if _, err := connection.setupLogger(c.editor); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	publisher, err := connection.connect(false, NewTrainRegistry())
+	if err != nil {
+		fmt.Fprintf(c.editor, "failed to connect to %s: %v\n", *connection.address, err)
+		return 1
+	}
+	defer publisher.Close()
+	c.publisher = publisher
+
+	if c.editor.Interactive() {
+		fmt.Fprintf(c.editor, "connected to %s, type help for the commands\n", *connection.address)
+	}
+
+	go c.sendLoop()
+
+	c.readLoop()
+
+	close(c.requests)
+	<-c.sent
+	return 0
+}
+
+func (c *console) readLoop() {
+	for {
+		line, err := c.editor.ReadLine()
+		if errors.Is(err, errInterrupted) {
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				fmt.Fprintln(c.editor, err)
+			}
+			return
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if fields[0] == "quit" || fields[0] == "exit" {
+			return
+		}
+
+		command, ok := findConsoleCommand(fields[0])
+		if !ok {
+			fmt.Fprintf(c.editor, "unknown command %q, type help for the commands\n", fields[0])
+			continue
+		}
+		if err := command.run(c, fields); err != nil {
+			fmt.Fprintf(c.editor, "%v\nusage: %s\n", err, command.usage)
+		}
+	}
+}
+
+func findConsoleCommand(name string) (consoleCommand, bool) {
+	for _, command := range consoleCommands {
+		if command.name == name {
+			return command, true
+		}
+	}
+	return consoleCommand{}, false
+}
+
+// sendLoop sends the queued requests and shows each ACK or NACK as it
+// arrives.
+func (c *console) sendLoop() {
+	defer close(c.sent)
+
+	for request := range c.requests {
+		result := commandResult{
+			Command:       request.command,
+			TransactionID: request.packet.TransactionID,
+			TrainNumber:   request.packet.TrainNumber,
+			Event:         request.packet.EventType(),
+		}
+
+		sent, err := c.publisher.Send(request.packet, request.force)
+		result.Sequence = sent.Packet.Sequence
+		if err != nil {
+			result.setError(err)
+		} else {
+			result.Acked = true
+			result.LatencyMs = float64(sent.Latency.Microseconds()) / 1000
+		}
+		result.print(c.editor, false)
+
+		if request.done != nil {
+			close(request.done)
+		}
+	}
+}
+
+func (c *console) enqueue(command string, packet utils.LRTPIDSPacket, force bool) {
+	c.transactionID++
+	if c.transactionID == 0 {
+		c.transactionID++
+	}
+	packet.TransactionID = c.transactionID
+
+	request := consoleRequest{command: command, packet: packet, force: force}
+	// Scripts piped into the console get every result before the next line
+	// is read, so that their output is in order.
+	if !c.editor.Interactive() {
+		request.done = make(chan struct{})
+	}
+
+	c.requests <- request
+	if request.done != nil {
+		<-request.done
+	}
+}
+
+func parseTrain(args []string) (uint16, error) {
+	if len(args) < 2 {
+		return 0, errors.New("missing train number")
+	}
+
+	train, err := strconv.ParseUint(args[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid train number %q", args[1])
+	}
+	return uint16(train), nil
+}
+
+func (c *console) eventCommand(args []string) error {
+	train, err := parseTrain(args)
+	if err != nil {
+		return err
+	}
+
+	packet := utils.LRTPIDSPacket{
+		TrainNumber: train,
+		Destination: strings.Join(args[2:], " "),
+	}
+
+	switch args[0] {
+	case "new":
+		packet.IsNewTrain = 1
+	case "update":
+		packet.IsUpdateTrain = 1
+	case "delete":
+		packet.IsDeleteTrain = 1
+	case "arrive":
+		packet.IsTrainArriving = 1
+	case "depart":
+		packet.IsTrainDeparting = 1
+	}
+
+	if (args[0] == "new" || args[0] == "update") && packet.Destination == "" {
+		return errors.New("missing destination")
+	}
+
+	c.enqueue(args[0], packet, c.force)
+	return nil
+}
+
+func (c *console) rawCommand(args []string) error {
+	train, err := parseTrain(args)
+	if err != nil {
+		return err
+	}
+	if len(args) < 3 {
+		return errors.New("missing flags")
+	}
+
+	packet := utils.LRTPIDSPacket{
+		TrainNumber: train,
+		Destination: strings.Join(args[3:], " "),
+	}
+	for _, name := range strings.Split(args[2], ",") {
+		switch name {
+		case "ack":
+			packet.IsAck = 1
+		case "new":
+			packet.IsNewTrain = 1
+		case "update":
+			packet.IsUpdateTrain = 1
+		case "delete":
+			packet.IsDeleteTrain = 1
+		case "arriving":
+			packet.IsTrainArriving = 1
+		case "departing":
+			packet.IsTrainDeparting = 1
+		default:
+			return fmt.Errorf("unknown flag %q", name)
+		}
+	}
+
+	c.enqueue(args[0], packet, true)
+	return nil
+}
+
+func (c *console) trainsCommand([]string) error {
+	trains := c.publisher.registry.Snapshot()
+	if len(trains) == 0 {
+		fmt.Fprintln(c.editor, "no trains")
+		return nil
+	}
+
+	for _, train := range trains {
+		fmt.Fprintf(c.editor, "%5d  %-9s  %s\n", train.TrainNumber, c.publisher.registry.State(train.TrainNumber), train.Destination)
+	}
+	return nil
+}
+
+func (c *console) forceCommand(args []string) error {
+	if len(args) > 1 {
+		switch args[1] {
+		case "on":
+			c.force = true
+		case "off":
+			c.force = false
+		default:
+			return fmt.Errorf("invalid argument %q", args[1])
+		}
+	}
+
+	if c.force {
+		fmt.Fprintln(c.editor, "force is on, events are sent without checking the train lifecycle")
+	} else {
+		fmt.Fprintln(c.editor, "force is off, events that do not fit the train lifecycle are refused")
+	}
+	return nil
+}
+
+func (c *console) historyCommand([]string) error {
+	for i, line := range c.editor.History() {
+		fmt.Fprintf(c.editor, "%4d  %s\n", i+1, line)
+	}
+	return nil
+}
+
+func (c *console) helpCommand([]string) error {
+	for _, command := range consoleCommands {
+		fmt.Fprintf(c.editor, "  %s\n", command.usage)
+	}
+	return nil
+}
+
+// complete completes command names, then train numbers the registry knows
+// and raw flag names.
+func (c *console) complete(previous []string, word string) []string {
+	var options []string
+	switch {
+	case len(previous) == 0:
+		for _, command := range consoleCommands {
+			options = append(options, command.name)
+		}
+	case len(previous) == 1:
+		if command, ok := findConsoleCommand(previous[0]); ok && command.takesTrain {
+			for _, train := range c.publisher.registry.Snapshot() {
+				options = append(options, strconv.Itoa(int(train.TrainNumber)))
+			}
+		}
+		if previous[0] == "force" {
+			options = []string{"on", "off"}
+		}
+	case len(previous) == 2 && previous[0] == "raw":
+		done := word[:strings.LastIndex(word, ",")+1]
+		for _, flag := range rawFlags {
+			options = append(options, done+flag)
+		}
+	}
+
+	var candidates []string
+	for _, option := range options {
+		if strings.HasPrefix(option, word) {
+			candidates = append(candidates, option)
+		}
+	}
+	sort.Strings(candidates)
+	return candidates
+}
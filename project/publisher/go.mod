@@ -4,12 +4,18 @@ go 1.21
 
 require (
 	github.com/quic-go/quic-go v0.40.0
+	golang.org/x/sys v0.8.0
+	jarkom.cs.ui.ac.id/h01/project/transport v0.0.0
 	jarkom.cs.ui.ac.id/h01/project/utils v0.0.0
 )
 
-replace jarkom.cs.ui.ac.id/h01/project/utils => ../utils
+replace (
+	jarkom.cs.ui.ac.id/h01/project/transport => ../transport
+	jarkom.cs.ui.ac.id/h01/project/utils => ../utils
+)
 
 require (
+	github.com/francoispqt/gojay v1.2.13 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
 	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
@@ -19,6 +25,5 @@ require (
 	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
 	golang.org/x/mod v0.11.0 // indirect
 	golang.org/x/net v0.10.0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/tools v0.9.1 // indirect
 )
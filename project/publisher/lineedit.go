@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// errInterrupted is returned by ReadLine when the operator presses Ctrl-C.
+var errInterrupted = errors.New("interrupted")
+
+// completer returns the candidates for the word being typed, given the
+// words before it on the line.
+type completer func(previous []string, word string) []string
+
+// lineEditor reads lines from a terminal with history and tab completion.
+// When the input is not a terminal it reads plain lines without a prompt,
+// so that the console can also be scripted through a pipe.
+type lineEditor struct {
+	input    *bufio.Reader
+	output   io.Writer
+	prompt   string
+	complete completer
+	restore  func() error
+
+	history     []string
+	historyFile *os.File
+
+	// mutex guards the terminal so that Write can print above the line
+	// being edited.
+	mutex   sync.Mutex
+	editing bool
+	line    []rune
+	cursor  int
+}
+
+func newLineEditor(input *os.File, output io.Writer, prompt string, complete completer) *lineEditor {
+	e := &lineEditor{
+		input:    bufio.NewReader(input),
+		output:   output,
+		prompt:   prompt,
+		complete: complete,
+	}
+
+	if restore, err := makeRaw(input); err == nil {
+		e.restore = restore
+	}
+	return e
+}
+
+// Interactive reports whether the input is a terminal in raw mode.
+func (e *lineEditor) Interactive() bool {
+	return e.restore != nil
+}
+
+// LoadHistory reads previous lines from path and appends new ones to it.
+func (e *lineEditor) LoadHistory(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read history: %v", err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			e.history = append(e.history, line)
+		}
+	}
+
+	e.historyFile, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open history: %v", err)
+	}
+	return nil
+}
+
+// History returns the lines entered so far, oldest first.
+func (e *lineEditor) History() []string {
+	return e.history
+}
+
+func (e *lineEditor) Close() error {
+	var err error
+	if e.restore != nil {
+		err = e.restore()
+	}
+	if e.historyFile != nil {
+		e.historyFile.Close()
+	}
+	return err
+}
+
+// Write prints p above the line being edited and redraws the line, so that
+// responses can be shown while the operator types.
+func (e *lineEditor) Write(p []byte) (int, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if !e.editing {
+		return e.output.Write(p)
+	}
+
+	fmt.Fprint(e.output, "\r\x1b[K")
+	n, err := e.output.Write(p)
+	if len(p) > 0 && p[len(p)-1] != '\n' {
+		fmt.Fprint(e.output, "\n")
+	}
+	e.redraw()
+	return n, err
+}
+
+// ReadLine returns the next line without its newline. It returns io.EOF on
+// Ctrl-D or at the end of the input and errInterrupted on Ctrl-C.
+func (e *lineEditor) ReadLine() (string, error) {
+	if !e.Interactive() {
+		line, err := e.input.ReadString('\n')
+		if err != nil && (err != io.EOF || line == "") {
+			return "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		e.remember(line)
+		return line, nil
+	}
+
+	e.mutex.Lock()
+	e.editing = true
+	e.line = e.line[:0]
+	e.cursor = 0
+	e.redraw()
+	e.mutex.Unlock()
+
+	// historyIndex points one past the history while editing a new line.
+	historyIndex := len(e.history)
+	var pending string
+
+	for {
+		r, _, err := e.input.ReadRune()
+		if err != nil {
+			e.finish()
+			return "", err
+		}
+
+		e.mutex.Lock()
+		switch r {
+		case '\r', '\n':
+			line := string(e.line)
+			e.mutex.Unlock()
+			e.finish()
+			e.remember(line)
+			return line, nil
+		case 0x03: // Ctrl-C
+			fmt.Fprint(e.output, "^C")
+			e.mutex.Unlock()
+			e.finish()
+			return "", errInterrupted
+		case 0x04: // Ctrl-D
+			if len(e.line) == 0 {
+				e.mutex.Unlock()
+				e.finish()
+				return "", io.EOF
+			}
+			e.deleteAt(e.cursor)
+		case 0x7f, 0x08: // Backspace
+			if e.cursor > 0 {
+				e.cursor--
+				e.deleteAt(e.cursor)
+			}
+		case 0x01: // Ctrl-A
+			e.cursor = 0
+		case 0x05: // Ctrl-E
+			e.cursor = len(e.line)
+		case 0x15: // Ctrl-U
+			e.line = append(e.line[:0], e.line[e.cursor:]...)
+			e.cursor = 0
+		case 0x17: // Ctrl-W
+			start := e.cursor
+			for start > 0 && e.line[start-1] == ' ' {
+				start--
+			}
+			for start > 0 && e.line[start-1] != ' ' {
+				start--
+			}
+			e.line = append(e.line[:start], e.line[e.cursor:]...)
+			e.cursor = start
+		case '\t':
+			e.completeWord()
+		case 0x1b: // Escape sequence
+			e.mutex.Unlock()
+			key := e.readEscape()
+			e.mutex.Lock()
+			switch key {
+			case 'A', 'B':
+				if historyIndex == len(e.history) {
+					pending = string(e.line)
+				}
+				if key == 'A' && historyIndex > 0 {
+					historyIndex--
+				} else if key == 'B' && historyIndex < len(e.history) {
+					historyIndex++
+				}
+				if historyIndex == len(e.history) {
+					e.line = []rune(pending)
+				} else {
+					e.line = []rune(e.history[historyIndex])
+				}
+				e.cursor = len(e.line)
+			case 'C':
+				if e.cursor < len(e.line) {
+					e.cursor++
+				}
+			case 'D':
+				if e.cursor > 0 {
+					e.cursor--
+				}
+			case 'H':
+				e.cursor = 0
+			case 'F':
+				e.cursor = len(e.line)
+			case '3': // Delete
+				e.deleteAt(e.cursor)
+			}
+		default:
+			if r >= ' ' {
+				e.line = append(e.line[:e.cursor], append([]rune{r}, e.line[e.cursor:]...)...)
+				e.cursor++
+			}
+		}
+		e.redraw()
+		e.mutex.Unlock()
+	}
+}
+
+// readEscape reads the rest of a CSI or SS3 sequence and returns its final
+// byte, or '3' for the Delete key.
+func (e *lineEditor) readEscape() byte {
+	introducer, err := e.input.ReadByte()
+	if err != nil || (introducer != '[' && introducer != 'O') {
+		return 0
+	}
+
+	var parameter byte
+	for {
+		b, err := e.input.ReadByte()
+		if err != nil {
+			return 0
+		}
+		if b >= '0' && b <= '9' || b == ';' {
+			if parameter == 0 {
+				parameter = b
+			}
+			continue
+		}
+		if b == '~' {
+			switch parameter {
+			case '3':
+				return '3'
+			case '1', '7':
+				return 'H'
+			case '4', '8':
+				return 'F'
+			}
+			return 0
+		}
+		return b
+	}
+}
+
+func (e *lineEditor) deleteAt(index int) {
+	if index < len(e.line) {
+		e.line = append(e.line[:index], e.line[index+1:]...)
+	}
+}
+
+// completeWord completes the word before the cursor as far as all candidates
+// agree, and lists the candidates when that adds nothing.
+func (e *lineEditor) completeWord() {
+	if e.complete == nil {
+		return
+	}
+
+	before := string(e.line[:e.cursor])
+	start := strings.LastIndex(before, " ") + 1
+	word := before[start:]
+	candidates := e.complete(strings.Fields(before[:start]), word)
+	if len(candidates) == 0 {
+		return
+	}
+
+	prefix := candidates[0]
+	for _, candidate := range candidates[1:] {
+		for !strings.HasPrefix(candidate, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if len(candidates) == 1 {
+		prefix += " "
+	}
+
+	if insert := []rune(strings.TrimPrefix(prefix, word)); len(insert) > 0 {
+		e.line = append(e.line[:e.cursor], append(insert, e.line[e.cursor:]...)...)
+		e.cursor += len(insert)
+		return
+	}
+
+	fmt.Fprintf(e.output, "\r\x1b[K%s\n", strings.Join(candidates, "  "))
+}
+
+// redraw repaints the prompt and line and puts the cursor back in place.
+func (e *lineEditor) redraw() {
+	fmt.Fprintf(e.output, "\r\x1b[K%s%s", e.prompt, string(e.line))
+	if back := len(e.line) - e.cursor; back > 0 {
+		fmt.Fprintf(e.output, "\x1b[%dD", back)
+	}
+}
+
+func (e *lineEditor) finish() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.editing = false
+	fmt.Fprint(e.output, "\n")
+}
+
+func (e *lineEditor) remember(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+
+	e.history = append(e.history, line)
+	if e.historyFile != nil {
+		fmt.Fprintln(e.historyFile, line)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"jarkom.cs.ui.ac.id/h01/project/utils/metrics"
+)
+
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	packetsSentTotal = metricsRegistry.NewCounter(
+		"pids_publisher_packets_sent_total",
+		"Packets passed to SendPacket, by event type and result.",
+		"event", "result")
+	sendErrorsTotal = metricsRegistry.NewCounter(
+		"pids_publisher_send_errors_total",
+		"SendPacket failures, by the stage that failed.",
+		"stage")
+	ackLatencySeconds = metricsRegistry.NewHistogram(
+		"pids_publisher_ack_latency_seconds",
+		"Time from opening the stream until a valid ACK is decoded.",
+		metrics.DefaultLatencyBuckets)
+	positionsSentTotal = metricsRegistry.NewCounter(
+		"pids_publisher_positions_sent_total",
+		"Position datagrams passed to SendPosition, by result.",
+		"result")
+	syncRequestsTotal = metricsRegistry.NewCounter(
+		"pids_publisher_sync_requests_total",
+		"Sync requests from subscribers, by result.",
+		"result")
+	trainsGauge = metricsRegistry.NewGauge(
+		"pids_publisher_trains",
+		"Live trains in the publisher registry, by lifecycle state.",
+		"state")
+	streamsOpenedTotal = metricsRegistry.NewCounter(
+		"pids_publisher_streams_opened_total",
+		"Streams opened towards the subscriber.")
+	reconnectsTotal = metricsRegistry.NewCounter(
+		"pids_publisher_reconnects_total",
+		"Connections reopened after the subscriber was lost.")
+)
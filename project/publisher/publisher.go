@@ -3,125 +3,595 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
 	"time"
 
-	"github.com/quic-go/quic-go"
+	"jarkom.cs.ui.ac.id/h01/project/transport"
 	"jarkom.cs.ui.ac.id/h01/project/utils"
+	"jarkom.cs.ui.ac.id/h01/project/utils/pidslog"
 )
 
 type PIDSPublisher struct {
-	connection quic.Connection
-	address    string
+	address   string
+	options   PublisherOptions
+	tlsConfig *tls.Config
+	keyLog    io.Closer
+	logger    *slog.Logger
+
+	// linkMutex guards link, which Reconnect replaces once it is lost.
+	linkMutex sync.Mutex
+	link      *link
+	closed    chan struct{}
+
+	registry *TrainRegistry
+	// truncateDestinations shortens destinations that do not fit a packet
+	// instead of refusing them.
+	truncateDestinations bool
+	ackTimeout           time.Duration
+	// clock paces Replay, a fake one in tests.
+	clock replayClock
+}
+
+// link is one connection to the subscriber with the session on it, nil with
+// legacy streams.
+type link struct {
+	connection transport.Conn
+	session    *session
+	logger     *slog.Logger
+	// sequences numbers the events sent on legacy streams, sessions number
+	// their own.
+	sequences trainSequences
+}
+
+// usable reports whether events can still be sent over l.
+func (l *link) usable() bool {
+	if l.connection.Context().Err() != nil {
+		return false
+	}
+	return l.session == nil || l.session.usable()
+}
+
+type PublisherOptions struct {
+	// Transport is one of transport.Kinds, QUIC when empty.
+	Transport string
+	// QlogDir enables qlog tracing into this directory when non-empty.
+	QlogDir string
+	// KeyLogFile enables TLS key logging into this file when non-empty.
+	KeyLogFile string
+	// Datagrams offers QUIC datagrams so that SendPosition can be used.
+	Datagrams bool
+	// LegacyStreams sends every packet on a stream of its own instead of a
+	// session, for subscribers that predate the session protocol.
+	LegacyStreams bool
+	// StationID is announced to the subscriber when the session starts.
+	StationID string
+	// TruncateDestinations shortens destinations longer than
+	// utils.MaxDestinationLength at a UTF-8 boundary instead of refusing
+	// the packet.
+	TruncateDestinations bool
+	// AckTimeout bounds the wait for each ACK, DefaultAckTimeout when zero.
+	AckTimeout time.Duration
+	// Registry is the train state to publish against, kept by the caller
+	// across connections. Only then is the subscriber offered a sync: a
+	// registry created for this connection knows no trains yet.
+	Registry *TrainRegistry
+	// Reconnect dials the subscriber again whenever the connection or its
+	// session is lost, keeping Registry so that the subscriber is resynced.
+	Reconnect bool
 }
 
-func NewPIDSPublisher(address string) (*PIDSPublisher, error) {
+// DefaultAckTimeout is how long Send waits for an ACK by default.
+const DefaultAckTimeout = 5 * time.Second
+
+const (
+	// reconnectMinDelay and reconnectMaxDelay bound the backoff between
+	// attempts to reconnect to a subscriber that is down.
+	reconnectMinDelay = 500 * time.Millisecond
+	reconnectMaxDelay = 30 * time.Second
+)
+
+var errPublisherClosed = errors.New("publisher closed")
+
+func NewPIDSPublisher(address string, options PublisherOptions) (*PIDSPublisher, error) {
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: true,
 		NextProtos:         []string{"lrt-jabodebek-2306214510"},
 		ServerName:         "3.81.118.89",
 	}
 
-	conn, err := quic.DialAddr(context.Background(), address, tlsConfig, nil)
+	if options.Transport == "" {
+		options.Transport = transport.KindQUIC
+	}
+	if options.AckTimeout == 0 {
+		options.AckTimeout = DefaultAckTimeout
+	}
+
+	keyLog, err := transport.OpenKeyLog(options.KeyLogFile, slog.Default())
+	if err != nil {
+		return nil, err
+	}
+	if keyLog != nil {
+		tlsConfig.KeyLogWriter = keyLog
+	}
+
+	registry := options.Registry
+	if registry == nil {
+		registry = NewTrainRegistry()
+	}
+
+	logger := slog.Default()
+	if options.StationID != "" {
+		logger = logger.With("station", options.StationID)
+	}
+
+	publisher := &PIDSPublisher{
+		address:              address,
+		options:              options,
+		tlsConfig:            tlsConfig,
+		keyLog:               keyLog,
+		logger:               logger,
+		closed:               make(chan struct{}),
+		registry:             registry,
+		truncateDestinations: options.TruncateDestinations,
+		ackTimeout:           options.AckTimeout,
+		clock:                systemClock{},
+	}
+
+	if err := publisher.connect(); err != nil {
+		if keyLog != nil {
+			keyLog.Close()
+		}
+		return nil, err
+	}
+	return publisher, nil
+}
+
+// connect dials the subscriber and starts a session on the new connection.
+// Sequences start over with it, as the subscriber orders the events of every
+// connection on their own. It is called with linkMutex held, or before the
+// publisher is shared.
+func (p *PIDSPublisher) connect() error {
+	conn, err := dial(p.address, p.options.Transport, transport.Config{
+		TLSConfig:       p.tlsConfig,
+		QlogDir:         p.options.QlogDir,
+		EnableDatagrams: p.options.Datagrams,
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to server: %v", err)
+		return err
 	}
 
-	return &PIDSPublisher{
+	l := &link{
 		connection: conn,
-		address:    address,
-	}, nil
+		logger: p.logger.With(
+			pidslog.KeyRemoteAddr, conn.RemoteAddr().String(),
+			pidslog.KeyConnectionID, conn.ID(),
+		),
+	}
+
+	if !p.options.LegacyStreams {
+		hello := utils.Hello{
+			Version:      utils.SessionVersion,
+			MessageTypes: []uint8{utils.MessageEvent, utils.MessageAck, utils.MessageNack},
+			StationID:    p.options.StationID,
+		}
+		if p.options.Datagrams {
+			hello.MessageTypes = append(hello.MessageTypes, utils.MessagePosition)
+		}
+		if p.options.Registry != nil {
+			hello.MessageTypes = append(hello.MessageTypes, utils.MessageSyncResponse)
+		}
+
+		l.session, err = openSession(conn, hello, p.registry, p.options.AckTimeout, l.logger)
+		if err != nil {
+			conn.CloseWithError(0, "publisher closed")
+			return fmt.Errorf("failed to start session (use legacy streams for older subscribers): %v", err)
+		}
+		l.logger.Info("session started", "version", l.session.peer.Version)
+	}
+
+	p.link = l
+	if p.options.Reconnect {
+		go p.watch(l)
+	}
+	return nil
 }
 
-func (p *PIDSPublisher) SendPacket(packet utils.LRTPIDSPacket) error {
-	stream, err := p.connection.OpenStreamSync(context.Background())
+// current returns the link to send over, reconnecting first when it has been
+// lost and Reconnect is set.
+func (p *PIDSPublisher) current() (*link, error) {
+	p.linkMutex.Lock()
+	l := p.link
+	p.linkMutex.Unlock()
+
+	if !p.options.Reconnect || l.usable() {
+		return l, nil
+	}
+	if err := p.reconnect(l); err != nil {
+		return nil, fmt.Errorf("failed to reconnect: %v", err)
+	}
+
+	p.linkMutex.Lock()
+	defer p.linkMutex.Unlock()
+	return p.link, nil
+}
+
+// Context is cancelled once the current connection is closed.
+func (p *PIDSPublisher) Context() context.Context {
+	p.linkMutex.Lock()
+	defer p.linkMutex.Unlock()
+	return p.link.connection.Context()
+}
+
+// watch reconnects as soon as lost fails, instead of waiting for the next
+// event, so that a subscriber that restarted is resynced right away. It
+// backs off between failed attempts until the publisher is closed.
+func (p *PIDSPublisher) watch(lost *link) {
+	var sessionLost <-chan struct{}
+	if lost.session != nil {
+		sessionLost = lost.session.lost
+	}
+	select {
+	case <-lost.connection.Context().Done():
+	case <-sessionLost:
+	case <-p.closed:
+		return
+	}
+
+	lost.logger.Warn("connection to the subscriber lost, reconnecting")
+	delay := reconnectMinDelay
+	for {
+		err := p.reconnect(lost)
+		if err == nil || errors.Is(err, errPublisherClosed) {
+			return
+		}
+		lost.logger.Warn("failed to reconnect", "error", err, "retry_in", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-p.closed:
+			timer.Stop()
+			return
+		}
+		delay = min(2*delay, reconnectMaxDelay)
+	}
+}
+
+// reconnect replaces lost with a new link, unless another caller already
+// has. lost is closed only afterwards, as closing may linger to flush it.
+func (p *PIDSPublisher) reconnect(lost *link) error {
+	p.linkMutex.Lock()
+	select {
+	case <-p.closed:
+		p.linkMutex.Unlock()
+		return errPublisherClosed
+	default:
+	}
+	if p.link != lost {
+		p.linkMutex.Unlock()
+		return nil
+	}
+
+	err := p.connect()
+	if err == nil {
+		reconnectsTotal.Inc()
+		p.link.logger.Info("reconnected to the subscriber")
+	}
+	p.linkMutex.Unlock()
 	if err != nil {
-		return fmt.Errorf("failed to open stream: %v", err)
+		return err
 	}
-	defer stream.Close()
 
-	data, err := utils.Encode(packet)
+	if lost.session != nil {
+		lost.session.Close()
+	}
+	lost.connection.CloseWithError(0, "reconnecting")
+	return nil
+}
+
+func dial(address, kind string, config transport.Config) (transport.Conn, error) {
+	t, err := transport.New(kind, config)
 	if err != nil {
-		return fmt.Errorf("failed to encode packet: %v", err)
+		return nil, err
 	}
 
-	_, err = stream.Write(data)
+	conn, err := t.Dial(context.Background(), address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to server over %s: %v", kind, err)
+	}
+	return conn, nil
+}
+
+type SendResult struct {
+	// Packet is what was sent, with its Sequence filled in.
+	Packet  utils.LRTPIDSPacket
+	Ack     utils.LRTPIDSPacket
+	Latency time.Duration
+}
+
+// SendPacket numbers packet within its train unless it already carries a
+// Sequence, sends it and waits for the ACK.
+func (p *PIDSPublisher) SendPacket(packet utils.LRTPIDSPacket) error {
+	_, err := p.Send(packet, false)
+	return err
+}
+
+// Send is SendPacket reporting the ACK and its latency. force sends packet
+// even when it does not fit the lifecycle of its train.
+func (p *PIDSPublisher) Send(packet utils.LRTPIDSPacket, force bool) (SendResult, error) {
+	if p.truncateDestinations && len(packet.Destination) > utils.MaxDestinationLength {
+		truncated := utils.TruncateUTF8(packet.Destination, utils.MaxDestinationLength)
+		p.logger.Warn("truncated destination", pidslog.KeyTrainNumber, packet.TrainNumber, "length", len(packet.Destination), "destination", truncated)
+		packet.Destination = truncated
+	}
+
+	l, err := p.current()
 	if err != nil {
-		return fmt.Errorf("failed to write data: %v", err)
+		sendErrorsTotal.Inc("reconnect")
+		packetsSentTotal.Inc(packet.EventType(), "error")
+		p.logger.Warn("packet not sent", pidslog.KeyTrainNumber, packet.TrainNumber, "error", err)
+		return SendResult{Packet: packet}, err
 	}
 
-	buffer := make([]byte, 1024)
-	n, err := stream.Read(buffer)
+	start := time.Now()
+	packet, ackPacket, err := p.sendPacket(l, packet, force)
+	logger := l.logger.With(pidslog.Packet(packet)...)
 	if err != nil {
-		return fmt.Errorf("failed to read ACK: %v", err)
+		packetsSentTotal.Inc(packet.EventType(), "error")
+		logger.Warn("packet not acknowledged", "error", err)
+		return SendResult{Packet: packet}, err
+	}
+
+	latency := time.Since(start)
+	ackLatencySeconds.Observe(latency.Seconds())
+	packetsSentTotal.Inc(packet.EventType(), "ack")
+	logger.Info("ACK received", "latency", latency)
+	return SendResult{Packet: packet, Ack: ackPacket, Latency: latency}, nil
+}
+
+// trainSequences numbers the events of every train on one connection. The
+// zero value is ready to use.
+type trainSequences struct {
+	mutex sync.Mutex
+	last  map[uint16]uint16
+}
+
+// number gives packet the next Sequence of its train, skipping 0 which marks
+// unsequenced packets, unless it carries a Sequence already. It reports
+// whether it did.
+func (t *trainSequences) number(packet *utils.LRTPIDSPacket) bool {
+	if packet.Sequence != 0 {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.last == nil {
+		t.last = make(map[uint16]uint16)
+	}
+	sequence := t.last[packet.TrainNumber] + 1
+	if sequence == 0 {
+		sequence = 1
+	}
+	t.last[packet.TrainNumber] = sequence
+	packet.Sequence = sequence
+	return true
+}
+
+// release hands the Sequence of packet back when it was refused before it
+// was sent, so that the subscriber does not see a gap.
+func (t *trainSequences) release(packet utils.LRTPIDSPacket, err error) {
+	var refused *refusedError
+	if !errors.As(err, &refused) {
+		return
 	}
 
-	ackPacket, err := utils.Decode(buffer[:n])
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.last[packet.TrainNumber] == packet.Sequence {
+		t.last[packet.TrainNumber] = packet.Sequence - 1
+	}
+}
+
+// sendPacket sends packet over l and returns it as sent, with its Sequence
+// filled in, along with the ACK.
+func (p *PIDSPublisher) sendPacket(l *link, packet utils.LRTPIDSPacket, force bool) (utils.LRTPIDSPacket, utils.LRTPIDSPacket, error) {
+	var ackPacket utils.LRTPIDSPacket
+	var err error
+	if l.session != nil {
+		packet, ackPacket, err = l.session.send(packet, force)
+	} else {
+		packet, ackPacket, err = p.sendOnStream(l, packet, force)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to decode ACK: %v", err)
+		return packet, ackPacket, err
 	}
 
 	if ackPacket.IsAck == 1 && ackPacket.TransactionID == packet.TransactionID {
-		fmt.Printf("ACK received for Transaction ID: %d\n", packet.TransactionID)
-		return nil
+		return packet, ackPacket, nil
 	}
 
-	return fmt.Errorf("invalid ACK received")
+	sendErrorsTotal.Inc("invalid_ack")
+	return packet, ackPacket, fmt.Errorf("invalid ACK received for Transaction ID %d", ackPacket.TransactionID)
 }
 
-func (p *PIDSPublisher) Close() error {
-	return p.connection.CloseWithError(0, "publisher closed")
+// sendOnStream numbers packet and sends it on a stream of its own. Streams
+// give no ordering, so neither is there any to number in.
+func (p *PIDSPublisher) sendOnStream(l *link, packet utils.LRTPIDSPacket, force bool) (utils.LRTPIDSPacket, utils.LRTPIDSPacket, error) {
+	numbered := l.sequences.number(&packet)
+	ackPacket, err := p.exchangeOnStream(l.connection, packet, force, l.logger.With(pidslog.Packet(packet)...))
+	if err != nil && numbered {
+		l.sequences.release(packet, err)
+	}
+	return packet, ackPacket, err
 }
 
-func main() {
-	publisher, err := NewPIDSPublisher("3.81.118.89:4510")
+// exchangeOnStream sends packet on a new stream and returns the ACK read
+// back from it. The registry is checked up front and updated once the ACK
+// is in; streams give no ordering to keep it consistent with anyway.
+func (p *PIDSPublisher) exchangeOnStream(conn transport.Conn, packet utils.LRTPIDSPacket, force bool, logger *slog.Logger) (utils.LRTPIDSPacket, error) {
+	data, err := utils.Encode(packet)
+	if err != nil {
+		sendErrorsTotal.Inc("encode")
+		return utils.LRTPIDSPacket{}, &refusedError{fmt.Errorf("failed to encode packet: %v", err)}
+	}
+
+	if err := p.registry.Check(packet, force); err != nil {
+		sendErrorsTotal.Inc("invalid_transition")
+		return utils.LRTPIDSPacket{}, err
+	}
+
+	stream, err := conn.OpenStream(context.Background())
 	if err != nil {
-		log.Fatalf("Failed to create publisher: %v", err)
+		sendErrorsTotal.Inc("open_stream")
+		return utils.LRTPIDSPacket{}, fmt.Errorf("failed to open stream: %v", err)
 	}
-	defer publisher.Close()
+	defer stream.Close()
+	streamsOpenedTotal.Inc()
+
+	logger = logger.With(pidslog.KeyStreamID, stream.StreamID())
+	logger.Debug("sending packet")
 
-	fmt.Println("PIDS Publisher connected to server")
+	_, err = stream.Write(data)
+	if err != nil {
+		sendErrorsTotal.Inc("write")
+		return utils.LRTPIDSPacket{}, fmt.Errorf("failed to write data: %v", err)
+	}
 
-	packetA := utils.LRTPIDSPacket{
-		TransactionID:    42,
-		IsAck:            0,
-		IsNewTrain:       0,
-		IsUpdateTrain:    0,
-		IsDeleteTrain:    0,
-		IsTrainArriving:  1,
-		IsTrainDeparting: 0,
-		TrainNumber:      42,
-		DestinationLength: 0,
-		Destination:      "Harjamukti",
+	ackData, err := readWithin(stream, p.ackTimeout)
+	if err != nil {
+		sendErrorsTotal.Inc("read_ack")
+		return utils.LRTPIDSPacket{}, fmt.Errorf("failed to read ACK: %v", err)
 	}
 
-	fmt.Println("Sending Packet A (Train Arriving)...")
-	err = publisher.SendPacket(packetA)
+	ackPacket, err := utils.Decode(ackData)
 	if err != nil {
-		log.Printf("Failed to send Packet A: %v", err)
+		sendErrorsTotal.Inc("decode_ack")
+		return utils.LRTPIDSPacket{}, fmt.Errorf("failed to decode ACK: %v", err)
 	}
 
-	time.Sleep(2 * time.Second)
+	// Another send may have moved the train since the check; the subscriber
+	// has taken the event regardless.
+	if _, err := p.registry.Apply(packet, force); err != nil {
+		logger.Warn("acknowledged event no longer fits the registry", "error", err)
+	}
+	return ackPacket, nil
+}
 
-	packetB := utils.LRTPIDSPacket{
-		TransactionID:    42,
-		IsAck:            0,
-		IsNewTrain:       0,
-		IsUpdateTrain:    0,
-		IsDeleteTrain:    0,
-		IsTrainArriving:  0,
-		IsTrainDeparting: 1,
-		TrainNumber:      42,
-		DestinationLength: 0,
-		Destination:      "Harjamukti",
+// readWithin reads once from stream, giving up after timeout. Streams have
+// no read deadline, so a read that times out is left to finish on its own
+// once the stream is closed.
+func readWithin(stream io.Reader, timeout time.Duration) ([]byte, error) {
+	type result struct {
+		data []byte
+		err  error
 	}
+	results := make(chan result, 1)
+	go func() {
+		buffer := make([]byte, 1024)
+		n, err := stream.Read(buffer)
+		results <- result{buffer[:n], err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 
-	fmt.Println("Sending Packet B (Train Departing)...")
-	err = publisher.SendPacket(packetB)
+	select {
+	case r := <-results:
+		return r.data, r.err
+	case <-timer.C:
+		sendErrorsTotal.Inc("ack_timeout")
+		return nil, fmt.Errorf("no ACK within %v", timeout)
+	}
+}
+
+// SendPosition sends position as a single unreliable datagram. Nothing is
+// retransmitted or acknowledged, callers simply send the next position.
+func (p *PIDSPublisher) SendPosition(position utils.LRTPIDSPosition) error {
+	p.linkMutex.Lock()
+	conn := p.link.connection
+	p.linkMutex.Unlock()
+
+	datagrams, ok := transport.Datagrams(conn)
+	if !ok {
+		positionsSentTotal.Inc("unsupported")
+		return fmt.Errorf("connection does not support datagrams")
+	}
+
+	data, err := utils.EncodePosition(position)
 	if err != nil {
-		log.Printf("Failed to send Packet B: %v", err)
+		positionsSentTotal.Inc("error")
+		return fmt.Errorf("failed to encode position: %v", err)
+	}
+
+	if err := datagrams.SendDatagram(data); err != nil {
+		positionsSentTotal.Inc("error")
+		return fmt.Errorf("failed to send datagram: %v", err)
+	}
+
+	positionsSentTotal.Inc("sent")
+	return nil
+}
+
+// sendDemoPositions moves trainNumber towards Harjamukti for duration, one
+// position every positionInterval.
+func (p *PIDSPublisher) sendDemoPositions(trainNumber uint16, duration time.Duration) {
+	const positionInterval = 200 * time.Millisecond
+	steps := int(duration / positionInterval)
+
+	ticker := time.NewTicker(positionInterval)
+	defer ticker.Stop()
+
+	for step := 0; step < steps; step++ {
+		<-ticker.C
+
+		position := utils.LRTPIDSPosition{
+			TrainNumber: trainNumber,
+			Timestamp:   time.Now().UnixMilli(),
+			Latitude:    -6.3600 - 0.0015*float32(step)/float32(steps),
+			Longitude:   106.8900 + 0.0050*float32(step)/float32(steps),
+			Speed:       uint16(60 - 60*step/steps),
+		}
+		if err := p.SendPosition(position); err != nil {
+			p.logger.Warn("failed to send position", pidslog.KeyTrainNumber, trainNumber, "error", err)
+			return
+		}
 	}
+}
+
+func (p *PIDSPublisher) Close() error {
+	p.linkMutex.Lock()
+	defer p.linkMutex.Unlock()
 
-	fmt.Println("All packets sent successfully!")
-}
\ No newline at end of file
+	select {
+	case <-p.closed:
+		return errPublisherClosed
+	default:
+		close(p.closed)
+	}
+
+	if p.link.session != nil {
+		p.link.session.Close()
+	}
+	err := p.link.connection.CloseWithError(0, "publisher closed")
+	if p.keyLog != nil {
+		p.keyLog.Close()
+	}
+	return err
+}
+
+func serveMetrics(address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metricsRegistry.Handler())
+
+	if err := http.ListenAndServe(address, mux); err != nil {
+		slog.Error("metrics endpoint stopped", "address", address, "error", err)
+	}
+}
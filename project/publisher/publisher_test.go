@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/transport"
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+// testSession is one session a testSubscriber accepted.
+type testSession struct {
+	conn   transport.Conn
+	peer   utils.Hello
+	synced chan []utils.LRTPIDSPacket
+	events chan utils.LRTPIDSPacket
+}
+
+// serveTestSubscriber speaks the subscriber side of the session protocol on
+// listener: it asks publishers that offer a sync for one and ACKs every
+// event. Every session is passed on once its hellos have been exchanged.
+func serveTestSubscriber(t *testing.T, listener transport.Listener) <-chan *testSession {
+	sessions := make(chan *testSession, 4)
+	go func() {
+		for {
+			conn, err := listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go serveTestSession(t, conn, sessions)
+		}
+	}()
+	return sessions
+}
+
+func serveTestSession(t *testing.T, conn transport.Conn, sessions chan<- *testSession) {
+	stream, err := conn.AcceptStream(context.Background())
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+
+	magic := make([]byte, len(utils.SessionMagic))
+	if _, err := io.ReadFull(stream, magic); err != nil || !utils.IsSessionStart(magic) {
+		t.Errorf("session start = %q, %v", magic, err)
+		return
+	}
+	peer, err := utils.ReadHello(stream)
+	if err != nil {
+		t.Errorf("ReadHello: %v", err)
+		return
+	}
+	hello := utils.Hello{
+		Version:      utils.SessionVersion,
+		MessageTypes: []uint8{utils.MessageEvent, utils.MessageAck, utils.MessageSyncRequest},
+	}
+	if err := utils.WriteHello(stream, hello); err != nil {
+		t.Errorf("WriteHello: %v", err)
+		return
+	}
+	if peer.Supports(utils.MessageSyncResponse) {
+		if err := utils.WriteMessage(stream, utils.MessageSyncRequest, nil); err != nil {
+			t.Errorf("sync request: %v", err)
+			return
+		}
+	}
+
+	session := &testSession{
+		conn:   conn,
+		peer:   peer,
+		synced: make(chan []utils.LRTPIDSPacket, 1),
+		events: make(chan utils.LRTPIDSPacket, 64),
+	}
+	sessions <- session
+
+	for {
+		messageType, payload, err := utils.ReadMessage(stream)
+		if err != nil {
+			return
+		}
+
+		switch messageType {
+		case utils.MessageSyncResponse:
+			trains, err := utils.DecodeSyncResponse(payload)
+			if err != nil {
+				t.Errorf("DecodeSyncResponse: %v", err)
+				return
+			}
+			session.synced <- trains
+		case utils.MessageEvent:
+			packet, err := utils.Decode(payload)
+			if err != nil {
+				t.Errorf("Decode: %v", err)
+				return
+			}
+			session.events <- packet
+
+			ack, _ := utils.Encode(utils.LRTPIDSPacket{IsAck: 1, TransactionID: packet.TransactionID, TrainNumber: packet.TrainNumber})
+			if err := utils.WriteMessage(stream, utils.MessageAck, ack); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func nextTestSession(t *testing.T, sessions <-chan *testSession) *testSession {
+	t.Helper()
+	select {
+	case session := <-sessions:
+		return session
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher did not open a session")
+		return nil
+	}
+}
+
+func syncedTrains(t *testing.T, session *testSession) []utils.LRTPIDSPacket {
+	t.Helper()
+	select {
+	case trains := <-session.synced:
+		return trains
+	case <-time.After(5 * time.Second):
+		t.Fatal("publisher did not answer the sync request")
+		return nil
+	}
+}
+
+// listenTestSubscriber starts a testSubscriber on the UDP transport, which
+// needs no certificates.
+func listenTestSubscriber(t *testing.T) (string, <-chan *testSession) {
+	udp, err := transport.New(transport.KindUDP, transport.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := udp.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String(), serveTestSubscriber(t, listener)
+}
+
+func TestConcurrentSendsKeepSequenceOrder(t *testing.T) {
+	address, sessions := listenTestSubscriber(t)
+	publisher, err := NewPIDSPublisher(address, PublisherOptions{Transport: transport.KindUDP})
+	if err != nil {
+		t.Fatalf("NewPIDSPublisher: %v", err)
+	}
+	defer publisher.Close()
+	session := nextTestSession(t, sessions)
+
+	if err := publisher.SendPacket(utils.LRTPIDSPacket{TransactionID: 1, IsNewTrain: 1, TrainNumber: 5, Destination: "DKAT"}); err != nil {
+		t.Fatalf("SendPacket: %v", err)
+	}
+
+	const updates = 32
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func(transactionID uint16) {
+			defer wg.Done()
+			if _, err := publisher.Send(utils.LRTPIDSPacket{TransactionID: transactionID, IsUpdateTrain: 1, TrainNumber: 5, Destination: "HJMK"}, false); err != nil {
+				t.Errorf("Send: %v", err)
+			}
+		}(uint16(i + 2))
+	}
+	wg.Wait()
+
+	for want := uint16(1); want <= updates+1; want++ {
+		select {
+		case packet := <-session.events:
+			if packet.Sequence != want {
+				t.Fatalf("event %d arrived with Sequence %d", want, packet.Sequence)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("event %d never arrived", want)
+		}
+	}
+}
+
+func TestSendNumbersUnderSendLock(t *testing.T) {
+	address, sessions := listenTestSubscriber(t)
+	publisher, err := NewPIDSPublisher(address, PublisherOptions{Transport: transport.KindUDP})
+	if err != nil {
+		t.Fatalf("NewPIDSPublisher: %v", err)
+	}
+	defer publisher.Close()
+	nextTestSession(t, sessions)
+
+	if err := publisher.SendPacket(utils.LRTPIDSPacket{TransactionID: 1, IsNewTrain: 1, TrainNumber: 5, Destination: "DKAT"}); err != nil {
+		t.Fatalf("SendPacket: %v", err)
+	}
+
+	// Another event is in flight: a send waiting for it must not have taken
+	// a sequence yet, or it could be overtaken by one numbered after it.
+	s := publisher.link.session
+	s.sendMutex.Lock()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- publisher.SendPacket(utils.LRTPIDSPacket{TransactionID: 2, IsUpdateTrain: 1, TrainNumber: 5, Destination: "HJMK"})
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	s.sequences.mutex.Lock()
+	last := s.sequences.last[5]
+	s.sequences.mutex.Unlock()
+	s.sendMutex.Unlock()
+
+	if last != 1 {
+		t.Errorf("last Sequence while waiting for the send lock = %d, want 1", last)
+	}
+	if err := <-errs; err != nil {
+		t.Errorf("SendPacket: %v", err)
+	}
+}
+
+func TestReconnectResyncsSubscriber(t *testing.T) {
+	address, sessions := listenTestSubscriber(t)
+	publisher, err := NewPIDSPublisher(address, PublisherOptions{
+		Transport:  transport.KindUDP,
+		AckTimeout: 2 * time.Second,
+		Registry:   NewTrainRegistry(),
+		Reconnect:  true,
+	})
+	if err != nil {
+		t.Fatalf("NewPIDSPublisher: %v", err)
+	}
+	defer publisher.Close()
+
+	first := nextTestSession(t, sessions)
+	if !first.peer.Supports(utils.MessageSyncResponse) {
+		t.Fatal("publisher with a registry does not offer a sync")
+	}
+	if trains := syncedTrains(t, first); len(trains) != 0 {
+		t.Errorf("first sync = %+v, want no trains", trains)
+	}
+
+	for i, packet := range []utils.LRTPIDSPacket{
+		{IsNewTrain: 1, TrainNumber: 5, Destination: "DKAT"},
+		{IsNewTrain: 1, TrainNumber: 7, Destination: "HJMK"},
+		{IsTrainArriving: 1, TrainNumber: 5},
+	} {
+		packet.TransactionID = uint16(i + 1)
+		if err := publisher.SendPacket(packet); err != nil {
+			t.Fatalf("SendPacket %+v: %v", packet, err)
+		}
+	}
+
+	// The subscriber restarts: its connection goes away and the publisher
+	// has to come back on its own, before it has anything new to send.
+	first.conn.CloseWithError(0, "subscriber restarting")
+
+	second := nextTestSession(t, sessions)
+	want := []utils.LRTPIDSPacket{
+		{IsNewTrain: 1, IsTrainArriving: 1, TrainNumber: 5, DestinationLength: 4, Destination: "DKAT"},
+		{IsNewTrain: 1, TrainNumber: 7, DestinationLength: 4, Destination: "HJMK"},
+	}
+	trains := syncedTrains(t, second)
+	if len(trains) != len(want) {
+		t.Fatalf("resync = %+v, want %+v", trains, want)
+	}
+	for i := range want {
+		if trains[i] != want[i] {
+			t.Errorf("resync train %d = %+v, want %+v", i, trains[i], want[i])
+		}
+	}
+
+	// Sequences start over on the new connection.
+	sent, err := publisher.Send(utils.LRTPIDSPacket{TransactionID: 4, IsTrainDeparting: 1, TrainNumber: 5}, false)
+	if err != nil {
+		t.Fatalf("Send after reconnecting: %v", err)
+	}
+	if sent.Packet.Sequence != 1 {
+		t.Errorf("Sequence after reconnecting = %d, want 1", sent.Packet.Sequence)
+	}
+	select {
+	case packet := <-second.events:
+		if packet.TrainNumber != 5 || packet.IsTrainDeparting != 1 {
+			t.Errorf("event after reconnecting = %+v", packet)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event after reconnecting never arrived")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+	"jarkom.cs.ui.ac.id/h01/project/utils/lifecycle"
+)
+
+// TrainRegistry is the publisher's authoritative view of the live trains.
+// Every event is checked against the train lifecycle before it is sent, and
+// the registry answers sync requests with the full state.
+type TrainRegistry struct {
+	mutex   sync.Mutex
+	machine *lifecycle.Machine
+	// destinations has an entry for every live train.
+	destinations map[uint16]string
+}
+
+// refusedError is returned for an event that was refused before anything
+// was sent, by Apply or because it does not encode.
+type refusedError struct {
+	err error
+}
+
+func (e *refusedError) Error() string { return e.err.Error() }
+func (e *refusedError) Unwrap() error { return e.err }
+
+func NewTrainRegistry() *TrainRegistry {
+	r := &TrainRegistry{
+		machine:      lifecycle.NewMachine(),
+		destinations: make(map[uint16]string),
+	}
+
+	for _, state := range lifecycle.States {
+		if state == lifecycle.Absent {
+			continue
+		}
+		label := string(state)
+		r.machine.OnEnter(state, func(lifecycle.Transition) { trainsGauge.Inc(label) })
+		r.machine.OnLeave(state, func(lifecycle.Transition) { trainsGauge.Dec(label) })
+	}
+	return r
+}
+
+// trainState is what the registry knows about one train, kept by Apply so
+// that Restore can undo it.
+type trainState struct {
+	trainNumber uint16
+	state       lifecycle.State
+	destination string
+}
+
+// Check validates the events carried by packet without recording anything,
+// so that a packet can be refused before it is sent. With force set nothing
+// is refused.
+func (r *TrainRegistry) Check(packet utils.LRTPIDSPacket, force bool) error {
+	if force {
+		return nil
+	}
+
+	if packet.IsAck == 1 {
+		return &refusedError{fmt.Errorf("train %d: ACKs are only sent by subscribers", packet.TrainNumber)}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, err := r.machine.Check(packet); err != nil {
+		return &refusedError{err}
+	}
+	return nil
+}
+
+// Apply validates the events carried by packet and records their outcome,
+// once the packet has been sent. Nothing is recorded when an event is
+// refused. With force set nothing is refused; the registry follows whatever
+// the packet says. The train as it was before is returned for Restore.
+func (r *TrainRegistry) Apply(packet utils.LRTPIDSPacket, force bool) (trainState, error) {
+	if !force && packet.IsAck == 1 {
+		return trainState{}, &refusedError{fmt.Errorf("train %d: ACKs are only sent by subscribers", packet.TrainNumber)}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	previous := trainState{
+		trainNumber: packet.TrainNumber,
+		state:       r.machine.State(packet.TrainNumber),
+		destination: r.destinations[packet.TrainNumber],
+	}
+
+	if force {
+		r.record(packet, r.machine.Force(packet))
+		return previous, nil
+	}
+
+	state, err := r.machine.Apply(packet)
+	if err != nil {
+		return previous, &refusedError{err}
+	}
+
+	r.record(packet, state)
+	return previous, nil
+}
+
+// Restore puts a train back as Apply found it, for an event the subscriber
+// refused after all.
+func (r *TrainRegistry) Restore(previous trainState) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.machine.Set(previous.trainNumber, previous.state)
+	if previous.state == lifecycle.Absent {
+		delete(r.destinations, previous.trainNumber)
+	} else {
+		r.destinations[previous.trainNumber] = previous.destination
+	}
+}
+
+// record keeps the destination of the train packet left in state.
+func (r *TrainRegistry) record(packet utils.LRTPIDSPacket, state lifecycle.State) {
+	if state == lifecycle.Absent {
+		delete(r.destinations, packet.TrainNumber)
+		return
+	}
+
+	destination := r.destinations[packet.TrainNumber]
+	if packet.Destination != "" {
+		destination = packet.Destination
+	}
+	r.destinations[packet.TrainNumber] = destination
+}
+
+// State returns the lifecycle state of train.
+func (r *TrainRegistry) State(train uint16) lifecycle.State {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	return r.machine.State(train)
+}
+
+// Snapshot returns one packet per live train that recreates it, with its
+// destination and latest status, on a subscriber that knows nothing.
+func (r *TrainRegistry) Snapshot() []utils.LRTPIDSPacket {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	trains := make([]utils.LRTPIDSPacket, 0, len(r.destinations))
+	for trainNumber, destination := range r.destinations {
+		packet := utils.LRTPIDSPacket{
+			IsNewTrain:  1,
+			TrainNumber: trainNumber,
+			Destination: destination,
+		}
+		switch r.machine.State(trainNumber) {
+		case lifecycle.Arriving:
+			packet.IsTrainArriving = 1
+		case lifecycle.Departing:
+			packet.IsTrainDeparting = 1
+		}
+		trains = append(trains, packet)
+	}
+
+	sort.Slice(trains, func(i, j int) bool {
+		return trains[i].TrainNumber < trains[j].TrainNumber
+	})
+
+	return trains
+}
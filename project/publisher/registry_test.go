@@ -0,0 +1,60 @@
+package main
+
+import (
+	"testing"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+	"jarkom.cs.ui.ac.id/h01/project/utils/lifecycle"
+)
+
+func TestCheckRecordsNothing(t *testing.T) {
+	registry := NewTrainRegistry()
+	packet := utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 5, Destination: "DKAT"}
+
+	if err := registry.Check(packet, false); err != nil {
+		t.Fatalf("Check: %v", err)
+	}
+	if state := registry.State(5); state != lifecycle.Absent {
+		t.Errorf("State after Check = %s, want %s", state, lifecycle.Absent)
+	}
+
+	if err := registry.Check(utils.LRTPIDSPacket{IsDeleteTrain: 1, TrainNumber: 6}, false); err == nil {
+		t.Error("Check accepted deleting a train that does not exist")
+	}
+	if err := registry.Check(utils.LRTPIDSPacket{IsDeleteTrain: 1, TrainNumber: 6}, true); err != nil {
+		t.Errorf("Check with force: %v", err)
+	}
+}
+
+func TestRestoreUndoesApply(t *testing.T) {
+	registry := NewTrainRegistry()
+	if _, err := registry.Apply(utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 5, Destination: "DKAT"}, false); err != nil {
+		t.Fatalf("Apply new: %v", err)
+	}
+
+	tests := []utils.LRTPIDSPacket{
+		{IsUpdateTrain: 1, TrainNumber: 5, Destination: "Harjamukti"},
+		{IsTrainArriving: 1, TrainNumber: 5},
+		{IsDeleteTrain: 1, TrainNumber: 5},
+		{IsNewTrain: 1, TrainNumber: 7, Destination: "Cawang"},
+	}
+	for _, packet := range tests {
+		before := registry.Snapshot()
+
+		previous, err := registry.Apply(packet, false)
+		if err != nil {
+			t.Fatalf("Apply %s: %v", packet.EventType(), err)
+		}
+		registry.Restore(previous)
+
+		after := registry.Snapshot()
+		if len(after) != len(before) {
+			t.Fatalf("after restoring %s: %d trains, want %d", packet.EventType(), len(after), len(before))
+		}
+		for i := range before {
+			if after[i] != before[i] {
+				t.Errorf("after restoring %s: %+v, want %+v", packet.EventType(), after[i], before[i])
+			}
+		}
+	}
+}
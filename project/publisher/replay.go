@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+	"jarkom.cs.ui.ac.id/h01/project/utils/lifecycle"
+	"jarkom.cs.ui.ac.id/h01/project/utils/pidslog"
+)
+
+// replayClock is the time Replay paces scenarios by.
+type replayClock interface {
+	Now() time.Time
+	// After returns a channel that receives once d has passed, and a
+	// function that stops the wait early.
+	After(d time.Duration) (<-chan time.Time, func() bool)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) After(d time.Duration) (<-chan time.Time, func() bool) {
+	timer := time.NewTimer(d)
+	return timer.C, timer.Stop
+}
+
+// ReplayStats counts the outcome of a replay.
+type ReplayStats struct {
+	Events int
+	Acked  int
+	Failed int
+}
+
+// Replay sends the events of scenario at their time, divided by speed, with
+// a speed of 0 sending them back to back. Every event gets a TransactionID
+// of its own. A train that is not live yet when one of its events is due is
+// registered first, so scenarios may list only arrivals and departures.
+// Replay stops early when ctx is cancelled.
+func (p *PIDSPublisher) Replay(ctx context.Context, scenario Scenario, speed float64) (ReplayStats, error) {
+	var stats ReplayStats
+	transactionID := uint16(rand.Intn(0xFFFF))
+	send := func(packet utils.LRTPIDSPacket) {
+		transactionID++
+		if transactionID == 0 {
+			transactionID++
+		}
+		packet.TransactionID = transactionID
+
+		stats.Events++
+		if _, err := p.Send(packet, false); err != nil {
+			stats.Failed++
+			return
+		}
+		stats.Acked++
+	}
+
+	start := p.clock.Now()
+	for _, event := range scenario {
+		if speed > 0 {
+			due := start.Add(time.Duration(float64(event.At) / speed))
+			fired, stop := p.clock.After(due.Sub(p.clock.Now()))
+			select {
+			case <-fired:
+			case <-ctx.Done():
+				stop()
+				return stats, ctx.Err()
+			}
+
+			if late := p.clock.Now().Sub(due); late > time.Second {
+				p.logger.Warn("scenario event sent late", "at", event.At, "late", late)
+			}
+		} else if ctx.Err() != nil {
+			return stats, ctx.Err()
+		}
+
+		packet := event.Packet
+		live := p.registry.State(packet.TrainNumber) != lifecycle.Absent
+		if !live && packet.IsNewTrain == 0 {
+			if packet.IsDeleteTrain == 1 {
+				p.logger.Warn("skipping delete of a train that is not live", pidslog.KeyTrainNumber, packet.TrainNumber)
+				continue
+			}
+			send(utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: packet.TrainNumber, Destination: packet.Destination})
+		}
+		send(packet)
+	}
+	return stats, nil
+}
+
+func runReplay(name string, args []string) int {
+	fs := newFlagSet(name)
+	connection := addConnectionFlags(fs)
+	path := fs.String("file", "", "scenario file to replay (required)")
+	format := fs.String("format", "", "scenario format: "+strings.Join(ScenarioFormats, ", ")+", picked from the file when empty")
+	speed := fs.Float64("speed", 1, "replay speed, 60 plays an hour in a minute and 0 sends every event without waiting")
+	stopID := fs.String("stop", "", "GTFS stop_id of the station, needed when stop_times.txt has several stops")
+	lead := fs.Duration("lead", 5*time.Minute, "GTFS: how long before its arrival a train is registered")
+	linger := fs.Duration("linger", time.Minute, "GTFS: how long after its departure a train is removed")
+	metricsAddress := fs.String("metrics", "", "HTTP address to expose /metrics on, empty to disable")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *path == "" || *speed < 0 {
+		fmt.Fprintf(os.Stderr, "%s: -file is required and -speed may not be negative\n", name)
+		return 2
+	}
+
+	logger, err := connection.setupLogger(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	scenario, err := LoadScenario(*path, *format, GTFSOptions{StopID: *stopID, Lead: *lead, Linger: *linger})
+	if err != nil {
+		logger.Error("failed to load scenario", "error", err)
+		return 1
+	}
+	logger.Info("scenario loaded", "file", *path, "events", len(scenario), "duration", scenario.Duration(), "speed", *speed)
+
+	if *metricsAddress != "" {
+		go serveMetrics(*metricsAddress)
+	}
+
+	publisher, err := connection.connect(false, NewTrainRegistry())
+	if err != nil {
+		logger.Error("failed to create publisher", "error", err)
+		return 1
+	}
+	defer publisher.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	stats, err := publisher.Replay(ctx, scenario, *speed)
+	logger.Info("scenario replayed", "events", stats.Events, "acked", stats.Acked, "failed", stats.Failed)
+	if err != nil {
+		logger.Warn("replay interrupted", "error", err)
+		return 1
+	}
+	if stats.Failed > 0 {
+		return 1
+	}
+	return 0
+}
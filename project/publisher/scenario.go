@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+// Scenario formats accepted by LoadScenario.
+const (
+	ScenarioCSV  = "csv"
+	ScenarioJSON = "json"
+	ScenarioGTFS = "gtfs"
+)
+
+// ScenarioFormats lists the scenario formats, for flag help texts.
+var ScenarioFormats = []string{ScenarioCSV, ScenarioJSON, ScenarioGTFS}
+
+// ScenarioEvent is one event of a scenario, At after the scenario starts.
+// Packet has no TransactionID or Sequence yet, they are assigned on replay.
+type ScenarioEvent struct {
+	At     time.Duration
+	Packet utils.LRTPIDSPacket
+}
+
+// Scenario is a list of events ordered by time.
+type Scenario []ScenarioEvent
+
+// Duration is the time from the start of the scenario to its last event.
+func (s Scenario) Duration() time.Duration {
+	if len(s) == 0 {
+		return 0
+	}
+	return s[len(s)-1].At
+}
+
+// GTFSOptions select the stop_times.txt rows of one station and say when the
+// trains around each stop are registered and removed.
+type GTFSOptions struct {
+	// StopID is the stop to replay. It may be empty when the file only has
+	// one stop.
+	StopID string
+	// Lead is how long before its arrival a train is registered.
+	Lead time.Duration
+	// Linger is how long after its departure a train is removed.
+	Linger time.Duration
+}
+
+// LoadScenario reads a scenario from path. format is one of ScenarioFormats,
+// or empty to pick it from the file: .json files are JSON, CSV files with a
+// trip_id column are GTFS stop_times.txt and other files are CSV.
+func LoadScenario(path, format string, gtfs GTFSOptions) (Scenario, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scenario: %v", err)
+	}
+	defer file.Close()
+
+	detect := format == ""
+	if detect {
+		format = ScenarioCSV
+		if strings.EqualFold(filepath.Ext(path), ".json") {
+			format = ScenarioJSON
+		}
+	}
+
+	var scenario Scenario
+	switch format {
+	case ScenarioJSON:
+		scenario, err = readJSONScenario(file)
+	case ScenarioCSV, ScenarioGTFS:
+		var header []string
+		var rows [][]string
+		header, rows, err = readCSV(file)
+		if err != nil {
+			break
+		}
+		if format == ScenarioGTFS || (detect && contains(header, "trip_id")) {
+			scenario, err = gtfsScenario(header, rows, tripHeadsigns(filepath.Join(filepath.Dir(path), "trips.txt")), gtfs)
+		} else {
+			scenario, err = csvScenario(header, rows)
+		}
+	default:
+		return nil, fmt.Errorf("unknown scenario format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load scenario %s: %v", path, err)
+	}
+
+	if len(scenario) == 0 {
+		return nil, fmt.Errorf("scenario %s has no events", path)
+	}
+
+	// Times are relative to the first event, which may be a clock time.
+	sort.SliceStable(scenario, func(i, j int) bool { return scenario[i].At < scenario[j].At })
+	start := scenario[0].At
+	for i := range scenario {
+		scenario[i].At -= start
+	}
+	return scenario, nil
+}
+
+// scenarioEvents maps the event names of scenario files onto packets.
+var scenarioEvents = map[string]func(*utils.LRTPIDSPacket){
+	"new":       func(p *utils.LRTPIDSPacket) { p.IsNewTrain = 1 },
+	"update":    func(p *utils.LRTPIDSPacket) { p.IsUpdateTrain = 1 },
+	"delete":    func(p *utils.LRTPIDSPacket) { p.IsDeleteTrain = 1 },
+	"arrive":    func(p *utils.LRTPIDSPacket) { p.IsTrainArriving = 1 },
+	"arriving":  func(p *utils.LRTPIDSPacket) { p.IsTrainArriving = 1 },
+	"depart":    func(p *utils.LRTPIDSPacket) { p.IsTrainDeparting = 1 },
+	"departing": func(p *utils.LRTPIDSPacket) { p.IsTrainDeparting = 1 },
+}
+
+func newScenarioEvent(at, event, train, destination string) (ScenarioEvent, error) {
+	offset, err := parseOffset(at)
+	if err != nil {
+		return ScenarioEvent{}, err
+	}
+
+	number, err := strconv.ParseUint(strings.TrimSpace(train), 10, 16)
+	if err != nil {
+		return ScenarioEvent{}, fmt.Errorf("invalid train number %q", train)
+	}
+
+	set, ok := scenarioEvents[strings.ToLower(strings.TrimSpace(event))]
+	if !ok {
+		return ScenarioEvent{}, fmt.Errorf("unknown event %q", event)
+	}
+
+	packet := utils.LRTPIDSPacket{
+		TrainNumber: uint16(number),
+		Destination: strings.TrimSpace(destination),
+	}
+	set(&packet)
+	return ScenarioEvent{At: offset, Packet: packet}, nil
+}
+
+// parseOffset accepts a clock time H:MM:SS as in GTFS, where hours may go
+// past 24, a Go duration such as 1m30s, or a number of seconds.
+func parseOffset(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+
+	if parts := strings.Split(value, ":"); len(parts) == 3 {
+		var clock [3]int
+		for i, part := range parts {
+			n, err := strconv.Atoi(part)
+			if err != nil || n < 0 || (i > 0 && n > 59) {
+				return 0, fmt.Errorf("invalid time %q", value)
+			}
+			clock[i] = n
+		}
+		return time.Duration(clock[0])*time.Hour + time.Duration(clock[1])*time.Minute + time.Duration(clock[2])*time.Second, nil
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+
+	offset, err := time.ParseDuration(value)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid time %q", value)
+	}
+	return offset, nil
+}
+
+// jsonScenarioEvent is an element of a JSON scenario, a list like
+//
+//	[{"at": "1m30s", "event": "arrive", "train": 42, "destination": "Harjamukti"}]
+//
+// where at may also be a number of seconds.
+type jsonScenarioEvent struct {
+	At          json.RawMessage `json:"at"`
+	Event       string          `json:"event"`
+	Train       json.Number     `json:"train"`
+	Destination string          `json:"destination"`
+}
+
+func readJSONScenario(r io.Reader) (Scenario, error) {
+	var events []jsonScenarioEvent
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if err := decoder.Decode(&events); err != nil {
+		return nil, err
+	}
+
+	scenario := make(Scenario, 0, len(events))
+	for i, event := range events {
+		var at string
+		if err := json.Unmarshal(event.At, &at); err != nil {
+			at = string(event.At)
+		}
+
+		scenarioEvent, err := newScenarioEvent(at, event.Event, event.Train.String(), event.Destination)
+		if err != nil {
+			return nil, fmt.Errorf("event %d: %v", i, err)
+		}
+		scenario = append(scenario, scenarioEvent)
+	}
+	return scenario, nil
+}
+
+func readCSV(r io.Reader) ([]string, [][]string, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil, errors.New("missing header")
+	}
+
+	header := rows[0]
+	for i := range header {
+		// GTFS files often start with a byte order mark.
+		header[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(header[i], "\ufeff")))
+	}
+	return header, rows[1:], nil
+}
+
+// columns returns the index of every name in header.
+func columns(header []string, required []string, optional []string) (map[string]int, error) {
+	index := make(map[string]int)
+	for i, name := range header {
+		index[name] = i
+	}
+
+	for _, name := range required {
+		if _, ok := index[name]; !ok {
+			return nil, fmt.Errorf("missing column %q", name)
+		}
+	}
+	for _, name := range optional {
+		if _, ok := index[name]; !ok {
+			index[name] = -1
+		}
+	}
+	return index, nil
+}
+
+func field(row []string, index int) string {
+	if index < 0 || index >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[index])
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// csvScenario reads rows with the columns at, event, train and optionally
+// destination.
+func csvScenario(header []string, rows [][]string) (Scenario, error) {
+	index, err := columns(header, []string{"at", "event", "train"}, []string{"destination"})
+	if err != nil {
+		return nil, err
+	}
+
+	scenario := make(Scenario, 0, len(rows))
+	for i, row := range rows {
+		event, err := newScenarioEvent(field(row, index["at"]), field(row, index["event"]), field(row, index["train"]), field(row, index["destination"]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+2, err)
+		}
+		scenario = append(scenario, event)
+	}
+	return scenario, nil
+}
+
+// gtfsScenario turns the stop_times.txt rows of one stop into a new,
+// arriving, departing and delete event per trip. The train number is the
+// trip_id when numeric, and the destination the stop_headsign or else the
+// trip_headsign from trips.txt.
+func gtfsScenario(header []string, rows [][]string, headsigns map[string]string, options GTFSOptions) (Scenario, error) {
+	index, err := columns(header, []string{"trip_id", "arrival_time", "departure_time", "stop_id"}, []string{"stop_headsign"})
+	if err != nil {
+		return nil, err
+	}
+
+	stopID := options.StopID
+	if stopID == "" {
+		for _, row := range rows {
+			id := field(row, index["stop_id"])
+			if stopID != "" && id != stopID {
+				return nil, errors.New("stop_times.txt has several stops, select one with the stop ID")
+			}
+			stopID = id
+		}
+	}
+
+	var scenario Scenario
+	for i, row := range rows {
+		if field(row, index["stop_id"]) != stopID {
+			continue
+		}
+
+		tripID := field(row, index["trip_id"])
+		train, err := strconv.ParseUint(tripID, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: trip_id %q is not a train number", i+2, tripID)
+		}
+
+		arrivalTime, departureTime := field(row, index["arrival_time"]), field(row, index["departure_time"])
+		if arrivalTime == "" {
+			arrivalTime = departureTime
+		}
+		if departureTime == "" {
+			departureTime = arrivalTime
+		}
+		if arrivalTime == "" {
+			// Stops between timepoints have no times of their own.
+			continue
+		}
+
+		arrival, err := parseOffset(arrivalTime)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+2, err)
+		}
+		departure, err := parseOffset(departureTime)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", i+2, err)
+		}
+
+		destination := field(row, index["stop_headsign"])
+		if destination == "" {
+			destination = headsigns[tripID]
+		}
+
+		registered := arrival - options.Lead
+		if registered < 0 {
+			registered = 0
+		}
+
+		packet := utils.LRTPIDSPacket{TrainNumber: uint16(train), Destination: destination}
+		newTrain, arriving, departing, deleteTrain := packet, packet, packet, packet
+		newTrain.IsNewTrain = 1
+		arriving.IsTrainArriving = 1
+		departing.IsTrainDeparting = 1
+		deleteTrain.IsDeleteTrain = 1
+
+		scenario = append(scenario,
+			ScenarioEvent{At: registered, Packet: newTrain},
+			ScenarioEvent{At: arrival, Packet: arriving},
+			ScenarioEvent{At: departure, Packet: departing},
+			ScenarioEvent{At: departure + options.Linger, Packet: deleteTrain},
+		)
+	}
+
+	if len(scenario) == 0 {
+		return nil, fmt.Errorf("no trips stop at %q", stopID)
+	}
+	return scenario, nil
+}
+
+// tripHeadsigns reads trip_headsign per trip_id from a GTFS trips.txt, and
+// returns nothing when there is no such file.
+func tripHeadsigns(path string) map[string]string {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	header, rows, err := readCSV(file)
+	if err != nil {
+		return nil
+	}
+	index, err := columns(header, []string{"trip_id", "trip_headsign"}, nil)
+	if err != nil {
+		return nil
+	}
+
+	headsigns := make(map[string]string)
+	for _, row := range rows {
+		headsigns[field(row, index["trip_id"])] = field(row, index["trip_headsign"])
+	}
+	return headsigns
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+func TestParseOffset(t *testing.T) {
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"1:02:03", time.Hour + 2*time.Minute + 3*time.Second, true},
+		{"25:10:00", 25*time.Hour + 10*time.Minute, true},
+		{" 07:00:00 ", 7 * time.Hour, true},
+		{"1m30s", 90 * time.Second, true},
+		{"90", 90 * time.Second, true},
+		{"1.5", 1500 * time.Millisecond, true},
+		{"0", 0, true},
+		{"", 0, false},
+		{"-1", 0, false},
+		{"-5s", 0, false},
+		{"1:60:00", 0, false},
+		{"1:00:60", 0, false},
+		{"a:00:00", 0, false},
+		{"12:00", 0, false},
+		{"soon", 0, false},
+	}
+
+	for _, test := range tests {
+		got, err := parseOffset(test.value)
+		if (err == nil) != test.ok || got != test.want {
+			t.Errorf("parseOffset(%q) = %v, %v, want %v, ok %v", test.value, got, err, test.want, test.ok)
+		}
+	}
+}
+
+// parseCSV reads a CSV scenario from text as LoadScenario would, without
+// ordering it.
+func parseCSV(t *testing.T, text string) (Scenario, error) {
+	t.Helper()
+	header, rows, err := readCSV(strings.NewReader(text))
+	if err != nil {
+		return nil, err
+	}
+	return csvScenario(header, rows)
+}
+
+func TestCSVScenario(t *testing.T) {
+	scenario, err := parseCSV(t, "\ufeffAt, Event ,TRAIN,destination\n# comment\n0s,new,42,Harjamukti\n1m,ARRIVE,42,Harjamukti\n90,depart,42,\n")
+	if err != nil {
+		t.Fatalf("csvScenario: %v", err)
+	}
+
+	want := Scenario{
+		{At: 0, Packet: utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 42, Destination: "Harjamukti"}},
+		{At: time.Minute, Packet: utils.LRTPIDSPacket{IsTrainArriving: 1, TrainNumber: 42, Destination: "Harjamukti"}},
+		{At: 90 * time.Second, Packet: utils.LRTPIDSPacket{IsTrainDeparting: 1, TrainNumber: 42}},
+	}
+	if len(scenario) != len(want) {
+		t.Fatalf("csvScenario = %+v, want %+v", scenario, want)
+	}
+	for i := range want {
+		if scenario[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, scenario[i], want[i])
+		}
+	}
+}
+
+func TestCSVScenarioMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"empty", "", "missing header"},
+		{"missing column", "at,event\n0s,new\n", `missing column "train"`},
+		{"unknown event", "at,event,train\n0s,new,42\n1s,teleport,42\n", `line 3: unknown event "teleport"`},
+		{"train number", "at,event,train\n0s,new,KA42\n", `line 2: invalid train number "KA42"`},
+		{"train number too large", "at,event,train\n0s,new,65536\n", `line 2: invalid train number "65536"`},
+		{"time", "at,event,train\nnoon,new,42\n", `line 2: invalid time "noon"`},
+		{"negative time", "at,event,train\n-1s,new,42\n", `line 2: invalid time "-1s"`},
+		{"missing field", "at,event,train\n0s,new\n", "wrong number of fields"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseCSV(t, test.text)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestJSONScenario(t *testing.T) {
+	scenario, err := readJSONScenario(strings.NewReader(`[
+		{"at": "1m30s", "event": "arrive", "train": 42, "destination": "Harjamukti"},
+		{"at": 2.5, "event": "new", "train": "43"}
+	]`))
+	if err != nil {
+		t.Fatalf("readJSONScenario: %v", err)
+	}
+
+	want := Scenario{
+		{At: 90 * time.Second, Packet: utils.LRTPIDSPacket{IsTrainArriving: 1, TrainNumber: 42, Destination: "Harjamukti"}},
+		{At: 2500 * time.Millisecond, Packet: utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 43}},
+	}
+	if len(scenario) != len(want) {
+		t.Fatalf("readJSONScenario = %+v, want %+v", scenario, want)
+	}
+	for i := range want {
+		if scenario[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, scenario[i], want[i])
+		}
+	}
+}
+
+func TestJSONScenarioMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"not a list", `{"at": 0}`, "cannot unmarshal"},
+		{"truncated", `[{"at": 0, "event": "new"`, "unexpected EOF"},
+		{"unknown event", `[{"at": 0, "event": "new", "train": 1}, {"at": 1, "event": "vanish", "train": 1}]`, `event 1: unknown event "vanish"`},
+		{"time", `[{"at": "-1m", "event": "new", "train": 1}]`, `event 0: invalid time "-1m"`},
+		{"missing time", `[{"event": "new", "train": 1}]`, `event 0: invalid time ""`},
+		{"missing train", `[{"at": 0, "event": "new"}]`, `event 0: invalid train number ""`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := readJSONScenario(strings.NewReader(test.text))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func TestGTFSScenario(t *testing.T) {
+	header := []string{"trip_id", "arrival_time", "departure_time", "stop_id", "stop_headsign"}
+	rows := [][]string{
+		{"7", "06:00:00", "06:01:00", "HJMK", ""},
+		{"7", "06:20:00", "06:21:00", "DKAT", ""},
+		// Only a departure time, as at the first stop of a trip.
+		{"8", "", "06:10:00", "HJMK", "Dukuh Atas"},
+		// No times at all, between timepoints.
+		{"9", "", "", "HJMK", ""},
+	}
+	headsigns := map[string]string{"7": "Harjamukti"}
+
+	scenario, err := gtfsScenario(header, rows, headsigns, GTFSOptions{StopID: "HJMK", Lead: 5 * time.Minute, Linger: time.Minute})
+	if err != nil {
+		t.Fatalf("gtfsScenario: %v", err)
+	}
+
+	at := func(clock string) time.Duration {
+		d, err := parseOffset(clock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	want := Scenario{
+		{At: at("05:55:00"), Packet: utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 7, Destination: "Harjamukti"}},
+		{At: at("06:00:00"), Packet: utils.LRTPIDSPacket{IsTrainArriving: 1, TrainNumber: 7, Destination: "Harjamukti"}},
+		{At: at("06:01:00"), Packet: utils.LRTPIDSPacket{IsTrainDeparting: 1, TrainNumber: 7, Destination: "Harjamukti"}},
+		{At: at("06:02:00"), Packet: utils.LRTPIDSPacket{IsDeleteTrain: 1, TrainNumber: 7, Destination: "Harjamukti"}},
+		{At: at("06:05:00"), Packet: utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 8, Destination: "Dukuh Atas"}},
+		{At: at("06:10:00"), Packet: utils.LRTPIDSPacket{IsTrainArriving: 1, TrainNumber: 8, Destination: "Dukuh Atas"}},
+		{At: at("06:10:00"), Packet: utils.LRTPIDSPacket{IsTrainDeparting: 1, TrainNumber: 8, Destination: "Dukuh Atas"}},
+		{At: at("06:11:00"), Packet: utils.LRTPIDSPacket{IsDeleteTrain: 1, TrainNumber: 8, Destination: "Dukuh Atas"}},
+	}
+	if len(scenario) != len(want) {
+		t.Fatalf("gtfsScenario = %+v, want %+v", scenario, want)
+	}
+	for i := range want {
+		if scenario[i] != want[i] {
+			t.Errorf("event %d = %+v, want %+v", i, scenario[i], want[i])
+		}
+	}
+}
+
+func TestGTFSScenarioMalformed(t *testing.T) {
+	header := []string{"trip_id", "arrival_time", "departure_time", "stop_id"}
+	tests := []struct {
+		name    string
+		header  []string
+		rows    [][]string
+		options GTFSOptions
+		want    string
+	}{
+		{"missing column", []string{"trip_id", "arrival_time", "stop_id"}, nil, GTFSOptions{}, `missing column "departure_time"`},
+		{"several stops", header, [][]string{{"7", "06:00:00", "06:01:00", "HJMK"}, {"7", "06:20:00", "06:21:00", "DKAT"}}, GTFSOptions{}, "several stops"},
+		{"trip_id", header, [][]string{{"KA7", "06:00:00", "06:01:00", "HJMK"}}, GTFSOptions{}, `line 2: trip_id "KA7" is not a train number`},
+		{"time", header, [][]string{{"7", "06:00:00", "6am", "HJMK"}}, GTFSOptions{}, `line 2: invalid time "6am"`},
+		{"unknown stop", header, [][]string{{"7", "06:00:00", "06:01:00", "HJMK"}}, GTFSOptions{StopID: "CBBR"}, `no trips stop at "CBBR"`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := gtfsScenario(test.header, test.rows, nil, test.options)
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Errorf("error = %v, want %q", err, test.want)
+			}
+		})
+	}
+}
+
+func writeScenario(t *testing.T, dir, name, text string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(text), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadScenarioOrdersEvents(t *testing.T) {
+	path := writeScenario(t, t.TempDir(), "morning.csv", "at,event,train\n"+
+		"06:00:10,depart,42\n"+
+		"06:00:00,new,42\n"+
+		"06:00:05,arrive,42\n"+
+		"06:00:10,delete,43\n"+
+		"06:00:00,new,43\n")
+
+	scenario, err := LoadScenario(path, "", GTFSOptions{})
+	if err != nil {
+		t.Fatalf("LoadScenario: %v", err)
+	}
+
+	// Events are ordered by time relative to the first one, keeping the
+	// order of the file between events at the same time.
+	want := []struct {
+		at    time.Duration
+		train uint16
+	}{{0, 42}, {0, 43}, {5 * time.Second, 42}, {10 * time.Second, 42}, {10 * time.Second, 43}}
+	if len(scenario) != len(want) {
+		t.Fatalf("LoadScenario = %+v", scenario)
+	}
+	for i, event := range scenario {
+		if event.At != want[i].at || event.Packet.TrainNumber != want[i].train {
+			t.Errorf("event %d at %v of train %d, want at %v of train %d", i, event.At, event.Packet.TrainNumber, want[i].at, want[i].train)
+		}
+	}
+	if duration := scenario.Duration(); duration != 10*time.Second {
+		t.Errorf("Duration = %v, want 10s", duration)
+	}
+}
+
+func TestLoadScenarioFormats(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := writeScenario(t, dir, "scenario.csv", "at,event,train\n0,new,1\n")
+	jsonPath := writeScenario(t, dir, "scenario.JSON", `[{"at": 0, "event": "new", "train": 2}]`)
+	gtfsPath := writeScenario(t, dir, "stop_times.txt", "trip_id,arrival_time,departure_time,stop_id\n3,06:00:00,06:01:00,HJMK\n")
+	writeScenario(t, dir, "trips.txt", "route_id,trip_id,trip_headsign\nLRT,3,Dukuh Atas\n")
+	emptyPath := writeScenario(t, dir, "empty.csv", "at,event,train\n")
+
+	tests := []struct {
+		path   string
+		format string
+		train  uint16
+		events int
+		// destination of the first event.
+		destination string
+	}{
+		{csvPath, "", 1, 1, ""},
+		{jsonPath, "", 2, 1, ""},
+		{gtfsPath, "", 3, 4, "Dukuh Atas"},
+		{gtfsPath, ScenarioGTFS, 3, 4, "Dukuh Atas"},
+	}
+	for _, test := range tests {
+		scenario, err := LoadScenario(test.path, test.format, GTFSOptions{})
+		if err != nil {
+			t.Errorf("LoadScenario(%s, %q): %v", filepath.Base(test.path), test.format, err)
+			continue
+		}
+		if len(scenario) != test.events || scenario[0].Packet.TrainNumber != test.train || scenario[0].Packet.Destination != test.destination {
+			t.Errorf("LoadScenario(%s, %q) = %+v", filepath.Base(test.path), test.format, scenario)
+		}
+	}
+
+	for _, failing := range []struct{ path, format string }{
+		{csvPath, ScenarioJSON},
+		{jsonPath, ScenarioCSV},
+		{csvPath, "xml"},
+		{emptyPath, ""},
+		{filepath.Join(dir, "missing.csv"), ""},
+	} {
+		if _, err := LoadScenario(failing.path, failing.format, GTFSOptions{}); err == nil {
+			t.Errorf("LoadScenario(%s, %q) succeeded", filepath.Base(failing.path), failing.format)
+		}
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/transport"
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+// session is the control stream that carries every event and its ACK, so
+// that sending a packet no longer costs a stream. Once the hellos have been
+// exchanged a reader goroutine hands ACKs to send and answers sync requests
+// from the subscriber out of registry.
+type session struct {
+	stream     transport.Stream
+	peer       utils.Hello
+	registry   *TrainRegistry
+	ackTimeout time.Duration
+	logger     *slog.Logger
+
+	// sendMutex keeps one event in flight at a time, so the next ACK is
+	// always for the event just written. It also covers numbering events,
+	// so that they are written in the order of their sequences.
+	sendMutex sync.Mutex
+	sequences trainSequences
+	// writeMutex also covers applying events to registry, so that a sync
+	// response contains exactly the events written before it.
+	writeMutex sync.Mutex
+	replies    chan reply
+	done       chan struct{}
+	err        error
+	// lost is closed once events can no longer be sent: when done is, or
+	// when an ACK did not arrive in time even though the session is still
+	// being read.
+	lost     chan struct{}
+	lostOnce sync.Once
+	// synced is closed once the first sync request has been answered.
+	synced     chan struct{}
+	syncedOnce sync.Once
+}
+
+// reply is the subscriber's answer to the event in flight, either an ACK
+// or, when nack is set, a refusal.
+type reply struct {
+	ack  utils.LRTPIDSPacket
+	nack *utils.Nack
+}
+
+// nackError is returned for an event the subscriber refused.
+type nackError struct {
+	reason string
+}
+
+func (e *nackError) Error() string { return "refused by subscriber: " + e.reason }
+
+func openSession(conn transport.Conn, hello utils.Hello, registry *TrainRegistry, ackTimeout time.Duration, logger *slog.Logger) (*session, error) {
+	stream, err := conn.OpenStream(context.Background())
+	if err != nil {
+		sendErrorsTotal.Inc("open_stream")
+		return nil, fmt.Errorf("failed to open control stream: %v", err)
+	}
+	streamsOpenedTotal.Inc()
+
+	if err := utils.WriteSessionStart(stream, hello); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("failed to send hello: %v", err)
+	}
+
+	peer, err := utils.ReadHello(stream)
+	if err != nil {
+		stream.Close()
+		return nil, err
+	}
+
+	if peer.Version != utils.SessionVersion {
+		stream.Close()
+		return nil, fmt.Errorf("subscriber speaks session version %d, want %d", peer.Version, utils.SessionVersion)
+	}
+
+	if !peer.Supports(utils.MessageEvent) {
+		stream.Close()
+		return nil, fmt.Errorf("subscriber does not accept events")
+	}
+
+	s := &session{
+		stream:     stream,
+		peer:       peer,
+		registry:   registry,
+		ackTimeout: ackTimeout,
+		logger:     logger,
+		replies:    make(chan reply, 1),
+		done:       make(chan struct{}),
+		lost:       make(chan struct{}),
+		synced:     make(chan struct{}),
+	}
+	go s.readLoop()
+
+	// A subscriber that asks for a sync does so right after its hello.
+	// Events sent before the answer would reach it before the trains they
+	// belong to.
+	if hello.Supports(utils.MessageSyncResponse) && peer.Supports(utils.MessageSyncRequest) {
+		s.awaitSync()
+	}
+	return s, nil
+}
+
+func (s *session) readLoop() {
+	defer s.markLost()
+	defer close(s.done)
+
+	for {
+		messageType, payload, err := utils.ReadMessage(s.stream)
+		if err != nil {
+			s.err = err
+			return
+		}
+
+		switch messageType {
+		case utils.MessageAck:
+			ackPacket, err := utils.Decode(payload)
+			if err != nil {
+				sendErrorsTotal.Inc("decode_ack")
+				s.logger.Warn("failed to decode ACK", "error", err)
+				continue
+			}
+			s.deliver(reply{ack: ackPacket}, ackPacket.TransactionID)
+		case utils.MessageNack:
+			nack, err := utils.DecodeNack(payload)
+			if err != nil {
+				sendErrorsTotal.Inc("decode_ack")
+				s.logger.Warn("failed to decode NACK", "error", err)
+				continue
+			}
+			s.deliver(reply{nack: &nack}, nack.TransactionID)
+		case utils.MessageSyncRequest:
+			s.answerSync()
+		default:
+			s.logger.Warn("unexpected session message", "type", messageType)
+		}
+	}
+}
+
+// deliver hands r to the send waiting for it.
+func (s *session) deliver(r reply, transactionID uint16) {
+	select {
+	case s.replies <- r:
+	default:
+		s.logger.Warn("dropping unexpected reply", "transaction_id", transactionID)
+	}
+}
+
+// answerSync sends the subscriber every active train so it can recover its
+// state after a restart or partition.
+func (s *session) answerSync() {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	trains := s.registry.Snapshot()
+	payload, err := utils.EncodeSyncResponse(trains)
+	if err != nil {
+		syncRequestsTotal.Inc("error")
+		s.logger.Error("failed to encode sync response", "error", err)
+		return
+	}
+
+	if err := utils.WriteMessage(s.stream, utils.MessageSyncResponse, payload); err != nil {
+		syncRequestsTotal.Inc("error")
+		s.logger.Warn("failed to send sync response", "error", err)
+		return
+	}
+
+	syncRequestsTotal.Inc("answered")
+	s.logger.Info("answered sync request", "trains", len(trains))
+	s.syncedOnce.Do(func() { close(s.synced) })
+}
+
+// awaitSync waits for the first sync request to be answered, at most as
+// long as for an ACK.
+func (s *session) awaitSync() {
+	timer := time.NewTimer(s.ackTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-s.synced:
+	case <-s.done:
+	case <-timer.C:
+		s.logger.Warn("subscriber did not ask for a sync", "timeout", s.ackTimeout)
+	}
+}
+
+// writeEvent writes packet unless the registry refuses it, and applies it
+// to the registry once it has been written. The subscriber applies events in
+// stream order, so the registry must change in that order too.
+func (s *session) writeEvent(packet utils.LRTPIDSPacket, force bool, data []byte) (trainState, error) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	if err := s.registry.Check(packet, force); err != nil {
+		sendErrorsTotal.Inc("invalid_transition")
+		return trainState{}, err
+	}
+
+	if err := utils.WriteMessage(s.stream, utils.MessageEvent, data); err != nil {
+		sendErrorsTotal.Inc("write")
+		return trainState{}, fmt.Errorf("failed to write data: %v", err)
+	}
+
+	// Check passed under the same lock, so this cannot be refused.
+	return s.registry.Apply(packet, force)
+}
+
+// restore undoes an event the subscriber refused.
+func (s *session) restore(previous trainState) {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+
+	s.registry.Restore(previous)
+}
+
+// send numbers packet, writes it and waits for the subscriber's answer. It
+// returns packet as sent along with the ACK.
+func (s *session) send(packet utils.LRTPIDSPacket, force bool) (utils.LRTPIDSPacket, utils.LRTPIDSPacket, error) {
+	s.sendMutex.Lock()
+	defer s.sendMutex.Unlock()
+
+	numbered := s.sequences.number(&packet)
+	ackPacket, err := s.exchange(packet, force)
+	if err != nil && numbered {
+		s.sequences.release(packet, err)
+	}
+	return packet, ackPacket, err
+}
+
+// exchange writes packet and waits for its ACK; s.sendMutex must be held.
+func (s *session) exchange(packet utils.LRTPIDSPacket, force bool) (utils.LRTPIDSPacket, error) {
+	data, err := utils.Encode(packet)
+	if err != nil {
+		sendErrorsTotal.Inc("encode")
+		return utils.LRTPIDSPacket{}, &refusedError{fmt.Errorf("failed to encode packet: %v", err)}
+	}
+
+	previous, err := s.writeEvent(packet, force, data)
+	if err != nil {
+		return utils.LRTPIDSPacket{}, err
+	}
+
+	timer := time.NewTimer(s.ackTimeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-s.replies:
+		if r.nack != nil {
+			sendErrorsTotal.Inc("nack")
+			s.restore(previous)
+			return utils.LRTPIDSPacket{}, &nackError{r.nack.Reason}
+		}
+		return r.ack, nil
+	case <-s.done:
+		sendErrorsTotal.Inc("read_ack")
+		return utils.LRTPIDSPacket{}, fmt.Errorf("failed to read ACK: %v", s.err)
+	case <-timer.C:
+		// A late ACK would be taken for the next event's, so the session
+		// cannot be used any more.
+		sendErrorsTotal.Inc("ack_timeout")
+		s.markLost()
+		s.stream.Close()
+		return utils.LRTPIDSPacket{}, fmt.Errorf("no ACK within %v, session closed", s.ackTimeout)
+	}
+}
+
+func (s *session) markLost() {
+	s.lostOnce.Do(func() { close(s.lost) })
+}
+
+// usable reports whether events can still be sent on the session.
+func (s *session) usable() bool {
+	select {
+	case <-s.lost:
+		return false
+	default:
+		return true
+	}
+}
+
+func (s *session) Close() error {
+	return s.stream.Close()
+}
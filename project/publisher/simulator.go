@@ -0,0 +1,384 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+// Station is a stop on a line. Run is the running time from the previous
+// station and Dwell how long trains stand at the platform, which at the
+// termini includes turning around.
+type Station struct {
+	Name  string
+	Run   time.Duration
+	Dwell time.Duration
+}
+
+// Line is a sequence of stations served back and forth between its termini.
+type Line struct {
+	Name     string
+	Stations []Station
+}
+
+// JabodebekLine is the Cibubur line of LRT Jabodebek from Dukuh Atas to
+// Harjamukti, with approximate running and dwell times.
+var JabodebekLine = Line{
+	Name: "Jabodebek Cibubur Line",
+	Stations: []Station{
+		{"Dukuh Atas BNI", 0, 5 * time.Minute},
+		{"Setiabudi", 2 * time.Minute, 30 * time.Second},
+		{"Rasuna Said", 2 * time.Minute, 30 * time.Second},
+		{"Kuningan", 2 * time.Minute, 30 * time.Second},
+		{"Pancoran Bank BJB", 2*time.Minute + 30*time.Second, 30 * time.Second},
+		{"Cikoko", 2 * time.Minute, 30 * time.Second},
+		{"Ciliwung", 2 * time.Minute, 30 * time.Second},
+		{"Cawang", 2 * time.Minute, 45 * time.Second},
+		{"Taman Mini", 3 * time.Minute, 30 * time.Second},
+		{"Kampung Rambutan", 2*time.Minute + 30*time.Second, 30 * time.Second},
+		{"Ciracas", 2 * time.Minute, 30 * time.Second},
+		{"Harjamukti", 3 * time.Minute, 5 * time.Minute},
+	},
+}
+
+// LoadLine reads a line from a JSON file like
+//
+//	{"name": "...", "stations": [{"name": "Dukuh Atas BNI", "run": "0s", "dwell": "5m"}, ...]}
+//
+// where run and dwell are durations or numbers of seconds.
+func LoadLine(path string) (Line, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Line{}, fmt.Errorf("failed to read line: %v", err)
+	}
+
+	var file struct {
+		Name     string `json:"name"`
+		Stations []struct {
+			Name  string `json:"name"`
+			Run   string `json:"run"`
+			Dwell string `json:"dwell"`
+		} `json:"stations"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return Line{}, fmt.Errorf("failed to parse line %s: %v", path, err)
+	}
+
+	line := Line{Name: file.Name}
+	for i, station := range file.Stations {
+		run, err := parseOffset(orZero(station.Run))
+		if err != nil {
+			return Line{}, fmt.Errorf("station %d: %v", i, err)
+		}
+		dwell, err := parseOffset(orZero(station.Dwell))
+		if err != nil {
+			return Line{}, fmt.Errorf("station %d: %v", i, err)
+		}
+		line.Stations = append(line.Stations, Station{Name: station.Name, Run: run, Dwell: dwell})
+	}
+
+	if len(line.Stations) < 2 {
+		return Line{}, fmt.Errorf("line %s needs at least two stations", path)
+	}
+	return line, nil
+}
+
+func orZero(value string) string {
+	if value == "" {
+		return "0"
+	}
+	return value
+}
+
+// Station returns the index of the station called name, ignoring case.
+func (l Line) Station(name string) (int, bool) {
+	for i, station := range l.Stations {
+		if strings.EqualFold(station.Name, name) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// roundTrip is the undelayed time a train takes to get back to where it
+// started.
+func (l Line) roundTrip() time.Duration {
+	var total time.Duration
+	for i, station := range l.Stations {
+		total += 2 * (station.Run + station.Dwell)
+		if i == 0 || i == len(l.Stations)-1 {
+			total -= station.Dwell
+		}
+	}
+	return total
+}
+
+type SimulationOptions struct {
+	// Trains run on the line, numbered from FirstTrain. Even trains start
+	// at the first station, odd ones at the last.
+	Trains     int
+	FirstTrain uint16
+	// Headway between the trains leaving a terminus, spreading them evenly
+	// over a round trip when zero.
+	Headway time.Duration
+	// Duration of service to simulate.
+	Duration time.Duration
+	// DelayProbability is the chance of every run and dwell to take up to
+	// MaxDelay longer. Delays carry over to the rest of the journey.
+	DelayProbability float64
+	MaxDelay         time.Duration
+	// Linger is how long a train stays on a display after it departed.
+	Linger time.Duration
+	Seed   int64
+}
+
+// visit is a train calling at a station.
+type visit struct {
+	station   int
+	announce  time.Duration
+	arrival   time.Duration
+	departure time.Duration
+	// arriveTo and departTo are the destinations shown before and after
+	// the train turns around at a terminus.
+	arriveTo string
+	departTo string
+}
+
+// Simulate moves the trains along line and returns the events each station
+// display sees, indexed like line.Stations. A train appears on a display
+// when it leaves the previous station, arrives, turns around at the
+// termini, departs and disappears Linger later.
+func Simulate(line Line, options SimulationOptions) []Scenario {
+	random := rand.New(rand.NewSource(options.Seed))
+	delay := func() time.Duration {
+		if options.MaxDelay <= 0 || random.Float64() >= options.DelayProbability {
+			return 0
+		}
+		return time.Duration(random.Int63n(int64(options.MaxDelay)))
+	}
+
+	headway := options.Headway
+	if headway <= 0 && options.Trains > 0 {
+		headway = line.roundTrip() / time.Duration(options.Trains)
+	}
+
+	last := len(line.Stations) - 1
+	terminus := func(direction int) string {
+		if direction > 0 {
+			return line.Stations[last].Name
+		}
+		return line.Stations[0].Name
+	}
+
+	scenarios := make([]Scenario, len(line.Stations))
+	for n := 0; n < options.Trains; n++ {
+		train := options.FirstTrain + uint16(n)
+		// Trains leave both termini alternately.
+		station, direction := 0, 1
+		if n%2 == 1 {
+			station, direction = last, -1
+		}
+		start := time.Duration(n/2) * 2 * headway
+		if n%2 == 1 {
+			start += headway
+		}
+
+		current := visit{station: station, announce: start, arrival: start, arriveTo: terminus(direction), departTo: terminus(direction)}
+		for current.arrival < options.Duration {
+			current.departure = current.arrival + line.Stations[current.station].Dwell + delay()
+			if current.announce == current.arrival {
+				// The train starts its service here and leaves after a dwell.
+				current.departure = current.arrival + line.Stations[current.station].Dwell
+			}
+			scenarios[current.station] = append(scenarios[current.station], current.events(train, options.Linger)...)
+
+			next := current.station + direction
+			run := line.Stations[current.station].Run
+			if direction > 0 {
+				run = line.Stations[next].Run
+			}
+
+			destination := terminus(direction)
+			if next == 0 || next == last {
+				direction = -direction
+			}
+			current = visit{
+				station:  next,
+				announce: current.departure,
+				arrival:  current.departure + run + delay(),
+				arriveTo: destination,
+				departTo: terminus(direction),
+			}
+		}
+	}
+
+	for _, scenario := range scenarios {
+		sort.SliceStable(scenario, func(i, j int) bool { return scenario[i].At < scenario[j].At })
+	}
+	return scenarios
+}
+
+func (v visit) events(train uint16, linger time.Duration) []ScenarioEvent {
+	packet := func(destination string, set func(*utils.LRTPIDSPacket)) utils.LRTPIDSPacket {
+		p := utils.LRTPIDSPacket{TrainNumber: train, Destination: destination}
+		set(&p)
+		return p
+	}
+
+	events := []ScenarioEvent{
+		{At: v.announce, Packet: packet(v.arriveTo, func(p *utils.LRTPIDSPacket) { p.IsNewTrain = 1 })},
+		{At: v.arrival, Packet: packet(v.arriveTo, func(p *utils.LRTPIDSPacket) { p.IsTrainArriving = 1 })},
+	}
+	if v.departTo != v.arriveTo {
+		turned := v.arrival + (v.departure-v.arrival)/2
+		events = append(events, ScenarioEvent{At: turned, Packet: packet(v.departTo, func(p *utils.LRTPIDSPacket) { p.IsUpdateTrain = 1 })})
+	}
+	return append(events,
+		ScenarioEvent{At: v.departure, Packet: packet(v.departTo, func(p *utils.LRTPIDSPacket) { p.IsTrainDeparting = 1 })},
+		ScenarioEvent{At: v.departure + linger, Packet: packet(v.departTo, func(p *utils.LRTPIDSPacket) { p.IsDeleteTrain = 1 })},
+	)
+}
+
+// subscriberFlag collects -subscriber STATION=ADDRESS flags.
+type subscriberFlag map[string]string
+
+func (f subscriberFlag) String() string { return "" }
+
+func (f subscriberFlag) Set(value string) error {
+	station, address, ok := strings.Cut(value, "=")
+	if !ok || station == "" || address == "" {
+		return errors.New("expected STATION=ADDRESS")
+	}
+	f[station] = address
+	return nil
+}
+
+func runSimulate(name string, args []string) int {
+	fs := newFlagSet(name)
+	connection := addConnectionFlags(fs)
+	subscribers := subscriberFlag{}
+	fs.Var(subscribers, "subscriber", "STATION=ADDRESS of the display of a station, may be repeated (default the first station at -addr)")
+	linePath := fs.String("line", "", "JSON file describing the line, the Jabodebek Cibubur line when empty")
+	trains := fs.Int("trains", 4, "number of trains on the line")
+	firstTrain := fs.Uint("first-train", 1, "number of the first train, the others follow on")
+	headway := fs.Duration("headway", 0, "time between trains leaving a terminus, spread evenly over a round trip when 0")
+	duration := fs.Duration("duration", time.Hour, "service time to simulate")
+	speed := fs.Float64("speed", 1, "simulation speed, 60 plays an hour in a minute and 0 sends every event without waiting")
+	delayProbability := fs.Float64("delay-probability", 0.2, "chance of every run and dwell to be delayed")
+	maxDelay := fs.Duration("max-delay", 2*time.Minute, "longest delay of a single run or dwell")
+	linger := fs.Duration("linger", 30*time.Second, "how long a departed train stays on the display")
+	seed := fs.Int64("seed", 0, "random seed, the current time when 0")
+	metricsAddress := fs.String("metrics", "", "HTTP address to expose /metrics on, empty to disable")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	if *trains < 1 || *firstTrain+uint(*trains)-1 > 0xFFFF || *speed < 0 {
+		fmt.Fprintf(os.Stderr, "%s: -trains must be positive, the train numbers must fit in 16 bits and -speed may not be negative\n", name)
+		return 2
+	}
+
+	logger, err := connection.setupLogger(os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	line := JabodebekLine
+	if *linePath != "" {
+		if line, err = LoadLine(*linePath); err != nil {
+			logger.Error("failed to load line", "error", err)
+			return 1
+		}
+	}
+
+	if len(subscribers) == 0 {
+		subscribers[line.Stations[0].Name] = *connection.address
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	scenarios := Simulate(line, SimulationOptions{
+		Trains:           *trains,
+		FirstTrain:       uint16(*firstTrain),
+		Headway:          *headway,
+		Duration:         *duration,
+		DelayProbability: *delayProbability,
+		MaxDelay:         *maxDelay,
+		Linger:           *linger,
+		Seed:             *seed,
+	})
+	logger.Info("line simulated", "line", line.Name, "stations", len(line.Stations), "trains", *trains, "duration", *duration, "seed", *seed)
+
+	if *metricsAddress != "" {
+		go serveMetrics(*metricsAddress)
+	}
+
+	type display struct {
+		station   int
+		publisher *PIDSPublisher
+	}
+	var displays []display
+	defer func() {
+		for _, d := range displays {
+			d.publisher.Close()
+		}
+	}()
+
+	for stationName, address := range subscribers {
+		station, ok := line.Station(stationName)
+		if !ok {
+			logger.Error("unknown station", "station", stationName, "line", line.Name)
+			return 2
+		}
+
+		// Each display is told which station it shows.
+		*connection.address = address
+		*connection.stationID = line.Stations[station].Name
+		publisher, err := connection.connect(false, NewTrainRegistry())
+		if err != nil {
+			logger.Error("failed to create publisher", "station", stationName, "address", address, "error", err)
+			return 1
+		}
+		displays = append(displays, display{station: station, publisher: publisher})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+	failed := false
+	var failedMutex sync.Mutex
+	for _, d := range displays {
+		wg.Add(1)
+		go func(d display) {
+			defer wg.Done()
+
+			stats, err := d.publisher.Replay(ctx, scenarios[d.station], *speed)
+			d.publisher.logger.Info("station simulated", "events", stats.Events, "acked", stats.Acked, "failed", stats.Failed)
+			if err != nil || stats.Failed > 0 {
+				failedMutex.Lock()
+				failed = true
+				failedMutex.Unlock()
+			}
+		}(d)
+	}
+	wg.Wait()
+
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/transport"
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+// testLine is a short line with round numbers: a round trip takes 13
+// minutes.
+var testLine = Line{
+	Name: "Test Line",
+	Stations: []Station{
+		{"Alpha", 0, time.Minute},
+		{"Bravo", 2 * time.Minute, 30 * time.Second},
+		{"Charlie", 3 * time.Minute, time.Minute},
+	},
+}
+
+func TestSimulateTimetable(t *testing.T) {
+	scenarios := Simulate(testLine, SimulationOptions{
+		Trains:     1,
+		FirstTrain: 42,
+		Duration:   10 * time.Minute,
+		Linger:     30 * time.Second,
+	})
+	if len(scenarios) != len(testLine.Stations) {
+		t.Fatalf("Simulate returned %d scenarios, want one per station", len(scenarios))
+	}
+
+	type event struct {
+		at          time.Duration
+		kind        string
+		destination string
+	}
+	kind := func(p utils.LRTPIDSPacket) string {
+		switch {
+		case p.IsNewTrain == 1:
+			return "new"
+		case p.IsTrainArriving == 1:
+			return "arriving"
+		case p.IsUpdateTrain == 1:
+			return "update"
+		case p.IsTrainDeparting == 1:
+			return "departing"
+		case p.IsDeleteTrain == 1:
+			return "delete"
+		}
+		return "none"
+	}
+	s := func(seconds int) time.Duration { return time.Duration(seconds) * time.Second }
+
+	// The train starts at Alpha, turns around at Charlie and is on its way
+	// back to Bravo when the service ends, before it gets there.
+	want := [][]event{
+		{{s(0), "new", "Charlie"}, {s(0), "arriving", "Charlie"}, {s(60), "departing", "Charlie"}, {s(90), "delete", "Charlie"}},
+		{{s(60), "new", "Charlie"}, {s(180), "arriving", "Charlie"}, {s(210), "departing", "Charlie"}, {s(240), "delete", "Charlie"}},
+		{{s(210), "new", "Charlie"}, {s(390), "arriving", "Charlie"}, {s(420), "update", "Alpha"}, {s(450), "departing", "Alpha"}, {s(480), "delete", "Alpha"}},
+	}
+	for station, scenario := range scenarios {
+		var got []event
+		for _, e := range scenario {
+			if e.Packet.TrainNumber != 42 {
+				t.Errorf("%s: event of train %d", testLine.Stations[station].Name, e.Packet.TrainNumber)
+			}
+			got = append(got, event{e.At, kind(e.Packet), e.Packet.Destination})
+		}
+		if len(got) != len(want[station]) {
+			t.Errorf("%s sees %v, want %v", testLine.Stations[station].Name, got, want[station])
+			continue
+		}
+		for i := range got {
+			if got[i] != want[station][i] {
+				t.Errorf("%s sees %v, want %v", testLine.Stations[station].Name, got, want[station])
+				break
+			}
+		}
+	}
+}
+
+func TestSimulateSpreadsTrainsOverRoundTrip(t *testing.T) {
+	if roundTrip := testLine.roundTrip(); roundTrip != 13*time.Minute {
+		t.Fatalf("roundTrip = %v, want 13m", roundTrip)
+	}
+
+	scenarios := Simulate(testLine, SimulationOptions{Trains: 2, FirstTrain: 1, Duration: 10 * time.Minute})
+
+	// The second train starts half a round trip later at the other
+	// terminus, heading back.
+	for _, event := range scenarios[len(scenarios)-1] {
+		if event.Packet.TrainNumber == 2 {
+			if event.At != 390*time.Second || event.Packet.IsNewTrain != 1 || event.Packet.Destination != "Alpha" {
+				t.Errorf("first event of train 2 = %+v, want it registered for Alpha at 6m30s", event)
+			}
+			return
+		}
+	}
+	t.Error("train 2 never reaches Charlie")
+}
+
+func TestSimulateDelays(t *testing.T) {
+	options := SimulationOptions{
+		Trains:           3,
+		FirstTrain:       1,
+		Duration:         time.Hour,
+		DelayProbability: 1,
+		MaxDelay:         time.Minute,
+		Seed:             7,
+	}
+	first := Simulate(testLine, options)
+	second := Simulate(testLine, options)
+	undelayed := Simulate(testLine, SimulationOptions{Trains: 3, FirstTrain: 1, Duration: time.Hour})
+
+	for station := range first {
+		if len(first[station]) != len(second[station]) {
+			t.Fatalf("%s: the same seed gave %d and %d events", testLine.Stations[station].Name, len(first[station]), len(second[station]))
+		}
+		for i := range first[station] {
+			if first[station][i] != second[station][i] {
+				t.Errorf("%s: the same seed gave %+v and %+v", testLine.Stations[station].Name, first[station][i], second[station][i])
+			}
+		}
+		if !sort.SliceIsSorted(first[station], func(i, j int) bool { return first[station][i].At < first[station][j].At }) {
+			t.Errorf("%s: events are not ordered by time", testLine.Stations[station].Name)
+		}
+		if len(first[station]) > len(undelayed[station]) {
+			t.Errorf("%s: delays made for more visits, %d events instead of %d", testLine.Stations[station].Name, len(first[station]), len(undelayed[station]))
+		}
+	}
+
+	// Trains leave their first terminus on time, delays start on the way.
+	if departure := first[0][2]; departure.Packet.IsTrainDeparting != 1 || departure.At != time.Minute {
+		t.Errorf("first departure = %+v, want at 1m", departure)
+	}
+}
+
+// fakeClock moves on by exactly what Replay waits for, recording every wait.
+type fakeClock struct {
+	mutex sync.Mutex
+	now   time.Time
+	waits []time.Duration
+	// hang keeps every wait from ending, counting how often one is stopped.
+	hang    bool
+	stopped int
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) (<-chan time.Time, func() bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.waits = append(c.waits, d)
+
+	fired := make(chan time.Time, 1)
+	if !c.hang {
+		c.now = c.now.Add(d)
+		fired <- c.now
+	}
+	return fired, func() bool {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.stopped++
+		return true
+	}
+}
+
+func newReplayPublisher(t *testing.T, clock replayClock) *PIDSPublisher {
+	t.Helper()
+	address, sessions := listenTestSubscriber(t)
+	publisher, err := NewPIDSPublisher(address, PublisherOptions{Transport: transport.KindUDP})
+	if err != nil {
+		t.Fatalf("NewPIDSPublisher: %v", err)
+	}
+	t.Cleanup(func() { publisher.Close() })
+	nextTestSession(t, sessions)
+	publisher.clock = clock
+	return publisher
+}
+
+func TestReplaySimulatedStation(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2023, 10, 2, 5, 30, 0, 0, time.UTC)}
+	publisher := newReplayPublisher(t, clock)
+
+	scenario := Simulate(testLine, SimulationOptions{Trains: 1, FirstTrain: 42, Duration: 10 * time.Minute, Linger: 30 * time.Second})[2]
+	stats, err := publisher.Replay(context.Background(), scenario, 60)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if stats.Events != len(scenario) || stats.Acked != len(scenario) || stats.Failed != 0 {
+		t.Errorf("Replay stats = %+v, want %d events acked", stats, len(scenario))
+	}
+
+	// At 60 times the speed every event is due a sixtieth of its time
+	// after the start.
+	var want []time.Duration
+	var previous time.Duration
+	for _, event := range scenario {
+		want = append(want, (event.At-previous)/60)
+		previous = event.At
+	}
+	if len(clock.waits) != len(want) {
+		t.Fatalf("Replay waited %v, want %v", clock.waits, want)
+	}
+	for i := range want {
+		if clock.waits[i] != want[i] {
+			t.Errorf("wait %d = %v, want %v", i, clock.waits[i], want[i])
+		}
+	}
+	if elapsed := clock.now.Sub(time.Date(2023, 10, 2, 5, 30, 0, 0, time.UTC)); elapsed != scenario.Duration()/60 {
+		t.Errorf("replay took %v, want %v", elapsed, scenario.Duration()/60)
+	}
+}
+
+func TestReplayWithoutWaiting(t *testing.T) {
+	clock := &fakeClock{}
+	publisher := newReplayPublisher(t, clock)
+
+	// The delete of train 7, which is not live, is skipped and the
+	// arrival of train 8 registers it first.
+	scenario := Scenario{
+		{At: time.Hour, Packet: utils.LRTPIDSPacket{IsDeleteTrain: 1, TrainNumber: 7}},
+		{At: 2 * time.Hour, Packet: utils.LRTPIDSPacket{IsTrainArriving: 1, TrainNumber: 8, Destination: "DKAT"}},
+	}
+	stats, err := publisher.Replay(context.Background(), scenario, 0)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if stats.Events != 2 || stats.Acked != 2 {
+		t.Errorf("Replay stats = %+v, want 2 events acked", stats)
+	}
+	if len(clock.waits) != 0 {
+		t.Errorf("Replay at speed 0 waited %v", clock.waits)
+	}
+}
+
+func TestReplayStopsWhenCancelled(t *testing.T) {
+	clock := &fakeClock{hang: true}
+	publisher := newReplayPublisher(t, clock)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	scenario := Scenario{{At: time.Minute, Packet: utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 7}}}
+	stats, err := publisher.Replay(ctx, scenario, 1)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Replay error = %v, want %v", err, context.Canceled)
+	}
+	if stats.Events != 0 {
+		t.Errorf("Replay sent %d events after being cancelled", stats.Events)
+	}
+	if clock.stopped != 1 {
+		t.Errorf("wait stopped %d times, want once", clock.stopped)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || dragonfly || freebsd || netbsd || openbsd)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// makeRaw is unsupported here, the console falls back to plain lines.
+func makeRaw(*os.File) (func() error, error) {
+	return nil, errors.New("raw terminal mode is not supported on this platform")
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	announcementHistorySize = 50
+	boardEventBufferSize    = 16
+)
+
+//go:embed board.html
+var boardPage []byte
+
+type Announcement struct {
+	Time        time.Time `json:"time"`
+	TrainNumber uint16    `json:"trainNumber"`
+	Destination string    `json:"destination"`
+	Message     string    `json:"message"`
+}
+
+type BoardEvent struct {
+	Type         string         `json:"type"`
+	Train        *TrainInfo     `json:"train,omitempty"`
+	Position     *TrainPosition `json:"position,omitempty"`
+	Announcement *Announcement  `json:"announcement,omitempty"`
+}
+
+// StatusBoard keeps the recent announcements and fans out registry changes
+// to every connected Server-Sent Events client.
+type StatusBoard struct {
+	registry *TrainRegistry
+	logger   *slog.Logger
+
+	mutex         sync.Mutex
+	announcements []Announcement
+	clients       map[chan BoardEvent]struct{}
+}
+
+func NewStatusBoard(registry *TrainRegistry, logger *slog.Logger) *StatusBoard {
+	return &StatusBoard{
+		registry: registry,
+		logger:   logger,
+		clients:  make(map[chan BoardEvent]struct{}),
+	}
+}
+
+func (b *StatusBoard) TrainChanged(train TrainInfo, deleted bool) {
+	eventType := "train"
+	if deleted {
+		eventType = "delete"
+	}
+
+	b.broadcast(BoardEvent{Type: eventType, Train: &train})
+}
+
+func (b *StatusBoard) PositionChanged(position TrainPosition) {
+	b.broadcast(BoardEvent{Type: "position", Position: &position})
+}
+
+func (b *StatusBoard) Announce(announcement Announcement) {
+	b.mutex.Lock()
+	b.announcements = append(b.announcements, announcement)
+	if len(b.announcements) > announcementHistorySize {
+		b.announcements = b.announcements[len(b.announcements)-announcementHistorySize:]
+	}
+	b.mutex.Unlock()
+
+	b.broadcast(BoardEvent{Type: "announcement", Announcement: &announcement})
+}
+
+func (b *StatusBoard) Announcements() []Announcement {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	announcements := make([]Announcement, len(b.announcements))
+	copy(announcements, b.announcements)
+	return announcements
+}
+
+func (b *StatusBoard) subscribe() chan BoardEvent {
+	events := make(chan BoardEvent, boardEventBufferSize)
+
+	b.mutex.Lock()
+	b.clients[events] = struct{}{}
+	b.mutex.Unlock()
+
+	return events
+}
+
+// unsubscribe removes a client that went away. broadcast may have removed
+// it already.
+func (b *StatusBoard) unsubscribe(events chan BoardEvent) {
+	b.mutex.Lock()
+	delete(b.clients, events)
+	b.mutex.Unlock()
+}
+
+func (b *StatusBoard) broadcast(event BoardEvent) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for events := range b.clients {
+		select {
+		case events <- event:
+		default:
+			// A slow client must not stall packet processing. It has
+			// missed this event, so its stream is ended: the page
+			// reconnects and reloads from the JSON endpoints.
+			delete(b.clients, events)
+			close(events)
+			b.logger.Warn("disconnected board client that fell behind", "buffered", boardEventBufferSize)
+		}
+	}
+}
+
+func (b *StatusBoard) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", b.handlePage)
+	mux.HandleFunc("/api/trains", b.handleTrains)
+	mux.HandleFunc("/api/positions", b.handlePositions)
+	mux.HandleFunc("/api/announcements", b.handleAnnouncements)
+	mux.HandleFunc("/events", b.handleEvents)
+	return mux
+}
+
+func (b *StatusBoard) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(boardPage)
+}
+
+func (b *StatusBoard) handleTrains(w http.ResponseWriter, r *http.Request) {
+	b.writeJSON(w, b.registry.Trains())
+}
+
+func (b *StatusBoard) handlePositions(w http.ResponseWriter, r *http.Request) {
+	b.writeJSON(w, b.registry.Positions())
+}
+
+func (b *StatusBoard) handleAnnouncements(w http.ResponseWriter, r *http.Request) {
+	b.writeJSON(w, b.Announcements())
+}
+
+func (b *StatusBoard) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	events := b.subscribe()
+	defer b.unsubscribe(events)
+
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				b.logger.Error("failed to encode board event", "error", err)
+				continue
+			}
+
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
+
+func (b *StatusBoard) writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		b.logger.Warn("failed to write JSON response", "error", err)
+	}
+}
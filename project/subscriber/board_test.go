@@ -0,0 +1,45 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestBroadcastDropsClientThatFellBehind(t *testing.T) {
+	board := NewStatusBoard(NewTrainRegistry(false), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	slow := board.subscribe()
+	fast := board.subscribe()
+	defer board.unsubscribe(fast)
+
+	for i := 0; i <= boardEventBufferSize; i++ {
+		board.TrainChanged(TrainInfo{TrainNumber: uint16(i)}, false)
+		// The fast client keeps up.
+		<-fast
+	}
+
+	for i := 0; i < boardEventBufferSize; i++ {
+		event, ok := <-slow
+		if !ok || event.Train.TrainNumber != uint16(i) {
+			t.Fatalf("buffered event %d = %+v, %v", i, event, ok)
+		}
+	}
+	if event, ok := <-slow; ok {
+		t.Fatalf("slow client received %+v after overflowing, want its stream closed", event)
+	}
+
+	board.mutex.Lock()
+	_, subscribed := board.clients[slow]
+	clients := len(board.clients)
+	board.mutex.Unlock()
+	if subscribed || clients != 1 {
+		t.Errorf("slow client subscribed = %v with %d clients, want only the fast one", subscribed, clients)
+	}
+
+	// The handler unsubscribes on its way out, after broadcast did.
+	board.unsubscribe(slow)
+	board.TrainChanged(TrainInfo{TrainNumber: 99}, false)
+	if event := <-fast; event.Train.TrainNumber != 99 {
+		t.Errorf("fast client received %+v, want train 99", event)
+	}
+}
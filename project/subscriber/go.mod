@@ -4,12 +4,17 @@ go 1.21
 
 require (
 	github.com/quic-go/quic-go v0.40.0
+	jarkom.cs.ui.ac.id/h01/project/transport v0.0.0
 	jarkom.cs.ui.ac.id/h01/project/utils v0.0.0
 )
 
-replace jarkom.cs.ui.ac.id/h01/project/utils => ../utils
+replace (
+	jarkom.cs.ui.ac.id/h01/project/transport => ../transport
+	jarkom.cs.ui.ac.id/h01/project/utils => ../utils
+)
 
 require (
+	github.com/francoispqt/gojay v1.2.13 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
 	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
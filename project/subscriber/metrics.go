@@ -0,0 +1,67 @@
+package main
+
+import (
+	"jarkom.cs.ui.ac.id/h01/project/utils/metrics"
+)
+
+var (
+	metricsRegistry = metrics.NewRegistry()
+
+	connectionsTotal = metricsRegistry.NewCounter(
+		"pids_subscriber_connections_total",
+		"QUIC connections accepted from publishers.")
+	connectionsActive = metricsRegistry.NewGauge(
+		"pids_subscriber_connections_active",
+		"QUIC connections currently open.")
+	streamsTotal = metricsRegistry.NewCounter(
+		"pids_subscriber_streams_total",
+		"Streams accepted across all connections.")
+	streamsActive = metricsRegistry.NewGauge(
+		"pids_subscriber_streams_active",
+		"Streams currently being read.")
+	sessionsTotal = metricsRegistry.NewCounter(
+		"pids_subscriber_sessions_total",
+		"Control stream sessions started by publishers.")
+	sessionsActive = metricsRegistry.NewGauge(
+		"pids_subscriber_sessions_active",
+		"Control stream sessions currently open.")
+	syncsTotal = metricsRegistry.NewCounter(
+		"pids_subscriber_syncs_total",
+		"Sync responses applied to the train registry.")
+	trainsGauge = metricsRegistry.NewGauge(
+		"pids_subscriber_trains",
+		"Trains on the board, by lifecycle state.",
+		"state")
+	invalidTransitionsTotal = metricsRegistry.NewCounter(
+		"pids_subscriber_invalid_transitions_total",
+		"Events that did not fit the train lifecycle, by event type.",
+		"event")
+	decodeFailuresTotal = metricsRegistry.NewCounter(
+		"pids_subscriber_decode_failures_total",
+		"Payloads that could not be decoded as LRTPIDSPacket or LRTPIDSPosition.")
+	packetsProcessedTotal = metricsRegistry.NewCounter(
+		"pids_subscriber_packets_processed_total",
+		"Packets handled by processPacket, by event type.",
+		"event")
+	sequencedPacketsTotal = metricsRegistry.NewCounter(
+		"pids_subscriber_sequenced_packets_total",
+		"Sequenced packets by how they were ordered: in_order, reordered, gap_skipped or late.",
+		"result")
+	processingSeconds = metricsRegistry.NewHistogram(
+		"pids_subscriber_processing_seconds",
+		"Time from decoding a packet until its ACK is written.",
+		metrics.DefaultLatencyBuckets)
+	positionsReceivedTotal = metricsRegistry.NewCounter(
+		"pids_subscriber_positions_received_total",
+		"Position datagrams received, by whether they were applied, stale or for an unknown train.",
+		"result")
+	ackFailuresTotal = metricsRegistry.NewCounter(
+		"pids_subscriber_ack_failures_total",
+		"ACKs that could not be encoded or written.")
+	storeWriteFailuresTotal = metricsRegistry.NewCounter(
+		"pids_subscriber_store_write_failures_total",
+		"Train state changes or flushes the journal failed to take.")
+	storeDegraded = metricsRegistry.NewGauge(
+		"pids_subscriber_store_degraded",
+		"1 while train state changes are not persisted after a journal write failed.")
+)
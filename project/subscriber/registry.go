@@ -0,0 +1,244 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+	"jarkom.cs.ui.ac.id/h01/project/utils/lifecycle"
+)
+
+const (
+	TrainStatusScheduled = string(lifecycle.Scheduled)
+	TrainStatusArriving  = string(lifecycle.Arriving)
+	TrainStatusDeparting = string(lifecycle.Departing)
+)
+
+// What ApplyPosition did with a position, also used as metric label.
+const (
+	positionApplied = "applied"
+	positionStale   = "stale"
+	positionUnknown = "unknown_train"
+)
+
+type TrainInfo struct {
+	TrainNumber uint16    `json:"trainNumber"`
+	Destination string    `json:"destination"`
+	Status      string    `json:"status"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+type TrainPosition struct {
+	TrainNumber uint16    `json:"trainNumber"`
+	Latitude    float32   `json:"latitude"`
+	Longitude   float32   `json:"longitude"`
+	Speed       uint16    `json:"speed"`
+	MeasuredAt  time.Time `json:"measuredAt"`
+}
+
+// TrainRegistry is the subscriber's view of the trains. Events are checked
+// against the train lifecycle; with strict set, events that do not fit are
+// refused, otherwise they are applied anyway as older publishers expect.
+type TrainRegistry struct {
+	mutex     sync.RWMutex
+	strict    bool
+	machine   *lifecycle.Machine
+	trains    map[uint16]TrainInfo
+	positions map[uint16]TrainPosition
+}
+
+func NewTrainRegistry(strict bool) *TrainRegistry {
+	r := &TrainRegistry{
+		strict:    strict,
+		machine:   lifecycle.NewMachine(),
+		trains:    make(map[uint16]TrainInfo),
+		positions: make(map[uint16]TrainPosition),
+	}
+
+	for _, state := range lifecycle.States {
+		if state == lifecycle.Absent {
+			continue
+		}
+		label := string(state)
+		r.machine.OnEnter(state, func(lifecycle.Transition) { trainsGauge.Inc(label) })
+		r.machine.OnLeave(state, func(lifecycle.Transition) { trainsGauge.Dec(label) })
+	}
+	return r
+}
+
+// Apply updates the registry with the event carried by packet and returns the
+// resulting train entry. deleted is true when the packet removed the train.
+// err reports an event that does not fit the lifecycle; in strict mode the
+// registry is then left unchanged and train is the current entry.
+func (r *TrainRegistry) Apply(packet utils.LRTPIDSPacket) (train TrainInfo, deleted bool, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, err = r.machine.Check(packet); err != nil && r.strict {
+		return r.trains[packet.TrainNumber], false, err
+	}
+
+	train, deleted = r.applyLocked(packet)
+	return train, deleted, err
+}
+
+func (r *TrainRegistry) applyLocked(packet utils.LRTPIDSPacket) (train TrainInfo, deleted bool) {
+	train, exists := r.trains[packet.TrainNumber]
+	if !exists {
+		train = TrainInfo{
+			TrainNumber: packet.TrainNumber,
+			Status:      TrainStatusScheduled,
+		}
+	}
+
+	if packet.Destination != "" && (packet.IsNewTrain == 1 || packet.IsUpdateTrain == 1 || !exists) {
+		train.Destination = packet.Destination
+	}
+
+	if packet.IsTrainArriving == 1 {
+		train.Status = TrainStatusArriving
+	}
+
+	if packet.IsTrainDeparting == 1 {
+		train.Status = TrainStatusDeparting
+	}
+
+	train.UpdatedAt = time.Now()
+
+	if packet.IsDeleteTrain == 1 {
+		delete(r.trains, packet.TrainNumber)
+		delete(r.positions, packet.TrainNumber)
+		r.machine.Set(packet.TrainNumber, lifecycle.Absent)
+		return train, true
+	}
+
+	r.trains[packet.TrainNumber] = train
+	r.machine.Set(packet.TrainNumber, lifecycle.State(train.Status))
+	return train, false
+}
+
+// Restore replaces the registry contents, e.g. with persisted state.
+func (r *TrainRegistry) Restore(trains []TrainInfo, positions []TrainPosition) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for trainNumber := range r.trains {
+		r.machine.Set(trainNumber, lifecycle.Absent)
+	}
+
+	r.trains = make(map[uint16]TrainInfo, len(trains))
+	for _, train := range trains {
+		r.trains[train.TrainNumber] = train
+		r.machine.Set(train.TrainNumber, lifecycle.State(train.Status))
+	}
+
+	r.positions = make(map[uint16]TrainPosition, len(positions))
+	for _, position := range positions {
+		r.positions[position.TrainNumber] = position
+	}
+}
+
+func (r *TrainRegistry) Put(train TrainInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.trains[train.TrainNumber] = train
+	r.machine.Set(train.TrainNumber, lifecycle.State(train.Status))
+}
+
+func (r *TrainRegistry) Remove(trainNumber uint16) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	delete(r.trains, trainNumber)
+	delete(r.positions, trainNumber)
+	r.machine.Set(trainNumber, lifecycle.Absent)
+}
+
+func (r *TrainRegistry) PutPosition(position TrainPosition) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.positions[position.TrainNumber] = position
+}
+
+func (r *TrainRegistry) Trains() []TrainInfo {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	trains := make([]TrainInfo, 0, len(r.trains))
+	for _, train := range r.trains {
+		trains = append(trains, train)
+	}
+
+	sort.Slice(trains, func(i, j int) bool {
+		return trains[i].TrainNumber < trains[j].TrainNumber
+	})
+
+	return trains
+}
+
+// Resync merges the trains described by packets, as sent in a sync
+// response, into the registry and returns the resulting trains. Trains
+// missing from packets are kept: other publishers may be announcing them,
+// and one publisher's view is no reason to clear the board.
+func (r *TrainRegistry) Resync(packets []utils.LRTPIDSPacket) (trains []TrainInfo, removed []TrainInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, packet := range packets {
+		train, deleted := r.applyLocked(packet)
+		if deleted {
+			removed = append(removed, train)
+		} else {
+			trains = append(trains, train)
+		}
+	}
+
+	return trains, removed
+}
+
+// ApplyPosition stores position unless a newer one for the same train is
+// already known, since datagrams may arrive out of order, and reports which
+// it did. Positions of trains the registry does not know are ignored: they
+// may trail the delete of their train and would outlive it.
+func (r *TrainRegistry) ApplyPosition(position utils.LRTPIDSPosition) (train TrainPosition, result string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.trains[position.TrainNumber]; !exists {
+		return TrainPosition{}, positionUnknown
+	}
+
+	measuredAt := time.UnixMilli(position.Timestamp)
+	if current, exists := r.positions[position.TrainNumber]; exists && !measuredAt.After(current.MeasuredAt) {
+		return current, positionStale
+	}
+
+	train = TrainPosition{
+		TrainNumber: position.TrainNumber,
+		Latitude:    position.Latitude,
+		Longitude:   position.Longitude,
+		Speed:       position.Speed,
+		MeasuredAt:  measuredAt,
+	}
+	r.positions[position.TrainNumber] = train
+	return train, positionApplied
+}
+
+func (r *TrainRegistry) Positions() []TrainPosition {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	positions := make([]TrainPosition, 0, len(r.positions))
+	for _, position := range r.positions {
+		positions = append(positions, position)
+	}
+
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i].TrainNumber < positions[j].TrainNumber
+	})
+
+	return positions
+}
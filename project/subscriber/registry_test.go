@@ -0,0 +1,87 @@
+package main
+
+import (
+	"testing"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+func TestResyncMergesWithoutRemoving(t *testing.T) {
+	registry := NewTrainRegistry(false)
+	registry.Apply(utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 1, Destination: "Harjamukti"})
+	registry.Apply(utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 2, Destination: "Jati Mulya"})
+
+	trains, removed := registry.Resync([]utils.LRTPIDSPacket{
+		{IsNewTrain: 1, TrainNumber: 2, Destination: "Dukuh Atas"},
+		{IsNewTrain: 1, TrainNumber: 3, Destination: "Harjamukti"},
+	})
+	if len(trains) != 2 || len(removed) != 0 {
+		t.Fatalf("Resync returned %d trains and %d removed, want 2 and 0", len(trains), len(removed))
+	}
+
+	got := registry.Trains()
+	want := []struct {
+		number      uint16
+		destination string
+	}{{1, "Harjamukti"}, {2, "Dukuh Atas"}, {3, "Harjamukti"}}
+	if len(got) != len(want) {
+		t.Fatalf("registry has %d trains, want %d", len(got), len(want))
+	}
+	for i, train := range got {
+		if train.TrainNumber != want[i].number || train.Destination != want[i].destination {
+			t.Errorf("train %d = %d to %q, want %d to %q", i, train.TrainNumber, train.Destination, want[i].number, want[i].destination)
+		}
+	}
+}
+
+func TestResyncEmptyKeepsTrains(t *testing.T) {
+	registry := NewTrainRegistry(false)
+	registry.Apply(utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 1, Destination: "Harjamukti"})
+
+	registry.Resync(nil)
+	if trains := registry.Trains(); len(trains) != 1 {
+		t.Fatalf("registry has %d trains after an empty sync, want 1", len(trains))
+	}
+}
+
+func TestApplyPosition(t *testing.T) {
+	registry := NewTrainRegistry(false)
+	registry.Apply(utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 1, Destination: "Harjamukti"})
+
+	tests := []struct {
+		name     string
+		position utils.LRTPIDSPosition
+		want     string
+	}{
+		{"first", utils.LRTPIDSPosition{TrainNumber: 1, Timestamp: 2000}, positionApplied},
+		{"newer", utils.LRTPIDSPosition{TrainNumber: 1, Timestamp: 3000}, positionApplied},
+		{"older", utils.LRTPIDSPosition{TrainNumber: 1, Timestamp: 1000}, positionStale},
+		{"same time", utils.LRTPIDSPosition{TrainNumber: 1, Timestamp: 3000}, positionStale},
+		{"unknown train", utils.LRTPIDSPosition{TrainNumber: 2, Timestamp: 4000}, positionUnknown},
+	}
+	for _, test := range tests {
+		if _, result := registry.ApplyPosition(test.position); result != test.want {
+			t.Errorf("%s: ApplyPosition = %s, want %s", test.name, result, test.want)
+		}
+	}
+
+	positions := registry.Positions()
+	if len(positions) != 1 || positions[0].TrainNumber != 1 || positions[0].MeasuredAt.UnixMilli() != 3000 {
+		t.Errorf("Positions = %+v, want train 1 at 3000", positions)
+	}
+}
+
+func TestApplyPositionAfterDelete(t *testing.T) {
+	registry := NewTrainRegistry(false)
+	registry.Apply(utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 1, Destination: "Harjamukti"})
+	registry.ApplyPosition(utils.LRTPIDSPosition{TrainNumber: 1, Timestamp: 1000})
+	registry.Apply(utils.LRTPIDSPacket{IsDeleteTrain: 1, TrainNumber: 1})
+
+	// A datagram sent before the delete arrives after it.
+	if _, result := registry.ApplyPosition(utils.LRTPIDSPosition{TrainNumber: 1, Timestamp: 2000}); result != positionUnknown {
+		t.Errorf("ApplyPosition after delete = %s, want %s", result, positionUnknown)
+	}
+	if positions := registry.Positions(); len(positions) != 0 {
+		t.Errorf("Positions = %+v, want none after the delete", positions)
+	}
+}
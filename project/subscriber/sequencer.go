@@ -0,0 +1,146 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	sequenceInOrder    = "in_order"
+	sequenceReordered  = "reordered"
+	sequenceGapSkipped = "gap_skipped"
+	sequenceLate       = "late"
+)
+
+// trainSequencer is the reorder buffer of one publisher connection. Every
+// legacy stream goroutine holding a sequenced packet waits in acquire until
+// the previous event of the same train has been applied, so events for one
+// train take effect in publish order while other trains carry on in
+// parallel. A missing event is given up on after gapTimeout. Sessions are
+// ordered already and go through admit, which does not wait for gaps.
+type trainSequencer struct {
+	gapTimeout time.Duration
+
+	mutex      sync.Mutex
+	next       map[uint16]uint16
+	processing map[uint16]bool
+	// changed is closed and replaced whenever a train advances, waking
+	// every waiter to check whether it is its turn.
+	changed chan struct{}
+}
+
+func newTrainSequencer(gapTimeout time.Duration) *trainSequencer {
+	return &trainSequencer{
+		gapTimeout: gapTimeout,
+		next:       make(map[uint16]uint16),
+		processing: make(map[uint16]bool),
+		changed:    make(chan struct{}),
+	}
+}
+
+// sequenceBefore compares sequence numbers in serial number arithmetic so
+// the per-train counters may wrap around.
+func sequenceBefore(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// acquire blocks until the event numbered sequence may be applied for train
+// and reports how it got there. Unless the result is sequenceLate the caller
+// must call release once the event has been applied.
+func (q *trainSequencer) acquire(train, sequence uint16) string {
+	deadline := time.NewTimer(q.gapTimeout)
+	defer deadline.Stop()
+
+	result := sequenceInOrder
+	for {
+		q.mutex.Lock()
+		next, exists := q.next[train]
+		if !exists {
+			next = 1
+		}
+
+		if sequenceBefore(sequence, next) {
+			q.mutex.Unlock()
+			return sequenceLate
+		}
+		if sequence == next && !q.processing[train] {
+			q.processing[train] = true
+			q.next[train] = sequence
+			q.mutex.Unlock()
+			return result
+		}
+		changed := q.changed
+		q.mutex.Unlock()
+
+		select {
+		case <-changed:
+			if result == sequenceInOrder {
+				result = sequenceReordered
+			}
+		case <-deadline.C:
+			// Skip whatever is missing in front of us. If an earlier
+			// event is still being applied, wait for it to finish.
+			q.mutex.Lock()
+			if next, exists := q.next[train]; !exists || sequenceBefore(next, sequence) {
+				q.next[train] = sequence
+				q.advanced()
+			}
+			q.mutex.Unlock()
+			result = sequenceGapSkipped
+		}
+	}
+}
+
+// admit is acquire for a stream that delivers events in publish order, such
+// as a session. An event missing in front of sequence can no longer arrive
+// ahead of it, so admit skips the gap at once rather than stalling the
+// stream. It only waits while another stream is applying an event of train.
+func (q *trainSequencer) admit(train, sequence uint16) string {
+	for {
+		q.mutex.Lock()
+		next, exists := q.next[train]
+		if !exists {
+			next = 1
+		}
+
+		if sequenceBefore(sequence, next) {
+			q.mutex.Unlock()
+			return sequenceLate
+		}
+		if !q.processing[train] {
+			q.processing[train] = true
+			q.next[train] = sequence
+			q.mutex.Unlock()
+			if sequence != next {
+				return sequenceGapSkipped
+			}
+			return sequenceInOrder
+		}
+		changed := q.changed
+		q.mutex.Unlock()
+
+		<-changed
+	}
+}
+
+func (q *trainSequencer) release(train, sequence uint16) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	// A waiter that timed out may already have moved the train past us.
+	if q.next[train] == sequence {
+		next := sequence + 1
+		if next == 0 {
+			next = 1
+		}
+		q.next[train] = next
+	}
+	q.processing[train] = false
+	q.advanced()
+}
+
+// advanced wakes the waiters; q.mutex must be held.
+func (q *trainSequencer) advanced() {
+	close(q.changed)
+	q.changed = make(chan struct{})
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSequenceBefore(t *testing.T) {
+	tests := []struct {
+		a, b uint16
+		want bool
+	}{
+		{1, 2, true},
+		{2, 1, false},
+		{5, 5, false},
+		{0xFFFF, 1, true},
+		{1, 0xFFFF, false},
+		{0xFFF0, 0x0010, true},
+		{0x0010, 0xFFF0, false},
+	}
+	for _, test := range tests {
+		if got := sequenceBefore(test.a, test.b); got != test.want {
+			t.Errorf("sequenceBefore(%#x, %#x) = %v, want %v", test.a, test.b, got, test.want)
+		}
+	}
+}
+
+// acquireAsync runs acquire in the background and returns its result.
+func acquireAsync(q *trainSequencer, train, sequence uint16) <-chan string {
+	result := make(chan string, 1)
+	go func() { result <- q.acquire(train, sequence) }()
+	return result
+}
+
+func expectResult(t *testing.T, results <-chan string, want string) {
+	t.Helper()
+	select {
+	case got := <-results:
+		if got != want {
+			t.Errorf("acquire = %s, want %s", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("acquire did not return, want %s", want)
+	}
+}
+
+func expectBlocked(t *testing.T, results <-chan string) {
+	t.Helper()
+	select {
+	case got := <-results:
+		t.Fatalf("acquire returned %s, want it to wait", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestSequencerInOrder(t *testing.T) {
+	q := newTrainSequencer(time.Second)
+	for sequence := uint16(1); sequence <= 3; sequence++ {
+		if result := q.acquire(7, sequence); result != sequenceInOrder {
+			t.Fatalf("acquire(%d) = %s, want %s", sequence, result, sequenceInOrder)
+		}
+		q.release(7, sequence)
+	}
+
+	if result := q.acquire(7, 2); result != sequenceLate {
+		t.Errorf("acquire of an applied sequence = %s, want %s", result, sequenceLate)
+	}
+}
+
+func TestSequencerReorders(t *testing.T) {
+	q := newTrainSequencer(time.Second)
+
+	second := acquireAsync(q, 7, 2)
+	expectBlocked(t, second)
+
+	if result := q.acquire(7, 1); result != sequenceInOrder {
+		t.Fatalf("acquire(1) = %s, want %s", result, sequenceInOrder)
+	}
+	expectBlocked(t, second)
+	q.release(7, 1)
+
+	expectResult(t, second, sequenceReordered)
+	q.release(7, 2)
+}
+
+func TestSequencerTrainsIndependent(t *testing.T) {
+	q := newTrainSequencer(time.Second)
+
+	if result := q.acquire(7, 1); result != sequenceInOrder {
+		t.Fatalf("acquire train 7 = %s", result)
+	}
+	// Train 7 is still being applied, train 8 must not wait for it.
+	expectResult(t, acquireAsync(q, 8, 1), sequenceInOrder)
+	q.release(8, 1)
+	q.release(7, 1)
+}
+
+func TestSequencerGapTimeout(t *testing.T) {
+	q := newTrainSequencer(30 * time.Millisecond)
+
+	start := time.Now()
+	if result := q.acquire(7, 3); result != sequenceGapSkipped {
+		t.Fatalf("acquire(3) = %s, want %s", result, sequenceGapSkipped)
+	}
+	if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+		t.Errorf("gap given up on after %v, before the timeout", elapsed)
+	}
+	q.release(7, 3)
+
+	// The skipped events are late once they turn up.
+	if result := q.acquire(7, 2); result != sequenceLate {
+		t.Errorf("acquire(2) after the gap = %s, want %s", result, sequenceLate)
+	}
+	if result := q.acquire(7, 4); result != sequenceInOrder {
+		t.Errorf("acquire(4) = %s, want %s", result, sequenceInOrder)
+	}
+	q.release(7, 4)
+}
+
+func TestSequencerGapWaitsForEventInProgress(t *testing.T) {
+	q := newTrainSequencer(20 * time.Millisecond)
+
+	if result := q.acquire(7, 1); result != sequenceInOrder {
+		t.Fatalf("acquire(1) = %s", result)
+	}
+	third := acquireAsync(q, 7, 3)
+	// The gap timeout passes, but event 1 is still being applied.
+	expectBlocked(t, third)
+	expectBlocked(t, third)
+
+	q.release(7, 1)
+	expectResult(t, third, sequenceGapSkipped)
+	q.release(7, 3)
+}
+
+func TestSequencerWrapsAround(t *testing.T) {
+	q := newTrainSequencer(time.Second)
+	q.next[7] = 0xFFFF
+
+	if result := q.acquire(7, 0xFFFF); result != sequenceInOrder {
+		t.Fatalf("acquire(0xFFFF) = %s, want %s", result, sequenceInOrder)
+	}
+	q.release(7, 0xFFFF)
+
+	// 0 means unsequenced, so the counter goes on at 1.
+	if next := q.next[7]; next != 1 {
+		t.Fatalf("next after 0xFFFF = %d, want 1", next)
+	}
+	if result := q.acquire(7, 1); result != sequenceInOrder {
+		t.Fatalf("acquire(1) after wrapping = %s, want %s", result, sequenceInOrder)
+	}
+	q.release(7, 1)
+
+	if result := q.acquire(7, 0xFFFE); result != sequenceLate {
+		t.Errorf("acquire(0xFFFE) after wrapping = %s, want %s", result, sequenceLate)
+	}
+}
+
+func TestSequencerAdmitSkipsGapsAtOnce(t *testing.T) {
+	// A gap timeout long enough to fail the test if admit waited for it.
+	q := newTrainSequencer(time.Hour)
+
+	if result := q.admit(7, 1); result != sequenceInOrder {
+		t.Fatalf("admit(1) = %s, want %s", result, sequenceInOrder)
+	}
+	q.release(7, 1)
+
+	if result := q.admit(7, 4); result != sequenceGapSkipped {
+		t.Fatalf("admit(4) = %s, want %s", result, sequenceGapSkipped)
+	}
+	q.release(7, 4)
+
+	if result := q.admit(7, 3); result != sequenceLate {
+		t.Errorf("admit(3) after the gap = %s, want %s", result, sequenceLate)
+	}
+	if result := q.admit(7, 5); result != sequenceInOrder {
+		t.Errorf("admit(5) = %s, want %s", result, sequenceInOrder)
+	}
+	q.release(7, 5)
+}
+
+func TestSequencerAdmitWaitsForEventInProgress(t *testing.T) {
+	q := newTrainSequencer(time.Hour)
+
+	if result := q.acquire(7, 1); result != sequenceInOrder {
+		t.Fatalf("acquire(1) = %s", result)
+	}
+	results := make(chan string, 1)
+	go func() { results <- q.admit(7, 2) }()
+	expectBlocked(t, results)
+
+	q.release(7, 1)
+	expectResult(t, results, sequenceInOrder)
+	q.release(7, 2)
+}
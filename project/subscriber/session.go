@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/transport"
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+	"jarkom.cs.ui.ac.id/h01/project/utils/pidslog"
+)
+
+// hello describes what this subscriber accepts on conn.
+func (s *PIDSSubscriber) hello(conn transport.Conn) utils.Hello {
+	hello := utils.Hello{
+		Version:      utils.SessionVersion,
+		MessageTypes: []uint8{utils.MessageEvent, utils.MessageAck, utils.MessageSyncRequest},
+		StationID:    s.stationID,
+	}
+	if _, ok := transport.Datagrams(conn); ok {
+		hello.MessageTypes = append(hello.MessageTypes, utils.MessagePosition)
+	}
+	return hello
+}
+
+// handleSession serves a control stream whose magic has already been
+// consumed from reader: the hello exchange, then events until the publisher
+// closes the stream.
+func (s *PIDSSubscriber) handleSession(stream transport.Stream, reader io.Reader, hello utils.Hello, sequencer *trainSequencer, logger *slog.Logger) {
+	peer, err := utils.ReadHello(reader)
+	if err != nil {
+		logger.Warn("failed to start session", "error", err)
+		return
+	}
+
+	logger = logger.With("station", peer.StationID)
+	if peer.Version != utils.SessionVersion {
+		logger.Warn("unsupported session version", "version", peer.Version)
+		return
+	}
+
+	if err := utils.WriteHello(stream, hello); err != nil {
+		logger.Warn("failed to send hello", "error", err)
+		return
+	}
+
+	sessionsTotal.Inc()
+	sessionsActive.Inc()
+	defer sessionsActive.Dec()
+	logger.Info("session started", "version", peer.Version)
+
+	// Whatever happened while we were restarting or cut off, a publisher
+	// that keeps its trains across connections knows their current state.
+	if peer.Supports(utils.MessageSyncResponse) {
+		if err := utils.WriteMessage(stream, utils.MessageSyncRequest, nil); err != nil {
+			logger.Warn("failed to request sync", "error", err)
+		}
+	}
+
+	acks := ackWriter{stream, peer.Supports(utils.MessageNack)}
+	for {
+		messageType, payload, err := utils.ReadMessage(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				logger.Warn("failed to read from session", "error", err)
+			}
+			logger.Info("session closed")
+			return
+		}
+
+		if messageType == utils.MessageSyncResponse {
+			s.resync(payload, logger)
+			continue
+		}
+
+		if messageType != utils.MessageEvent {
+			logger.Warn("unexpected session message", "type", messageType)
+			continue
+		}
+
+		start := time.Now()
+
+		packet, err := s.decode(payload)
+		if err != nil {
+			decodeFailuresTotal.Inc()
+			logger.Warn("failed to decode packet", "error", err, "length", len(payload))
+			if err := acks.refuse(transactionIDOf(payload), err.Error()); err != nil {
+				logger.Warn("failed to refuse packet", "error", err)
+			}
+			if !acks.nacks {
+				return
+			}
+			continue
+		}
+
+		s.processInOrder(packet, sequencer, true, acks, logger.With(pidslog.Packet(packet)...))
+		processingSeconds.Observe(time.Since(start).Seconds())
+	}
+}
+
+// resync merges a publisher's sync response into the train state.
+func (s *PIDSSubscriber) resync(payload []byte, logger *slog.Logger) {
+	packets, err := utils.DecodeSyncResponse(payload)
+	if err != nil {
+		decodeFailuresTotal.Inc()
+		logger.Warn("failed to decode sync response", "error", err)
+		return
+	}
+	if len(packets) == 0 {
+		logger.Info("ignored empty sync response")
+		return
+	}
+
+	trains, removed := s.registry.Resync(packets)
+	for _, train := range trains {
+		if s.store != nil {
+			s.store.TrainChanged(train, false)
+		}
+		s.board.TrainChanged(train, false)
+	}
+	for _, train := range removed {
+		if s.store != nil {
+			s.store.TrainChanged(train, true)
+		}
+		s.board.TrainChanged(train, true)
+	}
+
+	syncsTotal.Inc()
+	logger.Info("train state synchronised", "trains", len(trains), "removed", len(removed))
+}
+
+// ackWriter frames everything processPacket writes as a MessageAck.
+type ackWriter struct {
+	w io.WriteCloser
+	// nacks is set when the publisher understands MessageNack.
+	nacks bool
+}
+
+// refuse answers an event with a MessageNack. Publishers that predate it
+// would wait for an ACK forever, so their session is closed instead.
+func (a ackWriter) refuse(transactionID uint16, reason string) error {
+	if !a.nacks {
+		return a.w.Close()
+	}
+	return utils.WriteMessage(a.w, utils.MessageNack, utils.EncodeNack(utils.Nack{TransactionID: transactionID, Reason: reason}))
+}
+
+func (a ackWriter) Write(p []byte) (int, error) {
+	if err := utils.WriteMessage(a.w, utils.MessageAck, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
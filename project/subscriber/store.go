@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	snapshotFileName = "snapshot.json"
+	journalFileName  = "journal.jsonl"
+
+	SyncAlways   = "always"
+	SyncPeriodic = "periodic"
+	SyncNever    = "never"
+
+	periodicSyncInterval = time.Second
+	// recoverInterval spaces the snapshots a degraded store takes to get
+	// back on its feet.
+	recoverInterval = time.Second
+)
+
+type journalEntry struct {
+	Time     time.Time      `json:"time"`
+	Type     string         `json:"type"`
+	Train    *TrainInfo     `json:"train,omitempty"`
+	Position *TrainPosition `json:"position,omitempty"`
+}
+
+type snapshot struct {
+	SavedAt   time.Time       `json:"savedAt"`
+	Trains    []TrainInfo     `json:"trains"`
+	Positions []TrainPosition `json:"positions"`
+}
+
+// TrainStore persists the registry as a snapshot plus an append-only journal
+// of every change since. Compact folds the journal into a new snapshot.
+type TrainStore struct {
+	dir      string
+	registry *TrainRegistry
+	syncMode string
+	logger   *slog.Logger
+
+	mutex   sync.Mutex
+	journal *os.File
+	writer  *bufio.Writer
+	entries int
+	dirty   bool
+	done    chan struct{}
+	// err is the write failure that degraded the store, nil while every
+	// change reaches the journal. Changes made since are only in the
+	// registry until a snapshot succeeds.
+	err       error
+	recoverAt time.Time
+}
+
+// OpenTrainStore loads the state kept in dir into registry and starts a
+// fresh journal. syncMode is SyncAlways, SyncPeriodic or SyncNever.
+func OpenTrainStore(dir string, registry *TrainRegistry, syncMode string, logger *slog.Logger) (*TrainStore, error) {
+	switch syncMode {
+	case SyncAlways, SyncPeriodic, SyncNever:
+	default:
+		return nil, fmt.Errorf("unknown sync mode %q", syncMode)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	store := &TrainStore{
+		dir:      dir,
+		registry: registry,
+		syncMode: syncMode,
+		logger:   logger,
+		done:     make(chan struct{}),
+	}
+
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+
+	// Start from a compact state so a crash loop does not grow the
+	// journal forever.
+	if err := store.Compact(); err != nil {
+		return nil, err
+	}
+
+	if syncMode == SyncPeriodic {
+		go store.syncLoop()
+	}
+	return store, nil
+}
+
+func (s *TrainStore) load() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, snapshotFileName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read snapshot: %v", err)
+	}
+
+	var state snapshot
+	if err == nil {
+		if err := json.Unmarshal(data, &state); err != nil {
+			return fmt.Errorf("failed to parse snapshot: %v", err)
+		}
+	}
+	s.registry.Restore(state.Trains, state.Positions)
+
+	journal, err := os.Open(filepath.Join(s.dir, journalFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		s.logger.Info("train state loaded", "trains", len(state.Trains), "journal_entries", 0)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open journal: %v", err)
+	}
+	defer journal.Close()
+
+	replayed := 0
+	scanner := bufio.NewScanner(journal)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// Only the last line can be torn by a crash; anything after
+			// it was never acknowledged as written.
+			s.logger.Warn("ignoring unreadable journal entry", "line", replayed+1, "error", err)
+			break
+		}
+		s.replay(entry)
+		replayed++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read journal: %v", err)
+	}
+
+	s.logger.Info("train state loaded", "trains", len(state.Trains), "journal_entries", replayed)
+	return nil
+}
+
+func (s *TrainStore) replay(entry journalEntry) {
+	switch {
+	case entry.Type == "train" && entry.Train != nil:
+		s.registry.Put(*entry.Train)
+	case entry.Type == "delete" && entry.Train != nil:
+		s.registry.Remove(entry.Train.TrainNumber)
+	case entry.Type == "position" && entry.Position != nil:
+		s.registry.PutPosition(*entry.Position)
+	}
+}
+
+func (s *TrainStore) TrainChanged(train TrainInfo, deleted bool) {
+	entryType := "train"
+	if deleted {
+		entryType = "delete"
+	}
+	s.append(journalEntry{Time: time.Now(), Type: entryType, Train: &train})
+}
+
+func (s *TrainStore) PositionChanged(position TrainPosition) {
+	s.append(journalEntry{Time: time.Now(), Type: "position", Position: &position})
+}
+
+func (s *TrainStore) append(entry journalEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		s.logger.Error("failed to encode journal entry", "error", err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+
+	if s.err != nil {
+		// The registry already holds this change, the snapshot takes it.
+		s.recoverLocked()
+		return
+	}
+
+	if _, err := s.writer.Write(append(data, '\n')); err != nil {
+		s.failLocked(err)
+		return
+	}
+	s.entries++
+	s.dirty = true
+
+	if s.syncMode == SyncPeriodic {
+		return
+	}
+	if err := s.flushLocked(); err != nil {
+		s.failLocked(err)
+	}
+}
+
+// flushLocked writes buffered entries out and, unless syncing is off, waits
+// for them to reach the disk. The entries stay dirty until that worked.
+func (s *TrainStore) flushLocked() error {
+	if !s.dirty {
+		return nil
+	}
+
+	if err := s.writer.Flush(); err != nil {
+		return err
+	}
+	if s.syncMode != SyncNever {
+		if err := s.journal.Sync(); err != nil {
+			return err
+		}
+	}
+	s.dirty = false
+	return nil
+}
+
+// failLocked degrades the store after the journal failed to take a change.
+// A bufio.Writer keeps failing once it failed, so only a snapshot and a new
+// journal bring the files up to date again.
+func (s *TrainStore) failLocked(err error) {
+	storeWriteFailuresTotal.Inc()
+	if s.err == nil {
+		s.logger.Error("train state degraded, changes are not persisted until a snapshot succeeds", "error", err)
+		storeDegraded.Set(1)
+	}
+	s.err = err
+	s.recoverAt = time.Now().Add(recoverInterval)
+}
+
+// recoverLocked snapshots the registry of a degraded store, at most once per
+// recoverInterval.
+func (s *TrainStore) recoverLocked() {
+	if time.Now().Before(s.recoverAt) {
+		return
+	}
+	if err := s.compactLocked(); err != nil {
+		s.recoverAt = time.Now().Add(recoverInterval)
+		s.logger.Warn("failed to recover train state", "error", err)
+	}
+}
+
+func (s *TrainStore) syncLoop() {
+	ticker := time.NewTicker(periodicSyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mutex.Lock()
+			if s.err != nil {
+				s.recoverLocked()
+			} else if err := s.flushLocked(); err != nil {
+				s.failLocked(err)
+			}
+			s.mutex.Unlock()
+		}
+	}
+}
+
+// Compact writes the current registry to a new snapshot and starts an empty
+// journal. Appends wait meanwhile, so no change falls between the two. It
+// also recovers a degraded store. Once the store is closed it does nothing.
+func (s *TrainStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	return s.compactLocked()
+}
+
+func (s *TrainStore) compactLocked() error {
+	data, err := json.MarshalIndent(snapshot{
+		SavedAt:   time.Now(),
+		Trains:    s.registry.Trains(),
+		Positions: s.registry.Positions(),
+	}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %v", err)
+	}
+
+	if err := writeFileAtomic(filepath.Join(s.dir, snapshotFileName), data); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+
+	if s.journal != nil {
+		s.journal.Close()
+	}
+	journal, err := os.OpenFile(filepath.Join(s.dir, journalFileName), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		s.journal, s.writer = nil, nil
+		err = fmt.Errorf("failed to open journal: %v", err)
+		s.failLocked(err)
+		return err
+	}
+
+	s.logger.Debug("train state compacted", "journal_entries", s.entries)
+	s.journal = journal
+	s.writer = bufio.NewWriter(journal)
+	s.entries = 0
+	s.dirty = false
+
+	if s.err != nil {
+		s.logger.Info("train state recovered", "degraded_by", s.err)
+		storeDegraded.Set(0)
+		s.err = nil
+	}
+	return nil
+}
+
+// CompactEvery compacts the store every interval until it is closed.
+func (s *TrainStore) CompactEvery(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			if err := s.Compact(); err != nil {
+				s.logger.Error("failed to compact train state", "error", err)
+			}
+		}
+	}
+}
+
+// Close flushes the journal, or snapshots a degraded store, and stops the
+// store; later changes are not recorded.
+func (s *TrainStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	select {
+	case <-s.done:
+		return nil
+	default:
+	}
+	close(s.done)
+
+	if s.err != nil {
+		if err := s.compactLocked(); err != nil {
+			if s.journal != nil {
+				s.journal.Close()
+			}
+			s.journal, s.writer = nil, nil
+			return err
+		}
+	}
+
+	journal := s.journal
+	if journal == nil {
+		return nil
+	}
+	s.dirty = true
+	err := s.flushLocked()
+	s.journal, s.writer = nil, nil
+
+	if closeErr := journal.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeFileAtomic replaces path with data so that a crash leaves either the
+// old or the new file, never a mix.
+func writeFileAtomic(path string, data []byte) error {
+	temp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), path)
+}
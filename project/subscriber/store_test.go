@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+var discardLogger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+func openStore(t *testing.T, dir, syncMode string) (*TrainStore, *TrainRegistry) {
+	t.Helper()
+	registry := NewTrainRegistry(false)
+	store, err := OpenTrainStore(dir, registry, syncMode, discardLogger)
+	if err != nil {
+		t.Fatalf("OpenTrainStore: %v", err)
+	}
+	return store, registry
+}
+
+// applyTo applies packet to registry and records it in store, as the
+// subscriber does.
+func applyTo(t *testing.T, store *TrainStore, registry *TrainRegistry, packet utils.LRTPIDSPacket) {
+	t.Helper()
+	train, deleted, err := registry.Apply(packet)
+	if err != nil {
+		t.Fatalf("Apply %s: %v", packet.EventType(), err)
+	}
+	store.TrainChanged(train, deleted)
+}
+
+func expectTrains(t *testing.T, registry *TrainRegistry, want ...TrainInfo) {
+	t.Helper()
+	got := registry.Trains()
+	if len(got) != len(want) {
+		t.Fatalf("registry has %d trains, want %d: %+v", len(got), len(want), got)
+	}
+	for i := range want {
+		if got[i].TrainNumber != want[i].TrainNumber || got[i].Destination != want[i].Destination || got[i].Status != want[i].Status {
+			t.Errorf("train %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func journalLength(t *testing.T, dir string) int64 {
+	t.Helper()
+	info, err := os.Stat(filepath.Join(dir, journalFileName))
+	if err != nil {
+		t.Fatalf("stat journal: %v", err)
+	}
+	return info.Size()
+}
+
+func TestStoreReplaysJournal(t *testing.T) {
+	for _, syncMode := range []string{SyncAlways, SyncPeriodic, SyncNever} {
+		t.Run(syncMode, func(t *testing.T) {
+			dir := t.TempDir()
+			store, registry := openStore(t, dir, syncMode)
+
+			applyTo(t, store, registry, utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 1, Destination: "Harjamukti"})
+			applyTo(t, store, registry, utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 2, Destination: "Jati Mulya"})
+			applyTo(t, store, registry, utils.LRTPIDSPacket{IsDeleteTrain: 1, TrainNumber: 2})
+			applyTo(t, store, registry, utils.LRTPIDSPacket{IsTrainArriving: 1, TrainNumber: 1})
+			position, _ := registry.ApplyPosition(utils.LRTPIDSPosition{TrainNumber: 1, Timestamp: 1000, Speed: 40})
+			store.PositionChanged(position)
+
+			// Close flushes what periodic syncing still holds.
+			if err := store.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+			if journalLength(t, dir) == 0 {
+				t.Fatal("journal is empty after Close")
+			}
+
+			reopened, restored := openStore(t, dir, syncMode)
+			defer reopened.Close()
+
+			expectTrains(t, restored, TrainInfo{TrainNumber: 1, Destination: "Harjamukti", Status: TrainStatusArriving})
+			if positions := restored.Positions(); len(positions) != 1 || positions[0].Speed != 40 {
+				t.Errorf("positions = %+v, want train 1 at speed 40", positions)
+			}
+			// Opening compacts, so the replayed journal is folded away.
+			if length := journalLength(t, dir); length != 0 {
+				t.Errorf("journal is %d bytes after opening, want 0", length)
+			}
+		})
+	}
+}
+
+func TestStoreIgnoresTornEntry(t *testing.T) {
+	dir := t.TempDir()
+	journal := `{"type":"train","train":{"trainNumber":1,"destination":"Harjamukti","status":"scheduled"}}
+{"type":"train","train":{"trainNumber":2,"destin
+{"type":"train","train":{"trainNumber":3,"destination":"Cawang","status":"scheduled"}}
+`
+	if err := os.WriteFile(filepath.Join(dir, journalFileName), []byte(journal), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store, registry := openStore(t, dir, SyncAlways)
+	defer store.Close()
+
+	expectTrains(t, registry, TrainInfo{TrainNumber: 1, Destination: "Harjamukti", Status: TrainStatusScheduled})
+}
+
+func TestStoreCompact(t *testing.T) {
+	dir := t.TempDir()
+	store, registry := openStore(t, dir, SyncAlways)
+	defer store.Close()
+
+	applyTo(t, store, registry, utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 1, Destination: "Harjamukti"})
+	applyTo(t, store, registry, utils.LRTPIDSPacket{IsUpdateTrain: 1, TrainNumber: 1, Destination: "Dukuh Atas"})
+	if journalLength(t, dir) == 0 {
+		t.Fatal("journal is empty before compacting")
+	}
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if length := journalLength(t, dir); length != 0 {
+		t.Errorf("journal is %d bytes after compacting, want 0", length)
+	}
+
+	// The snapshot alone now holds the state.
+	snapshotOnly := t.TempDir()
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		t.Fatalf("read snapshot: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(snapshotOnly, snapshotFileName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	restoredStore, restored := openStore(t, snapshotOnly, SyncAlways)
+	defer restoredStore.Close()
+	expectTrains(t, restored, TrainInfo{TrainNumber: 1, Destination: "Dukuh Atas", Status: TrainStatusScheduled})
+
+	// Appends after compacting go to the new journal.
+	applyTo(t, store, registry, utils.LRTPIDSPacket{IsDeleteTrain: 1, TrainNumber: 1})
+	if journalLength(t, dir) == 0 {
+		t.Error("journal is empty after a change following Compact")
+	}
+}
+
+func TestStoreClosed(t *testing.T) {
+	dir := t.TempDir()
+	store, registry := openStore(t, dir, SyncPeriodic)
+	go store.CompactEvery(time.Millisecond)
+
+	applyTo(t, store, registry, utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 1, Destination: "Harjamukti"})
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	snapshot, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		t.Fatalf("read snapshot: %v", err)
+	}
+	journal := journalLength(t, dir)
+
+	// Neither changes nor compacting touch the files once closed.
+	applyTo(t, store, registry, utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 2, Destination: "Cawang"})
+	if err := store.Compact(); err != nil {
+		t.Errorf("Compact after Close: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	if length := journalLength(t, dir); length != journal {
+		t.Errorf("journal grew from %d to %d bytes after Close", journal, length)
+	}
+	after, err := os.ReadFile(filepath.Join(dir, snapshotFileName))
+	if err != nil {
+		t.Fatalf("read snapshot: %v", err)
+	}
+	if string(after) != string(snapshot) {
+		t.Error("snapshot was rewritten after Close")
+	}
+}
+
+func expectMetric(t *testing.T, line string) {
+	t.Helper()
+	var output bytes.Buffer
+	if _, err := metricsRegistry.WriteTo(&output); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if !strings.Contains(output.String(), "\n"+line+"\n") {
+		t.Errorf("metrics lack %q", line)
+	}
+}
+
+// breakJournal closes the journal file under the store, so that writing to it
+// fails as on a full or failing disk.
+func breakJournal(t *testing.T, store *TrainStore) {
+	t.Helper()
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+	if err := store.journal.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStoreDegradesAndRecovers(t *testing.T) {
+	dir := t.TempDir()
+	store, registry := openStore(t, dir, SyncAlways)
+	defer store.Close()
+
+	applyTo(t, store, registry, utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 1, Destination: "Harjamukti"})
+	breakJournal(t, store)
+	applyTo(t, store, registry, utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 2, Destination: "Cawang"})
+
+	store.mutex.Lock()
+	err, dirty := store.err, store.dirty
+	store.mutex.Unlock()
+	if err == nil {
+		t.Fatal("store is not degraded after the journal failed")
+	}
+	if !dirty {
+		t.Error("entries that failed to flush are no longer dirty")
+	}
+	expectMetric(t, "pids_subscriber_store_degraded 1")
+
+	// Within recoverInterval changes only reach the registry.
+	applyTo(t, store, registry, utils.LRTPIDSPacket{IsTrainArriving: 1, TrainNumber: 1})
+	store.mutex.Lock()
+	if store.err == nil {
+		t.Error("store recovered before recoverInterval passed")
+	}
+	store.recoverAt = time.Time{}
+	store.mutex.Unlock()
+
+	// The next change snapshots everything the journal missed.
+	applyTo(t, store, registry, utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 3, Destination: "Dukuh Atas"})
+	store.mutex.Lock()
+	err = store.err
+	store.mutex.Unlock()
+	if err != nil {
+		t.Fatalf("store still degraded after a snapshot: %v", err)
+	}
+	expectMetric(t, "pids_subscriber_store_degraded 0")
+
+	// And the journal takes changes again.
+	applyTo(t, store, registry, utils.LRTPIDSPacket{IsDeleteTrain: 1, TrainNumber: 2})
+	if journalLength(t, dir) == 0 {
+		t.Error("journal is empty after recovering")
+	}
+
+	restoredStore, restored := openStore(t, dir, SyncAlways)
+	defer restoredStore.Close()
+	expectTrains(t, restored,
+		TrainInfo{TrainNumber: 1, Destination: "Harjamukti", Status: TrainStatusArriving},
+		TrainInfo{TrainNumber: 3, Destination: "Dukuh Atas", Status: TrainStatusScheduled},
+	)
+}
+
+func TestStoreKeepsDirtyWhenFlushFails(t *testing.T) {
+	dir := t.TempDir()
+	store, registry := openStore(t, dir, SyncPeriodic)
+
+	applyTo(t, store, registry, utils.LRTPIDSPacket{IsNewTrain: 1, TrainNumber: 1, Destination: "Harjamukti"})
+	breakJournal(t, store)
+
+	store.mutex.Lock()
+	err := store.flushLocked()
+	dirty := store.dirty
+	store.mutex.Unlock()
+	if err == nil {
+		t.Fatal("flush to a closed journal succeeded")
+	}
+	if !dirty {
+		t.Error("entries that failed to flush are no longer dirty")
+	}
+
+	// Close snapshots what the journal could not take.
+	store.mutex.Lock()
+	store.failLocked(err)
+	store.mutex.Unlock()
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	restoredStore, restored := openStore(t, dir, SyncPeriodic)
+	defer restoredStore.Close()
+	expectTrains(t, restored, TrainInfo{TrainNumber: 1, Destination: "Harjamukti", Status: TrainStatusScheduled})
+}
@@ -1,53 +1,208 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"crypto/tls"
+	"encoding/binary"
+	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 
-	"github.com/quic-go/quic-go"
+	"jarkom.cs.ui.ac.id/h01/project/transport"
 	"jarkom.cs.ui.ac.id/h01/project/utils"
+	"jarkom.cs.ui.ac.id/h01/project/utils/pcapng"
+	"jarkom.cs.ui.ac.id/h01/project/utils/pidslog"
 )
 
 type PIDSSubscriber struct {
-	listener *quic.Listener
-	address  string
+	listener  transport.Listener
+	address   string
+	registry  *TrainRegistry
+	store     *TrainStore
+	board     *StatusBoard
+	stationID string
+	// reorderTimeout bounds how long an event waits for earlier events of
+	// the same train.
+	reorderTimeout  time.Duration
+	strictLifecycle bool
+	strictDecode    bool
+	keyLog          io.Closer
+	capture         io.Closer
+	logger          *slog.Logger
+
+	// closing stops the accept loop once Close has been called.
+	closing atomic.Bool
+}
+
+type SubscriberOptions struct {
+	// Transport is one of transport.Kinds, QUIC when empty.
+	Transport string
+	// QlogDir enables qlog tracing into this directory when non-empty.
+	QlogDir string
+	// KeyLogFile enables TLS key logging into this file when non-empty.
+	KeyLogFile string
+	// StationID is announced to publishers when a session starts.
+	StationID string
+	// ReorderTimeout bounds how long an event waits for earlier events of
+	// the same train, one second when zero.
+	ReorderTimeout time.Duration
+	// StateDir persists the train state across restarts when non-empty.
+	StateDir string
+	// StateSync is SyncAlways, SyncPeriodic or SyncNever, SyncAlways when
+	// empty.
+	StateSync string
+	// CompactInterval is how often the state journal is folded into the
+	// snapshot, never when zero.
+	CompactInterval time.Duration
+	// StrictLifecycle refuses events that do not fit the train lifecycle
+	// instead of only reporting them. Refused events are answered with a
+	// NACK rather than an ACK.
+	StrictLifecycle bool
+	// StrictDecode refuses packets that utils.DecodeStrict rejects, such as
+	// ones with trailing bytes or an ACK flag next to an event.
+	StrictDecode bool
+	// CaptureFile records every datagram of the QUIC and UDP transports in
+	// a pcapng file when non-empty.
+	CaptureFile string
+	// CaptureSecrets embeds the TLS secrets in the capture, so that it
+	// decrypts without a key log file.
+	CaptureSecrets bool
 }
 
-func NewPIDSSubscriber(address string) (*PIDSSubscriber, error) {
+func NewPIDSSubscriber(address string, options SubscriberOptions) (*PIDSSubscriber, error) {
+	logger := slog.Default()
 	tlsConfig := generateTLSConfig()
 
-	addr, err := net.ResolveUDPAddr("udp", address)
+	keyLog, err := transport.OpenKeyLog(options.KeyLogFile, logger)
 	if err != nil {
-		return nil, fmt.Errorf("failed to resolve address: %v", err)
+		return nil, err
+	}
+	if keyLog != nil {
+		tlsConfig.KeyLogWriter = keyLog
+	}
+
+	if options.Transport == "" {
+		options.Transport = transport.KindQUIC
+	}
+
+	var capture *pcapng.Writer
+	release := func() {
+		if keyLog != nil {
+			keyLog.Close()
+		}
+		if capture != nil {
+			capture.Close()
+		}
+	}
+
+	config := transport.Config{
+		TLSConfig:       tlsConfig,
+		QlogDir:         options.QlogDir,
+		EnableDatagrams: true,
+		Logger:          logger,
+	}
+	if options.CaptureFile != "" {
+		if options.Transport == transport.KindTCP {
+			release()
+			return nil, fmt.Errorf("packet capture needs the %s or %s transport", transport.KindQUIC, transport.KindUDP)
+		}
+
+		capture, err = pcapng.Create(options.CaptureFile)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		config.Capture = func(src, dst net.Addr, payload []byte) {
+			if err := capture.WriteUDP(time.Now(), src, dst, payload); err != nil {
+				logger.Debug("failed to capture datagram", "error", err)
+			}
+		}
+
+		if options.CaptureSecrets {
+			transport.WarnKeyLogging(options.CaptureFile, logger)
+			if keyLog != nil {
+				tlsConfig.KeyLogWriter = io.MultiWriter(keyLog, capture.KeyLogWriter())
+			} else {
+				tlsConfig.KeyLogWriter = capture.KeyLogWriter()
+			}
+		}
+		logger.Info("capturing datagrams", "file", options.CaptureFile, "secrets", options.CaptureSecrets)
 	}
 
-	conn, err := net.ListenUDP("udp", addr)
+	t, err := transport.New(options.Transport, config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to listen UDP: %v", err)
+		release()
+		return nil, err
+	}
+
+	if options.ReorderTimeout == 0 {
+		options.ReorderTimeout = time.Second
+	}
+
+	if options.StateSync == "" {
+		options.StateSync = SyncAlways
+	}
+
+	registry := NewTrainRegistry(options.StrictLifecycle)
+
+	var store *TrainStore
+	if options.StateDir != "" {
+		store, err = OpenTrainStore(options.StateDir, registry, options.StateSync, logger)
+		if err != nil {
+			release()
+			return nil, fmt.Errorf("failed to open train state: %v", err)
+		}
+
+		if options.CompactInterval > 0 {
+			go store.CompactEvery(options.CompactInterval)
+		}
 	}
 
-	listener, err := quic.Listen(conn, tlsConfig, nil)
+	listener, err := t.Listen(address)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create QUIC listener: %v", err)
+		release()
+		if store != nil {
+			store.Close()
+		}
+		return nil, err
 	}
 
 	return &PIDSSubscriber{
-		listener: listener,
-		address:  address,
+		listener:        listener,
+		address:         address,
+		registry:        registry,
+		store:           store,
+		board:           NewStatusBoard(registry, logger),
+		stationID:       options.StationID,
+		reorderTimeout:  options.ReorderTimeout,
+		strictLifecycle: options.StrictLifecycle,
+		strictDecode:    options.StrictDecode,
+		keyLog:          keyLog,
+		capture:         captureCloser(capture),
+		logger:          logger.With("transport", options.Transport),
 	}, nil
 }
 
 func (s *PIDSSubscriber) Start() {
-	fmt.Printf("PIDS Subscriber started on %s\n", s.address)
-	fmt.Println("Waiting for connections...")
+	s.logger.Info("PIDS subscriber started, waiting for connections", "address", s.address)
 
 	for {
 		conn, err := s.listener.Accept(context.Background())
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
+			if s.closing.Load() {
+				return
+			}
+			s.logger.Error("failed to accept connection", "error", err)
 			continue
 		}
 
@@ -55,79 +210,288 @@ func (s *PIDSSubscriber) Start() {
 	}
 }
 
-func (s *PIDSSubscriber) handleConnection(conn quic.Connection) {
-	fmt.Printf("New connection from: %s\n", conn.RemoteAddr())
+func (s *PIDSSubscriber) handleConnection(conn transport.Conn) {
+	logger := s.logger.With(
+		pidslog.KeyRemoteAddr, conn.RemoteAddr().String(),
+		pidslog.KeyConnectionID, conn.ID(),
+	)
+	logger.Info("new connection")
+
+	connectionsTotal.Inc()
+	connectionsActive.Inc()
+	defer connectionsActive.Dec()
+
+	if datagrams, ok := transport.Datagrams(conn); ok {
+		go s.handleDatagrams(conn.Context(), datagrams, logger)
+	}
 
+	hello := s.hello(conn)
+	sequencer := newTrainSequencer(s.reorderTimeout)
 	for {
 		stream, err := conn.AcceptStream(context.Background())
 		if err != nil {
-			log.Printf("Failed to accept stream: %v", err)
+			logger.Info("connection closed", "reason", err)
 			return
 		}
 
-		go s.handleStream(stream, conn)
+		go s.handleStream(stream, hello, sequencer, logger.With(pidslog.KeyStreamID, stream.StreamID()))
 	}
 }
 
-func (s *PIDSSubscriber) handleStream(stream quic.Stream, conn quic.Connection) {
+// handleStream serves either a session control stream or, for publishers
+// that predate sessions, a stream carrying a single packet.
+func (s *PIDSSubscriber) handleStream(stream transport.Stream, hello utils.Hello, sequencer *trainSequencer, logger *slog.Logger) {
 	defer stream.Close()
 
+	streamsTotal.Inc()
+	streamsActive.Inc()
+	defer streamsActive.Dec()
+
+	reader := bufio.NewReader(stream)
+	if prefix, err := reader.Peek(len(utils.SessionMagic)); err == nil && utils.IsSessionStart(prefix) {
+		reader.Discard(len(prefix))
+		s.handleSession(stream, reader, hello, sequencer, logger)
+		return
+	}
+
 	buffer := make([]byte, 1024)
 	for {
-		n, err := stream.Read(buffer)
+		n, err := reader.Read(buffer)
 		if err != nil {
 			if err.Error() != "EOF" {
-				log.Printf("Failed to read from stream: %v", err)
+				logger.Warn("failed to read from stream", "error", err)
 			}
 			return
 		}
 
-		packet, err := utils.Decode(buffer[:n])
+		start := time.Now()
+
+		packet, err := s.decode(buffer[:n])
+		if err != nil {
+			decodeFailuresTotal.Inc()
+			logger.Warn("failed to decode packet", "error", err, "length", n)
+			// Closing the stream is the only answer a legacy publisher
+			// understands other than an ACK.
+			return
+		}
+
+		s.processInOrder(packet, sequencer, false, legacyReplier{stream}, logger.With(pidslog.Packet(packet)...))
+		processingSeconds.Observe(time.Since(start).Seconds())
+	}
+}
+
+// replier answers events: Write sends an encoded ACK packet, refuse tells
+// the publisher that the event was not applied.
+type replier interface {
+	io.Writer
+	refuse(transactionID uint16, reason string) error
+}
+
+// legacyReplier answers on a stream that carries a single packet. Refusing
+// closes the stream, so the publisher reads no ACK.
+type legacyReplier struct {
+	transport.Stream
+}
+
+func (r legacyReplier) refuse(transactionID uint16, reason string) error {
+	return r.Close()
+}
+
+// transactionIDOf is the TransactionID of an event that could not be
+// decoded, 0 when it is too short to carry one.
+func transactionIDOf(payload []byte) uint16 {
+	if len(payload) < 2 {
+		return 0
+	}
+	return binary.BigEndian.Uint16(payload)
+}
+
+func (s *PIDSSubscriber) decode(data []byte) (utils.LRTPIDSPacket, error) {
+	if s.strictDecode {
+		return utils.DecodeStrict(data)
+	}
+	return utils.Decode(data)
+}
+
+// handleDatagrams applies position updates until the connection closes. They
+// are not acknowledged; the publisher just sends the next one.
+func (s *PIDSSubscriber) handleDatagrams(ctx context.Context, datagrams transport.DatagramConn, logger *slog.Logger) {
+	for {
+		data, err := datagrams.ReceiveDatagram(ctx)
+		if err != nil {
+			return
+		}
+
+		position, err := utils.DecodePosition(data)
 		if err != nil {
-			log.Printf("Failed to decode packet: %v", err)
+			decodeFailuresTotal.Inc()
+			logger.Warn("failed to decode position", "error", err, "length", len(data))
 			continue
 		}
 
-		s.processPacket(packet, stream)
+		train, result := s.registry.ApplyPosition(position)
+		positionsReceivedTotal.Inc(result)
+		if result != positionApplied {
+			logger.Debug("dropped position", pidslog.KeyTrainNumber, position.TrainNumber, "result", result)
+			continue
+		}
+
+		if s.store != nil {
+			s.store.PositionChanged(train)
+		}
+		s.board.PositionChanged(train)
+	}
+}
+
+// StartHTTP serves the status board, its JSON API and /metrics on address.
+func (s *PIDSSubscriber) StartHTTP(address string) {
+	s.logger.Info("PIDS status board available", "url", "http://"+address)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", s.board.Handler())
+	mux.Handle("/metrics", metricsRegistry.Handler())
+
+	if err := http.ListenAndServe(address, mux); err != nil {
+		s.logger.Error("status board stopped", "error", err)
 	}
 }
 
-func (s *PIDSSubscriber) processPacket(packet utils.LRTPIDSPacket, stream quic.Stream) {
+func (s *PIDSSubscriber) processPacket(packet utils.LRTPIDSPacket, stream replier, logger *slog.Logger) {
+	packetsProcessedTotal.Inc(packet.EventType())
+	logger.Debug("processing packet", "destination", packet.Destination)
+
+	train, deleted, err := s.registry.Apply(packet)
+	if err != nil {
+		invalidTransitionsTotal.Inc(packet.EventType())
+		logger.Warn("event does not fit the train lifecycle", "error", err, "strict", s.strictLifecycle)
+		if s.strictLifecycle {
+			if err := stream.refuse(packet.TransactionID, err.Error()); err != nil {
+				logger.Warn("failed to refuse packet", "error", err)
+			}
+			return
+		}
+	}
+
+	if s.store != nil {
+		s.store.TrainChanged(train, deleted)
+	}
+	s.board.TrainChanged(train, deleted)
+
 	if packet.IsTrainArriving == 1 {
-		fmt.Printf("Mohon perhatian, kereta tujuan %s akan tiba di Peron 1.\n", packet.Destination)
+		s.announce(train, fmt.Sprintf("Mohon perhatian, kereta tujuan %s akan tiba di Peron 1.", train.Destination), logger)
 	}
 
 	if packet.IsTrainDeparting == 1 {
-		fmt.Printf("Mohon perhatian, kereta tujuan %s akan diberangkatkan dari Peron 1.\n", packet.Destination)
+		s.announce(train, fmt.Sprintf("Mohon perhatian, kereta tujuan %s akan diberangkatkan dari Peron 1.", train.Destination), logger)
+	}
+
+	s.acknowledge(packet, stream, logger)
+}
+
+// processInOrder applies sequenced packets through sequencer so that events
+// of one train take effect in publish order. ordered is set for a stream
+// that delivers its events in publish order, which never waits for a gap.
+func (s *PIDSSubscriber) processInOrder(packet utils.LRTPIDSPacket, sequencer *trainSequencer, ordered bool, stream replier, logger *slog.Logger) {
+	if packet.Sequence == 0 {
+		s.processPacket(packet, stream, logger)
+		return
 	}
 
+	var result string
+	if ordered {
+		result = sequencer.admit(packet.TrainNumber, packet.Sequence)
+	} else {
+		result = sequencer.acquire(packet.TrainNumber, packet.Sequence)
+	}
+	sequencedPacketsTotal.Inc(result)
+
+	if result == sequenceLate {
+		// A later event of this train has been applied already, applying
+		// this one would roll its state back. The publisher is told that
+		// it was not applied.
+		logger.Warn("refusing event published before one already applied")
+		if err := stream.refuse(packet.TransactionID, "published before an event already applied"); err != nil {
+			logger.Warn("failed to refuse packet", "error", err)
+		}
+		return
+	}
+	defer sequencer.release(packet.TrainNumber, packet.Sequence)
+
+	if result == sequenceGapSkipped {
+		if ordered {
+			logger.Warn("skipped events of this train that were never received")
+		} else {
+			logger.Warn("gave up waiting for earlier events of this train", "timeout", sequencer.gapTimeout)
+		}
+	}
+	s.processPacket(packet, stream, logger)
+}
+
+func (s *PIDSSubscriber) acknowledge(packet utils.LRTPIDSPacket, stream io.Writer, logger *slog.Logger) {
 	ackPacket := utils.LRTPIDSPacket{
-		TransactionID:    packet.TransactionID,
-		IsAck:            1,
-		IsNewTrain:       0,
-		IsUpdateTrain:    0,
-		IsDeleteTrain:    0,
-		IsTrainArriving:  0,
-		IsTrainDeparting: 0,
-		TrainNumber:      packet.TrainNumber,
+		TransactionID:     packet.TransactionID,
+		IsAck:             1,
+		IsNewTrain:        0,
+		IsUpdateTrain:     0,
+		IsDeleteTrain:     0,
+		IsTrainArriving:   0,
+		IsTrainDeparting:  0,
+		TrainNumber:       packet.TrainNumber,
 		DestinationLength: 0,
-		Destination:      "",
+		Destination:       "",
 	}
 
 	ackData, err := utils.Encode(ackPacket)
 	if err != nil {
-		log.Printf("Failed to encode ACK packet: %v", err)
+		ackFailuresTotal.Inc()
+		logger.Error("failed to encode ACK packet", "error", err)
 		return
 	}
 
 	_, err = stream.Write(ackData)
 	if err != nil {
-		log.Printf("Failed to send ACK: %v", err)
+		ackFailuresTotal.Inc()
+		logger.Warn("failed to send ACK", "error", err)
+		return
 	}
+
+	logger.Debug("ACK sent")
+}
+
+func (s *PIDSSubscriber) announce(train TrainInfo, message string, logger *slog.Logger) {
+	logger.Info("announcement", "message", message)
+
+	s.board.Announce(Announcement{
+		Time:        time.Now(),
+		TrainNumber: train.TrainNumber,
+		Destination: train.Destination,
+		Message:     message,
+	})
 }
 
 func (s *PIDSSubscriber) Close() error {
-	return s.listener.Close()
+	if s.closing.Swap(true) {
+		return nil
+	}
+	err := s.listener.Close()
+	if s.store != nil {
+		s.store.Close()
+	}
+	if s.keyLog != nil {
+		s.keyLog.Close()
+	}
+	if s.capture != nil {
+		s.capture.Close()
+	}
+	return err
+}
+
+// captureCloser keeps a nil capture a nil io.Closer.
+func captureCloser(capture *pcapng.Writer) io.Closer {
+	if capture == nil {
+		return nil
+	}
+	return capture
 }
 
 func generateTLSConfig() *tls.Config {
@@ -139,11 +503,63 @@ func generateTLSConfig() *tls.Config {
 }
 
 func main() {
-	subscriber, err := NewPIDSSubscriber(":4510")
+	listenAddress := flag.String("listen", ":4510", "address to receive PIDS events on")
+	transportKind := flag.String("transport", transport.KindQUIC, "transport to accept publishers on: "+strings.Join(transport.Kinds, ", "))
+	httpAddress := flag.String("http", "127.0.0.1:8080", "HTTP address for the status board and /metrics, e.g. :8080 to serve every interface, empty to disable")
+	qlogDir := flag.String("qlog-dir", "", "directory to write one qlog file per connection to, empty to disable")
+	keyLogFile := flag.String("keylog-file", os.Getenv(transport.KeyLogFileEnv), "file to append TLS secrets to for decrypting captures (default $"+transport.KeyLogFileEnv+"), empty to disable")
+	stationID := flag.String("station", "", "station ID announced to publishers when a session starts")
+	reorderTimeout := flag.Duration("reorder-timeout", time.Second, "how long an event waits for earlier events of the same train before they are skipped")
+	stateDir := flag.String("state-dir", "", "directory to persist train state in across restarts, empty to disable")
+	stateSync := flag.String("state-sync", SyncAlways, "when to fsync the state journal: "+SyncAlways+", "+SyncPeriodic+" (every second) or "+SyncNever)
+	compactInterval := flag.Duration("state-compact-interval", 5*time.Minute, "how often to fold the state journal into a new snapshot, 0 to disable")
+	strictLifecycle := flag.Bool("strict-lifecycle", false, "refuse events that do not fit the train lifecycle instead of only logging them")
+	strictDecode := flag.Bool("strict-decode", false, "refuse packets with trailing bytes, invalid UTF-8 or bad event flags instead of decoding them leniently")
+	captureFile := flag.String("capture", "", "pcapng file to record every datagram in, for the quic and udp transports, empty to disable")
+	captureSecrets := flag.Bool("capture-secrets", false, "embed the TLS secrets in the capture so that Wireshark decrypts it without a key log file")
+	logConfig := pidslog.RegisterFlags(flag.CommandLine)
+	flag.Parse()
+
+	logger, err := logConfig.NewLogger(os.Stdout)
 	if err != nil {
-		log.Fatalf("Failed to create subscriber: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	subscriber, err := NewPIDSSubscriber(*listenAddress, SubscriberOptions{
+		Transport:       *transportKind,
+		QlogDir:         *qlogDir,
+		KeyLogFile:      *keyLogFile,
+		StationID:       *stationID,
+		ReorderTimeout:  *reorderTimeout,
+		StateDir:        *stateDir,
+		StateSync:       *stateSync,
+		CompactInterval: *compactInterval,
+		StrictLifecycle: *strictLifecycle,
+		StrictDecode:    *strictDecode,
+		CaptureFile:     *captureFile,
+		CaptureSecrets:  *captureSecrets,
+	})
+	if err != nil {
+		logger.Error("failed to create subscriber", "error", err)
+		os.Exit(1)
 	}
 	defer subscriber.Close()
 
+	// Flush the state journal before exiting on Ctrl-C or a service stop.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		logger.Info("shutting down")
+		subscriber.Close()
+		os.Exit(0)
+	}()
+
+	if *httpAddress != "" {
+		go subscriber.StartHTTP(*httpAddress)
+	}
+
 	subscriber.Start()
-}
\ No newline at end of file
+}
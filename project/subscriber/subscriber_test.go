@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+// recordingReplier records the answers to the events it is given.
+type recordingReplier struct {
+	acks    []utils.LRTPIDSPacket
+	refused []uint16
+}
+
+func (r *recordingReplier) Write(p []byte) (int, error) {
+	ack, err := utils.Decode(p)
+	if err != nil {
+		return 0, err
+	}
+	r.acks = append(r.acks, ack)
+	return len(p), nil
+}
+
+func (r *recordingReplier) refuse(transactionID uint16, reason string) error {
+	r.refused = append(r.refused, transactionID)
+	return nil
+}
+
+func newTestSubscriber() *PIDSSubscriber {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	registry := NewTrainRegistry(false)
+	return &PIDSSubscriber{
+		registry: registry,
+		board:    NewStatusBoard(registry, logger),
+		logger:   logger,
+	}
+}
+
+func TestProcessInOrderRefusesLateEvent(t *testing.T) {
+	s := newTestSubscriber()
+	sequencer := newTrainSequencer(time.Hour)
+	replies := &recordingReplier{}
+
+	s.processInOrder(utils.LRTPIDSPacket{TransactionID: 1, IsNewTrain: 1, TrainNumber: 5, Destination: "DKAT", Sequence: 1}, sequencer, true, replies, s.logger)
+	s.processInOrder(utils.LRTPIDSPacket{TransactionID: 3, IsTrainArriving: 1, TrainNumber: 5, Sequence: 3}, sequencer, true, replies, s.logger)
+	// Published before the arrival, but only received after it.
+	s.processInOrder(utils.LRTPIDSPacket{TransactionID: 2, IsUpdateTrain: 1, TrainNumber: 5, Destination: "HJMK", Sequence: 2}, sequencer, true, replies, s.logger)
+
+	if len(replies.acks) != 2 || replies.acks[0].TransactionID != 1 || replies.acks[1].TransactionID != 3 {
+		t.Errorf("ACKs = %+v, want transactions 1 and 3", replies.acks)
+	}
+	if len(replies.refused) != 1 || replies.refused[0] != 2 {
+		t.Errorf("refused = %v, want transaction 2", replies.refused)
+	}
+
+	trains := s.registry.Trains()
+	if len(trains) != 1 || trains[0].Destination != "DKAT" {
+		t.Errorf("trains = %+v, want train 5 to DKAT", trains)
+	}
+}
+
+func TestProcessInOrderSessionDoesNotWaitForGap(t *testing.T) {
+	s := newTestSubscriber()
+	sequencer := newTrainSequencer(time.Hour)
+	replies := &recordingReplier{}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.processInOrder(utils.LRTPIDSPacket{TransactionID: 1, IsNewTrain: 1, TrainNumber: 5, Destination: "DKAT", Sequence: 2}, sequencer, true, replies, s.logger)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("session event waited for the missing sequence 1")
+	}
+	if len(replies.acks) != 1 {
+		t.Errorf("ACKs = %+v, want one", replies.acks)
+	}
+}
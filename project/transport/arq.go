@@ -0,0 +1,456 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The UDP transport makes its frames reliable with a selective-repeat ARQ.
+// Every mux frame travels in a data datagram
+//
+//	0x10 | sequence number (4 bytes) | mux frame
+//
+// and the receiver answers each one with an acknowledgement
+//
+//	0x11 | next expected sequence number (4 bytes) | range count (1 byte) |
+//	range count * (first (4 bytes) | last (4 bytes))
+//
+// where the ranges list the blocks received beyond the first gap. Frames are
+// handed to the mux in sequence order, so stream data and FINs keep their
+// order even when datagrams are lost or reordered. Retransmission timeouts
+// follow RFC 6298.
+//
+// The TransactionID and IsAck of LRTPIDSPacket cannot take the place of these
+// sequence numbers. Most frames carry no packet at all: hellos, sync
+// responses, FINs, pings and the close frame, and a large message is split
+// over several frames. TransactionIDs are picked by the publisher and say
+// nothing about order, and the subscriber only ACKs an event once it has been
+// processed, which may take long or end in a NACK. So the ARQ gets every
+// frame across, and the application-level ACK still travels on top,
+// confirming that the subscriber processed the event rather than just
+// received it.
+const (
+	arqData = 0x10
+	arqAck  = 0x11
+
+	arqDataHeaderSize = 5
+	arqMaxAckRanges   = 32
+	arqWindow         = 256
+	// arqFastRetransmit is how many later datagrams must be acknowledged
+	// before a missing one is resent without waiting for its timer.
+	arqFastRetransmit = 3
+	arqMaxRetransmits = 10
+	arqInitialRTO     = time.Second
+	arqMinRTO         = 200 * time.Millisecond
+	arqMaxRTO         = 60 * time.Second
+	arqTimerInterval  = 10 * time.Millisecond
+	// arqCloseLinger bounds how long close waits for the datagrams in
+	// flight, the close frame among them, to be acknowledged.
+	arqCloseLinger = 2 * time.Second
+)
+
+var errPeerUnreachable = errors.New("peer stopped acknowledging datagrams")
+
+// datagramConn sends and receives raw datagrams to a single peer.
+type datagramConn interface {
+	send(data []byte) error
+	receive() ([]byte, error)
+	close() error
+	localAddr() net.Addr
+	remoteAddr() net.Addr
+}
+
+type arqPacket struct {
+	data          []byte
+	sentAt        time.Time
+	deadline      time.Time
+	transmissions int
+	laterAcked    int
+}
+
+type arqFramer struct {
+	conn datagramConn
+
+	mutex    sync.Mutex
+	window   *sync.Cond
+	nextSeq  uint32
+	inFlight map[uint32]*arqPacket
+	srtt     time.Duration
+	rttvar   time.Duration
+	rto      time.Duration
+	err      error
+
+	expected uint32
+	received map[uint32]frame
+
+	deliver   chan frame
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newARQFramer(conn datagramConn) *arqFramer {
+	f := &arqFramer{
+		conn:     conn,
+		inFlight: make(map[uint32]*arqPacket),
+		rto:      arqInitialRTO,
+		received: make(map[uint32]frame),
+		deliver:  make(chan frame, arqWindow),
+		closed:   make(chan struct{}),
+	}
+	f.window = sync.NewCond(&f.mutex)
+
+	go f.receiveLoop()
+	go f.timerLoop()
+	return f
+}
+
+// seqBefore compares sequence numbers in serial number arithmetic so the
+// counter may wrap around.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func (f *arqFramer) writeFrame(fr frame) error {
+	f.mutex.Lock()
+	for len(f.inFlight) >= arqWindow && f.err == nil {
+		f.window.Wait()
+	}
+	if err := f.err; err != nil {
+		f.mutex.Unlock()
+		return err
+	}
+
+	seq := f.nextSeq
+	f.nextSeq++
+
+	data := make([]byte, 0, arqDataHeaderSize+frameHeaderSize+len(fr.payload))
+	data = append(data, arqData)
+	data = binary.BigEndian.AppendUint32(data, seq)
+	data = fr.appendTo(data)
+
+	now := time.Now()
+	f.inFlight[seq] = &arqPacket{
+		data:          data,
+		sentAt:        now,
+		deadline:      now.Add(f.rto),
+		transmissions: 1,
+	}
+	f.mutex.Unlock()
+
+	return f.transmit(data)
+}
+
+// transmit sends data, which has to happen outside f.mutex: the socket and a
+// capture writer may block. Any failure but a closed socket counts as a lost
+// datagram that the retransmission timer or the next ACK makes up for.
+func (f *arqFramer) transmit(data []byte) error {
+	err := f.conn.send(data)
+	if errors.Is(err, net.ErrClosed) || errors.Is(err, errConnectionClosed) {
+		f.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (f *arqFramer) readFrame() (frame, error) {
+	select {
+	case fr := <-f.deliver:
+		return fr, nil
+	case <-f.closed:
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		return frame{}, f.err
+	}
+}
+
+// close lingers until the datagrams in flight are acknowledged, so that the
+// close frame the mux wrote last is retransmitted if it gets lost, and then
+// closes the socket.
+func (f *arqFramer) close() error {
+	f.drain(arqCloseLinger)
+	f.fail(errConnectionClosed)
+	return f.conn.close()
+}
+
+// drain waits until nothing is in flight, the framer failed or timeout
+// passed. The timer loop keeps retransmitting meanwhile.
+func (f *arqFramer) drain(timeout time.Duration) {
+	expired := false
+	timer := time.AfterFunc(timeout, func() {
+		f.mutex.Lock()
+		expired = true
+		f.mutex.Unlock()
+		f.window.Broadcast()
+	})
+	defer timer.Stop()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for len(f.inFlight) > 0 && f.err == nil && !expired {
+		f.window.Wait()
+	}
+}
+
+func (f *arqFramer) localAddr() net.Addr  { return f.conn.localAddr() }
+func (f *arqFramer) remoteAddr() net.Addr { return f.conn.remoteAddr() }
+
+func (f *arqFramer) fail(err error) {
+	f.closeOnce.Do(func() {
+		f.mutex.Lock()
+		f.err = err
+		f.mutex.Unlock()
+		f.window.Broadcast()
+		close(f.closed)
+	})
+}
+
+func (f *arqFramer) receiveLoop() {
+	for {
+		data, err := f.conn.receive()
+		if err != nil {
+			f.fail(err)
+			return
+		}
+
+		if len(data) == 0 {
+			continue
+		}
+
+		switch data[0] {
+		case arqData:
+			f.handleData(data)
+		case arqAck:
+			f.handleAck(data)
+		}
+	}
+}
+
+func (f *arqFramer) handleData(data []byte) {
+	if len(data) < arqDataHeaderSize {
+		return
+	}
+
+	seq := binary.BigEndian.Uint32(data[1:arqDataHeaderSize])
+	fr, err := parseFrame(data[arqDataHeaderSize:])
+	if err != nil {
+		return
+	}
+
+	f.mutex.Lock()
+	var ready []frame
+	if !seqBefore(seq, f.expected) && seqBefore(seq, f.expected+arqWindow) {
+		f.received[seq] = fr
+		for {
+			next, ok := f.received[f.expected]
+			if !ok {
+				break
+			}
+			delete(f.received, f.expected)
+			ready = append(ready, next)
+			f.expected++
+		}
+	}
+	ack := f.ackLocked()
+	f.mutex.Unlock()
+
+	// Duplicates are acknowledged again since the previous ACK may have been
+	// the datagram that got lost.
+	if err := f.transmit(ack); err != nil {
+		return
+	}
+
+	for _, next := range ready {
+		select {
+		case f.deliver <- next:
+		case <-f.closed:
+			return
+		}
+	}
+}
+
+func (f *arqFramer) ackLocked() []byte {
+	pending := make([]uint32, 0, len(f.received))
+	for seq := range f.received {
+		pending = append(pending, seq)
+	}
+	sort.Slice(pending, func(i, j int) bool { return seqBefore(pending[i], pending[j]) })
+
+	var ranges [][2]uint32
+	for _, seq := range pending {
+		if n := len(ranges); n > 0 && ranges[n-1][1]+1 == seq {
+			ranges[n-1][1] = seq
+			continue
+		}
+		if len(ranges) == arqMaxAckRanges {
+			break
+		}
+		ranges = append(ranges, [2]uint32{seq, seq})
+	}
+
+	ack := make([]byte, 0, 6+8*len(ranges))
+	ack = append(ack, arqAck)
+	ack = binary.BigEndian.AppendUint32(ack, f.expected)
+	ack = append(ack, uint8(len(ranges)))
+	for _, r := range ranges {
+		ack = binary.BigEndian.AppendUint32(ack, r[0])
+		ack = binary.BigEndian.AppendUint32(ack, r[1])
+	}
+	return ack
+}
+
+func (f *arqFramer) handleAck(data []byte) {
+	if len(data) < 6 {
+		return
+	}
+
+	cumulative := binary.BigEndian.Uint32(data[1:5])
+	count := int(data[5])
+	if len(data) != 6+8*count {
+		return
+	}
+
+	now := time.Now()
+	var resend [][]byte
+	defer func() {
+		for _, data := range resend {
+			f.transmit(data)
+		}
+	}()
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	highest := cumulative
+	acked := func(seq uint32) {
+		packet, ok := f.inFlight[seq]
+		if !ok {
+			return
+		}
+		// Karn's algorithm: only unambiguous round trips update the estimate.
+		if packet.transmissions == 1 {
+			f.updateRTT(now.Sub(packet.sentAt))
+		}
+		delete(f.inFlight, seq)
+	}
+
+	for seq := range f.inFlight {
+		if seqBefore(seq, cumulative) {
+			acked(seq)
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		first := binary.BigEndian.Uint32(data[6+8*i:])
+		last := binary.BigEndian.Uint32(data[10+8*i:])
+		if seqBefore(last, first) || last-first >= arqWindow {
+			continue
+		}
+		for seq := first; ; seq++ {
+			acked(seq)
+			if seq == last {
+				break
+			}
+		}
+		if seqBefore(highest, last) {
+			highest = last
+		}
+	}
+
+	// Anything still outstanding below the highest acknowledged datagram
+	// was probably lost; resend it once enough later datagrams got through.
+	for seq, packet := range f.inFlight {
+		if !seqBefore(seq, highest) {
+			continue
+		}
+		packet.laterAcked++
+		if packet.laterAcked == arqFastRetransmit {
+			resend = append(resend, f.retransmitLocked(packet, now))
+		}
+	}
+
+	f.window.Broadcast()
+}
+
+// updateRTT applies RFC 6298 section 2.
+func (f *arqFramer) updateRTT(sample time.Duration) {
+	if f.srtt == 0 {
+		f.srtt = sample
+		f.rttvar = sample / 2
+	} else {
+		delta := f.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		f.rttvar = (3*f.rttvar + delta) / 4
+		f.srtt = (7*f.srtt + sample) / 8
+	}
+
+	f.rto = f.srtt + 4*f.rttvar
+	if f.rto < arqMinRTO {
+		f.rto = arqMinRTO
+	}
+	if f.rto > arqMaxRTO {
+		f.rto = arqMaxRTO
+	}
+}
+
+// retransmitLocked backs the timer of packet off exponentially, as in RFC
+// 6298 section 5.5 but per datagram so that one burst of losses does not
+// inflate the timeout of everything sent afterwards, and returns the datagram
+// to transmit once f.mutex is released.
+func (f *arqFramer) retransmitLocked(packet *arqPacket, now time.Time) []byte {
+	packet.transmissions++
+	packet.sentAt = now
+
+	timeout := f.rto << (packet.transmissions - 1)
+	if timeout > arqMaxRTO || timeout <= 0 {
+		timeout = arqMaxRTO
+	}
+	packet.deadline = now.Add(timeout)
+	return packet.data
+}
+
+func (f *arqFramer) timerLoop() {
+	ticker := time.NewTicker(arqTimerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-f.closed:
+			return
+		case now := <-ticker.C:
+			if err := f.onTimer(now); err != nil {
+				f.fail(err)
+				f.conn.close()
+				return
+			}
+		}
+	}
+}
+
+func (f *arqFramer) onTimer(now time.Time) error {
+	var resend [][]byte
+	f.mutex.Lock()
+	for _, packet := range f.inFlight {
+		if now.Before(packet.deadline) {
+			continue
+		}
+		if packet.transmissions > arqMaxRetransmits {
+			f.mutex.Unlock()
+			return fmt.Errorf("%w after %d retransmissions", errPeerUnreachable, arqMaxRetransmits)
+		}
+		resend = append(resend, f.retransmitLocked(packet, now))
+	}
+	f.mutex.Unlock()
+
+	for _, data := range resend {
+		f.transmit(data)
+	}
+	return nil
+}
@@ -0,0 +1,434 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// pipeEnd is one end of an in-memory datagram link. drop decides which
+// datagrams sent from this end get lost.
+type pipeEnd struct {
+	peer    *pipeEnd
+	inbound chan []byte
+
+	mutex sync.Mutex
+	drop  func(data []byte) bool
+	sent  [][]byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newPipe() (*pipeEnd, *pipeEnd) {
+	a := &pipeEnd{inbound: make(chan []byte, 1024), closed: make(chan struct{})}
+	b := &pipeEnd{inbound: make(chan []byte, 1024), closed: make(chan struct{})}
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (p *pipeEnd) setDrop(drop func(data []byte) bool) {
+	p.mutex.Lock()
+	p.drop = drop
+	p.mutex.Unlock()
+}
+
+func (p *pipeEnd) send(data []byte) error {
+	select {
+	case <-p.closed:
+		return errConnectionClosed
+	default:
+	}
+
+	p.mutex.Lock()
+	p.sent = append(p.sent, append([]byte(nil), data...))
+	drop := p.drop != nil && p.drop(data)
+	p.mutex.Unlock()
+	if drop {
+		return nil
+	}
+
+	select {
+	case p.peer.inbound <- append([]byte(nil), data...):
+	default:
+	}
+	return nil
+}
+
+func (p *pipeEnd) receive() ([]byte, error) {
+	select {
+	case data := <-p.inbound:
+		return data, nil
+	case <-p.closed:
+		return nil, errConnectionClosed
+	}
+}
+
+func (p *pipeEnd) close() error {
+	p.closeOnce.Do(func() { close(p.closed) })
+	return nil
+}
+
+func (p *pipeEnd) localAddr() net.Addr  { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1} }
+func (p *pipeEnd) remoteAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2} }
+
+// sentData counts the data datagrams carrying seq sent from this end.
+func (p *pipeEnd) sentData(seq uint32) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	count := 0
+	for _, data := range p.sent {
+		if data[0] == arqData && binary.BigEndian.Uint32(data[1:arqDataHeaderSize]) == seq {
+			count++
+		}
+	}
+	return count
+}
+
+// newIdleFramer is an arqFramer without its goroutines, for driving the
+// protocol by hand.
+func newIdleFramer(conn datagramConn) *arqFramer {
+	f := &arqFramer{
+		conn:     conn,
+		inFlight: make(map[uint32]*arqPacket),
+		rto:      arqInitialRTO,
+		received: make(map[uint32]frame),
+		deliver:  make(chan frame, arqWindow),
+		closed:   make(chan struct{}),
+	}
+	f.window = sync.NewCond(&f.mutex)
+	return f
+}
+
+func dataDatagram(seq uint32, fr frame) []byte {
+	data := append([]byte{arqData}, binary.BigEndian.AppendUint32(nil, seq)...)
+	return fr.appendTo(data)
+}
+
+func ackDatagram(cumulative uint32, ranges ...[2]uint32) []byte {
+	ack := append([]byte{arqAck}, binary.BigEndian.AppendUint32(nil, cumulative)...)
+	ack = append(ack, uint8(len(ranges)))
+	for _, r := range ranges {
+		ack = binary.BigEndian.AppendUint32(ack, r[0])
+		ack = binary.BigEndian.AppendUint32(ack, r[1])
+	}
+	return ack
+}
+
+func TestARQSelectiveAck(t *testing.T) {
+	conn, _ := newPipe()
+	f := newIdleFramer(conn)
+
+	for _, seq := range []uint32{1, 2, 4, 5, 7} {
+		f.handleData(dataDatagram(seq, frame{kind: frameData, payload: []byte{byte(seq)}}))
+	}
+	if got, want := f.ackLocked(), ackDatagram(0, [2]uint32{1, 2}, [2]uint32{4, 5}, [2]uint32{7, 7}); !bytes.Equal(got, want) {
+		t.Fatalf("ACK with a gap at 0 = % x, want % x", got, want)
+	}
+
+	f.handleData(dataDatagram(0, frame{kind: frameData, payload: []byte{0}}))
+	if got, want := f.ackLocked(), ackDatagram(3, [2]uint32{4, 5}, [2]uint32{7, 7}); !bytes.Equal(got, want) {
+		t.Fatalf("ACK after filling 0 = % x, want % x", got, want)
+	}
+
+	// 0, 1 and 2 are ready, in order; the rest waits for 3.
+	for want := byte(0); want < 3; want++ {
+		select {
+		case fr := <-f.deliver:
+			if fr.payload[0] != want {
+				t.Fatalf("delivered frame %d, want %d", fr.payload[0], want)
+			}
+		default:
+			t.Fatalf("frame %d was not delivered", want)
+		}
+	}
+	if len(f.deliver) != 0 {
+		t.Errorf("%d frames delivered past the gap", len(f.deliver))
+	}
+}
+
+func TestARQHandleAck(t *testing.T) {
+	conn, _ := newPipe()
+	f := newIdleFramer(conn)
+	for i := 0; i < 10; i++ {
+		if err := f.writeFrame(frame{kind: frameData, payload: []byte{byte(i)}}); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+	}
+
+	// 0 and 1 cumulatively, then 4-5 and 7 selectively.
+	f.handleAck(ackDatagram(2, [2]uint32{4, 5}, [2]uint32{7, 7}))
+
+	var outstanding []uint32
+	for seq := uint32(0); seq < 10; seq++ {
+		if _, ok := f.inFlight[seq]; ok {
+			outstanding = append(outstanding, seq)
+		}
+	}
+	if fmt.Sprint(outstanding) != "[2 3 6 8 9]" {
+		t.Errorf("outstanding after ACK = %v, want [2 3 6 8 9]", outstanding)
+	}
+
+	// Malformed ACKs change nothing.
+	f.handleAck(ackDatagram(10)[:5])
+	f.handleAck(append(ackDatagram(10), 0))
+	if len(f.inFlight) != 5 {
+		t.Errorf("malformed ACKs changed the outstanding datagrams to %d", len(f.inFlight))
+	}
+}
+
+func TestARQFastRetransmit(t *testing.T) {
+	conn, _ := newPipe()
+	f := newIdleFramer(conn)
+	for i := 0; i < 5; i++ {
+		f.writeFrame(frame{kind: frameData, payload: []byte{byte(i)}})
+	}
+
+	// Datagram 0 is lost; each ACK of a later one counts against it.
+	for i := uint32(1); i <= arqFastRetransmit; i++ {
+		if sent := conn.sentData(0); sent != 1 {
+			t.Fatalf("datagram 0 sent %d times after %d later ACKs, want 1", sent, i-1)
+		}
+		f.handleAck(ackDatagram(0, [2]uint32{1, i}))
+	}
+	if sent := conn.sentData(0); sent != 2 {
+		t.Errorf("datagram 0 sent %d times after %d later ACKs, want 2", sent, arqFastRetransmit)
+	}
+}
+
+// blockingConn holds every send until release is closed, as a full socket
+// buffer or a slow capture file would.
+type blockingConn struct {
+	*pipeEnd
+	sending chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingConn) send(data []byte) error {
+	c.sending <- struct{}{}
+	<-c.release
+	return c.pipeEnd.send(data)
+}
+
+func TestARQSendsOutsideLock(t *testing.T) {
+	pipe, _ := newPipe()
+	conn := &blockingConn{pipeEnd: pipe, sending: make(chan struct{}, 8), release: make(chan struct{})}
+	f := newIdleFramer(conn)
+	defer close(conn.release)
+
+	go f.writeFrame(frame{kind: frameData, payload: []byte{0}})
+	<-conn.sending
+
+	// Acknowledgements keep being processed while a datagram is being sent.
+	handled := make(chan struct{})
+	go func() {
+		f.handleAck(ackDatagram(1))
+		close(handled)
+	}()
+	select {
+	case <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("handleAck waited for a blocked send")
+	}
+}
+
+// failingConn fails every send with err.
+type failingConn struct {
+	*pipeEnd
+	err error
+}
+
+func (c *failingConn) send([]byte) error {
+	return c.err
+}
+
+func TestARQSendErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		// fails is whether the framer gives up, rather than treating the
+		// datagram as lost.
+		fails bool
+	}{
+		{"no buffer space", syscall.ENOBUFS, false},
+		{"port unreachable", syscall.ECONNREFUSED, false},
+		{"socket closed", net.ErrClosed, true},
+		{"connection closed", errConnectionClosed, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pipe, _ := newPipe()
+			f := newIdleFramer(&failingConn{pipeEnd: pipe, err: test.err})
+
+			err := f.writeFrame(frame{kind: frameData, payload: []byte{0}})
+			if fails := err != nil; fails != test.fails {
+				t.Fatalf("writeFrame = %v, want failure %v", err, test.fails)
+			}
+			if test.fails {
+				if _, err := f.readFrame(); !errors.Is(err, test.err) {
+					t.Errorf("readFrame after the socket went away = %v, want %v", err, test.err)
+				}
+				return
+			}
+			if len(f.inFlight) != 1 {
+				t.Errorf("%d datagrams in flight, want the unsent one kept for retransmission", len(f.inFlight))
+			}
+		})
+	}
+}
+
+func TestARQUpdateRTT(t *testing.T) {
+	tests := []struct {
+		name    string
+		samples []time.Duration
+		want    time.Duration
+	}{
+		{"first sample", []time.Duration{100 * time.Millisecond}, 300 * time.Millisecond},
+		{"second sample", []time.Duration{100 * time.Millisecond, 200 * time.Millisecond}, 112500*time.Microsecond + 4*62500*time.Microsecond},
+		{"clamped to minimum", []time.Duration{time.Millisecond, time.Millisecond}, arqMinRTO},
+		{"clamped to maximum", []time.Duration{time.Minute}, arqMaxRTO},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newIdleFramer(nil)
+			for _, sample := range test.samples {
+				f.updateRTT(sample)
+			}
+			if f.rto != test.want {
+				t.Errorf("rto = %v, want %v", f.rto, test.want)
+			}
+		})
+	}
+}
+
+func TestARQRetransmitBackoff(t *testing.T) {
+	conn, _ := newPipe()
+	f := newIdleFramer(conn)
+	f.rto = arqMinRTO
+	f.writeFrame(frame{kind: frameData})
+	packet := f.inFlight[0]
+
+	now := time.Now()
+	for transmissions, want := 2, 2*arqMinRTO; transmissions <= 6; transmissions, want = transmissions+1, 2*want {
+		f.retransmitLocked(packet, now)
+		if packet.transmissions != transmissions {
+			t.Fatalf("transmissions = %d, want %d", packet.transmissions, transmissions)
+		}
+		if timeout := packet.deadline.Sub(now); timeout != want {
+			t.Errorf("timeout after %d transmissions = %v, want %v", transmissions, timeout, want)
+		}
+	}
+
+	packet.transmissions = 40
+	f.retransmitLocked(packet, now)
+	if timeout := packet.deadline.Sub(now); timeout != arqMaxRTO {
+		t.Errorf("timeout after 41 transmissions = %v, want %v", timeout, arqMaxRTO)
+	}
+}
+
+func TestARQGivesUp(t *testing.T) {
+	conn, _ := newPipe()
+	f := newIdleFramer(conn)
+	f.writeFrame(frame{kind: frameData})
+
+	now := time.Now()
+	for i := 0; i < arqMaxRetransmits; i++ {
+		now = now.Add(arqMaxRTO)
+		if err := f.onTimer(now); err != nil {
+			t.Fatalf("onTimer gave up after %d retransmissions: %v", i, err)
+		}
+	}
+	if sent := conn.sentData(0); sent != arqMaxRetransmits+1 {
+		t.Errorf("datagram sent %d times, want %d", sent, arqMaxRetransmits+1)
+	}
+
+	err := f.onTimer(now.Add(arqMaxRTO))
+	if !errors.Is(err, errPeerUnreachable) {
+		t.Errorf("onTimer = %v, want %v", err, errPeerUnreachable)
+	}
+}
+
+// TestARQDeliversDespiteLoss sends frames over a link that loses the first
+// transmission of every fourth datagram and every fifth ACK, and expects all
+// of them in order.
+func TestARQDeliversDespiteLoss(t *testing.T) {
+	a, b := newPipe()
+	seen := make(map[uint32]bool)
+	a.setDrop(func(data []byte) bool {
+		seq := binary.BigEndian.Uint32(data[1:arqDataHeaderSize])
+		first := !seen[seq]
+		seen[seq] = true
+		return first && seq%4 == 1
+	})
+	var acks int
+	b.setDrop(func([]byte) bool {
+		acks++
+		return acks%5 == 0
+	})
+
+	sender, receiver := newARQFramer(a), newARQFramer(b)
+	defer sender.fail(errConnectionClosed)
+	defer receiver.fail(errConnectionClosed)
+
+	const frames = 100
+	go func() {
+		for i := 0; i < frames; i++ {
+			sender.writeFrame(frame{kind: frameData, payload: binary.BigEndian.AppendUint32(nil, uint32(i))})
+		}
+	}()
+
+	for i := 0; i < frames; i++ {
+		received := make(chan frame, 1)
+		go func() {
+			fr, _ := receiver.readFrame()
+			received <- fr
+		}()
+		select {
+		case fr := <-received:
+			if got := binary.BigEndian.Uint32(fr.payload); got != uint32(i) {
+				t.Fatalf("frame %d arrived as number %d", i, got)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatalf("frame %d did not arrive", i)
+		}
+	}
+}
+
+// TestARQCloseRetransmitsCloseFrame loses the first transmission of the close
+// frame; close must linger until the retransmission got through.
+func TestARQCloseRetransmitsCloseFrame(t *testing.T) {
+	a, b := newPipe()
+	sender, receiver := newARQFramer(a), newARQFramer(b)
+	defer receiver.fail(errConnectionClosed)
+
+	var dropped bool
+	a.setDrop(func(data []byte) bool {
+		if data[0] == arqData && data[arqDataHeaderSize] == frameClose && !dropped {
+			dropped = true
+			return true
+		}
+		return false
+	})
+
+	if err := sender.writeFrame(frame{kind: frameClose, payload: closePayload(0, "bye")}); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	sender.close()
+
+	select {
+	case fr := <-receiver.deliver:
+		if fr.kind != frameClose {
+			t.Errorf("received frame kind %#x, want the close frame", fr.kind)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close frame was lost with the socket")
+	}
+}
@@ -0,0 +1,54 @@
+package transport
+
+import (
+	"net"
+)
+
+// CaptureFunc is handed every datagram the QUIC and UDP transports send or
+// receive, to record the traffic for debugging. It must not keep payload.
+type CaptureFunc func(src, dst net.Addr, payload []byte)
+
+func (f CaptureFunc) datagram(src, dst net.Addr, payload []byte) {
+	if f != nil {
+		f(src, dst, payload)
+	}
+}
+
+// capturingPacketConn captures the datagrams quic-go sends and receives.
+// It deliberately hides the ReadMsgUDP of the socket, which quic-go would
+// otherwise use instead of ReadFrom.
+type capturingPacketConn struct {
+	net.PacketConn
+	socket  *net.UDPConn
+	capture CaptureFunc
+}
+
+func newCapturingPacketConn(socket *net.UDPConn, capture CaptureFunc) *capturingPacketConn {
+	return &capturingPacketConn{PacketConn: socket, socket: socket, capture: capture}
+}
+
+func (c *capturingPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, address, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		c.capture.datagram(address, c.LocalAddr(), p[:n])
+	}
+	return n, address, err
+}
+
+func (c *capturingPacketConn) WriteTo(p []byte, address net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(p, address)
+	if err == nil {
+		c.capture.datagram(c.LocalAddr(), address, p[:n])
+	}
+	return n, err
+}
+
+// SetReadBuffer and SetWriteBuffer let quic-go size the socket buffers as it
+// would without the capture.
+func (c *capturingPacketConn) SetReadBuffer(bytes int) error {
+	return c.socket.SetReadBuffer(bytes)
+}
+
+func (c *capturingPacketConn) SetWriteBuffer(bytes int) error {
+	return c.socket.SetWriteBuffer(bytes)
+}
@@ -0,0 +1,38 @@
+package transport
+
+import (
+	"context"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// ConnectionIDs remembers the original destination connection ID of every
+// QUIC connection, which quic-go only reveals to tracers, so that log lines can
+// be matched against qlog files and packet captures.
+type ConnectionIDs struct {
+	ids sync.Map
+}
+
+// Tracer is meant to be installed as quic.Config.Tracer.
+func (c *ConnectionIDs) Tracer(ctx context.Context, perspective logging.Perspective, connectionID quic.ConnectionID) *logging.ConnectionTracer {
+	key := ctx.Value(quic.ConnectionTracingKey)
+	c.ids.Store(key, connectionID.String())
+
+	return &logging.ConnectionTracer{
+		Close: func() {
+			c.ids.Delete(key)
+		},
+	}
+}
+
+// Lookup returns the connection ID of conn, or an empty string when conn was
+// not created with Tracer installed.
+func (c *ConnectionIDs) Lookup(conn quic.Connection) string {
+	id, ok := c.ids.Load(conn.Context().Value(quic.ConnectionTracingKey))
+	if !ok {
+		return ""
+	}
+	return id.(string)
+}
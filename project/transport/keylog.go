@@ -0,0 +1,40 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+)
+
+// KeyLogFileEnv names the environment variable that supplies the default key
+// log path, following the convention used by browsers and curl.
+const KeyLogFileEnv = "SSLKEYLOGFILE"
+
+// OpenKeyLog opens path for appending TLS secrets in NSS key log format, to be
+// used as tls.Config.KeyLogWriter. An empty path disables key logging and
+// returns a nil writer. Because the file defeats the encryption of every
+// session it covers, enabling it is announced loudly on stderr and in the log.
+func OpenKeyLog(path string, logger *slog.Logger) (io.WriteCloser, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open TLS key log: %v", err)
+	}
+
+	WarnKeyLogging(path, logger)
+	return file, nil
+}
+
+// WarnKeyLogging announces on stderr and in the log that TLS secrets are
+// written to path, a key log or a capture embedding them.
+func WarnKeyLogging(path string, logger *slog.Logger) {
+	fmt.Fprintf(os.Stderr, "**********************************************************************\n")
+	fmt.Fprintf(os.Stderr, "WARNING: TLS key logging is enabled, secrets are written to %s\n", path)
+	fmt.Fprintf(os.Stderr, "WARNING: anyone holding this file can decrypt the captured traffic\n")
+	fmt.Fprintf(os.Stderr, "**********************************************************************\n")
+	logger.Warn("TLS key logging enabled", "file", path)
+}
@@ -0,0 +1,447 @@
+package transport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The TCP and UDP transports carry QUIC-like streams as frames of
+//
+//	type (1 byte) | stream ID (4 bytes) | payload length (2 bytes) | payload
+//
+// Client streams use IDs 0, 4, 8, ... and server streams 1, 5, 9, ... as in
+// QUIC. A stream comes into existence on the peer with its first frame.
+const (
+	frameOpen  = 0x01
+	frameData  = 0x02
+	frameFin   = 0x03
+	frameClose = 0x04
+	framePing  = 0x05
+
+	frameHeaderSize = 7
+	connectionIDLen = 8
+	acceptQueueSize = 64
+	// maxStreamBuffer bounds the data received on a stream that its reader
+	// has not consumed yet. Frames carry no flow control to slow the peer
+	// down, so a peer that gets this far ahead has its connection closed, as
+	// QUIC does when flow control limits are exceeded.
+	maxStreamBuffer = 1 << 20
+)
+
+var errConnectionClosed = errors.New("connection closed")
+
+type frame struct {
+	kind     uint8
+	streamID uint32
+	payload  []byte
+}
+
+func (f frame) appendTo(buffer []byte) []byte {
+	buffer = append(buffer, f.kind)
+	buffer = binary.BigEndian.AppendUint32(buffer, f.streamID)
+	buffer = binary.BigEndian.AppendUint16(buffer, uint16(len(f.payload)))
+	return append(buffer, f.payload...)
+}
+
+func parseFrame(data []byte) (frame, error) {
+	if len(data) < frameHeaderSize {
+		return frame{}, fmt.Errorf("frame too short: %d bytes", len(data))
+	}
+
+	length := int(binary.BigEndian.Uint16(data[5:7]))
+	if len(data)-frameHeaderSize != length {
+		return frame{}, fmt.Errorf("frame length %d does not match %d payload bytes", length, len(data)-frameHeaderSize)
+	}
+
+	return frame{
+		kind:     data[0],
+		streamID: binary.BigEndian.Uint32(data[1:5]),
+		payload:  data[frameHeaderSize:],
+	}, nil
+}
+
+func closePayload(code uint64, reason string) []byte {
+	return append(binary.BigEndian.AppendUint64(nil, code), reason...)
+}
+
+func parseClosePayload(payload []byte) *CloseError {
+	closeError := &CloseError{Remote: true}
+	if len(payload) >= 8 {
+		closeError.Code = binary.BigEndian.Uint64(payload[:8])
+		closeError.Reason = string(payload[8:])
+	}
+	return closeError
+}
+
+func newConnectionID() string {
+	id := make([]byte, connectionIDLen)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// framer moves whole frames over the underlying socket.
+type framer interface {
+	writeFrame(f frame) error
+	readFrame() (frame, error)
+	close() error
+	localAddr() net.Addr
+	remoteAddr() net.Addr
+}
+
+type muxOptions struct {
+	maxPayload int
+	// keepAlive sends a ping when nothing was sent for this long and
+	// idleTimeout closes the connection when nothing was received; both are
+	// disabled when zero.
+	keepAlive   time.Duration
+	idleTimeout time.Duration
+}
+
+type muxConn struct {
+	framer   framer
+	id       string
+	isClient bool
+	options  muxOptions
+
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	mutex      sync.Mutex
+	streams    map[uint32]*muxStream
+	nextStream uint32
+	closeErr   error
+
+	accept chan *muxStream
+
+	writeMutex   sync.Mutex
+	lastSent     atomic.Int64
+	lastReceived atomic.Int64
+}
+
+func newMuxConn(f framer, isClient bool, id string, options muxOptions) *muxConn {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	c := &muxConn{
+		framer:   f,
+		id:       id,
+		isClient: isClient,
+		options:  options,
+		ctx:      ctx,
+		cancel:   cancel,
+		streams:  make(map[uint32]*muxStream),
+		accept:   make(chan *muxStream, acceptQueueSize),
+	}
+	if !isClient {
+		c.nextStream = 1
+	}
+
+	now := time.Now().UnixNano()
+	c.lastSent.Store(now)
+	c.lastReceived.Store(now)
+
+	go c.readLoop()
+	if options.keepAlive > 0 || options.idleTimeout > 0 {
+		go c.timerLoop()
+	}
+	return c
+}
+
+func (c *muxConn) ID() string {
+	return c.id
+}
+
+func (c *muxConn) Context() context.Context {
+	return c.ctx
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.framer.localAddr()
+}
+
+func (c *muxConn) RemoteAddr() net.Addr {
+	return c.framer.remoteAddr()
+}
+
+func (c *muxConn) OpenStream(ctx context.Context) (Stream, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closeErr != nil {
+		return nil, c.closeErr
+	}
+
+	stream := newMuxStream(c, c.nextStream)
+	c.streams[stream.id] = stream
+	c.nextStream += 4
+	return stream, nil
+}
+
+func (c *muxConn) AcceptStream(ctx context.Context) (Stream, error) {
+	select {
+	case stream := <-c.accept:
+		return stream, nil
+	case <-c.ctx.Done():
+		return nil, context.Cause(c.ctx)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// CloseWithError tells the peer why the connection is closed. The framer
+// delivers the close frame before it lets go of the socket: TCP flushes it on
+// close and the ARQ lingers until it is acknowledged.
+func (c *muxConn) CloseWithError(code uint64, reason string) error {
+	c.writeFrame(frame{kind: frameClose, payload: closePayload(code, reason)})
+	c.shutdown(&CloseError{Code: code, Reason: reason})
+	return nil
+}
+
+func (c *muxConn) writeFrame(f frame) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if err := c.ctx.Err(); err != nil {
+		return context.Cause(c.ctx)
+	}
+
+	if err := c.framer.writeFrame(f); err != nil {
+		return err
+	}
+	c.lastSent.Store(time.Now().UnixNano())
+	return nil
+}
+
+func (c *muxConn) readLoop() {
+	for {
+		f, err := c.framer.readFrame()
+		if err != nil {
+			c.shutdown(err)
+			return
+		}
+		c.lastReceived.Store(time.Now().UnixNano())
+
+		switch f.kind {
+		case frameData, frameFin:
+			c.handleStreamFrame(f)
+		case frameClose:
+			c.shutdown(parseClosePayload(f.payload))
+			return
+		}
+	}
+}
+
+func (c *muxConn) handleStreamFrame(f frame) {
+	c.mutex.Lock()
+	stream, exists := c.streams[f.streamID]
+	if !exists {
+		// Only the peer may create streams with its own parity; anything
+		// else belongs to a stream we already forgot about.
+		peerInitiated := f.streamID%2 == 1
+		if !c.isClient {
+			peerInitiated = f.streamID%2 == 0
+		}
+		if !peerInitiated || c.closeErr != nil {
+			c.mutex.Unlock()
+			return
+		}
+
+		stream = newMuxStream(c, f.streamID)
+		c.streams[f.streamID] = stream
+		select {
+		case c.accept <- stream:
+		default:
+			delete(c.streams, f.streamID)
+			c.mutex.Unlock()
+			return
+		}
+	}
+	c.mutex.Unlock()
+
+	if f.kind == frameData {
+		if !stream.receive(f.payload) {
+			c.CloseWithError(0, fmt.Sprintf("stream %d received more than %d unread bytes", f.streamID, maxStreamBuffer))
+		}
+	} else {
+		stream.receiveFin()
+	}
+}
+
+func (c *muxConn) removeStream(id uint32) {
+	c.mutex.Lock()
+	delete(c.streams, id)
+	c.mutex.Unlock()
+}
+
+func (c *muxConn) timerLoop() {
+	interval := c.options.keepAlive
+	if interval == 0 || (c.options.idleTimeout > 0 && c.options.idleTimeout < interval) {
+		interval = c.options.idleTimeout
+	}
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case now := <-ticker.C:
+			if c.options.idleTimeout > 0 && now.Sub(time.Unix(0, c.lastReceived.Load())) > c.options.idleTimeout {
+				c.shutdown(fmt.Errorf("no recent network activity for %s", c.options.idleTimeout))
+				return
+			}
+			if c.options.keepAlive > 0 && now.Sub(time.Unix(0, c.lastSent.Load())) >= c.options.keepAlive {
+				c.writeFrame(frame{kind: framePing})
+			}
+		}
+	}
+}
+
+// shutdown tears down the connection once; cause is what every pending and
+// future operation reports.
+func (c *muxConn) shutdown(cause error) {
+	c.mutex.Lock()
+	if c.closeErr != nil {
+		c.mutex.Unlock()
+		return
+	}
+	c.closeErr = cause
+	streams := c.streams
+	c.streams = make(map[uint32]*muxStream)
+	c.mutex.Unlock()
+
+	c.cancel(cause)
+	for _, stream := range streams {
+		stream.fail(cause)
+	}
+
+	// The ARQ framer may linger here to get the close frame across.
+	c.framer.close()
+}
+
+type muxStream struct {
+	conn *muxConn
+	id   uint32
+
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	buffer    bytes.Buffer
+	remoteFin bool
+	localFin  bool
+	err       error
+}
+
+func newMuxStream(conn *muxConn, id uint32) *muxStream {
+	s := &muxStream{conn: conn, id: id}
+	s.cond = sync.NewCond(&s.mutex)
+	return s
+}
+
+func (s *muxStream) StreamID() int64 {
+	return int64(s.id)
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for s.buffer.Len() == 0 && !s.remoteFin && s.err == nil {
+		s.cond.Wait()
+	}
+
+	if s.buffer.Len() > 0 {
+		return s.buffer.Read(p)
+	}
+	if s.remoteFin {
+		return 0, io.EOF
+	}
+	return 0, s.err
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	s.mutex.Lock()
+	localFin, err := s.localFin, s.err
+	s.mutex.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	if localFin {
+		return 0, fmt.Errorf("write on closed stream %d", s.id)
+	}
+
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > s.conn.options.maxPayload {
+			chunk = chunk[:s.conn.options.maxPayload]
+		}
+
+		if err := s.conn.writeFrame(frame{kind: frameData, streamID: s.id, payload: chunk}); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+func (s *muxStream) Close() error {
+	s.mutex.Lock()
+	if s.localFin || s.err != nil {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.localFin = true
+	done := s.remoteFin
+	s.mutex.Unlock()
+
+	err := s.conn.writeFrame(frame{kind: frameFin, streamID: s.id})
+	if done {
+		s.conn.removeStream(s.id)
+	}
+	return err
+}
+
+// receive buffers data for Read, and reports false instead when that would
+// take the buffer over maxStreamBuffer.
+func (s *muxStream) receive(data []byte) bool {
+	s.mutex.Lock()
+	overflow := s.buffer.Len()+len(data) > maxStreamBuffer
+	if !s.remoteFin && !overflow {
+		s.buffer.Write(data)
+	}
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+	return !overflow
+}
+
+func (s *muxStream) receiveFin() {
+	s.mutex.Lock()
+	s.remoteFin = true
+	done := s.localFin
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+
+	if done {
+		s.conn.removeStream(s.id)
+	}
+}
+
+func (s *muxStream) fail(err error) {
+	s.mutex.Lock()
+	if s.err == nil {
+		s.err = err
+	}
+	s.mutex.Unlock()
+	s.cond.Broadcast()
+}
@@ -0,0 +1,113 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chanFramer hands the mux the frames pushed into inbound and keeps the ones
+// it writes.
+type chanFramer struct {
+	inbound chan frame
+	closed  chan struct{}
+	once    sync.Once
+
+	mutex   sync.Mutex
+	written []frame
+}
+
+func newChanFramer() *chanFramer {
+	return &chanFramer{inbound: make(chan frame, 64), closed: make(chan struct{})}
+}
+
+func (f *chanFramer) writeFrame(fr frame) error {
+	f.mutex.Lock()
+	f.written = append(f.written, fr)
+	f.mutex.Unlock()
+	return nil
+}
+
+func (f *chanFramer) readFrame() (frame, error) {
+	select {
+	case fr := <-f.inbound:
+		return fr, nil
+	case <-f.closed:
+		return frame{}, errConnectionClosed
+	}
+}
+
+func (f *chanFramer) close() error {
+	f.once.Do(func() { close(f.closed) })
+	return nil
+}
+
+func (f *chanFramer) localAddr() net.Addr  { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1} }
+func (f *chanFramer) remoteAddr() net.Addr { return &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2} }
+
+func (f *chanFramer) writtenKinds() []uint8 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	kinds := make([]uint8, len(f.written))
+	for i, fr := range f.written {
+		kinds[i] = fr.kind
+	}
+	return kinds
+}
+
+func TestMuxStreamBufferLimit(t *testing.T) {
+	framer := newChanFramer()
+	conn := newMuxConn(framer, true, "test", muxOptions{maxPayload: 0xFFFF})
+
+	chunk := make([]byte, 0xFFFF)
+	// Server streams have odd IDs.
+	framer.inbound <- frame{kind: frameData, streamID: 1, payload: []byte("hello")}
+	stream, err := conn.AcceptStream(context.Background())
+	if err != nil {
+		t.Fatalf("AcceptStream: %v", err)
+	}
+	buffer := make([]byte, 5)
+	if _, err := io.ReadFull(stream, buffer); err != nil || string(buffer) != "hello" {
+		t.Fatalf("Read = %q, %v", buffer, err)
+	}
+
+	// Data the reader keeps up with never adds up.
+	for sent := 0; sent <= 2*maxStreamBuffer; sent += len(chunk) {
+		framer.inbound <- frame{kind: frameData, streamID: 1, payload: chunk}
+		if _, err := io.ReadFull(stream, chunk); err != nil {
+			t.Fatalf("Read after %d bytes: %v", sent, err)
+		}
+	}
+	if err := conn.Context().Err(); err != nil {
+		t.Fatalf("connection closed while the reader kept up: %v", context.Cause(conn.Context()))
+	}
+
+	// A reader that falls behind gets the connection closed.
+	for sent := 0; sent <= maxStreamBuffer; sent += len(chunk) {
+		framer.inbound <- frame{kind: frameData, streamID: 1, payload: chunk}
+	}
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection still open with an unread stream over the limit")
+	}
+
+	var closeErr *CloseError
+	if !errors.As(context.Cause(conn.Context()), &closeErr) || closeErr.Remote {
+		t.Errorf("connection closed with %v, want a local CloseError", context.Cause(conn.Context()))
+	}
+	if kinds := framer.writtenKinds(); len(kinds) == 0 || kinds[len(kinds)-1] != frameClose {
+		t.Errorf("frames written = %v, want the peer told with a close frame", kinds)
+	}
+
+	// What was buffered within the limit can still be read before the error.
+	read, err := io.Copy(io.Discard, stream)
+	if read > maxStreamBuffer || err == nil {
+		t.Errorf("read %d bytes and %v after the close, want at most %d and an error", read, err, maxStreamBuffer)
+	}
+}
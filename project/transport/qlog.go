@@ -0,0 +1,74 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+	"github.com/quic-go/quic-go/qlog"
+)
+
+// Tracer has the signature of quic.Config.Tracer.
+type Tracer = func(context.Context, logging.Perspective, quic.ConnectionID) *logging.ConnectionTracer
+
+// QlogTracer writes one qlog file per connection into dir, named
+// <connection ID>_<client|server>.qlog so it can be loaded into qvis. It
+// returns nil when dir is empty.
+func QlogTracer(dir string, logger *slog.Logger) Tracer {
+	if dir == "" {
+		return nil
+	}
+
+	return func(ctx context.Context, perspective logging.Perspective, connectionID quic.ConnectionID) *logging.ConnectionTracer {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			logger.Error("failed to create qlog directory", "dir", dir, "error", err)
+			return nil
+		}
+
+		fileName := filepath.Join(dir, fmt.Sprintf("%s_%s.qlog", connectionID, strings.ToLower(perspective.String())))
+		file, err := os.Create(fileName)
+		if err != nil {
+			logger.Error("failed to create qlog file", "file", fileName, "error", err)
+			return nil
+		}
+
+		logger.Info("writing qlog trace", "conn_id", connectionID.String(), "file", fileName)
+		return qlog.NewConnectionTracer(&bufferedFile{Writer: bufio.NewWriter(file), Closer: file}, perspective, connectionID)
+	}
+}
+
+// CombineTracers calls every non-nil tracer for each new connection.
+func CombineTracers(tracers ...Tracer) Tracer {
+	return func(ctx context.Context, perspective logging.Perspective, connectionID quic.ConnectionID) *logging.ConnectionTracer {
+		var connectionTracers []*logging.ConnectionTracer
+		for _, tracer := range tracers {
+			if tracer == nil {
+				continue
+			}
+			if connectionTracer := tracer(ctx, perspective, connectionID); connectionTracer != nil {
+				connectionTracers = append(connectionTracers, connectionTracer)
+			}
+		}
+		return logging.NewMultiplexedConnectionTracer(connectionTracers...)
+	}
+}
+
+type bufferedFile struct {
+	*bufio.Writer
+	io.Closer
+}
+
+func (f *bufferedFile) Close() error {
+	if err := f.Writer.Flush(); err != nil {
+		f.Closer.Close()
+		return err
+	}
+	return f.Closer.Close()
+}
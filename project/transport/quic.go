@@ -0,0 +1,159 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/quic-go/quic-go"
+)
+
+type quicTransport struct {
+	config        Config
+	connectionIDs *ConnectionIDs
+	quicConfig    *quic.Config
+}
+
+func newQUICTransport(config Config) *quicTransport {
+	t := &quicTransport{
+		config:        config,
+		connectionIDs: &ConnectionIDs{},
+	}
+
+	t.quicConfig = &quic.Config{
+		EnableDatagrams: config.EnableDatagrams,
+		Tracer: CombineTracers(
+			t.connectionIDs.Tracer,
+			QlogTracer(config.QlogDir, config.Logger),
+		),
+	}
+	return t
+}
+
+func (t *quicTransport) Dial(ctx context.Context, address string) (Conn, error) {
+	if t.config.Capture != nil {
+		return t.dialCapturing(ctx, address)
+	}
+
+	conn, err := quic.DialAddr(ctx, address, t.config.TLSConfig, t.quicConfig)
+	if err != nil {
+		return nil, err
+	}
+	return t.wrap(conn), nil
+}
+
+// dialCapturing dials from a socket of its own so that its datagrams can be
+// captured. quic-go leaves closing such a socket to the caller.
+func (t *quicTransport) dialCapturing(ctx context.Context, address string) (Conn, error) {
+	remoteAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %v", err)
+	}
+
+	socket, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open UDP socket: %v", err)
+	}
+
+	conn, err := quic.Dial(ctx, newCapturingPacketConn(socket, t.config.Capture), remoteAddress, t.config.TLSConfig, t.quicConfig)
+	if err != nil {
+		socket.Close()
+		return nil, err
+	}
+
+	go func() {
+		<-conn.Context().Done()
+		socket.Close()
+	}()
+	return t.wrap(conn), nil
+}
+
+func (t *quicTransport) Listen(address string) (Listener, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %v", err)
+	}
+
+	socket, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen UDP: %v", err)
+	}
+
+	var packetConn net.PacketConn = socket
+	if t.config.Capture != nil {
+		packetConn = newCapturingPacketConn(socket, t.config.Capture)
+	}
+
+	listener, err := quic.Listen(packetConn, t.config.TLSConfig, t.quicConfig)
+	if err != nil {
+		socket.Close()
+		return nil, fmt.Errorf("failed to create QUIC listener: %v", err)
+	}
+
+	return &quicListener{Listener: listener, socket: socket, transport: t}, nil
+}
+
+func (t *quicTransport) wrap(conn quic.Connection) *quicConn {
+	return &quicConn{Connection: conn, id: t.connectionIDs.Lookup(conn)}
+}
+
+type quicListener struct {
+	*quic.Listener
+	socket    *net.UDPConn
+	transport *quicTransport
+}
+
+func (l *quicListener) Accept(ctx context.Context) (Conn, error) {
+	conn, err := l.Listener.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return l.transport.wrap(conn), nil
+}
+
+func (l *quicListener) Close() error {
+	err := l.Listener.Close()
+	l.socket.Close()
+	return err
+}
+
+type quicConn struct {
+	quic.Connection
+	id string
+}
+
+func (c *quicConn) OpenStream(ctx context.Context) (Stream, error) {
+	stream, err := c.Connection.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return quicStream{stream}, nil
+}
+
+func (c *quicConn) AcceptStream(ctx context.Context) (Stream, error) {
+	stream, err := c.Connection.AcceptStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return quicStream{stream}, nil
+}
+
+func (c *quicConn) ID() string {
+	return c.id
+}
+
+func (c *quicConn) SupportsDatagrams() bool {
+	return c.ConnectionState().SupportsDatagrams
+}
+
+func (c *quicConn) CloseWithError(code uint64, reason string) error {
+	return c.Connection.CloseWithError(quic.ApplicationErrorCode(code), reason)
+}
+
+type quicStream struct {
+	quic.Stream
+}
+
+func (s quicStream) StreamID() int64 {
+	return int64(s.Stream.StreamID())
+}
@@ -0,0 +1,182 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	tcpMaxPayload       = 16 * 1024
+	tcpHandshakeTimeout = 10 * time.Second
+)
+
+// tcpTransport runs the stream multiplexer over a single TLS-over-TCP
+// connection, for sites where firewalls drop UDP.
+type tcpTransport struct {
+	config Config
+}
+
+func newTCPTransport(config Config) *tcpTransport {
+	return &tcpTransport{config: config}
+}
+
+func (t *tcpTransport) options() muxOptions {
+	return muxOptions{maxPayload: tcpMaxPayload}
+}
+
+func (t *tcpTransport) Dial(ctx context.Context, address string) (Conn, error) {
+	dialer := &tls.Dialer{Config: t.config.TLSConfig}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	f := newTCPFramer(conn)
+	id := newConnectionID()
+	if err := f.writeFrame(frame{kind: frameOpen, payload: []byte(id)}); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open session: %v", err)
+	}
+
+	return newMuxConn(f, true, id, t.options()), nil
+}
+
+func (t *tcpTransport) Listen(address string) (Listener, error) {
+	listener, err := tls.Listen("tcp", address, t.config.TLSConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen TCP: %v", err)
+	}
+
+	l := &tcpListener{
+		listener:  listener,
+		transport: t,
+		accepted:  make(chan *muxConn, acceptQueueSize),
+		done:      make(chan struct{}),
+	}
+	go l.acceptLoop()
+	return l, nil
+}
+
+type tcpListener struct {
+	listener  net.Listener
+	transport *tcpTransport
+	accepted  chan *muxConn
+	done      chan struct{}
+	err       error
+}
+
+func (l *tcpListener) acceptLoop() {
+	defer close(l.done)
+
+	for {
+		conn, err := l.listener.Accept()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				continue
+			}
+			l.err = err
+			return
+		}
+
+		go l.handshake(conn)
+	}
+}
+
+// handshake waits for the TLS handshake and the client's open frame without
+// holding up other connections.
+func (l *tcpListener) handshake(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(tcpHandshakeTimeout))
+
+	f := newTCPFramer(conn)
+	open, err := f.readFrame()
+	if err != nil || open.kind != frameOpen || len(open.payload) != 2*connectionIDLen {
+		l.transport.config.Logger.Debug("rejected TCP connection", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	select {
+	case l.accepted <- newMuxConn(f, false, string(open.payload), l.transport.options()):
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+func (l *tcpListener) Accept(ctx context.Context) (Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *tcpListener) Addr() net.Addr {
+	return l.listener.Addr()
+}
+
+func (l *tcpListener) Close() error {
+	return l.listener.Close()
+}
+
+type tcpFramer struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	writeBuffer []byte
+}
+
+func newTCPFramer(conn net.Conn) *tcpFramer {
+	return &tcpFramer{
+		conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+}
+
+// writeFrame is serialised by muxConn.writeMutex, apart from the open frame
+// which is written before the mux starts.
+func (f *tcpFramer) writeFrame(fr frame) error {
+	f.writeBuffer = fr.appendTo(f.writeBuffer[:0])
+	_, err := f.conn.Write(f.writeBuffer)
+	return err
+}
+
+func (f *tcpFramer) readFrame() (frame, error) {
+	header := make([]byte, frameHeaderSize)
+	if _, err := io.ReadFull(f.reader, header); err != nil {
+		return frame{}, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint16(header[5:7]))
+	if _, err := io.ReadFull(f.reader, payload); err != nil {
+		return frame{}, err
+	}
+
+	return frame{
+		kind:     header[0],
+		streamID: binary.BigEndian.Uint32(header[1:5]),
+		payload:  payload,
+	}, nil
+}
+
+func (f *tcpFramer) close() error {
+	return f.conn.Close()
+}
+
+func (f *tcpFramer) localAddr() net.Addr {
+	return f.conn.LocalAddr()
+}
+
+func (f *tcpFramer) remoteAddr() net.Addr {
+	return f.conn.RemoteAddr()
+}
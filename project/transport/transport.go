@@ -0,0 +1,124 @@
+// Package transport connects the PIDS publisher and subscriber over QUIC, or
+// over TCP or UDP with a stream multiplexer of its own, and holds what the
+// connections share: connection IDs for logs, qlog tracing, TLS key logs and
+// packet captures.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+)
+
+const (
+	KindQUIC = "quic"
+	KindTCP  = "tcp"
+	KindUDP  = "udp"
+)
+
+// Kinds lists the transports accepted by New, for flag help texts.
+var Kinds = []string{KindQUIC, KindTCP, KindUDP}
+
+// Transport creates connections between a PIDS publisher and subscriber. The
+// QUIC implementation maps directly onto quic-go, the TCP and UDP ones
+// multiplex QUIC-like bidirectional streams over a single socket.
+type Transport interface {
+	Dial(ctx context.Context, address string) (Conn, error)
+	Listen(address string) (Listener, error)
+}
+
+type Listener interface {
+	Accept(ctx context.Context) (Conn, error)
+	Addr() net.Addr
+	Close() error
+}
+
+type Conn interface {
+	// OpenStream opens a new bidirectional stream. The peer only learns about
+	// it once data or a close has been sent on it.
+	OpenStream(ctx context.Context) (Stream, error)
+	AcceptStream(ctx context.Context) (Stream, error)
+	LocalAddr() net.Addr
+	RemoteAddr() net.Addr
+	// ID identifies the connection in logs, and is the same on both peers.
+	ID() string
+	// Context is cancelled when the connection is closed.
+	Context() context.Context
+	CloseWithError(code uint64, reason string) error
+}
+
+// Stream is a bidirectional byte stream. Close only ends the write direction,
+// the peer reads io.EOF once it has consumed everything written before.
+type Stream interface {
+	io.ReadWriteCloser
+	StreamID() int64
+}
+
+// DatagramConn is implemented by connections that can send unreliable
+// datagrams next to their streams. Use Datagrams to find out whether both
+// peers actually negotiated them.
+type DatagramConn interface {
+	SendDatagram(payload []byte) error
+	ReceiveDatagram(ctx context.Context) ([]byte, error)
+	SupportsDatagrams() bool
+}
+
+// Datagrams returns the datagram side of conn, or false when the transport
+// has none or the peer did not enable it.
+func Datagrams(conn Conn) (DatagramConn, bool) {
+	datagrams, ok := conn.(DatagramConn)
+	if !ok || !datagrams.SupportsDatagrams() {
+		return nil, false
+	}
+	return datagrams, true
+}
+
+type Config struct {
+	// TLSConfig secures QUIC and TCP connections. UDP traffic is not
+	// encrypted.
+	TLSConfig *tls.Config
+	// QlogDir enables qlog tracing of QUIC connections when non-empty.
+	QlogDir string
+	// EnableDatagrams offers QUIC DATAGRAM frames to the peer, see
+	// DatagramConn. The TCP and UDP transports ignore it.
+	EnableDatagrams bool
+	// Capture records the datagrams of QUIC and UDP connections. The TCP
+	// transport ignores it.
+	Capture CaptureFunc
+	Logger  *slog.Logger
+}
+
+func New(kind string, config Config) (Transport, error) {
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	switch kind {
+	case KindQUIC:
+		return newQUICTransport(config), nil
+	case KindTCP:
+		return newTCPTransport(config), nil
+	case KindUDP:
+		return newUDPTransport(config), nil
+	}
+	return nil, fmt.Errorf("unknown transport %q", kind)
+}
+
+// CloseError is returned by stream and connection operations once a mux
+// connection has been closed with CloseWithError by either side.
+type CloseError struct {
+	Code   uint64
+	Reason string
+	Remote bool
+}
+
+func (e *CloseError) Error() string {
+	side := "local"
+	if e.Remote {
+		side = "remote"
+	}
+	return fmt.Sprintf("Application error %#x (%s): %s", e.Code, side, e.Reason)
+}
@@ -0,0 +1,292 @@
+package transport
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// udpMaxPayload keeps every datagram within the 1200 bytes QUIC assumes
+	// any path can carry without fragmentation.
+	udpMaxPayload   = 1200 - arqDataHeaderSize - frameHeaderSize
+	udpBufferSize   = 2048
+	udpInboundQueue = 256
+	udpKeepAlive    = 5 * time.Second
+	udpIdleTimeout  = 30 * time.Second
+	udpNetwork      = "udp"
+)
+
+// udpTransport sends every mux frame as its own datagram, made reliable by the
+// ARQ in arq.go. It is meant for legacy display controllers that only speak
+// plain UDP, so nothing is encrypted.
+type udpTransport struct {
+	config Config
+}
+
+func newUDPTransport(config Config) *udpTransport {
+	return &udpTransport{config: config}
+}
+
+func (t *udpTransport) options() muxOptions {
+	return muxOptions{
+		maxPayload:  udpMaxPayload,
+		keepAlive:   udpKeepAlive,
+		idleTimeout: udpIdleTimeout,
+	}
+}
+
+func (t *udpTransport) Dial(ctx context.Context, address string) (Conn, error) {
+	remoteAddress, err := net.ResolveUDPAddr(udpNetwork, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %v", err)
+	}
+
+	socket, err := net.DialUDP(udpNetwork, nil, remoteAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	f := newARQFramer(&udpClientConn{socket: socket, capture: t.config.Capture})
+	id := newConnectionID()
+	if err := f.writeFrame(frame{kind: frameOpen, payload: []byte(id)}); err != nil {
+		f.close()
+		return nil, fmt.Errorf("failed to open session: %v", err)
+	}
+
+	return newMuxConn(f, true, id, t.options()), nil
+}
+
+func (t *udpTransport) Listen(address string) (Listener, error) {
+	localAddress, err := net.ResolveUDPAddr(udpNetwork, address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve address: %v", err)
+	}
+
+	socket, err := net.ListenUDP(udpNetwork, localAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen UDP: %v", err)
+	}
+
+	l := &udpListener{
+		socket:    socket,
+		transport: t,
+		peers:     make(map[string]*udpPeerConn),
+		accepted:  make(chan *muxConn, acceptQueueSize),
+		done:      make(chan struct{}),
+	}
+	go l.readLoop()
+	return l, nil
+}
+
+type udpClientConn struct {
+	socket     *net.UDPConn
+	capture    CaptureFunc
+	readBuffer [udpBufferSize]byte
+}
+
+func (c *udpClientConn) send(data []byte) error {
+	_, err := c.socket.Write(data)
+	if err == nil {
+		c.capture.datagram(c.socket.LocalAddr(), c.socket.RemoteAddr(), data)
+	}
+	return err
+}
+
+func (c *udpClientConn) receive() ([]byte, error) {
+	for {
+		n, err := c.socket.Read(c.readBuffer[:])
+		if err != nil {
+			// An ICMP port unreachable only means the subscriber is not up
+			// yet; retransmissions keep trying until the ARQ gives up.
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			return nil, err
+		}
+		c.capture.datagram(c.socket.RemoteAddr(), c.socket.LocalAddr(), c.readBuffer[:n])
+		return append([]byte(nil), c.readBuffer[:n]...), nil
+	}
+}
+
+func (c *udpClientConn) close() error {
+	return c.socket.Close()
+}
+
+func (c *udpClientConn) localAddr() net.Addr {
+	return c.socket.LocalAddr()
+}
+
+func (c *udpClientConn) remoteAddr() net.Addr {
+	return c.socket.RemoteAddr()
+}
+
+// udpListener demultiplexes datagrams arriving on one socket into a
+// connection per remote address, in the spirit of samples/udp/server.
+type udpListener struct {
+	socket    *net.UDPConn
+	transport *udpTransport
+
+	mutex sync.Mutex
+	peers map[string]*udpPeerConn
+
+	accepted chan *muxConn
+	done     chan struct{}
+	err      error
+}
+
+func (l *udpListener) readLoop() {
+	defer close(l.done)
+
+	buffer := make([]byte, udpBufferSize)
+	for {
+		n, address, err := l.socket.ReadFromUDP(buffer)
+		if err != nil {
+			l.err = err
+			l.closePeers()
+			return
+		}
+
+		l.transport.config.Capture.datagram(address, l.socket.LocalAddr(), buffer[:n])
+		l.dispatch(address, append([]byte(nil), buffer[:n]...))
+	}
+}
+
+func (l *udpListener) dispatch(address *net.UDPAddr, data []byte) {
+	key := address.String()
+
+	l.mutex.Lock()
+	peer, exists := l.peers[key]
+	if !exists {
+		// Only the first datagram of a session, carrying the open frame,
+		// may create a connection.
+		id, ok := parseOpenDatagram(data)
+		if !ok {
+			l.mutex.Unlock()
+			return
+		}
+
+		peer = &udpPeerConn{
+			listener: l,
+			address:  address,
+			inbound:  make(chan []byte, udpInboundQueue),
+			closed:   make(chan struct{}),
+		}
+		l.peers[key] = peer
+		l.mutex.Unlock()
+
+		peer.inbound <- data
+		select {
+		case l.accepted <- newMuxConn(newARQFramer(peer), false, id, l.transport.options()):
+		default:
+			peer.close()
+		}
+		return
+	}
+	l.mutex.Unlock()
+
+	select {
+	case peer.inbound <- data:
+	default:
+		// Behave like a full socket buffer and drop the datagram.
+	}
+}
+
+func parseOpenDatagram(data []byte) (string, bool) {
+	if len(data) < arqDataHeaderSize || data[0] != arqData || binary.BigEndian.Uint32(data[1:arqDataHeaderSize]) != 0 {
+		return "", false
+	}
+
+	fr, err := parseFrame(data[arqDataHeaderSize:])
+	if err != nil || fr.kind != frameOpen || len(fr.payload) != 2*connectionIDLen {
+		return "", false
+	}
+	return string(fr.payload), true
+}
+
+func (l *udpListener) removePeer(peer *udpPeerConn) {
+	l.mutex.Lock()
+	if l.peers[peer.address.String()] == peer {
+		delete(l.peers, peer.address.String())
+	}
+	l.mutex.Unlock()
+}
+
+func (l *udpListener) closePeers() {
+	l.mutex.Lock()
+	peers := make([]*udpPeerConn, 0, len(l.peers))
+	for _, peer := range l.peers {
+		peers = append(peers, peer)
+	}
+	l.mutex.Unlock()
+
+	for _, peer := range peers {
+		peer.close()
+	}
+}
+
+func (l *udpListener) Accept(ctx context.Context) (Conn, error) {
+	select {
+	case conn := <-l.accepted:
+		return conn, nil
+	case <-l.done:
+		return nil, l.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *udpListener) Addr() net.Addr {
+	return l.socket.LocalAddr()
+}
+
+func (l *udpListener) Close() error {
+	return l.socket.Close()
+}
+
+type udpPeerConn struct {
+	listener *udpListener
+	address  *net.UDPAddr
+	inbound  chan []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func (c *udpPeerConn) send(data []byte) error {
+	_, err := c.listener.socket.WriteToUDP(data, c.address)
+	if err == nil {
+		c.listener.transport.config.Capture.datagram(c.listener.socket.LocalAddr(), c.address, data)
+	}
+	return err
+}
+
+func (c *udpPeerConn) receive() ([]byte, error) {
+	select {
+	case data := <-c.inbound:
+		return data, nil
+	case <-c.closed:
+		return nil, errConnectionClosed
+	}
+}
+
+func (c *udpPeerConn) close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.listener.removePeer(c)
+	})
+	return nil
+}
+
+func (c *udpPeerConn) localAddr() net.Addr {
+	return c.listener.socket.LocalAddr()
+}
+
+func (c *udpPeerConn) remoteAddr() net.Addr {
+	return c.address
+}
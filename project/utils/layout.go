@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+)
+
+// FieldKind is how one field of the packet layout is put on the wire.
+type FieldKind int
+
+const (
+	// FieldUint8 and FieldUint16 are big-endian unsigned integers.
+	FieldUint8 FieldKind = iota
+	FieldUint16
+	// FieldFlag is a single byte that is 1 when set.
+	FieldFlag
+	// FieldLength is a single byte holding the length of the FieldString
+	// right after it. Encode fills it in from the string.
+	FieldLength
+	// FieldString is as many bytes as the FieldLength before it says.
+	FieldString
+)
+
+// Errors wrapped in a DecodeError, for use with errors.Is. Decode only
+// reports ErrTruncated; the others come from DecodeStrict.
+var (
+	ErrTruncated    = errors.New("packet is truncated")
+	ErrTrailingData = errors.New("trailing bytes after the packet")
+	ErrInvalidUTF8  = errors.New("invalid UTF-8")
+	ErrInvalidFlag  = errors.New("flag is neither 0 nor 1")
+	ErrEventFlags   = errors.New("neither an ACK nor an event, or both")
+)
+
+// DecodeError reports malformed input to Decode and DecodeStrict. Offset is
+// where in the input the problem starts, and Field the layout field found
+// there, empty when the problem is with the packet as a whole.
+type DecodeError struct {
+	Field  string
+	Offset int
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	field := e.Field
+	if field == "" {
+		field = "packet"
+	}
+	return fmt.Sprintf("error decoding %s at offset %d: %v", field, e.Offset, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// Size is the number of bytes the kind takes on the wire, 0 for strings.
+func (kind FieldKind) Size() int {
+	switch kind {
+	case FieldUint16:
+		return 2
+	case FieldString:
+		return 0
+	}
+	return 1
+}
+
+func (kind FieldKind) String() string {
+	switch kind {
+	case FieldUint8:
+		return "uint8"
+	case FieldUint16:
+		return "uint16"
+	case FieldFlag:
+		return "flag"
+	case FieldLength:
+		return "length"
+	case FieldString:
+		return "string"
+	}
+	return fmt.Sprintf("FieldKind(%d)", int(kind))
+}
+
+// Field is one field of the packet layout, named after the LRTPIDSPacket
+// field that holds it.
+type Field struct {
+	Name        string
+	Kind        FieldKind
+	Description string
+	// Event names the event a FieldFlag announces, as EventType does.
+	Event string
+	// Optional fields trail the packet and are missing from packets sent
+	// by older publishers.
+	Optional bool
+
+	index int
+}
+
+// PacketLayout is the wire format of LRTPIDSPacket, in order. Encode and
+// Decode walk it, and the Wireshark dissector is generated from it, so a
+// field added here shows up everywhere at once. A FieldLength is always
+// followed by its FieldString, and only the last fields may be optional;
+// the tests check both.
+var PacketLayout = []Field{
+	{Name: "TransactionID", Kind: FieldUint16, Description: "Transaction ID"},
+	{Name: "IsAck", Kind: FieldFlag, Description: "Acknowledgement", Event: "ack"},
+	{Name: "IsNewTrain", Kind: FieldFlag, Description: "New train", Event: "new"},
+	{Name: "IsUpdateTrain", Kind: FieldFlag, Description: "Update train", Event: "update"},
+	{Name: "IsDeleteTrain", Kind: FieldFlag, Description: "Delete train", Event: "delete"},
+	{Name: "IsTrainArriving", Kind: FieldFlag, Description: "Train arriving", Event: "arriving"},
+	{Name: "IsTrainDeparting", Kind: FieldFlag, Description: "Train departing", Event: "departing"},
+	{Name: "TrainNumber", Kind: FieldUint16, Description: "Train number"},
+	{Name: "DestinationLength", Kind: FieldLength, Description: "Destination length"},
+	{Name: "Destination", Kind: FieldString, Description: "Destination"},
+	{Name: "Sequence", Kind: FieldUint16, Description: "Sequence number", Optional: true},
+}
+
+// init resolves the struct field behind each layout field once, so that
+// Encode and Decode do not look them up by name for every packet.
+func init() {
+	packetType := reflect.TypeOf(LRTPIDSPacket{})
+	for i := range PacketLayout {
+		structField, ok := packetType.FieldByName(PacketLayout[i].Name)
+		if !ok {
+			panic(fmt.Sprintf("packet layout names unknown field %s", PacketLayout[i].Name))
+		}
+		PacketLayout[i].index = structField.Index[0]
+	}
+}
+
+func (field Field) encode(buffer *bytes.Buffer, value reflect.Value) error {
+	switch field.Kind {
+	case FieldUint16:
+		return binary.Write(buffer, binary.BigEndian, uint16(value.Uint()))
+	case FieldString:
+		_, err := buffer.WriteString(value.String())
+		return err
+	}
+	return binary.Write(buffer, binary.BigEndian, uint8(value.Uint()))
+}
+
+// decode reads the field into value. length is the value of the preceding
+// FieldLength for strings.
+func (field Field) decode(buffer *bytes.Reader, value reflect.Value, length uint64) error {
+	switch field.Kind {
+	case FieldUint16:
+		var number uint16
+		if err := binary.Read(buffer, binary.BigEndian, &number); err != nil {
+			return err
+		}
+		value.SetUint(uint64(number))
+	case FieldString:
+		if length == 0 {
+			value.SetString("")
+			return nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(buffer, data); err != nil {
+			return err
+		}
+		value.SetString(string(data))
+	default:
+		var number uint8
+		if err := binary.Read(buffer, binary.BigEndian, &number); err != nil {
+			return err
+		}
+		value.SetUint(uint64(number))
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+// Package lifecycle defines the states a train goes through on the PIDS and
+// the events, carried by the flag bits of LRTPIDSPacket, that move it
+// between them:
+//
+//	absent --new--> scheduled --arriving--> arriving --departing--> departing
+//
+// Updates keep a train in its state and delete returns it to absent from
+// anywhere. Both the publisher and the subscriber check packets against the
+// same table, so they agree on which sequences are invalid.
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+type State string
+
+const (
+	Absent    State = "absent"
+	Scheduled State = "scheduled"
+	Arriving  State = "arriving"
+	Departing State = "departing"
+)
+
+// States lists every state, for registering hooks on all of them.
+var States = []State{Absent, Scheduled, Arriving, Departing}
+
+type Event string
+
+const (
+	EventNew       Event = "new"
+	EventUpdate    Event = "update"
+	EventArriving  Event = "arriving"
+	EventDeparting Event = "departing"
+	EventDelete    Event = "delete"
+)
+
+var transitions = map[State]map[Event]State{
+	Absent: {
+		EventNew: Scheduled,
+	},
+	Scheduled: {
+		EventUpdate:   Scheduled,
+		EventArriving: Arriving,
+		EventDelete:   Absent,
+	},
+	Arriving: {
+		EventUpdate:    Arriving,
+		EventDeparting: Departing,
+		EventDelete:    Absent,
+	},
+	Departing: {
+		EventUpdate: Departing,
+		EventDelete: Absent,
+	},
+}
+
+// forced is where Force takes events that are not allowed; updates keep the
+// current state, or create the train when it does not exist.
+var forced = map[Event]State{
+	EventNew:       Scheduled,
+	EventArriving:  Arriving,
+	EventDeparting: Departing,
+	EventDelete:    Absent,
+}
+
+var ErrNoEvent = errors.New("packet carries no event")
+
+// TransitionError reports an event that is not allowed in the state the
+// train is in.
+type TransitionError struct {
+	TrainNumber uint16
+	From        State
+	Event       Event
+}
+
+func (e *TransitionError) Error() string {
+	if e.From == Absent {
+		return fmt.Sprintf("train %d: %s event for a train that does not exist", e.TrainNumber, e.Event)
+	}
+	return fmt.Sprintf("train %d: %s event not allowed while %s", e.TrainNumber, e.Event, e.From)
+}
+
+// Next returns the state event leads to from state, false when the event is
+// not allowed there.
+func Next(from State, event Event) (State, bool) {
+	to, ok := transitions[from][event]
+	return to, ok
+}
+
+// Events lists the events carried by packet in lifecycle order, which is
+// the order they are applied in when a packet sets several flags.
+func Events(packet utils.LRTPIDSPacket) []Event {
+	var events []Event
+	if packet.IsNewTrain == 1 {
+		events = append(events, EventNew)
+	}
+	if packet.IsUpdateTrain == 1 {
+		events = append(events, EventUpdate)
+	}
+	if packet.IsTrainArriving == 1 {
+		events = append(events, EventArriving)
+	}
+	if packet.IsTrainDeparting == 1 {
+		events = append(events, EventDeparting)
+	}
+	if packet.IsDeleteTrain == 1 {
+		events = append(events, EventDelete)
+	}
+	return events
+}
+
+type Transition struct {
+	TrainNumber uint16
+	// Event is empty for transitions made with Machine.Set.
+	Event Event
+	From  State
+	To    State
+}
+
+type Hook func(Transition)
+
+// Machine tracks the state of every train. It is not safe for concurrent
+// use; the registries that own one guard it with their own lock, and hooks
+// run under that lock so they must not call back into the registry.
+type Machine struct {
+	states map[uint16]State
+	enter  map[State][]Hook
+	leave  map[State][]Hook
+}
+
+func NewMachine() *Machine {
+	return &Machine{
+		states: make(map[uint16]State),
+		enter:  make(map[State][]Hook),
+		leave:  make(map[State][]Hook),
+	}
+}
+
+// OnEnter runs hook whenever a train enters state. Updates, which keep the
+// train where it is, do not count as entering.
+func (m *Machine) OnEnter(state State, hook Hook) {
+	m.enter[state] = append(m.enter[state], hook)
+}
+
+// OnLeave runs hook whenever a train leaves state.
+func (m *Machine) OnLeave(state State, hook Hook) {
+	m.leave[state] = append(m.leave[state], hook)
+}
+
+func (m *Machine) State(trainNumber uint16) State {
+	if state, exists := m.states[trainNumber]; exists {
+		return state
+	}
+	return Absent
+}
+
+// Check returns the transitions packet would make without making them.
+func (m *Machine) Check(packet utils.LRTPIDSPacket) ([]Transition, error) {
+	events := Events(packet)
+	if len(events) == 0 {
+		return nil, fmt.Errorf("train %d: %w", packet.TrainNumber, ErrNoEvent)
+	}
+
+	state := m.State(packet.TrainNumber)
+	transitions := make([]Transition, 0, len(events))
+	for _, event := range events {
+		next, ok := Next(state, event)
+		if !ok {
+			return nil, &TransitionError{TrainNumber: packet.TrainNumber, From: state, Event: event}
+		}
+		transitions = append(transitions, Transition{
+			TrainNumber: packet.TrainNumber,
+			Event:       event,
+			From:        state,
+			To:          next,
+		})
+		state = next
+	}
+	return transitions, nil
+}
+
+// Apply makes the transitions of packet, or none of them when one is not
+// allowed, and returns the resulting state.
+func (m *Machine) Apply(packet utils.LRTPIDSPacket) (State, error) {
+	transitions, err := m.Check(packet)
+	if err != nil {
+		return m.State(packet.TrainNumber), err
+	}
+
+	for _, transition := range transitions {
+		m.move(transition)
+	}
+	return m.State(packet.TrainNumber), nil
+}
+
+// Force makes the transitions of packet whether they are allowed or not,
+// taking each event to the state it is named after, and returns the
+// resulting state. It is meant for tools that must be able to send anything.
+func (m *Machine) Force(packet utils.LRTPIDSPacket) State {
+	state := m.State(packet.TrainNumber)
+	for _, event := range Events(packet) {
+		next, ok := Next(state, event)
+		if !ok {
+			next = forced[event]
+			if next == "" {
+				next = state
+			}
+			if next == Absent && event != EventDelete {
+				next = Scheduled
+			}
+		}
+		m.move(Transition{TrainNumber: packet.TrainNumber, Event: event, From: state, To: next})
+		state = next
+	}
+	return state
+}
+
+// Set moves a train to state without validation, e.g. when restoring saved
+// state or taking over a sync response. Hooks still run.
+func (m *Machine) Set(trainNumber uint16, state State) {
+	m.move(Transition{TrainNumber: trainNumber, From: m.State(trainNumber), To: state})
+}
+
+func (m *Machine) move(transition Transition) {
+	if transition.To == Absent {
+		delete(m.states, transition.TrainNumber)
+	} else {
+		m.states[transition.TrainNumber] = transition.To
+	}
+
+	if transition.From == transition.To {
+		return
+	}
+	for _, hook := range m.leave[transition.From] {
+		hook(transition)
+	}
+	for _, hook := range m.enter[transition.To] {
+		hook(transition)
+	}
+}
@@ -0,0 +1,225 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+var allEvents = []Event{EventNew, EventUpdate, EventArriving, EventDeparting, EventDelete}
+
+func TestNext(t *testing.T) {
+	legal := map[State]map[Event]State{
+		Absent:    {EventNew: Scheduled},
+		Scheduled: {EventUpdate: Scheduled, EventArriving: Arriving, EventDelete: Absent},
+		Arriving:  {EventUpdate: Arriving, EventDeparting: Departing, EventDelete: Absent},
+		Departing: {EventUpdate: Departing, EventDelete: Absent},
+	}
+
+	for _, from := range States {
+		for _, event := range allEvents {
+			want, wantOK := legal[from][event]
+			got, ok := Next(from, event)
+			if got != want || ok != wantOK {
+				t.Errorf("Next(%s, %s) = %q, %v, want %q, %v", from, event, got, ok, want, wantOK)
+			}
+		}
+	}
+}
+
+func TestEventsInLifecycleOrder(t *testing.T) {
+	packet := utils.LRTPIDSPacket{IsNewTrain: 1, IsUpdateTrain: 1, IsDeleteTrain: 1, IsTrainArriving: 1, IsTrainDeparting: 1}
+	want := []Event{EventNew, EventUpdate, EventArriving, EventDeparting, EventDelete}
+	if got := Events(packet); !reflect.DeepEqual(got, want) {
+		t.Errorf("Events = %v, want %v", got, want)
+	}
+	if got := Events(utils.LRTPIDSPacket{IsAck: 1}); len(got) != 0 {
+		t.Errorf("Events of an ACK = %v, want none", got)
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   State
+		packet utils.LRTPIDSPacket
+		want   State
+		// err is the TransitionError expected, nil when the packet is
+		// allowed.
+		err *TransitionError
+	}{
+		{"new", Absent, utils.LRTPIDSPacket{IsNewTrain: 1}, Scheduled, nil},
+		{"update keeps the state", Arriving, utils.LRTPIDSPacket{IsUpdateTrain: 1}, Arriving, nil},
+		{"new and arriving at once", Absent, utils.LRTPIDSPacket{IsNewTrain: 1, IsTrainArriving: 1}, Arriving, nil},
+		{"delete from departing", Departing, utils.LRTPIDSPacket{IsDeleteTrain: 1}, Absent, nil},
+		{"update before new", Absent, utils.LRTPIDSPacket{IsUpdateTrain: 1}, Absent, &TransitionError{From: Absent, Event: EventUpdate}},
+		{"new twice", Scheduled, utils.LRTPIDSPacket{IsNewTrain: 1}, Scheduled, &TransitionError{From: Scheduled, Event: EventNew}},
+		{"departing before arriving", Scheduled, utils.LRTPIDSPacket{IsTrainDeparting: 1}, Scheduled, &TransitionError{From: Scheduled, Event: EventDeparting}},
+		{"arriving again", Departing, utils.LRTPIDSPacket{IsTrainArriving: 1}, Departing, &TransitionError{From: Departing, Event: EventArriving}},
+		// The second event is refused, so the first is not made either.
+		{"all or nothing", Absent, utils.LRTPIDSPacket{IsNewTrain: 1, IsTrainDeparting: 1}, Absent, &TransitionError{From: Scheduled, Event: EventDeparting}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMachine()
+			m.Set(7, test.from)
+			test.packet.TrainNumber = 7
+
+			state, err := m.Apply(test.packet)
+			if state != test.want || m.State(7) != test.want {
+				t.Errorf("Apply = %s, State = %s, want %s", state, m.State(7), test.want)
+			}
+
+			if test.err == nil {
+				if err != nil {
+					t.Errorf("Apply: %v", err)
+				}
+				return
+			}
+			test.err.TrainNumber = 7
+			var transitionErr *TransitionError
+			if !errors.As(err, &transitionErr) || *transitionErr != *test.err {
+				t.Errorf("Apply error = %v, want %+v", err, *test.err)
+			}
+		})
+	}
+}
+
+func TestApplyWithoutEvent(t *testing.T) {
+	m := NewMachine()
+	if _, err := m.Apply(utils.LRTPIDSPacket{IsAck: 1, TrainNumber: 7}); !errors.Is(err, ErrNoEvent) {
+		t.Errorf("Apply of an ACK: %v, want %v", err, ErrNoEvent)
+	}
+}
+
+func TestTransitionErrorMessage(t *testing.T) {
+	tests := []struct {
+		err  TransitionError
+		want string
+	}{
+		{TransitionError{TrainNumber: 7, From: Absent, Event: EventDelete}, "train 7: delete event for a train that does not exist"},
+		{TransitionError{TrainNumber: 7, From: Scheduled, Event: EventNew}, "train 7: new event not allowed while scheduled"},
+	}
+	for _, test := range tests {
+		if got := test.err.Error(); got != test.want {
+			t.Errorf("Error() = %q, want %q", got, test.want)
+		}
+	}
+}
+
+// recordHooks registers a hook on entering and leaving every state of m that
+// appends what happened to the returned log.
+func recordHooks(m *Machine) *[]string {
+	var log []string
+	for _, state := range States {
+		state := state
+		m.OnLeave(state, func(transition Transition) {
+			log = append(log, fmt.Sprintf("leave %s on %q", state, transition.Event))
+		})
+		m.OnEnter(state, func(transition Transition) {
+			log = append(log, fmt.Sprintf("enter %s on %q", state, transition.Event))
+		})
+	}
+	return &log
+}
+
+func TestHookOrder(t *testing.T) {
+	m := NewMachine()
+	log := recordHooks(m)
+	var order []int
+	m.OnEnter(Arriving, func(Transition) { order = append(order, 1) })
+	m.OnEnter(Arriving, func(Transition) { order = append(order, 2) })
+
+	if _, err := m.Apply(utils.LRTPIDSPacket{TrainNumber: 7, IsNewTrain: 1, IsTrainArriving: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.Apply(utils.LRTPIDSPacket{TrainNumber: 7, IsUpdateTrain: 1}); err != nil {
+		t.Fatal(err)
+	}
+	// A refused packet runs no hooks.
+	m.Apply(utils.LRTPIDSPacket{TrainNumber: 7, IsNewTrain: 1})
+
+	want := []string{
+		`leave absent on "new"`,
+		`enter scheduled on "new"`,
+		`leave scheduled on "arriving"`,
+		`enter arriving on "arriving"`,
+	}
+	if !reflect.DeepEqual(*log, want) {
+		t.Errorf("hooks ran as\n%q\nwant\n%q", *log, want)
+	}
+	if !reflect.DeepEqual(order, []int{1, 2}) {
+		t.Errorf("hooks on the same state ran in order %v, want registration order", order)
+	}
+}
+
+func TestForce(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   State
+		packet utils.LRTPIDSPacket
+		want   State
+		log    []string
+	}{
+		{"allowed events as Apply", Absent, utils.LRTPIDSPacket{IsNewTrain: 1}, Scheduled,
+			[]string{`leave absent on "new"`, `enter scheduled on "new"`}},
+		{"arriving creates the train", Absent, utils.LRTPIDSPacket{IsTrainArriving: 1}, Arriving,
+			[]string{`leave absent on "arriving"`, `enter arriving on "arriving"`}},
+		{"update creates the train", Absent, utils.LRTPIDSPacket{IsUpdateTrain: 1}, Scheduled,
+			[]string{`leave absent on "update"`, `enter scheduled on "update"`}},
+		{"departing skips arriving", Scheduled, utils.LRTPIDSPacket{IsTrainDeparting: 1}, Departing,
+			[]string{`leave scheduled on "departing"`, `enter departing on "departing"`}},
+		{"new starts over", Departing, utils.LRTPIDSPacket{IsNewTrain: 1}, Scheduled,
+			[]string{`leave departing on "new"`, `enter scheduled on "new"`}},
+		{"delete of a missing train", Absent, utils.LRTPIDSPacket{IsDeleteTrain: 1}, Absent, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMachine()
+			m.Set(7, test.from)
+			log := recordHooks(m)
+			test.packet.TrainNumber = 7
+
+			if state := m.Force(test.packet); state != test.want || m.State(7) != test.want {
+				t.Errorf("Force = %s, State = %s, want %s", state, m.State(7), test.want)
+			}
+			if !reflect.DeepEqual(*log, test.log) {
+				t.Errorf("hooks ran as %q, want %q", *log, test.log)
+			}
+		})
+	}
+}
+
+func TestSet(t *testing.T) {
+	m := NewMachine()
+	log := recordHooks(m)
+
+	m.Set(7, Departing)
+	m.Set(7, Departing)
+	if state := m.State(7); state != Departing {
+		t.Errorf("State after Set = %s, want %s", state, Departing)
+	}
+	m.Set(7, Absent)
+	if state := m.State(7); state != Absent {
+		t.Errorf("State after Set to absent = %s, want %s", state, Absent)
+	}
+	if len(m.states) != 0 {
+		t.Errorf("absent train is still tracked: %v", m.states)
+	}
+
+	// Set bypasses validation but not the hooks, which see no event.
+	want := []string{
+		`leave absent on ""`,
+		`enter departing on ""`,
+		`leave departing on ""`,
+		`enter absent on ""`,
+	}
+	if !reflect.DeepEqual(*log, want) {
+		t.Errorf("hooks ran as %q, want %q", *log, want)
+	}
+}
@@ -0,0 +1,296 @@
+// Package metrics implements counters, gauges and histograms that can be
+// rendered in the Prometheus text exposition format without any external
+// dependency.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLatencyBuckets covers round trips from a sub-millisecond LAN hop up to
+// a badly congested mobile link.
+var DefaultLatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type metricKind string
+
+const (
+	kindCounter   metricKind = "counter"
+	kindGauge     metricKind = "gauge"
+	kindHistogram metricKind = "histogram"
+)
+
+type Registry struct {
+	mutex    sync.Mutex
+	families map[string]*family
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		families: make(map[string]*family),
+	}
+}
+
+type family struct {
+	name       string
+	help       string
+	kind       metricKind
+	labelNames []string
+	buckets    []float64
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func (r *Registry) register(name, help string, kind metricKind, buckets []float64, labelNames []string) *family {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, exists := r.families[name]; exists {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+
+	// Unlabelled metrics are exported as zero from the start rather than
+	// appearing only after their first update.
+	if len(labelNames) == 0 {
+		f.with(nil)
+	}
+
+	r.families[name] = f
+	return f
+}
+
+// with returns the series for labelValues; the caller must hold f.mutex.
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	s, exists := f.series[key]
+	if !exists {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		if f.kind == kindHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+type Counter struct{ family *family }
+
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	return &Counter{family: r.register(name, help, kindCounter, nil, labelNames)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter. Negative deltas are ignored since counters only
+// ever go up.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		return
+	}
+
+	c.family.mutex.Lock()
+	c.family.with(labelValues).value += delta
+	c.family.mutex.Unlock()
+}
+
+type Gauge struct{ family *family }
+
+func (r *Registry) NewGauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{family: r.register(name, help, kindGauge, nil, labelNames)}
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.family.mutex.Lock()
+	g.family.with(labelValues).value = value
+	g.family.mutex.Unlock()
+}
+
+func (g *Gauge) Add(delta float64, labelValues ...string) {
+	g.family.mutex.Lock()
+	g.family.with(labelValues).value += delta
+	g.family.mutex.Unlock()
+}
+
+func (g *Gauge) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+func (g *Gauge) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+type Histogram struct{ family *family }
+
+// NewHistogram registers a histogram with the given upper bucket bounds, which
+// must be sorted in increasing order. The +Inf bucket is implicit.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: buckets of %s are not sorted", name))
+	}
+	return &Histogram{family: r.register(name, help, kindHistogram, buckets, labelNames)}
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.family.mutex.Lock()
+	defer h.family.mutex.Unlock()
+
+	s := h.family.with(labelValues)
+	for i, bound := range h.family.buckets {
+		if value <= bound {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// WriteTo renders every registered metric in the Prometheus text exposition
+// format, families and series sorted by name so the output is stable.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	families := make([]*family, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		families = append(families, r.families[name])
+	}
+	r.mutex.Unlock()
+
+	counter := &countingWriter{Writer: bufio.NewWriter(w)}
+	for _, f := range families {
+		f.writeTo(counter)
+	}
+
+	if err := counter.Writer.(*bufio.Writer).Flush(); err != nil {
+		return counter.written, err
+	}
+	return counter.written, counter.err
+}
+
+func (f *family) writeTo(w io.Writer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.name, f.kind)
+
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := f.series[key]
+		if f.kind != kindHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", f.name, f.labels(s.labelValues, "", ""), formatValue(s.value))
+			continue
+		}
+
+		for i, bound := range f.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labels(s.labelValues, "le", formatValue(bound)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", f.name, f.labels(s.labelValues, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", f.name, f.labels(s.labelValues, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", f.name, f.labels(s.labelValues, "", ""), s.count)
+	}
+}
+
+func (f *family) labels(values []string, extraName, extraValue string) string {
+	if len(values) == 0 && extraName == "" {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(values)+1)
+	for i, name := range f.labelNames {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabelValue(values[i])))
+	}
+	if extraName != "" {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extraName, extraValue))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Handler serves the registry on any path, typically mounted at /metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+type countingWriter struct {
+	io.Writer
+	written int64
+	err     error
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n, err := c.Writer.Write(p)
+	c.written += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func render(t *testing.T, r *Registry) string {
+	t.Helper()
+	var output strings.Builder
+	n, err := r.WriteTo(&output)
+	if err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	if int(n) != output.Len() {
+		t.Errorf("WriteTo reported %d bytes, wrote %d", n, output.Len())
+	}
+	return output.String()
+}
+
+func TestWriteTo(t *testing.T) {
+	tests := []struct {
+		name   string
+		update func(r *Registry)
+		want   string
+	}{
+		{
+			name: "unlabelled counter starts at zero",
+			update: func(r *Registry) {
+				r.NewCounter("packets_total", "Packets seen.")
+			},
+			want: `# HELP packets_total Packets seen.
+# TYPE packets_total counter
+packets_total 0
+`,
+		},
+		{
+			name: "counter ignores negative deltas",
+			update: func(r *Registry) {
+				c := r.NewCounter("packets_total", "Packets seen.", "event")
+				c.Inc("new")
+				c.Add(2.5, "new")
+				c.Add(-10, "new")
+				c.Inc("delete")
+			},
+			want: `# HELP packets_total Packets seen.
+# TYPE packets_total counter
+packets_total{event="delete"} 1
+packets_total{event="new"} 3.5
+`,
+		},
+		{
+			name: "gauge",
+			update: func(r *Registry) {
+				g := r.NewGauge("trains", "Live trains.", "state")
+				g.Inc("arriving")
+				g.Inc("arriving")
+				g.Dec("arriving")
+				g.Dec("scheduled")
+				g.Set(7, "departing")
+				g.Add(0.5, "departing")
+			},
+			want: `# HELP trains Live trains.
+# TYPE trains gauge
+trains{state="arriving"} 1
+trains{state="departing"} 7.5
+trains{state="scheduled"} -1
+`,
+		},
+		{
+			name: "escaping",
+			update: func(r *Registry) {
+				c := r.NewCounter("errors_total", "Errors\nby \\ reason.", "reason")
+				c.Inc("say \"hi\"\\\n")
+			},
+			want: `# HELP errors_total Errors\nby \\ reason.
+# TYPE errors_total counter
+errors_total{reason="say \"hi\"\\\n"} 1
+`,
+		},
+		{
+			name: "histogram",
+			update: func(r *Registry) {
+				h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1}, "kind")
+				h.Observe(0.05, "ack")
+				h.Observe(0.1, "ack")
+				h.Observe(0.5, "ack")
+				h.Observe(3, "ack")
+			},
+			want: `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{kind="ack",le="0.1"} 2
+latency_seconds_bucket{kind="ack",le="1"} 3
+latency_seconds_bucket{kind="ack",le="+Inf"} 4
+latency_seconds_sum{kind="ack"} 3.65
+latency_seconds_count{kind="ack"} 4
+`,
+		},
+		{
+			name: "families sorted by name",
+			update: func(r *Registry) {
+				r.NewGauge("b", "B.")
+				r.NewCounter("a", "A.")
+			},
+			want: `# HELP a A.
+# TYPE a counter
+a 0
+# HELP b B.
+# TYPE b gauge
+b 0
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := NewRegistry()
+			test.update(r)
+			if got := render(t, r); got != test.want {
+				t.Errorf("WriteTo =\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests.").Inc()
+
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	response := recorder.Result()
+	if contentType := response.Header.Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", contentType)
+	}
+	body, _ := io.ReadAll(response.Body)
+	if !strings.Contains(string(body), "requests_total 1\n") {
+		t.Errorf("body lacks the counter:\n%s", body)
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	tests := []struct {
+		name string
+		use  func(r *Registry)
+	}{
+		{"registered twice", func(r *Registry) {
+			r.NewCounter("x", "X.")
+			r.NewGauge("x", "X.")
+		}},
+		{"wrong label count", func(r *Registry) {
+			r.NewCounter("x", "X.", "a", "b").Inc("only one")
+		}},
+		{"unsorted buckets", func(r *Registry) {
+			r.NewHistogram("x", "X.", []float64{1, 0.5})
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("did not panic")
+				}
+			}()
+			test.use(NewRegistry())
+		})
+	}
+}
@@ -0,0 +1,233 @@
+// Package netem impairs UDP traffic the way Linux netem does, to test the
+// PIDS publisher and subscriber over lossy, slow and reordering networks.
+// Proxy relays datagrams between clients and a server through a pair of
+// impaired links, one per direction. In a Go test:
+//
+//	proxy, err := netem.Listen("127.0.0.1:0", subscriberAddress, netem.Config{
+//		Upstream:   netem.Impairment{Loss: 0.1, Delay: 20 * time.Millisecond},
+//		Downstream: netem.Impairment{Loss: 0.1, Delay: 20 * time.Millisecond},
+//	})
+//	defer proxy.Close()
+//	// dial proxy.Addr() instead of the subscriber
+package netem
+
+import (
+	"container/heap"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Impairment describes what a link does to the datagrams crossing it.
+type Impairment struct {
+	// Loss is the probability of a datagram being dropped.
+	Loss float64
+	// Delay is added to every datagram, varied uniformly by up to Jitter in
+	// either direction. Jitter alone already reorders datagrams.
+	Delay  time.Duration
+	Jitter time.Duration
+	// Duplicate is the probability of a datagram being sent twice.
+	Duplicate float64
+	// Reorder is the probability of a datagram being held back by
+	// ReorderDelay, letting the datagrams after it overtake it.
+	Reorder      float64
+	ReorderDelay time.Duration
+	// Bandwidth caps the link in bytes per second, 0 for no cap. Datagrams
+	// queue behind each other and are dropped once QueueSize bytes wait.
+	Bandwidth int64
+	QueueSize int
+}
+
+// DefaultQueueSize is used for links with a Bandwidth but no QueueSize.
+const DefaultQueueSize = 64 * 1024
+
+// LinkStats counts what happened to the datagrams sent on a link.
+type LinkStats struct {
+	Received   int64
+	Delivered  int64
+	Lost       int64
+	Duplicated int64
+	Reordered  int64
+	// Overflowed datagrams were dropped because the queue was full.
+	Overflowed int64
+}
+
+type linkCounters struct {
+	received, delivered, lost, duplicated, reordered, overflowed atomic.Int64
+}
+
+func (c *linkCounters) stats() LinkStats {
+	return LinkStats{
+		Received:   c.received.Load(),
+		Delivered:  c.delivered.Load(),
+		Lost:       c.lost.Load(),
+		Duplicated: c.duplicated.Load(),
+		Reordered:  c.reordered.Load(),
+		Overflowed: c.overflowed.Load(),
+	}
+}
+
+// pending is a datagram waiting to leave the link.
+type pending struct {
+	at      time.Time
+	order   uint64
+	data    []byte
+	deliver func([]byte)
+}
+
+type pendingHeap []*pending
+
+func (h pendingHeap) Len() int { return len(h) }
+func (h pendingHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].order < h[j].order
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h pendingHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *pendingHeap) Push(x any)   { *h = append(*h, x.(*pending)) }
+func (h *pendingHeap) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// link delays, drops, duplicates and reorders datagrams in one direction.
+type link struct {
+	mutex      sync.Mutex
+	impairment Impairment
+	random     *rand.Rand
+	// free is when the link has sent everything queued so far, with a
+	// Bandwidth cap.
+	free    time.Time
+	queue   pendingHeap
+	order   uint64
+	counter linkCounters
+
+	wake   chan struct{}
+	closed chan struct{}
+}
+
+func newLink(impairment Impairment, seed int64) *link {
+	l := &link{
+		impairment: impairment,
+		random:     rand.New(rand.NewSource(seed)),
+		wake:       make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+func (l *link) setImpairment(impairment Impairment) {
+	l.mutex.Lock()
+	l.impairment = impairment
+	l.mutex.Unlock()
+}
+
+// send schedules data to be passed to deliver once it crossed the link.
+// data must not be modified afterwards.
+func (l *link) send(data []byte, deliver func([]byte)) {
+	l.counter.received.Add(1)
+
+	l.mutex.Lock()
+	impairment := l.impairment
+	if l.random.Float64() < impairment.Loss {
+		l.mutex.Unlock()
+		l.counter.lost.Add(1)
+		return
+	}
+
+	copies := 1
+	if l.random.Float64() < impairment.Duplicate {
+		copies = 2
+		l.counter.duplicated.Add(1)
+	}
+
+	now := time.Now()
+	for i := 0; i < copies; i++ {
+		sent := now
+		if impairment.Bandwidth > 0 {
+			if l.free.Before(now) {
+				l.free = now
+			}
+			queueSize := impairment.QueueSize
+			if queueSize <= 0 {
+				queueSize = DefaultQueueSize
+			}
+			if backlog := int64(l.free.Sub(now).Seconds() * float64(impairment.Bandwidth)); backlog+int64(len(data)) > int64(queueSize) {
+				l.counter.overflowed.Add(1)
+				continue
+			}
+			l.free = l.free.Add(time.Duration(float64(len(data)) / float64(impairment.Bandwidth) * float64(time.Second)))
+			sent = l.free
+		}
+
+		delay := impairment.Delay
+		if impairment.Jitter > 0 {
+			delay += time.Duration(l.random.Int63n(int64(2*impairment.Jitter)+1)) - impairment.Jitter
+		}
+		if l.random.Float64() < impairment.Reorder {
+			delay += impairment.ReorderDelay
+			l.counter.reordered.Add(1)
+		}
+		if delay < 0 {
+			delay = 0
+		}
+
+		l.order++
+		heap.Push(&l.queue, &pending{at: sent.Add(delay), order: l.order, data: data, deliver: deliver})
+	}
+	l.mutex.Unlock()
+
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run delivers the queued datagrams when they are due.
+func (l *link) run() {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		l.mutex.Lock()
+		var due []*pending
+		now := time.Now()
+		for len(l.queue) > 0 && !l.queue[0].at.After(now) {
+			due = append(due, heap.Pop(&l.queue).(*pending))
+		}
+		wait := time.Hour
+		if len(l.queue) > 0 {
+			wait = l.queue[0].at.Sub(now)
+		}
+		l.mutex.Unlock()
+
+		for _, p := range due {
+			p.deliver(p.data)
+			l.counter.delivered.Add(1)
+		}
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-timer.C:
+		case <-l.wake:
+		case <-l.closed:
+			return
+		}
+	}
+}
+
+func (l *link) close() {
+	close(l.closed)
+}
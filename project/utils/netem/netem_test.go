@@ -0,0 +1,228 @@
+package netem
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+// echo starts a UDP server on loopback that sends every datagram back.
+func echo(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buffer := make([]byte, bufferSize)
+		for {
+			n, address, err := conn.ReadFromUDP(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buffer[:n], address)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// dial starts a proxy in front of an echo server and connects to it.
+func dial(t *testing.T, config Config) (*Proxy, *net.UDPConn) {
+	t.Helper()
+	if config.Seed == 0 {
+		config.Seed = 2306214510
+	}
+	config.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	proxy, err := Listen("127.0.0.1:0", echo(t), config)
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+
+	conn, err := net.DialUDP("udp", nil, proxy.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("failed to dial proxy: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return proxy, conn
+}
+
+// exchange sends count datagrams of size bytes numbered from 0, paced by
+// interval, and returns the numbers echoed back in arrival order, waiting
+// quiet for a datagram to come before giving up.
+func exchange(t *testing.T, conn *net.UDPConn, count, size int, interval, quiet time.Duration) []uint32 {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		datagram := make([]byte, size)
+		binary.BigEndian.PutUint32(datagram, uint32(i))
+		if _, err := conn.Write(datagram); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if interval > 0 {
+			time.Sleep(interval)
+		}
+	}
+
+	var received []uint32
+	buffer := make([]byte, bufferSize)
+	for {
+		conn.SetReadDeadline(time.Now().Add(quiet))
+		n, err := conn.Read(buffer)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return received
+		}
+		if err != nil {
+			t.Fatalf("failed to receive: %v", err)
+		}
+		if n != size {
+			t.Fatalf("received %d bytes, sent %d", n, size)
+		}
+		received = append(received, binary.BigEndian.Uint32(buffer))
+	}
+}
+
+func sorted(numbers []uint32) bool {
+	return sort.SliceIsSorted(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+}
+
+func TestProxyUnimpaired(t *testing.T) {
+	proxy, conn := dial(t, Config{})
+
+	received := exchange(t, conn, 50, 100, time.Millisecond, 200*time.Millisecond)
+	if len(received) != 50 || !sorted(received) {
+		t.Fatalf("received %v, want 0 to 49 in order", received)
+	}
+
+	stats := proxy.Stats()
+	want := LinkStats{Received: 50, Delivered: 50}
+	if stats.Upstream != want || stats.Downstream != want {
+		t.Errorf("Stats = %+v, want %+v both ways", stats, want)
+	}
+	if stats.Clients != 1 {
+		t.Errorf("Clients = %d, want 1", stats.Clients)
+	}
+}
+
+func TestProxyLoss(t *testing.T) {
+	run := func() ([]uint32, Stats) {
+		proxy, conn := dial(t, Config{
+			Upstream:   Impairment{Loss: 0.3},
+			Downstream: Impairment{Loss: 0.2},
+		})
+		return exchange(t, conn, 200, 100, 0, 200*time.Millisecond), proxy.Stats()
+	}
+
+	received, stats := run()
+	for _, link := range []LinkStats{stats.Upstream, stats.Downstream} {
+		if link.Lost+link.Delivered != link.Received {
+			t.Errorf("link lost %d and delivered %d of %d", link.Lost, link.Delivered, link.Received)
+		}
+	}
+	if stats.Upstream.Received != 200 || stats.Downstream.Received != stats.Upstream.Delivered {
+		t.Errorf("Stats = %+v, want 200 sent and everything delivered upstream echoed", stats)
+	}
+	if lost := stats.Upstream.Lost; lost < 30 || lost > 90 {
+		t.Errorf("lost %d of 200 upstream at 30%%", lost)
+	}
+	if int64(len(received)) != stats.Downstream.Delivered {
+		t.Errorf("received %d datagrams, the proxy delivered %d", len(received), stats.Downstream.Delivered)
+	}
+	if !sorted(received) {
+		t.Errorf("loss alone reordered datagrams: %v", received)
+	}
+
+	// The same seed loses the same datagrams.
+	again, _ := run()
+	if len(again) != len(received) {
+		t.Fatalf("second run received %d datagrams, first %d", len(again), len(received))
+	}
+	for i := range received {
+		if again[i] != received[i] {
+			t.Fatalf("second run received %d where the first received %d", again[i], received[i])
+		}
+	}
+}
+
+func TestProxyDuplicate(t *testing.T) {
+	proxy, conn := dial(t, Config{Upstream: Impairment{Duplicate: 1}})
+
+	received := exchange(t, conn, 20, 100, time.Millisecond, 200*time.Millisecond)
+	if len(received) != 40 {
+		t.Fatalf("received %d datagrams, want every one of 20 twice", len(received))
+	}
+	for i, number := range received {
+		if number != uint32(i/2) {
+			t.Fatalf("received %v, want each number twice in order", received)
+		}
+	}
+
+	stats := proxy.Stats()
+	if stats.Upstream.Duplicated != 20 || stats.Upstream.Delivered != 40 || stats.Downstream.Received != 40 {
+		t.Errorf("Stats = %+v, want 20 duplicated and 40 delivered upstream", stats)
+	}
+}
+
+func TestProxyReorder(t *testing.T) {
+	proxy, conn := dial(t, Config{Upstream: Impairment{Reorder: 0.25, ReorderDelay: 50 * time.Millisecond}})
+
+	received := exchange(t, conn, 40, 100, time.Millisecond, 300*time.Millisecond)
+	if len(received) != 40 {
+		t.Fatalf("received %d datagrams, want all 40", len(received))
+	}
+	if sorted(received) {
+		t.Errorf("received %v in order despite reordering", received)
+	}
+
+	stats := proxy.Stats()
+	if stats.Upstream.Reordered == 0 || stats.Upstream.Reordered == 40 {
+		t.Errorf("reordered %d of 40 at 25%%", stats.Upstream.Reordered)
+	}
+	if stats.Upstream.Lost != 0 || stats.Upstream.Delivered != 40 {
+		t.Errorf("Stats = %+v, want all 40 delivered", stats)
+	}
+}
+
+func TestProxyBandwidth(t *testing.T) {
+	// 1000 bytes take 100ms at 10000 bytes per second, and the queue holds
+	// two of them.
+	proxy, conn := dial(t, Config{Upstream: Impairment{Bandwidth: 10000, QueueSize: 2500}})
+
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := conn.Write(make([]byte, 1000)); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+
+	buffer := make([]byte, bufferSize)
+	var arrivals []time.Duration
+	for {
+		conn.SetReadDeadline(time.Now().Add(400 * time.Millisecond))
+		if _, err := conn.Read(buffer); err != nil {
+			break
+		}
+		arrivals = append(arrivals, time.Since(start))
+	}
+
+	if len(arrivals) != 2 {
+		t.Fatalf("received %d datagrams, want the two that fit the queue", len(arrivals))
+	}
+	// The second datagram waits for the first to be sent.
+	if arrivals[0] < 90*time.Millisecond || arrivals[1] < 190*time.Millisecond {
+		t.Errorf("datagrams arrived after %v at 10000 bytes per second, want 100ms and 200ms", arrivals)
+	}
+
+	stats := proxy.Stats()
+	if stats.Upstream.Overflowed != 3 || stats.Upstream.Delivered != 2 {
+		t.Errorf("Stats = %+v, want 3 overflowed and 2 delivered", stats)
+	}
+}
@@ -0,0 +1,263 @@
+package netem
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	bufferSize = 65535
+	// DefaultIdleTimeout is used when Config has no IdleTimeout.
+	DefaultIdleTimeout = time.Minute
+)
+
+type Config struct {
+	// Upstream impairs datagrams from the clients to the target and
+	// Downstream those coming back.
+	Upstream   Impairment
+	Downstream Impairment
+	// Seed makes the impairments repeatable, the current time is used
+	// when it is 0.
+	Seed int64
+	// IdleTimeout forgets a client that sent nothing for that long.
+	IdleTimeout time.Duration
+	// Capture is handed every datagram the proxy delivers, after the
+	// impairments, as if it had gone straight between client and target.
+	Capture func(src, dst net.Addr, payload []byte)
+	Logger  *slog.Logger
+}
+
+// Stats counts the datagrams in each direction.
+type Stats struct {
+	Upstream   LinkStats
+	Downstream LinkStats
+	Clients    int
+}
+
+// Proxy relays UDP datagrams between its clients and a target address. Each
+// client gets a socket of its own towards the target, so the target sees
+// one peer per client as it would without the proxy.
+type Proxy struct {
+	conn        *net.UDPConn
+	target      *net.UDPAddr
+	upstream    *link
+	downstream  *link
+	idleTimeout time.Duration
+	capture     func(src, dst net.Addr, payload []byte)
+	logger      *slog.Logger
+
+	mutex   sync.Mutex
+	clients map[string]*client
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	wg        sync.WaitGroup
+}
+
+// client is the socket relaying the datagrams of one client to the target.
+type client struct {
+	address  *net.UDPAddr
+	conn     *net.UDPConn
+	lastSeen time.Time
+}
+
+// Listen starts a proxy receiving datagrams on address and relaying them to
+// target.
+func Listen(address, target string, config Config) (*Proxy, error) {
+	targetAddress, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve target: %v", err)
+	}
+	listenAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve listen address: %v", err)
+	}
+
+	conn, err := net.ListenUDP("udp", listenAddress)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %v", err)
+	}
+
+	if config.Seed == 0 {
+		config.Seed = time.Now().UnixNano()
+	}
+	if config.IdleTimeout <= 0 {
+		config.IdleTimeout = DefaultIdleTimeout
+	}
+	if config.Logger == nil {
+		config.Logger = slog.Default()
+	}
+
+	p := &Proxy{
+		conn:        conn,
+		target:      targetAddress,
+		upstream:    newLink(config.Upstream, config.Seed),
+		downstream:  newLink(config.Downstream, config.Seed+1),
+		idleTimeout: config.IdleTimeout,
+		capture:     config.Capture,
+		logger:      config.Logger.With("proxy", conn.LocalAddr().String(), "target", targetAddress.String()),
+		clients:     make(map[string]*client),
+		closed:      make(chan struct{}),
+	}
+
+	p.wg.Add(2)
+	go p.serve()
+	go p.expireClients()
+	return p, nil
+}
+
+// Addr is the address clients send to instead of the target.
+func (p *Proxy) Addr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+// SetImpairment changes the impairments while the proxy runs, for tests
+// that break the network halfway.
+func (p *Proxy) SetImpairment(upstream, downstream Impairment) {
+	p.upstream.setImpairment(upstream)
+	p.downstream.setImpairment(downstream)
+}
+
+func (p *Proxy) Stats() Stats {
+	p.mutex.Lock()
+	clients := len(p.clients)
+	p.mutex.Unlock()
+
+	return Stats{
+		Upstream:   p.upstream.counter.stats(),
+		Downstream: p.downstream.counter.stats(),
+		Clients:    clients,
+	}
+}
+
+func (p *Proxy) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		err = p.conn.Close()
+
+		p.mutex.Lock()
+		for _, c := range p.clients {
+			c.conn.Close()
+		}
+		p.mutex.Unlock()
+
+		p.wg.Wait()
+		p.upstream.close()
+		p.downstream.close()
+	})
+	return err
+}
+
+// serve reads datagrams from clients like the samples/udp server loop and
+// relays them upstream.
+func (p *Proxy) serve() {
+	defer p.wg.Done()
+
+	buffer := make([]byte, bufferSize)
+	for {
+		n, address, err := p.conn.ReadFromUDP(buffer)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				p.logger.Error("failed to read from client", "error", err)
+			}
+			return
+		}
+
+		c, err := p.client(address)
+		if err != nil {
+			p.logger.Warn("failed to open socket to target", "client", address.String(), "error", err)
+			continue
+		}
+
+		// The datagram may wait in a queue, so it gets a copy of its own
+		// size rather than holding on to buffer.
+		p.upstream.send(bytes.Clone(buffer[:n]), func(data []byte) {
+			if _, err := c.conn.Write(data); err == nil && p.capture != nil {
+				p.capture(c.address, p.target, data)
+			}
+		})
+	}
+}
+
+// client returns the relay socket of address, opening it on first use.
+func (p *Proxy) client(address *net.UDPAddr) (*client, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	key := address.String()
+	if c, ok := p.clients[key]; ok {
+		c.lastSeen = time.Now()
+		return c, nil
+	}
+
+	select {
+	case <-p.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	conn, err := net.DialUDP("udp", nil, p.target)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &client{address: address, conn: conn, lastSeen: time.Now()}
+	p.clients[key] = c
+	p.logger.Debug("new client", "client", key)
+
+	p.wg.Add(1)
+	go p.relayDownstream(c)
+	return c, nil
+}
+
+// relayDownstream sends what the target answers back to the client.
+func (p *Proxy) relayDownstream(c *client) {
+	defer p.wg.Done()
+
+	buffer := make([]byte, bufferSize)
+	for {
+		n, err := c.conn.Read(buffer)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				p.logger.Debug("failed to read from target", "client", c.address.String(), "error", err)
+			}
+			return
+		}
+
+		p.downstream.send(bytes.Clone(buffer[:n]), func(data []byte) {
+			if _, err := p.conn.WriteToUDP(data, c.address); err == nil && p.capture != nil {
+				p.capture(p.target, c.address, data)
+			}
+		})
+	}
+}
+
+func (p *Proxy) expireClients() {
+	defer p.wg.Done()
+
+	ticker := time.NewTicker(p.idleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.closed:
+			return
+		case now := <-ticker.C:
+			p.mutex.Lock()
+			for key, c := range p.clients {
+				if now.Sub(c.lastSeen) > p.idleTimeout {
+					c.conn.Close()
+					delete(p.clients, key)
+					p.logger.Debug("client idle", "client", key)
+				}
+			}
+			p.mutex.Unlock()
+		}
+	}
+}
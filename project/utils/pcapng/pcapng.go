@@ -0,0 +1,300 @@
+// Package pcapng writes UDP datagrams to pcapng files that Wireshark opens
+// directly. Only payloads are known to the PIDS programs, so every datagram
+// gets a made up IPv4 or IPv6 and UDP header. TLS secrets can be embedded in
+// Decryption Secrets Blocks, so QUIC sessions decrypt without a key log file.
+package pcapng
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	blockSectionHeader    = 0x0A0D0D0A
+	blockInterface        = 0x00000001
+	blockEnhancedPacket   = 0x00000006
+	blockDecryptionSecret = 0x0000000A
+
+	byteOrderMagic = 0x1A2B3C4D
+	// linkTypeRaw packets start with an IPv4 or IPv6 header.
+	linkTypeRaw = 101
+	// secretsTLSKeyLog is "TLSK", NSS key log lines.
+	secretsTLSKeyLog = 0x544c534b
+
+	optionEnd         = 0
+	optionApplication = 4
+	optionName        = 2
+	optionTSResol     = 9
+
+	protocolUDP = 17
+	ttl         = 64
+)
+
+var order = binary.LittleEndian
+
+// Writer appends datagrams and secrets to a pcapng file. It is safe for
+// concurrent use.
+type Writer struct {
+	mutex  sync.Mutex
+	w      io.Writer
+	closer io.Closer
+}
+
+// Create truncates path and starts a pcapng file in it.
+func Create(path string) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create capture: %v", err)
+	}
+
+	w, err := NewWriter(file, path)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	w.closer = file
+	return w, nil
+}
+
+// NewWriter writes the section header and the interface called name to w.
+// Every block is written with a single Write call.
+func NewWriter(w io.Writer, name string) (*Writer, error) {
+	var options []byte
+	options = appendOption(options, optionApplication, []byte("PIDS capture"))
+	header := make([]byte, 0, 16)
+	header = order.AppendUint32(header, byteOrderMagic)
+	header = order.AppendUint16(header, 1)
+	header = order.AppendUint16(header, 0)
+	// The section length is not known up front.
+	header = order.AppendUint64(header, 0xFFFFFFFFFFFFFFFF)
+	if _, err := w.Write(block(blockSectionHeader, header, options)); err != nil {
+		return nil, fmt.Errorf("failed to write section header: %v", err)
+	}
+
+	options = options[:0]
+	options = appendOption(options, optionName, []byte(name))
+	// Timestamps are in nanoseconds rather than the default microseconds.
+	options = appendOption(options, optionTSResol, []byte{9})
+	description := make([]byte, 0, 8)
+	description = order.AppendUint16(description, linkTypeRaw)
+	description = order.AppendUint16(description, 0)
+	description = order.AppendUint32(description, 0)
+	if _, err := w.Write(block(blockInterface, description, options)); err != nil {
+		return nil, fmt.Errorf("failed to write interface description: %v", err)
+	}
+
+	return &Writer{w: w}, nil
+}
+
+// WriteUDP records payload travelling from src to dst, both *net.UDPAddr.
+func (w *Writer) WriteUDP(timestamp time.Time, src, dst net.Addr, payload []byte) error {
+	source, ok := src.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("not a UDP address: %v", src)
+	}
+	destination, ok := dst.(*net.UDPAddr)
+	if !ok {
+		return fmt.Errorf("not a UDP address: %v", dst)
+	}
+
+	packet, err := ipPacket(source, destination, payload)
+	if err != nil {
+		return err
+	}
+
+	nanoseconds := uint64(timestamp.UnixNano())
+	body := make([]byte, 0, 20+len(packet)+3)
+	body = order.AppendUint32(body, 0)
+	body = order.AppendUint32(body, uint32(nanoseconds>>32))
+	body = order.AppendUint32(body, uint32(nanoseconds))
+	body = order.AppendUint32(body, uint32(len(packet)))
+	body = order.AppendUint32(body, uint32(len(packet)))
+	body = append(body, packet...)
+	body = pad(body)
+
+	return w.write(block(blockEnhancedPacket, body, nil))
+}
+
+// WriteSecrets embeds NSS key log lines. Wireshark uses them for the
+// packets that follow, so secrets should be written as soon as they exist.
+func (w *Writer) WriteSecrets(keyLog []byte) error {
+	body := make([]byte, 0, 8+len(keyLog)+3)
+	body = order.AppendUint32(body, secretsTLSKeyLog)
+	body = order.AppendUint32(body, uint32(len(keyLog)))
+	body = append(body, keyLog...)
+	body = pad(body)
+
+	return w.write(block(blockDecryptionSecret, body, nil))
+}
+
+// KeyLogWriter returns a writer for tls.Config.KeyLogWriter that embeds
+// every secret as it is logged.
+func (w *Writer) KeyLogWriter() io.Writer {
+	return secretsWriter{w}
+}
+
+type secretsWriter struct {
+	w *Writer
+}
+
+func (s secretsWriter) Write(p []byte) (int, error) {
+	if err := s.w.WriteSecrets(p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *Writer) write(data []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.w == nil {
+		return errors.New("capture closed")
+	}
+	_, err := w.w.Write(data)
+	return err
+}
+
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.w = nil
+	if w.closer != nil {
+		return w.closer.Close()
+	}
+	return nil
+}
+
+// block frames body and options as a pcapng block of kind.
+func block(kind uint32, body, options []byte) []byte {
+	if len(options) > 0 {
+		options = appendOption(options, optionEnd, nil)
+	}
+
+	length := uint32(12 + len(body) + len(options))
+	data := make([]byte, 0, length)
+	data = order.AppendUint32(data, kind)
+	data = order.AppendUint32(data, length)
+	data = append(data, body...)
+	data = append(data, options...)
+	return order.AppendUint32(data, length)
+}
+
+func appendOption(options []byte, code uint16, value []byte) []byte {
+	options = order.AppendUint16(options, code)
+	options = order.AppendUint16(options, uint16(len(value)))
+	options = append(options, value...)
+	return pad(options)
+}
+
+// pad fills data up to a multiple of four bytes.
+func pad(data []byte) []byte {
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// ipPacket wraps payload in a UDP header and an IPv4 header when both ends
+// are IPv4, or an IPv6 header otherwise. An unspecified local address, as
+// sockets listening on all interfaces report, takes the family of the peer.
+func ipPacket(src, dst *net.UDPAddr, payload []byte) ([]byte, error) {
+	srcIP, dstIP := src.IP, dst.IP
+	if srcIP == nil || srcIP.IsUnspecified() {
+		srcIP = unspecifiedLike(dstIP)
+	}
+	if dstIP == nil || dstIP.IsUnspecified() {
+		dstIP = unspecifiedLike(srcIP)
+	}
+
+	udpLength := 8 + len(payload)
+	if udpLength > 0xFFFF {
+		return nil, fmt.Errorf("datagram of %d bytes is too large", len(payload))
+	}
+
+	udp := make([]byte, 0, udpLength)
+	udp = binary.BigEndian.AppendUint16(udp, uint16(src.Port))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(dst.Port))
+	udp = binary.BigEndian.AppendUint16(udp, uint16(udpLength))
+	udp = binary.BigEndian.AppendUint16(udp, 0)
+	udp = append(udp, payload...)
+
+	if src4, dst4 := srcIP.To4(), dstIP.To4(); src4 != nil && dst4 != nil {
+		pseudo := make([]byte, 0, 12)
+		pseudo = append(pseudo, src4...)
+		pseudo = append(pseudo, dst4...)
+		pseudo = append(pseudo, 0, protocolUDP)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(udpLength))
+		binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudo, udp))
+
+		header := make([]byte, 20, 20+udpLength)
+		header[0] = 0x45
+		binary.BigEndian.PutUint16(header[2:], uint16(20+udpLength))
+		// Don't fragment.
+		header[6] = 0x40
+		header[8] = ttl
+		header[9] = protocolUDP
+		copy(header[12:], src4)
+		copy(header[16:], dst4)
+		binary.BigEndian.PutUint16(header[10:], ^uint16(sum(0, header)))
+		return append(header, udp...), nil
+	}
+
+	src16, dst16 := srcIP.To16(), dstIP.To16()
+	if src16 == nil || dst16 == nil {
+		return nil, fmt.Errorf("invalid addresses %v and %v", src, dst)
+	}
+
+	pseudo := make([]byte, 0, 40)
+	pseudo = append(pseudo, src16...)
+	pseudo = append(pseudo, dst16...)
+	pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(udpLength))
+	pseudo = append(pseudo, 0, 0, 0, protocolUDP)
+	binary.BigEndian.PutUint16(udp[6:], udpChecksum(pseudo, udp))
+
+	header := make([]byte, 40, 40+udpLength)
+	header[0] = 0x60
+	binary.BigEndian.PutUint16(header[4:], uint16(udpLength))
+	header[6] = protocolUDP
+	header[7] = ttl
+	copy(header[8:], src16)
+	copy(header[24:], dst16)
+	return append(header, udp...), nil
+}
+
+func unspecifiedLike(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return net.IPv4zero
+	}
+	return net.IPv6unspecified
+}
+
+// sum adds data to the ones' complement sum of the Internet checksum.
+func sum(total uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		total += uint32(binary.BigEndian.Uint16(data[i:]))
+	}
+	if len(data)%2 == 1 {
+		total += uint32(data[len(data)-1]) << 8
+	}
+	for total > 0xFFFF {
+		total = total>>16 + total&0xFFFF
+	}
+	return total
+}
+
+func udpChecksum(pseudo, udp []byte) uint16 {
+	checksum := ^uint16(sum(sum(0, pseudo), udp))
+	// A zero checksum means none was computed, so it is sent as all ones.
+	if checksum == 0 {
+		checksum = 0xFFFF
+	}
+	return checksum
+}
@@ -0,0 +1,235 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// recorder keeps every Write call apart, since each has to be one block.
+type recorder struct {
+	writes [][]byte
+}
+
+func (r *recorder) Write(p []byte) (int, error) {
+	r.writes = append(r.writes, bytes.Clone(p))
+	return len(p), nil
+}
+
+func join(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestNewWriterHeaderBlocks(t *testing.T) {
+	var r recorder
+	if _, err := NewWriter(&r, "cap"); err != nil {
+		t.Fatalf("NewWriter: %v", err)
+	}
+
+	sectionHeader := join(
+		[]byte{0x0A, 0x0D, 0x0D, 0x0A}, // block type
+		[]byte{48, 0, 0, 0},            // block length
+		[]byte{0x4D, 0x3C, 0x2B, 0x1A}, // byte order magic
+		[]byte{1, 0, 0, 0},             // version 1.0
+		bytes.Repeat([]byte{0xFF}, 8),  // unknown section length
+		[]byte{4, 0, 12, 0}, []byte("PIDS capture"),
+		[]byte{0, 0, 0, 0}, // end of options
+		[]byte{48, 0, 0, 0},
+	)
+	interfaceDescription := join(
+		[]byte{1, 0, 0, 0},
+		[]byte{40, 0, 0, 0},
+		[]byte{101, 0, 0, 0},                         // raw IP, reserved
+		[]byte{0, 0, 0, 0},                           // no snap length
+		[]byte{2, 0, 3, 0}, []byte("cap"), []byte{0}, // padded name
+		[]byte{9, 0, 1, 0, 9, 0, 0, 0}, // nanosecond timestamps
+		[]byte{0, 0, 0, 0},
+		[]byte{40, 0, 0, 0},
+	)
+
+	want := [][]byte{sectionHeader, interfaceDescription}
+	if len(r.writes) != len(want) {
+		t.Fatalf("NewWriter made %d writes, want %d", len(r.writes), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(r.writes[i], want[i]) {
+			t.Errorf("block %d = % x, want % x", i, r.writes[i], want[i])
+		}
+	}
+}
+
+func TestWriteUDPv4(t *testing.T) {
+	var r recorder
+	w, err := NewWriter(&r, "cap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1000}
+	dst := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 2000}
+	if err := w.WriteUDP(time.Unix(1, 2), src, dst, []byte("abc")); err != nil {
+		t.Fatalf("WriteUDP: %v", err)
+	}
+
+	// 31 bytes of packet pad the block body to 52 bytes.
+	want := join(
+		[]byte{6, 0, 0, 0},
+		[]byte{64, 0, 0, 0},
+		[]byte{0, 0, 0, 0},             // interface
+		[]byte{0, 0, 0, 0},             // timestamp, high
+		[]byte{0x02, 0xCA, 0x9A, 0x3B}, // timestamp, low: 1000000002 ns
+		[]byte{31, 0, 0, 0},            // captured length
+		[]byte{31, 0, 0, 0},            // original length
+		[]byte{
+			0x45, 0, 0, 31, // version, header length, total length
+			0, 0, 0x40, 0, // don't fragment
+			64, 17, 0x3C, 0xCC, // TTL, UDP, header checksum
+			127, 0, 0, 1,
+			127, 0, 0, 1,
+		},
+		[]byte{0x03, 0xE8, 0x07, 0xD0, 0, 11, 0x31, 0xBB},
+		[]byte("abc"),
+		[]byte{0}, // padding
+		[]byte{64, 0, 0, 0},
+	)
+	if len(r.writes) != 3 {
+		t.Fatalf("WriteUDP made %d writes, want one", len(r.writes)-2)
+	}
+	if got := r.writes[2]; !bytes.Equal(got, want) {
+		t.Errorf("enhanced packet block =\n% x\nwant\n% x", got, want)
+	}
+}
+
+func TestWriteUDPv6(t *testing.T) {
+	var r recorder
+	w, err := NewWriter(&r, "cap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A socket listening on all interfaces takes the family of its peer.
+	src := &net.UDPAddr{IP: net.IPv4zero, Port: 4433}
+	dst := &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}
+	payload := []byte("hello")
+	if err := w.WriteUDP(time.Unix(0, 0), src, dst, payload); err != nil {
+		t.Fatalf("WriteUDP: %v", err)
+	}
+
+	data := r.writes[2]
+	const packetLength = 40 + 8 + 5
+	// 20 bytes of fields and 53 of packet, padded to 76.
+	const blockLength = 12 + 76
+	if len(data) != blockLength || binary.LittleEndian.Uint32(data[4:]) != blockLength || binary.LittleEndian.Uint32(data[len(data)-4:]) != blockLength {
+		t.Fatalf("block of %d bytes has lengths %d and %d, want %d", len(data), binary.LittleEndian.Uint32(data[4:]), binary.LittleEndian.Uint32(data[len(data)-4:]), blockLength)
+	}
+	if captured := binary.LittleEndian.Uint32(data[20:]); captured != packetLength {
+		t.Errorf("captured length = %d, want %d", captured, packetLength)
+	}
+	if padding := data[28+packetLength : len(data)-4]; !bytes.Equal(padding, []byte{0, 0, 0}) {
+		t.Errorf("padding = % x, want three zero bytes", padding)
+	}
+
+	packet := data[28 : 28+packetLength]
+	if packet[0] != 0x60 || binary.BigEndian.Uint16(packet[4:]) != 8+5 || packet[6] != protocolUDP || packet[7] != ttl {
+		t.Errorf("IPv6 header = % x", packet[:8])
+	}
+	if !net.IP(packet[8:24]).Equal(net.IPv6unspecified) || !net.IP(packet[24:40]).Equal(dst.IP) {
+		t.Errorf("addresses = %v and %v", net.IP(packet[8:24]), net.IP(packet[24:40]))
+	}
+
+	// The checksum over the pseudo header and the datagram adds up to all
+	// ones.
+	udp := packet[40:]
+	pseudo := join(packet[8:40], []byte{0, 0, 0, 8 + 5, 0, 0, 0, protocolUDP})
+	if total := sum(sum(0, pseudo), udp); total != 0xFFFF {
+		t.Errorf("UDP checksum %#04x does not verify, sum %#04x", binary.BigEndian.Uint16(udp[6:]), total)
+	}
+	if !bytes.Equal(udp[8:], payload) {
+		t.Errorf("payload = %q, want %q", udp[8:], payload)
+	}
+}
+
+func TestWriteUDPInvalid(t *testing.T) {
+	w, err := NewWriter(&recorder{}, "cap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+
+	if err := w.WriteUDP(time.Now(), &net.TCPAddr{}, udp, nil); err == nil {
+		t.Error("WriteUDP from a TCP address succeeded")
+	}
+	if err := w.WriteUDP(time.Now(), udp, udp, make([]byte, 0xFFFF)); err == nil {
+		t.Error("WriteUDP of a datagram too large for UDP succeeded")
+	}
+}
+
+func TestWriteSecrets(t *testing.T) {
+	tests := []struct {
+		keyLog []byte
+		want   []byte
+	}{
+		{[]byte("abcd"), join(
+			[]byte{10, 0, 0, 0},
+			[]byte{24, 0, 0, 0},
+			[]byte("KSLT"), // TLS key log, little endian
+			[]byte{4, 0, 0, 0},
+			[]byte("abcd"),
+			[]byte{24, 0, 0, 0},
+		)},
+		{[]byte("hello"), join(
+			[]byte{10, 0, 0, 0},
+			[]byte{28, 0, 0, 0},
+			[]byte("KSLT"),
+			[]byte{5, 0, 0, 0},
+			[]byte("hello"), []byte{0, 0, 0},
+			[]byte{28, 0, 0, 0},
+		)},
+	}
+
+	for _, test := range tests {
+		var r recorder
+		w, err := NewWriter(&r, "cap")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Secrets logged by crypto/tls arrive through KeyLogWriter.
+		n, err := w.KeyLogWriter().Write(test.keyLog)
+		if err != nil || n != len(test.keyLog) {
+			t.Fatalf("Write(%q) = %d, %v", test.keyLog, n, err)
+		}
+		if got := r.writes[2]; !bytes.Equal(got, test.want) {
+			t.Errorf("secrets block of %q = % x, want % x", test.keyLog, got, test.want)
+		}
+	}
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestWriteErrors(t *testing.T) {
+	if _, err := NewWriter(failingWriter{}, "cap"); err == nil {
+		t.Error("NewWriter on a failing writer succeeded")
+	}
+
+	var r recorder
+	w, err := NewWriter(&r, "cap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := w.WriteSecrets([]byte("abcd")); err == nil {
+		t.Error("WriteSecrets after Close succeeded")
+	}
+	if len(r.writes) != 2 {
+		t.Errorf("%d blocks written after Close", len(r.writes)-2)
+	}
+}
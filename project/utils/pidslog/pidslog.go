@@ -0,0 +1,72 @@
+// Package pidslog configures log/slog for the PIDS binaries and defines the
+// attribute keys shared by the publisher and subscriber, so that one
+// TransactionID can be followed across both sides.
+package pidslog
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"jarkom.cs.ui.ac.id/h01/project/utils"
+)
+
+const (
+	KeyRemoteAddr    = "remote_addr"
+	KeyConnectionID  = "conn_id"
+	KeyStreamID      = "stream_id"
+	KeyTransactionID = "transaction_id"
+	KeyTrainNumber   = "train_number"
+	KeySequence      = "sequence"
+	KeyEvent         = "event"
+)
+
+type Config struct {
+	Format string
+	Level  string
+}
+
+// RegisterFlags adds -log-format and -log-level to fs.
+func RegisterFlags(fs *flag.FlagSet) *Config {
+	config := &Config{}
+	fs.StringVar(&config.Format, "log-format", "text", "log output format: text or json")
+	fs.StringVar(&config.Level, "log-level", "info", "minimum log level: debug, info, warn or error")
+	return config
+}
+
+func (c *Config) NewLogger(w io.Writer) (*slog.Logger, error) {
+	level, err := ParseLevel(c.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(c.Format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, options)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, options)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", c.Format)
+}
+
+func ParseLevel(level string) (slog.Level, error) {
+	var parsed slog.Level
+	if err := parsed.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("unknown log level %q", level)
+	}
+	return parsed, nil
+}
+
+// Packet returns the attributes that identify packet in a log line.
+func Packet(packet utils.LRTPIDSPacket) []any {
+	return []any{
+		KeyTransactionID, packet.TransactionID,
+		KeyTrainNumber, packet.TrainNumber,
+		KeySequence, packet.Sequence,
+		KeyEvent, packet.EventType(),
+	}
+}
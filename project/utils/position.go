@@ -0,0 +1,73 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// LRTPIDSPosition reports where a train currently is. Positions are sent as
+// unreliable QUIC datagrams without an ACK; a lost update is simply replaced
+// by the next one, so receivers keep the one with the latest Timestamp.
+type LRTPIDSPosition struct {
+	TrainNumber uint16
+	// Timestamp is when the position was measured, in Unix milliseconds.
+	Timestamp int64
+	Latitude  float32
+	Longitude float32
+	// Speed is in km/h.
+	Speed uint16
+}
+
+func EncodePosition(position LRTPIDSPosition) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	if err := binary.Write(&buffer, binary.BigEndian, position.TrainNumber); err != nil {
+		return nil, fmt.Errorf("error encoding TrainNumber: %v", err)
+	}
+
+	if err := binary.Write(&buffer, binary.BigEndian, position.Timestamp); err != nil {
+		return nil, fmt.Errorf("error encoding Timestamp: %v", err)
+	}
+
+	if err := binary.Write(&buffer, binary.BigEndian, position.Latitude); err != nil {
+		return nil, fmt.Errorf("error encoding Latitude: %v", err)
+	}
+
+	if err := binary.Write(&buffer, binary.BigEndian, position.Longitude); err != nil {
+		return nil, fmt.Errorf("error encoding Longitude: %v", err)
+	}
+
+	if err := binary.Write(&buffer, binary.BigEndian, position.Speed); err != nil {
+		return nil, fmt.Errorf("error encoding Speed: %v", err)
+	}
+
+	return buffer.Bytes(), nil
+}
+
+func DecodePosition(data []byte) (LRTPIDSPosition, error) {
+	var position LRTPIDSPosition
+	buffer := bytes.NewReader(data)
+
+	if err := binary.Read(buffer, binary.BigEndian, &position.TrainNumber); err != nil {
+		return position, fmt.Errorf("error decoding TrainNumber: %v", err)
+	}
+
+	if err := binary.Read(buffer, binary.BigEndian, &position.Timestamp); err != nil {
+		return position, fmt.Errorf("error decoding Timestamp: %v", err)
+	}
+
+	if err := binary.Read(buffer, binary.BigEndian, &position.Latitude); err != nil {
+		return position, fmt.Errorf("error decoding Latitude: %v", err)
+	}
+
+	if err := binary.Read(buffer, binary.BigEndian, &position.Longitude); err != nil {
+		return position, fmt.Errorf("error decoding Longitude: %v", err)
+	}
+
+	if err := binary.Read(buffer, binary.BigEndian, &position.Speed); err != nil {
+		return position, fmt.Errorf("error decoding Speed: %v", err)
+	}
+
+	return position, nil
+}
@@ -0,0 +1,279 @@
+package utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// A session runs over one long-lived bidirectional stream. The publisher
+// opens it by writing SessionMagic followed by a MessageHello, the subscriber
+// answers with its own MessageHello, and from then on every message is
+//
+//	type (1 byte) | payload length (2 bytes) | payload
+//
+// Streams that do not start with SessionMagic carry a single legacy
+// LRTPIDSPacket; the magic cannot be mistaken for one since its IsAck byte
+// would be 'D'.
+const (
+	SessionMagic   = "PIDS"
+	SessionVersion = 1
+
+	MessageHello = 0x01
+	// MessageEvent and MessageAck carry an encoded LRTPIDSPacket.
+	MessageEvent = 0x02
+	MessageAck   = 0x03
+	// MessagePosition is only advertised in Hello.MessageTypes: positions
+	// travel as QUIC datagrams outside the session stream.
+	MessagePosition = 0x04
+	// MessageSyncRequest asks the publisher for every active train, which
+	// it answers with a MessageSyncResponse, see EncodeSyncResponse.
+	MessageSyncRequest  = 0x05
+	MessageSyncResponse = 0x06
+	// MessageNack answers a MessageEvent the subscriber refused instead of
+	// a MessageAck, see EncodeNack. Publishers that do not list it in their
+	// hello have the session closed on them instead.
+	MessageNack = 0x07
+
+	maxMessagePayload = 0xFFFF
+)
+
+// Hello is exchanged once in each direction when a session starts.
+type Hello struct {
+	Version      uint8
+	MessageTypes []uint8
+	StationID    string
+}
+
+// Supports reports whether the peer that sent hello handles messageType.
+func (hello Hello) Supports(messageType uint8) bool {
+	for _, supported := range hello.MessageTypes {
+		if supported == messageType {
+			return true
+		}
+	}
+	return false
+}
+
+func EncodeHello(hello Hello) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	if err := binary.Write(&buffer, binary.BigEndian, hello.Version); err != nil {
+		return nil, fmt.Errorf("error encoding Version: %v", err)
+	}
+
+	if len(hello.MessageTypes) > 0xFF {
+		return nil, fmt.Errorf("error encoding MessageTypes: %d types do not fit", len(hello.MessageTypes))
+	}
+	buffer.WriteByte(uint8(len(hello.MessageTypes)))
+	buffer.Write(hello.MessageTypes)
+
+	if len(hello.StationID) > 0xFF {
+		return nil, fmt.Errorf("error encoding StationID: %d bytes do not fit", len(hello.StationID))
+	}
+	buffer.WriteByte(uint8(len(hello.StationID)))
+	buffer.WriteString(hello.StationID)
+
+	return buffer.Bytes(), nil
+}
+
+func DecodeHello(data []byte) (Hello, error) {
+	var hello Hello
+	buffer := bytes.NewReader(data)
+
+	if err := binary.Read(buffer, binary.BigEndian, &hello.Version); err != nil {
+		return hello, fmt.Errorf("error decoding Version: %v", err)
+	}
+
+	count, err := buffer.ReadByte()
+	if err != nil {
+		return hello, fmt.Errorf("error decoding MessageTypes: %v", err)
+	}
+	hello.MessageTypes = make([]uint8, count)
+	if _, err := io.ReadFull(buffer, hello.MessageTypes); err != nil {
+		return hello, fmt.Errorf("error decoding MessageTypes: %v", err)
+	}
+
+	length, err := buffer.ReadByte()
+	if err != nil {
+		return hello, fmt.Errorf("error decoding StationID: %v", err)
+	}
+	station := make([]byte, length)
+	if _, err := io.ReadFull(buffer, station); err != nil {
+		return hello, fmt.Errorf("error decoding StationID: %v", err)
+	}
+	hello.StationID = string(station)
+
+	return hello, nil
+}
+
+// Nack tells the publisher why the event with TransactionID was refused.
+// TransactionID is 0 when the event was too short to carry one.
+type Nack struct {
+	TransactionID uint16
+	Reason        string
+}
+
+// EncodeNack packs nack as
+//
+//	transaction ID (2 bytes) | reason length (1 byte) | reason
+//
+// cutting reasons that do not fit.
+func EncodeNack(nack Nack) []byte {
+	reason := TruncateUTF8(nack.Reason, 0xFF)
+
+	payload := make([]byte, 0, 3+len(reason))
+	payload = binary.BigEndian.AppendUint16(payload, nack.TransactionID)
+	payload = append(payload, uint8(len(reason)))
+	return append(payload, reason...)
+}
+
+func DecodeNack(data []byte) (Nack, error) {
+	var nack Nack
+	buffer := bytes.NewReader(data)
+
+	if err := binary.Read(buffer, binary.BigEndian, &nack.TransactionID); err != nil {
+		return nack, fmt.Errorf("error decoding TransactionID: %v", err)
+	}
+
+	length, err := buffer.ReadByte()
+	if err != nil {
+		return nack, fmt.Errorf("error decoding Reason: %v", err)
+	}
+	reason := make([]byte, length)
+	if _, err := io.ReadFull(buffer, reason); err != nil {
+		return nack, fmt.Errorf("error decoding Reason: %v", err)
+	}
+	nack.Reason = string(reason)
+
+	return nack, nil
+}
+
+// EncodeSyncResponse packs the state of every active train, each as the
+// LRTPIDSPacket that would create it from scratch:
+//
+//	train count (2 bytes) | train count * (length (2 bytes) | LRTPIDSPacket)
+func EncodeSyncResponse(trains []LRTPIDSPacket) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	if len(trains) > 0xFFFF {
+		return nil, fmt.Errorf("error encoding sync response: %d trains do not fit", len(trains))
+	}
+	binary.Write(&buffer, binary.BigEndian, uint16(len(trains)))
+
+	for _, train := range trains {
+		data, err := Encode(train)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding train %d: %v", train.TrainNumber, err)
+		}
+		binary.Write(&buffer, binary.BigEndian, uint16(len(data)))
+		buffer.Write(data)
+	}
+
+	if buffer.Len() > maxMessagePayload {
+		return nil, fmt.Errorf("error encoding sync response: %d bytes exceed one message", buffer.Len())
+	}
+	return buffer.Bytes(), nil
+}
+
+func DecodeSyncResponse(data []byte) ([]LRTPIDSPacket, error) {
+	buffer := bytes.NewReader(data)
+
+	var count uint16
+	if err := binary.Read(buffer, binary.BigEndian, &count); err != nil {
+		return nil, fmt.Errorf("error decoding train count: %w", ErrTruncated)
+	}
+
+	trains := make([]LRTPIDSPacket, 0, count)
+	for i := 0; i < int(count); i++ {
+		var length uint16
+		if err := binary.Read(buffer, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("error decoding train %d length: %w", i, ErrTruncated)
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(buffer, data); err != nil {
+			return nil, fmt.Errorf("error decoding train %d: %w", i, ErrTruncated)
+		}
+
+		train, err := Decode(data)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding train %d: %w", i, err)
+		}
+		trains = append(trains, train)
+	}
+
+	return trains, nil
+}
+
+// WriteMessage writes one framed message in a single Write call.
+func WriteMessage(w io.Writer, messageType uint8, payload []byte) error {
+	if len(payload) > maxMessagePayload {
+		return fmt.Errorf("message payload of %d bytes exceeds %d", len(payload), maxMessagePayload)
+	}
+
+	message := make([]byte, 0, 3+len(payload))
+	message = append(message, messageType)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(payload)))
+	message = append(message, payload...)
+
+	_, err := w.Write(message)
+	return err
+}
+
+func ReadMessage(r io.Reader) (messageType uint8, payload []byte, err error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+
+	payload = make([]byte, binary.BigEndian.Uint16(header[1:3]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, fmt.Errorf("error reading message payload: %v", err)
+	}
+
+	return header[0], payload, nil
+}
+
+// IsSessionStart reports whether prefix, the first len(SessionMagic) bytes
+// of a stream, open a session rather than carry a legacy packet.
+func IsSessionStart(prefix []byte) bool {
+	return string(prefix) == SessionMagic
+}
+
+// WriteSessionStart opens a session on w by sending the magic and hello.
+func WriteSessionStart(w io.Writer, hello Hello) error {
+	payload, err := EncodeHello(hello)
+	if err != nil {
+		return err
+	}
+
+	message := append([]byte(SessionMagic), MessageHello)
+	message = binary.BigEndian.AppendUint16(message, uint16(len(payload)))
+	message = append(message, payload...)
+
+	_, err = w.Write(message)
+	return err
+}
+
+func WriteHello(w io.Writer, hello Hello) error {
+	payload, err := EncodeHello(hello)
+	if err != nil {
+		return err
+	}
+	return WriteMessage(w, MessageHello, payload)
+}
+
+// ReadHello reads the MessageHello every session starts with, after the
+// magic on the subscriber side.
+func ReadHello(r io.Reader) (Hello, error) {
+	messageType, payload, err := ReadMessage(r)
+	if err != nil {
+		return Hello{}, fmt.Errorf("error reading hello: %v", err)
+	}
+	if messageType != MessageHello {
+		return Hello{}, fmt.Errorf("expected hello, got message type %#x", messageType)
+	}
+	return DecodeHello(payload)
+}
@@ -0,0 +1,39 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNackRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		nack Nack
+		want Nack
+	}{
+		{"empty reason", Nack{TransactionID: 7}, Nack{TransactionID: 7}},
+		{"reason", Nack{TransactionID: 0xBEEF, Reason: "train 9 does not exist"}, Nack{TransactionID: 0xBEEF, Reason: "train 9 does not exist"}},
+		{"long reason", Nack{TransactionID: 1, Reason: strings.Repeat("é", 200)}, Nack{TransactionID: 1, Reason: strings.Repeat("é", 127)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeNack(EncodeNack(tt.nack))
+			if err != nil {
+				t.Fatalf("DecodeNack: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeNackTruncated(t *testing.T) {
+	data := EncodeNack(Nack{TransactionID: 1, Reason: "refused"})
+	for n := 0; n < len(data); n++ {
+		if _, err := DecodeNack(data[:n]); err == nil {
+			t.Errorf("DecodeNack of %d of %d bytes succeeded", n, len(data))
+		}
+	}
+}
@@ -2,119 +2,189 @@ package utils
 
 import (
 	"bytes"
-	"encoding/binary"
 	"fmt"
+	"io"
+	"reflect"
+	"unicode/utf8"
 )
 
+// MaxDestinationLength is the longest Destination in bytes that fits its
+// one byte length. Encode refuses longer ones, see TruncateUTF8.
+const MaxDestinationLength = 0xFF
+
 type LRTPIDSPacket struct {
-	TransactionID    uint16
-	IsAck            uint8
-	IsNewTrain       uint8
-	IsUpdateTrain    uint8
-	IsDeleteTrain    uint8
-	IsTrainArriving  uint8
-	IsTrainDeparting uint8
-	TrainNumber      uint16
+	TransactionID     uint16
+	IsAck             uint8
+	IsNewTrain        uint8
+	IsUpdateTrain     uint8
+	IsDeleteTrain     uint8
+	IsTrainArriving   uint8
+	IsTrainDeparting  uint8
+	TrainNumber       uint16
 	DestinationLength uint8
-	Destination      string
+	Destination       string
+	// Sequence orders the events of one TrainNumber as published on a
+	// connection, starting at 1. It trails the destination so that older
+	// decoders ignore it; 0 means the packet is not sequenced.
+	Sequence uint16
+}
+
+// EventType names the event carried by the packet after the first flag that is
+// set, for use in logs and metric labels.
+func (packet LRTPIDSPacket) EventType() string {
+	switch {
+	case packet.IsAck == 1:
+		return "ack"
+	case packet.IsNewTrain == 1:
+		return "new"
+	case packet.IsUpdateTrain == 1:
+		return "update"
+	case packet.IsDeleteTrain == 1:
+		return "delete"
+	case packet.IsTrainArriving == 1:
+		return "arriving"
+	case packet.IsTrainDeparting == 1:
+		return "departing"
+	}
+	return "none"
 }
 
 func Encode(packet LRTPIDSPacket) ([]byte, error) {
 	var buffer bytes.Buffer
+	value := reflect.ValueOf(&packet).Elem()
+
+	for i, field := range PacketLayout {
+		if field.Kind == FieldLength {
+			next := PacketLayout[i+1]
+			length := len(value.Field(next.index).String())
+			if length > MaxDestinationLength {
+				return nil, fmt.Errorf("error encoding %s: %d bytes do not fit", next.Name, length)
+			}
+			value.Field(field.index).SetUint(uint64(length))
+		}
 
-	if err := binary.Write(&buffer, binary.BigEndian, packet.TransactionID); err != nil {
-		return nil, fmt.Errorf("error encoding TransactionID: %v", err)
-	}
-
-	if err := binary.Write(&buffer, binary.BigEndian, packet.IsAck); err != nil {
-		return nil, fmt.Errorf("error encoding IsAck: %v", err)
-	}
-
-	if err := binary.Write(&buffer, binary.BigEndian, packet.IsNewTrain); err != nil {
-		return nil, fmt.Errorf("error encoding IsNewTrain: %v", err)
-	}
-
-	if err := binary.Write(&buffer, binary.BigEndian, packet.IsUpdateTrain); err != nil {
-		return nil, fmt.Errorf("error encoding IsUpdateTrain: %v", err)
-	}
-
-	if err := binary.Write(&buffer, binary.BigEndian, packet.IsDeleteTrain); err != nil {
-		return nil, fmt.Errorf("error encoding IsDeleteTrain: %v", err)
-	}
-
-	if err := binary.Write(&buffer, binary.BigEndian, packet.IsTrainArriving); err != nil {
-		return nil, fmt.Errorf("error encoding IsTrainArriving: %v", err)
-	}
-
-	if err := binary.Write(&buffer, binary.BigEndian, packet.IsTrainDeparting); err != nil {
-		return nil, fmt.Errorf("error encoding IsTrainDeparting: %v", err)
-	}
-
-	if err := binary.Write(&buffer, binary.BigEndian, packet.TrainNumber); err != nil {
-		return nil, fmt.Errorf("error encoding TrainNumber: %v", err)
-	}
-
-	packet.DestinationLength = uint8(len(packet.Destination))
-	if err := binary.Write(&buffer, binary.BigEndian, packet.DestinationLength); err != nil {
-		return nil, fmt.Errorf("error encoding DestinationLength: %v", err)
-	}
-
-	if _, err := buffer.WriteString(packet.Destination); err != nil {
-		return nil, fmt.Errorf("error encoding Destination: %v", err)
+		if err := field.encode(&buffer, value.Field(field.index)); err != nil {
+			return nil, fmt.Errorf("error encoding %s: %v", field.Name, err)
+		}
 	}
 
 	return buffer.Bytes(), nil
 }
 
+// Decode reads a packet leniently: flags and the destination are taken as
+// they are. Bytes after the destination are the optional Sequence, and only
+// bytes after the Sequence are ignored. Only input that ends early fails,
+// including a single byte where the Sequence would be, with a *DecodeError
+// wrapping ErrTruncated.
 func Decode(data []byte) (LRTPIDSPacket, error) {
-	var packet LRTPIDSPacket
-	buffer := bytes.NewReader(data)
-
-	if err := binary.Read(buffer, binary.BigEndian, &packet.TransactionID); err != nil {
-		return packet, fmt.Errorf("error decoding TransactionID: %v", err)
-	}
+	return decode(data, false)
+}
 
-	if err := binary.Read(buffer, binary.BigEndian, &packet.IsAck); err != nil {
-		return packet, fmt.Errorf("error decoding IsAck: %v", err)
-	}
+// DecodeStrict is Decode for input that must be exactly one well-formed
+// packet: it also fails on trailing bytes, a destination that is not UTF-8,
+// flags other than 0 or 1, packets with no flag set and ACKs that also carry
+// an event. Several events in one packet are fine, the lifecycle applies
+// them in turn.
+func DecodeStrict(data []byte) (LRTPIDSPacket, error) {
+	return decode(data, true)
+}
 
-	if err := binary.Read(buffer, binary.BigEndian, &packet.IsNewTrain); err != nil {
-		return packet, fmt.Errorf("error decoding IsNewTrain: %v", err)
-	}
+func decode(data []byte, strict bool) (LRTPIDSPacket, error) {
+	var packet LRTPIDSPacket
+	buffer := bytes.NewReader(data)
+	value := reflect.ValueOf(&packet).Elem()
+
+	var length uint64
+	var firstFlag string
+	var firstFlagOffset int
+	var ack, events bool
+	for _, field := range PacketLayout {
+		// Packets from publishers that predate an optional field end here.
+		if field.Optional && buffer.Len() == 0 {
+			break
+		}
 
-	if err := binary.Read(buffer, binary.BigEndian, &packet.IsUpdateTrain); err != nil {
-		return packet, fmt.Errorf("error decoding IsUpdateTrain: %v", err)
-	}
+		offset := len(data) - buffer.Len()
+		target := value.Field(field.index)
+		if err := field.decode(buffer, target, length); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				err = ErrTruncated
+			}
+			return packet, &DecodeError{Field: field.Name, Offset: offset, Err: err}
+		}
 
-	if err := binary.Read(buffer, binary.BigEndian, &packet.IsDeleteTrain); err != nil {
-		return packet, fmt.Errorf("error decoding IsDeleteTrain: %v", err)
+		switch field.Kind {
+		case FieldLength:
+			length = target.Uint()
+		case FieldFlag:
+			if firstFlag == "" {
+				firstFlag, firstFlagOffset = field.Name, offset
+			}
+			if !strict || target.Uint() == 0 {
+				break
+			}
+			if target.Uint() != 1 {
+				return packet, &DecodeError{Field: field.Name, Offset: offset, Err: ErrInvalidFlag}
+			}
+			if field.Event == "ack" {
+				ack = true
+			} else {
+				events = true
+			}
+			if ack && events {
+				return packet, &DecodeError{Field: field.Name, Offset: offset, Err: ErrEventFlags}
+			}
+		case FieldString:
+			if !strict {
+				break
+			}
+			if invalid := invalidUTF8(target.String()); invalid >= 0 {
+				return packet, &DecodeError{Field: field.Name, Offset: offset + invalid, Err: ErrInvalidUTF8}
+			}
+		}
 	}
 
-	if err := binary.Read(buffer, binary.BigEndian, &packet.IsTrainArriving); err != nil {
-		return packet, fmt.Errorf("error decoding IsTrainArriving: %v", err)
+	if !strict {
+		return packet, nil
 	}
-
-	if err := binary.Read(buffer, binary.BigEndian, &packet.IsTrainDeparting); err != nil {
-		return packet, fmt.Errorf("error decoding IsTrainDeparting: %v", err)
+	if !ack && !events {
+		return packet, &DecodeError{Field: firstFlag, Offset: firstFlagOffset, Err: ErrEventFlags}
 	}
-
-	if err := binary.Read(buffer, binary.BigEndian, &packet.TrainNumber); err != nil {
-		return packet, fmt.Errorf("error decoding TrainNumber: %v", err)
+	if buffer.Len() > 0 {
+		return packet, &DecodeError{Offset: len(data) - buffer.Len(), Err: ErrTrailingData}
 	}
+	return packet, nil
+}
 
-	if err := binary.Read(buffer, binary.BigEndian, &packet.DestinationLength); err != nil {
-		return packet, fmt.Errorf("error decoding DestinationLength: %v", err)
+// invalidUTF8 returns the index of the first byte of s that is not part of a
+// valid UTF-8 sequence, or -1.
+func invalidUTF8(s string) int {
+	for i, r := range s {
+		if r == utf8.RuneError {
+			if _, size := utf8.DecodeRuneInString(s[i:]); size == 1 {
+				return i
+			}
+		}
 	}
+	return -1
+}
 
-	if packet.DestinationLength > 0 {
-		destinationBytes := make([]byte, packet.DestinationLength)
-		if _, err := buffer.Read(destinationBytes); err != nil {
-			return packet, fmt.Errorf("error decoding Destination: %v", err)
+// TruncateUTF8 shortens s to at most max bytes without splitting a UTF-8
+// sequence, for callers that prefer a shortened string to an error. A
+// negative max is taken as 0.
+func TruncateUTF8(s string, max int) string {
+	if max < 0 {
+		max = 0
+	}
+	if len(s) <= max {
+		return s
+	}
+	// Back up to the start of the sequence that s[max] belongs to. Invalid
+	// input may have no start nearby, then it is cut at max regardless.
+	for end := max; end > 0 && end > max-utf8.UTFMax; end-- {
+		if utf8.RuneStart(s[end]) {
+			return s[:end]
 		}
-		packet.Destination = string(destinationBytes)
-	} else {
-		packet.Destination = ""
 	}
-
-	return packet, nil
-}
\ No newline at end of file
+	return s[:max]
+}
@@ -0,0 +1,358 @@
+package utils
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// validPacket encodes to
+//
+//	00 01 | 00 01 00 00 00 00 | 00 05 | 04 | 'D' 'K' 'A' 'T' | 00 02
+var validPacket = LRTPIDSPacket{
+	TransactionID: 1,
+	IsNewTrain:    1,
+	TrainNumber:   5,
+	Destination:   "DKAT",
+	Sequence:      2,
+}
+
+func encodeValid(t *testing.T, change func(data []byte) []byte) []byte {
+	t.Helper()
+	data, err := Encode(validPacket)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	return change(data)
+}
+
+func TestDecodeErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(data []byte) []byte
+		strict bool
+		err    error
+		field  string
+		offset int
+	}{
+		{
+			name:   "empty",
+			change: func(data []byte) []byte { return nil },
+			err:    ErrTruncated, field: "TransactionID", offset: 0,
+		},
+		{
+			name:   "cut inside the flags",
+			change: func(data []byte) []byte { return data[:5] },
+			err:    ErrTruncated, field: "IsDeleteTrain", offset: 5,
+		},
+		{
+			name:   "destination shorter than its length",
+			change: func(data []byte) []byte { return data[:13] },
+			err:    ErrTruncated, field: "Destination", offset: 11,
+		},
+		{
+			name:   "half a sequence",
+			change: func(data []byte) []byte { return data[:16] },
+			err:    ErrTruncated, field: "Sequence", offset: 15,
+		},
+		{
+			name:   "trailing bytes",
+			change: func(data []byte) []byte { return append(data, 0xFF, 0xFF) },
+			strict: true,
+			err:    ErrTrailingData, field: "", offset: 17,
+		},
+		{
+			name:   "invalid UTF-8 in the destination",
+			change: func(data []byte) []byte { data[13] = 0xC3; data[14] = 0x28; return data },
+			strict: true,
+			err:    ErrInvalidUTF8, field: "Destination", offset: 13,
+		},
+		{
+			name:   "flag neither 0 nor 1",
+			change: func(data []byte) []byte { data[6] = 2; return data },
+			strict: true,
+			err:    ErrInvalidFlag, field: "IsTrainArriving", offset: 6,
+		},
+		{
+			name:   "no flag set",
+			change: func(data []byte) []byte { data[3] = 0; return data },
+			strict: true,
+			err:    ErrEventFlags, field: "IsAck", offset: 2,
+		},
+		{
+			name:   "ACK carrying an event",
+			change: func(data []byte) []byte { data[2] = 1; return data },
+			strict: true,
+			err:    ErrEventFlags, field: "IsNewTrain", offset: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := encodeValid(t, tt.change)
+
+			decode := Decode
+			if tt.strict {
+				decode = DecodeStrict
+				if _, err := Decode(data); err != nil {
+					t.Errorf("Decode: %v, want lenient success", err)
+				}
+			}
+
+			_, err := decode(data)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			var decodeErr *DecodeError
+			if !errors.As(err, &decodeErr) {
+				t.Fatalf("got error of type %T, want *DecodeError", err)
+			}
+			if decodeErr.Field != tt.field || decodeErr.Offset != tt.offset {
+				t.Errorf("got field %q at offset %d, want %q at %d", decodeErr.Field, decodeErr.Offset, tt.field, tt.offset)
+			}
+		})
+	}
+}
+
+func TestDecodeStrictAccepts(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(data []byte) []byte
+	}{
+		{"valid packet", func(data []byte) []byte { return data }},
+		{"no sequence", func(data []byte) []byte { return data[:15] }},
+		{"several events", func(data []byte) []byte { data[6] = 1; return data }},
+		{"ACK", func(data []byte) []byte { data[2], data[3] = 1, 0; return data }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := DecodeStrict(encodeValid(t, tt.change)); err != nil {
+				t.Errorf("DecodeStrict: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeSyncResponseWrapsErrors(t *testing.T) {
+	payload, err := EncodeSyncResponse([]LRTPIDSPacket{validPacket})
+	if err != nil {
+		t.Fatalf("EncodeSyncResponse: %v", err)
+	}
+
+	// Drop the last byte of the train and shorten its length to match, so
+	// that Decode itself sees half a sequence.
+	payload[3]--
+	_, err = DecodeSyncResponse(payload[:len(payload)-1])
+	var decodeErr *DecodeError
+	if !errors.Is(err, ErrTruncated) || !errors.As(err, &decodeErr) || decodeErr.Field != "Sequence" {
+		t.Errorf("got %v, want a truncated Sequence", err)
+	}
+
+	_, err = DecodeSyncResponse(payload[:5])
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("got %v, want ErrTruncated for a cut train", err)
+	}
+}
+
+// TestCodecGolden pins Encode and Decode to the byte layout the hand-written
+// codec used before PacketLayout, so that publishers and subscribers of
+// either kind keep understanding each other.
+func TestCodecGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet LRTPIDSPacket
+		data   []byte
+	}{
+		{
+			name: "sequenced",
+			packet: LRTPIDSPacket{
+				TransactionID:     0x1234,
+				IsTrainArriving:   1,
+				TrainNumber:       7,
+				DestinationLength: 10,
+				Destination:       "Harjamukti",
+				Sequence:          9,
+			},
+			data: append(append([]byte{0x12, 0x34, 0, 0, 0, 0, 1, 0, 0x00, 0x07, 0x0a}, "Harjamukti"...), 0x00, 0x09),
+		},
+		{
+			name: "ack",
+			packet: LRTPIDSPacket{
+				TransactionID: 0xBEEF,
+				IsAck:         1,
+			},
+			data: []byte{0xbe, 0xef, 1, 0, 0, 0, 0, 0, 0x00, 0x00, 0x00, 0x00, 0x00},
+		},
+		{
+			name: "utf8 destination",
+			packet: LRTPIDSPacket{
+				TransactionID:     1,
+				IsDeleteTrain:     1,
+				TrainNumber:       0x0102,
+				DestinationLength: 3,
+				Destination:       "J\u00e9",
+				Sequence:          0xFFFF,
+			},
+			data: []byte{0x00, 0x01, 0, 0, 0, 1, 0, 0, 0x01, 0x02, 0x03, 'J', 0xc3, 0xa9, 0xff, 0xff},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data, err := Encode(test.packet)
+			if err != nil {
+				t.Fatalf("Encode: %v", err)
+			}
+			if !bytes.Equal(data, test.data) {
+				t.Errorf("Encode = % x, want % x", data, test.data)
+			}
+
+			packet, err := DecodeStrict(test.data)
+			if err != nil {
+				t.Fatalf("DecodeStrict: %v", err)
+			}
+			if packet != test.packet {
+				t.Errorf("DecodeStrict = %+v, want %+v", packet, test.packet)
+			}
+		})
+	}
+}
+
+// TestDecodeUnsequenced decodes a packet from a publisher that predates
+// Sequence, which ends right after the destination.
+func TestDecodeTrailingBytes(t *testing.T) {
+	unsequenced := encodeValid(t, func(data []byte) []byte { return data[:15] })
+
+	// One byte cannot hold a Sequence.
+	_, err := Decode(append(unsequenced, 0x07))
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || !errors.Is(err, ErrTruncated) || decodeErr.Field != "Sequence" {
+		t.Errorf("Decode with one trailing byte: %v, want Sequence truncated", err)
+	}
+
+	// Two or more are read as the Sequence, whatever follows it is ignored.
+	for _, trailing := range [][]byte{{0x01, 0x02}, {0x01, 0x02, 0x03}} {
+		packet, err := Decode(append(bytes.Clone(unsequenced), trailing...))
+		if err != nil {
+			t.Errorf("Decode with %d trailing bytes: %v", len(trailing), err)
+			continue
+		}
+		if packet.Sequence != 0x0102 || packet.Destination != "DKAT" {
+			t.Errorf("Decode with %d trailing bytes = %+v, want Sequence 0x0102", len(trailing), packet)
+		}
+	}
+}
+
+func TestDecodeUnsequenced(t *testing.T) {
+	data := append([]byte{0x00, 0x2a, 0, 1, 0, 0, 0, 0, 0x00, 0x03, 0x04}, "DKAT"...)
+	want := LRTPIDSPacket{
+		TransactionID:     42,
+		IsNewTrain:        1,
+		TrainNumber:       3,
+		DestinationLength: 4,
+		Destination:       "DKAT",
+	}
+
+	for _, decode := range []func([]byte) (LRTPIDSPacket, error){Decode, DecodeStrict} {
+		packet, err := decode(data)
+		if err != nil {
+			t.Fatalf("decode: %v", err)
+		}
+		if packet != want {
+			t.Errorf("decode = %+v, want %+v", packet, want)
+		}
+	}
+}
+
+func TestPacketLayout(t *testing.T) {
+	packetType := reflect.TypeOf(LRTPIDSPacket{})
+	if len(PacketLayout) != packetType.NumField() {
+		t.Errorf("PacketLayout has %d fields, LRTPIDSPacket %d", len(PacketLayout), packetType.NumField())
+	}
+
+	for i, field := range PacketLayout {
+		if packetType.Field(i).Name != field.Name {
+			t.Errorf("PacketLayout[%d] is %s, LRTPIDSPacket has %s there", i, field.Name, packetType.Field(i).Name)
+		}
+		if field.Kind == FieldLength && (i+1 == len(PacketLayout) || PacketLayout[i+1].Kind != FieldString) {
+			t.Errorf("length %s is not followed by a string", field.Name)
+		}
+		if field.Kind == FieldString && (i == 0 || PacketLayout[i-1].Kind != FieldLength) {
+			t.Errorf("string %s has no length before it", field.Name)
+		}
+		if i > 0 && PacketLayout[i-1].Optional && !field.Optional {
+			t.Errorf("field %s follows an optional field", field.Name)
+		}
+		if (field.Kind == FieldFlag) != (field.Event != "") {
+			t.Errorf("field %s of kind %v has event %q", field.Name, field.Kind, field.Event)
+		}
+	}
+}
+
+// TestEventTypeMatchesLayout keeps the switch in EventType in step with the
+// events named in PacketLayout.
+func TestEventTypeMatchesLayout(t *testing.T) {
+	for _, field := range PacketLayout {
+		if field.Kind != FieldFlag {
+			continue
+		}
+		var packet LRTPIDSPacket
+		reflect.ValueOf(&packet).Elem().FieldByName(field.Name).SetUint(1)
+		if got := packet.EventType(); got != field.Event {
+			t.Errorf("EventType with %s set = %q, want %q", field.Name, got, field.Event)
+		}
+	}
+	if got := (LRTPIDSPacket{}).EventType(); got != "none" {
+		t.Errorf("EventType with no flag set = %q, want none", got)
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	tests := []struct {
+		name string
+		s    string
+		max  int
+		want string
+	}{
+		{"fits", "Cawang", 6, "Cawang"},
+		{"ascii", "Harjamukti", 4, "Harj"},
+		{"before two byte rune", "Jé", 2, "J"},
+		{"after two byte rune", "Jé", 3, "Jé"},
+		{"inside three byte rune", "a€b", 3, "a"},
+		{"inside four byte rune", "a\U0001F686b", 4, "a"},
+		{"after four byte rune", "a\U0001F686b", 5, "a\U0001F686"},
+		{"zero", "abc", 0, ""},
+		{"negative", "abc", -1, ""},
+		{"negative empty", "", -3, ""},
+		{"invalid input", "\x80\x80\x80\x80\x80\x80", 5, "\x80\x80\x80\x80\x80"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := TruncateUTF8(test.s, test.max)
+			if got != test.want {
+				t.Errorf("TruncateUTF8(%q, %d) = %q, want %q", test.s, test.max, got, test.want)
+			}
+			if len(got) > max(test.max, 0) {
+				t.Errorf("TruncateUTF8(%q, %d) is %d bytes long", test.s, test.max, len(got))
+			}
+		})
+	}
+}
+
+func TestEncodeDestinationLimit(t *testing.T) {
+	packet := LRTPIDSPacket{IsNewTrain: 1, Destination: strings.Repeat("é", 200)}
+	if _, err := Encode(packet); err == nil {
+		t.Fatal("Encode accepted a destination longer than MaxDestinationLength")
+	}
+
+	packet.Destination = TruncateUTF8(packet.Destination, MaxDestinationLength)
+	data, err := Encode(packet)
+	if err != nil {
+		t.Fatalf("Encode after TruncateUTF8: %v", err)
+	}
+	if _, err := DecodeStrict(data); err != nil {
+		t.Errorf("DecodeStrict after TruncateUTF8: %v", err)
+	}
+}
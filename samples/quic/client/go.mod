@@ -2,13 +2,18 @@ module jarkom.cs.ui.ac.id/h01/samples/quic/client
 
 go 1.21.0
 
-require github.com/quic-go/quic-go v0.39.0
+require (
+	github.com/quic-go/quic-go v0.40.0
+	jarkom.cs.ui.ac.id/h01/project/transport v0.0.0 // indirect
+	jarkom.cs.ui.ac.id/h01/samples/quic/utils v0.0.0
+)
 
 require (
+	github.com/francoispqt/gojay v1.2.13 // indirect
 	github.com/go-task/slim-sprig v0.0.0-20230315185526-52ccab3ef572 // indirect
 	github.com/google/pprof v0.0.0-20210407192527-94a9f03dee38 // indirect
 	github.com/onsi/ginkgo/v2 v2.9.5 // indirect
-	github.com/quic-go/qtls-go1-20 v0.3.4 // indirect
+	github.com/quic-go/qtls-go1-20 v0.4.1 // indirect
 	go.uber.org/mock v0.3.0 // indirect
 	golang.org/x/crypto v0.4.0 // indirect
 	golang.org/x/exp v0.0.0-20221205204356-47842c84f3db // indirect
@@ -17,3 +22,7 @@ require (
 	golang.org/x/sys v0.8.0 // indirect
 	golang.org/x/tools v0.9.1 // indirect
 )
+
+replace jarkom.cs.ui.ac.id/h01/project/transport => ../../../project/transport
+
+replace jarkom.cs.ui.ac.id/h01/samples/quic/utils => ../utils
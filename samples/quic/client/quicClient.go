@@ -10,33 +10,35 @@ import (
 	"os"
 
 	"github.com/quic-go/quic-go"
+	"jarkom.cs.ui.ac.id/h01/samples/quic/utils"
 )
 
 const (
-	serverIP          = "127.0.0.1"
-	serverPort        = "4510"
-	serverType        = "udp4"
-	bufferSize        = 2048
-	appLayerProto     = "jarkom-quic-sample-zacky"
-	sslKeyLogFileName = "ssl-key.log"
+	serverIP      = "127.0.0.1"
+	serverPort    = "4510"
+	serverType    = "udp4"
+	bufferSize    = 2048
+	appLayerProto = "jarkom-quic-sample-zacky"
+	qlogDirEnv    = "QLOGDIR"
 )
 
 func main() {
-
-	sslKeyLogFile, err := os.Create(sslKeyLogFileName)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	defer sslKeyLogFile.Close()
-
 	fmt.Printf("QUIC Client Socket Program Example in Go\n")
 
 	tlsConfig := &tls.Config{
 		InsecureSkipVerify: true,
 		NextProtos:         []string{appLayerProto},
-		KeyLogWriter:       sslKeyLogFile,
 	}
-	connection, err := quic.DialAddr(context.Background(), net.JoinHostPort(serverIP, serverPort), tlsConfig, &quic.Config{})
+
+	if sslKeyLogFile := utils.NewKeyLogWriter(); sslKeyLogFile != nil {
+		defer sslKeyLogFile.Close()
+		tlsConfig.KeyLogWriter = sslKeyLogFile
+	}
+
+	quicConfig := &quic.Config{
+		Tracer: utils.NewQlogTracer(os.Getenv(qlogDirEnv)),
+	}
+	connection, err := quic.DialAddr(context.Background(), net.JoinHostPort(serverIP, serverPort), tlsConfig, quicConfig)
 	if err != nil {
 		log.Fatalln(err)
 	}
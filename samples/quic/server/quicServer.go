@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"os"
 	"strings"
 
 	"github.com/quic-go/quic-go"
@@ -19,6 +20,7 @@ const (
 	serverType    = "udp4"
 	bufferSize    = 2048
 	appLayerProto = "jarkom-quic-sample-zacky"
+	qlogDirEnv    = "QLOGDIR"
 )
 
 func main() {
@@ -40,7 +42,15 @@ func main() {
 		Certificates: utils.GenerateTLSSelfSignedCertificates(),
 		NextProtos:   []string{appLayerProto},
 	}
-	listener, err := quic.Listen(socket, tlsConfig, &quic.Config{})
+
+	if sslKeyLogFile := utils.NewKeyLogWriter(); sslKeyLogFile != nil {
+		defer sslKeyLogFile.Close()
+		tlsConfig.KeyLogWriter = sslKeyLogFile
+	}
+	quicConfig := &quic.Config{
+		Tracer: utils.NewQlogTracer(os.Getenv(qlogDirEnv)),
+	}
+	listener, err := quic.Listen(socket, tlsConfig, quicConfig)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -1,7 +1,6 @@
 package utils
 
 import (
-	"bufio"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
@@ -9,12 +8,30 @@ import (
 	"encoding/pem"
 	"io"
 	"log"
+	"log/slog"
 	"math/big"
+	"os"
+
+	"jarkom.cs.ui.ac.id/h01/project/transport"
 )
 
-type qlogWriter struct {
-	*bufio.Writer
-	io.Closer
+// NewKeyLogWriter opens the file named by the transport.KeyLogFileEnv
+// environment variable with transport.OpenKeyLog, so that Wireshark can
+// decrypt the QUIC traffic. It returns nil when the variable is unset, which
+// keeps key logging off by default.
+func NewKeyLogWriter() io.WriteCloser {
+	file, err := transport.OpenKeyLog(os.Getenv(transport.KeyLogFileEnv), slog.Default())
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return file
+}
+
+// NewQlogTracer returns transport.QlogTracer for dir, which writes one qlog
+// file per connection. It returns nil when dir is empty so tracing stays
+// disabled by default.
+func NewQlogTracer(dir string) transport.Tracer {
+	return transport.QlogTracer(dir, slog.Default())
 }
 
 func GenerateTLSSelfSignedCertificates() []tls.Certificate {